@@ -0,0 +1,516 @@
+/*
+Install split apks with pm install session
+
+Supported sources:
+
+	directory: contains base.apk and split apks, eg: pulled from another device
+	.apks: created by bundletool build-apks, splits/*.apk or standalones/*.apk
+	.xapk: zip file with manifest.json, split_apks and obb expansions
+
+Splits are selected by device abi, density and language
+
+	pm install-create -r -d -g -S $TOTAL_SIZE
+	pm install-write -S $SIZE $SESSION base-master.apk -
+	pm install-commit $SESSION
+*/
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shogo82148/androidbinary/apk"
+)
+
+var ErrInstallCanceled = errors.New("install canceled")
+
+var splitDensities = map[string]int{
+	"ldpi":    120,
+	"mdpi":    160,
+	"tvdpi":   213,
+	"hdpi":    240,
+	"xhdpi":   320,
+	"xxhdpi":  480,
+	"xxxhdpi": 640,
+}
+
+var splitAbis = map[string]bool{
+	"armeabi":     true,
+	"armeabi_v7a": true,
+	"arm64_v8a":   true,
+	"x86":         true,
+	"x86_64":      true,
+	"mips":        true,
+	"mips64":      true,
+}
+
+var splitLanguageRe = regexp.MustCompile(`^[a-z]{2,3}(_[a-zA-Z]{2,4})?$`)
+
+// splitSpec is the device configuration used to select splits
+type splitSpec struct {
+	Abis     []string `json:"abis"`
+	Density  int      `json:"density"`
+	Language string   `json:"language"`
+}
+
+func deviceSplitSpec() splitSpec {
+	info := getDeviceInfo()
+	return splitSpec{
+		Abis:     info.Abis,
+		Density:  info.Density,
+		Language: info.Locale,
+	}
+}
+
+type apkSplit struct {
+	Name   string // name in install session
+	Config string // master, arm64_v8a, xxhdpi, en ...
+	Size   int64
+	path   string    // file on disk
+	zf     *zip.File // or file in archive
+}
+
+func (s apkSplit) Open() (io.ReadCloser, error) {
+	if s.zf != nil {
+		return s.zf.Open()
+	}
+	return os.Open(s.path)
+}
+
+// splitConfigOf parse split config from file name
+//
+//	base-arm64_v8a.apk(bundletool) -> arm64_v8a
+//	config.xxhdpi.apk(xapk), split_config.en.apk -> xxhdpi, en
+//	base.apk -> master
+func splitConfigOf(name string) string {
+	name = strings.TrimSuffix(path.Base(name), ".apk")
+	if idx := strings.LastIndex(name, "config."); idx >= 0 {
+		return name[idx+len("config."):]
+	}
+	if idx := strings.LastIndex(name, "-"); idx >= 0 {
+		return name[idx+1:]
+	}
+	return "master"
+}
+
+// splitDimension return abi, density, language or empty string for master and unknown splits
+func splitDimension(config string) string {
+	config = strings.Replace(config, "-", "_", -1)
+	switch {
+	case splitAbis[config]:
+		return "abi"
+	case splitDensities[config] > 0:
+		return "density"
+	case config != "master" && splitLanguageRe.MatchString(config):
+		return "language"
+	}
+	return ""
+}
+
+// selectSplits keep master and unknown splits, the best abi and density split, and splits of the device language
+func selectSplits(splits []apkSplit, spec splitSpec) ([]apkSplit, error) {
+	available := map[string]map[string]bool{"abi": {}, "density": {}, "language": {}}
+	for _, s := range splits {
+		if dim := splitDimension(s.Config); dim != "" {
+			available[dim][strings.Replace(s.Config, "-", "_", -1)] = true
+		}
+	}
+
+	abi := ""
+	for _, deviceAbi := range spec.Abis {
+		deviceAbi = strings.Replace(strings.TrimSpace(deviceAbi), "-", "_", -1)
+		if available["abi"][deviceAbi] {
+			abi = deviceAbi
+			break
+		}
+	}
+	if abi == "" && len(available["abi"]) > 0 && len(spec.Abis) > 0 {
+		return nil, errors.Errorf("no split apk match device abis %v", spec.Abis)
+	}
+
+	density := ""
+	for name := range available["density"] {
+		if density == "" || betterDensity(splitDensities[name], splitDensities[density], spec.Density) {
+			density = name
+		}
+	}
+
+	language := strings.ToLower(strings.SplitN(strings.Replace(spec.Language, "-", "_", -1), "_", 2)[0])
+
+	selected := make([]apkSplit, 0, len(splits))
+	for _, s := range splits {
+		config := strings.Replace(s.Config, "-", "_", -1)
+		switch splitDimension(s.Config) {
+		case "abi":
+			if abi != "" && config != abi {
+				continue
+			}
+		case "density":
+			if config != density {
+				continue
+			}
+		case "language":
+			if language != "" && strings.ToLower(strings.SplitN(config, "_", 2)[0]) != language {
+				continue
+			}
+		}
+		selected = append(selected, s)
+	}
+	return selected, nil
+}
+
+// betterDensity prefer the smallest density not less than the device, or the largest one
+func betterDensity(a, b, device int) bool {
+	if a >= device && b >= device {
+		return a < b
+	}
+	if a < device && b < device {
+		return a > b
+	}
+	return a >= device
+}
+
+type xapkManifest struct {
+	PackageName string `json:"package_name"`
+	SplitApks   []struct {
+		File string `json:"file"`
+		Id   string `json:"id"`
+	} `json:"split_apks"`
+	Expansions []struct {
+		File            string `json:"file"`
+		InstallLocation string `json:"install_location"`
+		InstallPath     string `json:"install_path"`
+	} `json:"expansions"`
+}
+
+type xapkExpansion struct {
+	zf          *zip.File
+	installPath string // relative to /sdcard
+}
+
+// apkBundle is a set of split apks, from a directory, .apks or .xapk file
+type apkBundle struct {
+	PackageName string
+	Splits      []apkSplit
+	expansions  []xapkExpansion
+	standalone  bool // choose one of the standalone apks
+	zr          *zip.ReadCloser
+}
+
+// openAPKBundle return nil when path is a single apk
+func openAPKBundle(fpath string) (*apkBundle, error) {
+	finfo, err := os.Stat(fpath)
+	if err != nil {
+		return nil, err
+	}
+	if finfo.IsDir() {
+		return openAPKDirectory(fpath)
+	}
+	zr, err := zip.OpenReader(fpath)
+	if err != nil {
+		return nil, nil // not a zip file, leave the error to pm install
+	}
+	bundle := &apkBundle{zr: zr}
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	switch {
+	case files["AndroidManifest.xml"] != nil:
+		zr.Close()
+		return nil, nil
+	case files["manifest.json"] != nil:
+		err = bundle.loadXapk(files)
+	default:
+		err = bundle.loadApks()
+	}
+	if err == nil && len(bundle.Splits) == 0 {
+		err = errors.New("no apk found in " + fpath)
+	}
+	if err != nil {
+		zr.Close()
+		return nil, err
+	}
+	return bundle, nil
+}
+
+func openAPKDirectory(dir string) (*apkBundle, error) {
+	finfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &apkBundle{}
+	for _, finfo := range finfos {
+		if finfo.IsDir() || !strings.HasSuffix(finfo.Name(), ".apk") {
+			continue
+		}
+		bundle.Splits = append(bundle.Splits, apkSplit{
+			Name:   finfo.Name(),
+			Config: splitConfigOf(finfo.Name()),
+			Size:   finfo.Size(),
+			path:   filepath.Join(dir, finfo.Name()),
+		})
+	}
+	if len(bundle.Splits) == 0 {
+		return nil, errors.New("no apk found in " + dir)
+	}
+	return bundle, nil
+}
+
+// loadApks read bundletool output, standalones are used when there is no splits (device sdk < 21)
+func (b *apkBundle) loadApks() error {
+	var standalones []apkSplit
+	for _, f := range b.zr.File {
+		if !strings.HasSuffix(f.Name, ".apk") {
+			continue
+		}
+		split := apkSplit{
+			Name:   path.Base(f.Name),
+			Config: splitConfigOf(f.Name),
+			Size:   int64(f.UncompressedSize64),
+			zf:     f,
+		}
+		if strings.HasPrefix(f.Name, "standalones/") || f.Name == "universal.apk" {
+			standalones = append(standalones, split)
+			continue
+		}
+		b.Splits = append(b.Splits, split)
+	}
+	if len(b.Splits) == 0 {
+		b.Splits = standalones
+		b.standalone = true
+	}
+	return nil
+}
+
+func (b *apkBundle) loadXapk(files map[string]*zip.File) error {
+	rd, err := files["manifest.json"].Open()
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	var manifest xapkManifest
+	if err := json.NewDecoder(rd).Decode(&manifest); err != nil {
+		return errors.Wrap(err, "xapk manifest.json")
+	}
+	b.PackageName = manifest.PackageName
+	for _, s := range manifest.SplitApks {
+		f := files[s.File]
+		if f == nil {
+			return errors.New("xapk split not found: " + s.File)
+		}
+		b.Splits = append(b.Splits, apkSplit{
+			Name:   path.Base(s.File),
+			Config: splitConfigOf(s.Id),
+			Size:   int64(f.UncompressedSize64),
+			zf:     f,
+		})
+	}
+	if len(manifest.SplitApks) == 0 { // old xapk: package.apk with obb files
+		for name, f := range files {
+			if !strings.Contains(name, "/") && strings.HasSuffix(name, ".apk") {
+				b.Splits = append(b.Splits, apkSplit{Name: name, Config: "master", Size: int64(f.UncompressedSize64), zf: f})
+			}
+		}
+	}
+	for _, e := range manifest.Expansions {
+		f := files[e.File]
+		if f == nil {
+			return errors.New("xapk expansion not found: " + e.File)
+		}
+		installPath := path.Clean("/" + e.InstallPath)[1:]
+		b.expansions = append(b.expansions, xapkExpansion{zf: f, installPath: installPath})
+	}
+	return nil
+}
+
+func (b *apkBundle) Close() error {
+	if b.zr != nil {
+		return b.zr.Close()
+	}
+	return nil
+}
+
+// Select return splits to install
+func (b *apkBundle) Select(spec splitSpec) ([]apkSplit, error) {
+	if !b.standalone {
+		return selectSplits(b.Splits, spec)
+	}
+	// standalone-arm64_v8a_xxhdpi.apk, prefer the first device abi
+	for _, abi := range spec.Abis {
+		abi = strings.Replace(strings.TrimSpace(abi), "-", "_", -1)
+		for _, s := range b.Splits {
+			if strings.Contains(s.Name, "-"+abi+"_") || strings.HasSuffix(s.Name, "-"+abi+".apk") {
+				return []apkSplit{s}, nil
+			}
+		}
+	}
+	return b.Splits[:1], nil
+}
+
+// packageName parse from the master split when not given by xapk manifest
+func (b *apkBundle) packageName() (string, error) {
+	if b.PackageName != "" {
+		return b.PackageName, nil
+	}
+	for _, s := range b.Splits {
+		if s.Config != "master" {
+			continue
+		}
+		var pkg *apk.Apk
+		var err error
+		if s.zf != nil {
+			var data []byte
+			if data, err = readZipFile(s.zf); err == nil {
+				pkg, err = apk.OpenZipReader(bytes.NewReader(data), int64(len(data)))
+			}
+		} else {
+			pkg, err = apk.OpenFile(s.path)
+		}
+		if err != nil {
+			continue // feature module master split has no package resources
+		}
+		b.PackageName = pkg.PackageName()
+		pkg.Close()
+		return b.PackageName, nil
+	}
+	return "", errors.New("package name not found in splits")
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rd, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return ioutil.ReadAll(rd)
+}
+
+type splitInstallProgress struct {
+	TotalSize   int64    `json:"totalSize"`
+	WrittenSize int64    `json:"writtenSize"`
+	Current     string   `json:"current,omitempty"`
+	Splits      []string `json:"splits"`
+}
+
+// Install write selected splits into one session, obb expansions are copied to /sdcard after installed
+func (b *apkBundle) Install(ctx context.Context, spec splitSpec, opts InstallOptions, onProgress func(splitInstallProgress)) (result InstallResult, err error) {
+	splits, err := b.Select(spec)
+	if err != nil {
+		result.Message = err.Error()
+		return
+	}
+	result, err = installWithRetry(opts, b.packageName, func() error {
+		return installSplits(ctx, splits, opts, onProgress)
+	})
+	if err != nil {
+		return
+	}
+	for _, e := range b.expansions {
+		dst := filepath.Join("/sdcard", filepath.FromSlash(e.installPath))
+		if err = extractZipFile(e.zf, dst); err != nil {
+			err = errors.Wrap(err, "copy obb")
+			result.Message = err.Error()
+			return
+		}
+	}
+	return
+}
+
+func extractZipFile(f *zip.File, dst string) error {
+	rd, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return copyToFile(rd, dst)
+}
+
+func installSplits(ctx context.Context, splits []apkSplit, opts InstallOptions, onProgress func(splitInstallProgress)) (err error) {
+	progress := splitInstallProgress{}
+	for _, s := range splits {
+		progress.TotalSize += s.Size
+		progress.Splits = append(progress.Splits, s.Name)
+	}
+	session, err := pmInstallCreate(progress.TotalSize, opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			runShell("pm", "install-abandon", session)
+		}
+	}()
+	for _, s := range splits {
+		if ctx.Err() != nil {
+			return ErrInstallCanceled
+		}
+		progress.Current = s.Name
+		onProgress(progress)
+		rd, err := s.Open()
+		if err != nil {
+			return err
+		}
+		written := progress.WrittenSize
+		err = pmInstallWrite(session, s, &progressReader{rd: rd, fn: func(n int64) {
+			progress.WrittenSize = written + n
+			onProgress(progress)
+		}})
+		rd.Close()
+		if err != nil {
+			return err
+		}
+	}
+	progress.Current = ""
+	onProgress(progress)
+	if ctx.Err() != nil {
+		return ErrInstallCanceled
+	}
+	return checkInstallOutput(runShell("pm", "install-commit", session))
+}
+
+func pmInstallCreate(totalSize int64, opts InstallOptions) (session string, err error) {
+	args := append([]string{"pm", "install-create"}, opts.args()...)
+	args = append(args, "-S", strconv.FormatInt(totalSize, 10))
+	out, err := runShellQuote(args...)
+	matches := regexp.MustCompile(`Success: created install session \[(\d+)\]`).FindStringSubmatch(string(out))
+	if matches == nil {
+		return "", newInstallError(out, err)
+	}
+	return matches[1], nil
+}
+
+// pmInstallWrite stream split into session by stdin, so files in archive need not extract
+func pmInstallWrite(session string, s apkSplit, rd io.Reader) error {
+	cmd := exec.Command("pm", "install-write", "-S", strconv.FormatInt(s.Size, 10), session, s.Name, "-")
+	cmd.Stdin = rd
+	return checkInstallOutput(cmd.CombinedOutput())
+}
+
+type progressReader struct {
+	rd io.Reader
+	n  int64
+	fn func(n int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.n += int64(n)
+	r.fn(r.n)
+	return n, err
+}
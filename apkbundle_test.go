@@ -0,0 +1,168 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitConfigOf(t *testing.T) {
+	assert.Equal(t, "master", splitConfigOf("splits/base-master.apk"))
+	assert.Equal(t, "arm64_v8a", splitConfigOf("splits/base-arm64_v8a.apk"))
+	assert.Equal(t, "xxhdpi", splitConfigOf("config.xxhdpi.apk"))
+	assert.Equal(t, "en", splitConfigOf("split_config.en.apk"))
+	assert.Equal(t, "master", splitConfigOf("base.apk"))
+
+	assert.Equal(t, "abi", splitDimension("x86"))
+	assert.Equal(t, "abi", splitDimension("arm64-v8a"))
+	assert.Equal(t, "density", splitDimension("hdpi"))
+	assert.Equal(t, "language", splitDimension("zh"))
+	assert.Equal(t, "", splitDimension("master"))
+	assert.Equal(t, "", splitDimension("astc"))
+}
+
+func TestSelectSplits(t *testing.T) {
+	splits := []apkSplit{}
+	for _, name := range []string{
+		"base-master.apk", "base-armeabi_v7a.apk", "base-arm64_v8a.apk", "base-x86.apk",
+		"base-hdpi.apk", "base-xxhdpi.apk", "base-xxxhdpi.apk",
+		"base-en.apk", "base-zh.apk", "base-astc.apk", "feature-master.apk",
+	} {
+		splits = append(splits, apkSplit{Name: name, Config: splitConfigOf(name)})
+	}
+	names := func(splits []apkSplit) []string {
+		result := []string{}
+		for _, s := range splits {
+			result = append(result, s.Name)
+		}
+		return result
+	}
+
+	selected, err := selectSplits(splits, splitSpec{Abis: []string{"arm64-v8a", "armeabi-v7a"}, Density: 420, Language: "zh-CN"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"base-master.apk", "base-arm64_v8a.apk", "base-xxhdpi.apk", "base-zh.apk", "base-astc.apk", "feature-master.apk"}, names(selected))
+
+	// density larger than all splits, language without split
+	selected, err = selectSplits(splits, splitSpec{Abis: []string{"x86_64", "x86"}, Density: 800, Language: "fr"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"base-master.apk", "base-x86.apk", "base-xxxhdpi.apk", "base-astc.apk", "feature-master.apk"}, names(selected))
+
+	_, err = selectSplits(splits, splitSpec{Abis: []string{"mips"}})
+	assert.Error(t, err)
+}
+
+// fakePM put a pm script into PATH, which log the arguments
+func fakePM(t *testing.T, commitOutput string) (logPath string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "atx-pm")
+	assert.NoError(t, err)
+	logPath = filepath.Join(dir, "pm.log")
+	script := `#!/bin/sh
+echo "$@" >> ` + logPath + `
+case "$1" in
+install-create) echo "Success: created install session [7]";;
+install-write) cat > /dev/null; echo "Success: streamed bytes";;
+install-commit) echo "` + commitOutput + `";;
+esac
+`
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "pm"), []byte(script), 0755))
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath)
+	return logPath, func() {
+		os.Setenv("PATH", oldPath)
+		os.RemoveAll(dir)
+	}
+}
+
+func writeTestZip(t *testing.T, path string, files map[string]string) {
+	fd, err := os.Create(path)
+	assert.NoError(t, err)
+	zw := zip.NewWriter(fd)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w, _ := zw.Create(name)
+		w.Write([]byte(files[name]))
+	}
+	assert.NoError(t, zw.Close())
+	fd.Close()
+}
+
+func TestAPKBundleInstall(t *testing.T) {
+	logPath, cleanup := fakePM(t, "Success")
+	defer cleanup()
+	tmpdir, err := ioutil.TempDir("", "atx-bundle")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	apksPath := filepath.Join(tmpdir, "app.apks")
+	writeTestZip(t, apksPath, map[string]string{
+		"toc.pb":                    "",
+		"splits/base-master.apk":    "0123456789",
+		"splits/base-arm64_v8a.apk": "abcde",
+		"splits/base-x86.apk":       "x86",
+	})
+	bundle, err := openAPKBundle(apksPath)
+	assert.NoError(t, err)
+	assert.NotNil(t, bundle)
+	defer bundle.Close()
+
+	var last splitInstallProgress
+	result, err := bundle.Install(context.Background(), splitSpec{Abis: []string{"arm64-v8a"}}, DefaultInstallOptions(), func(p splitInstallProgress) {
+		last = p
+	})
+	assert.NoError(t, err)
+	assert.False(t, result.Retried)
+	assert.Equal(t, int64(15), last.TotalSize)
+	assert.Equal(t, int64(15), last.WrittenSize)
+	assert.Len(t, last.Splits, 2)
+
+	data, _ := ioutil.ReadFile(logPath)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 4)
+	assert.Contains(t, lines[0], "install-create")
+	assert.Contains(t, lines[0], "-S 15")
+	assert.Equal(t, "install-write -S 5 7 base-arm64_v8a.apk -", lines[1])
+	assert.Equal(t, "install-write -S 10 7 base-master.apk -", lines[2])
+	assert.Equal(t, "install-commit 7", lines[3])
+
+	// single apk is not a bundle
+	apkPath := filepath.Join(tmpdir, "app.apk")
+	writeTestZip(t, apkPath, map[string]string{"AndroidManifest.xml": "", "classes.dex": ""})
+	bundle, err = openAPKBundle(apkPath)
+	assert.NoError(t, err)
+	assert.Nil(t, bundle)
+}
+
+func TestAPKBundleInstallFailure(t *testing.T) {
+	logPath, cleanup := fakePM(t, "Failure [INSTALL_FAILED_INSUFFICIENT_STORAGE]")
+	defer cleanup()
+	tmpdir, err := ioutil.TempDir("", "atx-bundle")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	ioutil.WriteFile(filepath.Join(tmpdir, "base.apk"), []byte("base"), 0644)
+	ioutil.WriteFile(filepath.Join(tmpdir, "split_config.en.apk"), []byte("en"), 0644)
+	bundle, err := openAPKBundle(tmpdir)
+	assert.NoError(t, err)
+	result, err := bundle.Install(context.Background(), splitSpec{}, DefaultInstallOptions(), func(splitInstallProgress) {})
+	assert.EqualError(t, err, "Failure [INSTALL_FAILED_INSUFFICIENT_STORAGE]: not enough storage space")
+	assert.Equal(t, "INSTALL_FAILED_INSUFFICIENT_STORAGE", result.FailureCode)
+
+	data, _ := ioutil.ReadFile(logPath)
+	assert.Contains(t, string(data), "install-abandon 7")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = bundle.Install(ctx, splitSpec{}, DefaultInstallOptions(), func(splitInstallProgress) {})
+	assert.Equal(t, ErrInstallCanceled, err)
+}
@@ -0,0 +1,667 @@
+/*
+Inspect apk file: full manifest, native abis and signing certificates
+
+	$ curl $DEVICE_URL/packages/com.example/manifest
+	$ curl -F file=@app.apk $DEVICE_URL/apk/manifest
+*/
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shogo82148/androidbinary"
+)
+
+// xml structs decoded by androidbinary, references are resolved with resources.arsc
+type xmlIntentData struct {
+	Scheme   androidbinary.String `xml:"http://schemas.android.com/apk/res/android scheme,attr"`
+	Host     androidbinary.String `xml:"http://schemas.android.com/apk/res/android host,attr"`
+	Port     androidbinary.String `xml:"http://schemas.android.com/apk/res/android port,attr"`
+	Path     androidbinary.String `xml:"http://schemas.android.com/apk/res/android path,attr"`
+	Prefix   androidbinary.String `xml:"http://schemas.android.com/apk/res/android pathPrefix,attr"`
+	Pattern  androidbinary.String `xml:"http://schemas.android.com/apk/res/android pathPattern,attr"`
+	MimeType androidbinary.String `xml:"http://schemas.android.com/apk/res/android mimeType,attr"`
+}
+
+type xmlName struct {
+	Name androidbinary.String `xml:"http://schemas.android.com/apk/res/android name,attr"`
+}
+
+type xmlIntentFilter struct {
+	Priority   androidbinary.Int32 `xml:"http://schemas.android.com/apk/res/android priority,attr"`
+	Actions    []xmlName           `xml:"action"`
+	Categories []xmlName           `xml:"category"`
+	Data       []xmlIntentData     `xml:"data"`
+}
+
+type xmlComponent struct {
+	Name           androidbinary.String `xml:"http://schemas.android.com/apk/res/android name,attr"`
+	Label          androidbinary.String `xml:"http://schemas.android.com/apk/res/android label,attr"`
+	Exported       androidbinary.Bool   `xml:"http://schemas.android.com/apk/res/android exported,attr"`
+	Enabled        androidbinary.Bool   `xml:"http://schemas.android.com/apk/res/android enabled,attr"`
+	Permission     androidbinary.String `xml:"http://schemas.android.com/apk/res/android permission,attr"`
+	Process        androidbinary.String `xml:"http://schemas.android.com/apk/res/android process,attr"`
+	TargetActivity androidbinary.String `xml:"http://schemas.android.com/apk/res/android targetActivity,attr"`
+	Authorities    androidbinary.String `xml:"http://schemas.android.com/apk/res/android authorities,attr"`
+	IntentFilters  []xmlIntentFilter    `xml:"intent-filter"`
+}
+
+type xmlManifest struct {
+	Package         androidbinary.String `xml:"package,attr"`
+	VersionCode     androidbinary.Int32  `xml:"http://schemas.android.com/apk/res/android versionCode,attr"`
+	VersionName     androidbinary.String `xml:"http://schemas.android.com/apk/res/android versionName,attr"`
+	CompileSdk      androidbinary.Int32  `xml:"http://schemas.android.com/apk/res/android compileSdkVersion,attr"`
+	SharedUserId    androidbinary.String `xml:"http://schemas.android.com/apk/res/android sharedUserId,attr"`
+	InstallLocation androidbinary.String `xml:"http://schemas.android.com/apk/res/android installLocation,attr"`
+	UsesSDK         struct {
+		Min    androidbinary.Int32 `xml:"http://schemas.android.com/apk/res/android minSdkVersion,attr"`
+		Target androidbinary.Int32 `xml:"http://schemas.android.com/apk/res/android targetSdkVersion,attr"`
+		Max    androidbinary.Int32 `xml:"http://schemas.android.com/apk/res/android maxSdkVersion,attr"`
+	} `xml:"uses-sdk"`
+	UsesPermissions      []xmlName `xml:"uses-permission"`
+	UsesPermissionsSdk23 []xmlName `xml:"uses-permission-sdk-23"`
+	Permissions          []struct {
+		Name            androidbinary.String `xml:"http://schemas.android.com/apk/res/android name,attr"`
+		ProtectionLevel androidbinary.String `xml:"http://schemas.android.com/apk/res/android protectionLevel,attr"`
+	} `xml:"permission"`
+	UsesFeatures []struct {
+		Name     androidbinary.String `xml:"http://schemas.android.com/apk/res/android name,attr"`
+		Required androidbinary.Bool   `xml:"http://schemas.android.com/apk/res/android required,attr"`
+	} `xml:"uses-feature"`
+	Instrumentations []struct {
+		Name   androidbinary.String `xml:"http://schemas.android.com/apk/res/android name,attr"`
+		Target androidbinary.String `xml:"http://schemas.android.com/apk/res/android targetPackage,attr"`
+	} `xml:"instrumentation"`
+	Application struct {
+		Name              androidbinary.String `xml:"http://schemas.android.com/apk/res/android name,attr"`
+		Label             androidbinary.String `xml:"http://schemas.android.com/apk/res/android label,attr"`
+		Debuggable        androidbinary.Bool   `xml:"http://schemas.android.com/apk/res/android debuggable,attr"`
+		TestOnly          androidbinary.Bool   `xml:"http://schemas.android.com/apk/res/android testOnly,attr"`
+		AllowBackup       androidbinary.Bool   `xml:"http://schemas.android.com/apk/res/android allowBackup,attr"`
+		ExtractNativeLibs androidbinary.Bool   `xml:"http://schemas.android.com/apk/res/android extractNativeLibs,attr"`
+		Activities        []xmlComponent       `xml:"activity"`
+		ActivityAliases   []xmlComponent       `xml:"activity-alias"`
+		Services          []xmlComponent       `xml:"service"`
+		Receivers         []xmlComponent       `xml:"receiver"`
+		Providers         []xmlComponent       `xml:"provider"`
+		UsesLibraries     []xmlName            `xml:"uses-library"`
+		MetaData          []struct {
+			Name     androidbinary.String `xml:"http://schemas.android.com/apk/res/android name,attr"`
+			Value    androidbinary.String `xml:"http://schemas.android.com/apk/res/android value,attr"`
+			Resource androidbinary.String `xml:"http://schemas.android.com/apk/res/android resource,attr"`
+		} `xml:"meta-data"`
+	} `xml:"application"`
+}
+
+type ApkIntentData struct {
+	Scheme   string `json:"scheme,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Port     string `json:"port,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Prefix   string `json:"pathPrefix,omitempty"`
+	Pattern  string `json:"pathPattern,omitempty"`
+	MimeType string `json:"mimeType,omitempty"`
+}
+
+type ApkIntentFilter struct {
+	Priority   int             `json:"priority,omitempty"`
+	Actions    []string        `json:"actions"`
+	Categories []string        `json:"categories"`
+	Data       []ApkIntentData `json:"data,omitempty"`
+}
+
+type ApkComponent struct {
+	Name           string            `json:"name"`
+	Label          string            `json:"label,omitempty"`
+	Exported       *bool             `json:"exported,omitempty"` // nil when not declared
+	Enabled        *bool             `json:"enabled,omitempty"`
+	Permission     string            `json:"permission,omitempty"`
+	Process        string            `json:"process,omitempty"`
+	TargetActivity string            `json:"targetActivity,omitempty"` // activity-alias
+	Authorities    string            `json:"authorities,omitempty"`    // provider
+	IntentFilters  []ApkIntentFilter `json:"intentFilters,omitempty"`
+}
+
+type ApkPermission struct {
+	Name            string `json:"name"`
+	ProtectionLevel string `json:"protectionLevel,omitempty"`
+}
+
+type ApkFeature struct {
+	Name     string `json:"name"`
+	Required bool   `json:"required"`
+}
+
+type ApkCertificate struct {
+	Schemes   []string  `json:"schemes"` // v1, v2, v3
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	Sha256    string    `json:"sha256"`
+	Sha1      string    `json:"sha1"`
+	Md5       string    `json:"md5"`
+}
+
+type ApkManifest struct {
+	PackageName       string            `json:"packageName"`
+	VersionCode       int               `json:"versionCode"`
+	VersionName       string            `json:"versionName"`
+	MinSdk            int               `json:"minSdkVersion"`
+	TargetSdk         int               `json:"targetSdkVersion"`
+	MaxSdk            int               `json:"maxSdkVersion,omitempty"`
+	CompileSdk        int               `json:"compileSdkVersion,omitempty"`
+	SharedUserId      string            `json:"sharedUserId,omitempty"`
+	InstallLocation   string            `json:"installLocation,omitempty"`
+	Label             string            `json:"label"`
+	Application       string            `json:"application,omitempty"`
+	Debuggable        bool              `json:"debuggable"`
+	TestOnly          bool              `json:"testOnly"`
+	AllowBackup       bool              `json:"allowBackup"`
+	ExtractNativeLibs bool              `json:"extractNativeLibs"`
+	Activities        []ApkComponent    `json:"activities"`
+	ActivityAliases   []ApkComponent    `json:"activityAliases"`
+	Services          []ApkComponent    `json:"services"`
+	Receivers         []ApkComponent    `json:"receivers"`
+	Providers         []ApkComponent    `json:"providers"`
+	UsesPermissions   []string          `json:"usesPermissions"`
+	Permissions       []ApkPermission   `json:"permissions"` // declared by the apk
+	Features          []ApkFeature      `json:"features"`
+	Libraries         []string          `json:"libraries"`
+	Instrumentations  []ApkComponent    `json:"instrumentations,omitempty"`
+	MetaData          map[string]string `json:"metaData"`
+	Abis              []string          `json:"abis"` // native libraries in lib/
+	Certificates      []ApkCertificate  `json:"certificates"`
+	Size              int64             `json:"size"`
+	Sha256            string            `json:"sha256"`
+}
+
+func xmlString(s androidbinary.String) string {
+	v, _ := s.String()
+	return v
+}
+
+func xmlInt(i androidbinary.Int32) int {
+	v, _ := i.Int32()
+	return int(v)
+}
+
+// xmlBool return defaultValue when attribute not set
+func xmlBool(b androidbinary.Bool, defaultValue bool) bool {
+	v, err := b.Bool()
+	if err != nil {
+		return defaultValue
+	}
+	return v
+}
+
+func xmlBoolPtr(b androidbinary.Bool) *bool {
+	v, err := b.Bool()
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+// fullClassName expand .MainActivity and MainActivity to com.example.MainActivity
+func fullClassName(packageName, name string) string {
+	if strings.HasPrefix(name, ".") {
+		return packageName + name
+	}
+	if name != "" && !strings.Contains(name, ".") {
+		return packageName + "." + name
+	}
+	return name
+}
+
+func convertComponents(packageName string, xcs []xmlComponent) []ApkComponent {
+	components := make([]ApkComponent, 0, len(xcs))
+	for _, xc := range xcs {
+		c := ApkComponent{
+			Name:           fullClassName(packageName, xmlString(xc.Name)),
+			Label:          xmlString(xc.Label),
+			Exported:       xmlBoolPtr(xc.Exported),
+			Enabled:        xmlBoolPtr(xc.Enabled),
+			Permission:     xmlString(xc.Permission),
+			Process:        xmlString(xc.Process),
+			TargetActivity: fullClassName(packageName, xmlString(xc.TargetActivity)),
+			Authorities:    xmlString(xc.Authorities),
+		}
+		for _, xf := range xc.IntentFilters {
+			filter := ApkIntentFilter{Priority: xmlInt(xf.Priority), Actions: []string{}, Categories: []string{}}
+			for _, a := range xf.Actions {
+				filter.Actions = append(filter.Actions, xmlString(a.Name))
+			}
+			for _, cat := range xf.Categories {
+				filter.Categories = append(filter.Categories, xmlString(cat.Name))
+			}
+			for _, d := range xf.Data {
+				filter.Data = append(filter.Data, ApkIntentData{
+					Scheme:   xmlString(d.Scheme),
+					Host:     xmlString(d.Host),
+					Port:     xmlString(d.Port),
+					Path:     xmlString(d.Path),
+					Prefix:   xmlString(d.Prefix),
+					Pattern:  xmlString(d.Pattern),
+					MimeType: xmlString(d.MimeType),
+				})
+			}
+			c.IntentFilters = append(c.IntentFilters, filter)
+		}
+		components = append(components, c)
+	}
+	return components
+}
+
+func readZipEntry(zr *zip.Reader, name string) ([]byte, error) {
+	for _, f := range zr.File {
+		if f.Name == name {
+			return readZipFile(f)
+		}
+	}
+	return nil, errors.New("apk: file " + name + " not found")
+}
+
+// inspectAPK parse manifest, abis and signatures of the apk file
+func inspectAPK(fpath string) (manifest ApkManifest, err error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	finfo, err := f.Stat()
+	if err != nil {
+		return
+	}
+	manifest.Size = finfo.Size()
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, f); err != nil {
+		return
+	}
+	manifest.Sha256 = hex.EncodeToString(hasher.Sum(nil))
+
+	zr, err := zip.NewReader(f, manifest.Size)
+	if err != nil {
+		return manifest, errors.Wrap(err, "open apk")
+	}
+	if err = parseManifestXML(zr, &manifest); err != nil {
+		return
+	}
+	manifest.Abis = apkAbis(zr)
+	manifest.Certificates, err = apkCertificates(f, manifest.Size, zr)
+	return
+}
+
+func parseManifestXML(zr *zip.Reader, manifest *ApkManifest) error {
+	var table *androidbinary.TableFile
+	if data, err := readZipEntry(zr, "resources.arsc"); err == nil {
+		table, _ = androidbinary.NewTableFile(bytes.NewReader(data))
+	}
+	data, err := readZipEntry(zr, "AndroidManifest.xml")
+	if err != nil {
+		return err
+	}
+	xmlFile, err := androidbinary.NewXMLFile(bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "parse AndroidManifest.xml")
+	}
+	var xm xmlManifest
+	if err := xmlFile.Decode(&xm, table, nil); err != nil {
+		return errors.Wrap(err, "decode AndroidManifest.xml")
+	}
+
+	pkg := xmlString(xm.Package)
+	app := xm.Application
+	manifest.PackageName = pkg
+	manifest.VersionCode = xmlInt(xm.VersionCode)
+	manifest.VersionName = xmlString(xm.VersionName)
+	manifest.MinSdk = xmlInt(xm.UsesSDK.Min)
+	manifest.TargetSdk = xmlInt(xm.UsesSDK.Target)
+	manifest.MaxSdk = xmlInt(xm.UsesSDK.Max)
+	manifest.CompileSdk = xmlInt(xm.CompileSdk)
+	manifest.SharedUserId = xmlString(xm.SharedUserId)
+	manifest.InstallLocation = xmlString(xm.InstallLocation)
+	manifest.Label = xmlString(app.Label)
+	manifest.Application = fullClassName(pkg, xmlString(app.Name))
+	manifest.Debuggable = xmlBool(app.Debuggable, false)
+	manifest.TestOnly = xmlBool(app.TestOnly, false)
+	manifest.AllowBackup = xmlBool(app.AllowBackup, true)
+	manifest.ExtractNativeLibs = xmlBool(app.ExtractNativeLibs, true)
+	manifest.Activities = convertComponents(pkg, app.Activities)
+	manifest.ActivityAliases = convertComponents(pkg, app.ActivityAliases)
+	manifest.Services = convertComponents(pkg, app.Services)
+	manifest.Receivers = convertComponents(pkg, app.Receivers)
+	manifest.Providers = convertComponents(pkg, app.Providers)
+
+	manifest.UsesPermissions = []string{}
+	for _, p := range append(xm.UsesPermissions, xm.UsesPermissionsSdk23...) {
+		manifest.UsesPermissions = append(manifest.UsesPermissions, xmlString(p.Name))
+	}
+	manifest.Permissions = []ApkPermission{}
+	for _, p := range xm.Permissions {
+		manifest.Permissions = append(manifest.Permissions, ApkPermission{
+			Name:            xmlString(p.Name),
+			ProtectionLevel: xmlString(p.ProtectionLevel),
+		})
+	}
+	manifest.Features = []ApkFeature{}
+	for _, feature := range xm.UsesFeatures {
+		manifest.Features = append(manifest.Features, ApkFeature{
+			Name:     xmlString(feature.Name),
+			Required: xmlBool(feature.Required, true),
+		})
+	}
+	manifest.Libraries = []string{}
+	for _, lib := range app.UsesLibraries {
+		manifest.Libraries = append(manifest.Libraries, xmlString(lib.Name))
+	}
+	for _, inst := range xm.Instrumentations {
+		manifest.Instrumentations = append(manifest.Instrumentations, ApkComponent{
+			Name:           fullClassName(pkg, xmlString(inst.Name)),
+			TargetActivity: xmlString(inst.Target),
+		})
+	}
+	manifest.MetaData = make(map[string]string)
+	for _, md := range app.MetaData {
+		value := xmlString(md.Value)
+		if value == "" {
+			value = xmlString(md.Resource)
+		}
+		manifest.MetaData[xmlString(md.Name)] = value
+	}
+	return nil
+}
+
+// apkAbis return abi names of lib/<abi>/*.so
+func apkAbis(zr *zip.Reader) []string {
+	seen := make(map[string]bool)
+	abis := []string{}
+	for _, f := range zr.File {
+		if !strings.HasPrefix(f.Name, "lib/") || !strings.HasSuffix(f.Name, ".so") {
+			continue
+		}
+		abi := strings.SplitN(f.Name, "/", 3)[1]
+		if !seen[abi] {
+			seen[abi] = true
+			abis = append(abis, abi)
+		}
+	}
+	sort.Strings(abis)
+	return abis
+}
+
+// apkCertificates collect certificates of v1 (META-INF/*.RSA|DSA|EC) and v2/v3 signing block
+func apkCertificates(r io.ReaderAt, size int64, zr *zip.Reader) ([]ApkCertificate, error) {
+	certs := []ApkCertificate{}
+	index := make(map[string]int)
+	add := func(scheme string, cert *x509.Certificate) {
+		digest := sha256.Sum256(cert.Raw)
+		key := hex.EncodeToString(digest[:])
+		if i, ok := index[key]; ok {
+			certs[i].Schemes = append(certs[i].Schemes, scheme)
+			return
+		}
+		sha1sum := sha1.Sum(cert.Raw)
+		md5sum := md5.Sum(cert.Raw)
+		index[key] = len(certs)
+		certs = append(certs, ApkCertificate{
+			Schemes:   []string{scheme},
+			Subject:   cert.Subject.String(),
+			Issuer:    cert.Issuer.String(),
+			Serial:    cert.SerialNumber.String(),
+			NotBefore: cert.NotBefore,
+			NotAfter:  cert.NotAfter,
+			Sha256:    key,
+			Sha1:      hex.EncodeToString(sha1sum[:]),
+			Md5:       hex.EncodeToString(md5sum[:]),
+		})
+	}
+
+	for _, f := range zr.File {
+		dir, name := path.Split(f.Name)
+		ext := strings.ToUpper(path.Ext(name))
+		if dir != "META-INF/" || (ext != ".RSA" && ext != ".DSA" && ext != ".EC") {
+			continue
+		}
+		data, err := readZipFile(f)
+		if err != nil {
+			return certs, err
+		}
+		v1certs, err := parsePKCS7Certificates(data)
+		if err != nil {
+			return certs, errors.Wrap(err, f.Name)
+		}
+		for _, cert := range v1certs {
+			add("v1", cert)
+		}
+	}
+
+	blocks, err := readSigningBlock(r, size)
+	if err != nil {
+		return certs, err
+	}
+	for _, scheme := range []struct {
+		name string
+		id   uint32
+	}{{"v2", apkSignatureSchemeV2}, {"v3", apkSignatureSchemeV3}} {
+		value, ok := blocks[scheme.id]
+		if !ok {
+			continue
+		}
+		schemeCerts, err := parseSignatureSchemeCertificates(value)
+		if err != nil {
+			return certs, errors.Wrap(err, "apk signature scheme "+scheme.name)
+		}
+		for _, cert := range schemeCerts {
+			add(scheme.name, cert)
+		}
+	}
+	return certs, nil
+}
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// parsePKCS7Certificates read certificates from PKCS#7 SignedData of v1 signature
+func parsePKCS7Certificates(data []byte) ([]*x509.Certificate, error) {
+	var info pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	var signedData pkcs7SignedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &signedData); err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificates(signedData.Certificates.Bytes)
+}
+
+const (
+	apkSigningBlockMagic = "APK Sig Block 42"
+	apkSignatureSchemeV2 = 0x7109871a
+	apkSignatureSchemeV3 = 0xf05368c0
+)
+
+// readSigningBlock return id-value pairs of APK Signing Block, empty when apk has no signing block
+//
+//	[signing block][central directory][end of central directory]
+func readSigningBlock(r io.ReaderAt, size int64) (map[uint32][]byte, error) {
+	blocks := make(map[uint32][]byte)
+	// end of central directory is at least 22 bytes, comment is up to 65535 bytes
+	tailSize := int64(22 + 65535)
+	if tailSize > size {
+		tailSize = size
+	}
+	tail := make([]byte, tailSize)
+	if _, err := r.ReadAt(tail, size-tailSize); err != nil && err != io.EOF {
+		return nil, err
+	}
+	eocd := bytes.LastIndex(tail, []byte{0x50, 0x4b, 0x05, 0x06})
+	if eocd < 0 || eocd+22 > len(tail) {
+		return nil, errors.New("end of central directory not found")
+	}
+	cdOffset := int64(binary.LittleEndian.Uint32(tail[eocd+16:]))
+	if cdOffset < 32 || cdOffset > size {
+		return blocks, nil
+	}
+	footer := make([]byte, 24)
+	if _, err := r.ReadAt(footer, cdOffset-24); err != nil {
+		return nil, err
+	}
+	if string(footer[8:]) != apkSigningBlockMagic {
+		return blocks, nil // v1 only
+	}
+	blockSize := int64(binary.LittleEndian.Uint64(footer))
+	if blockSize < 24 || blockSize+8 > cdOffset {
+		return nil, errors.New("invalid apk signing block size")
+	}
+	data := make([]byte, blockSize-24)
+	if _, err := r.ReadAt(data, cdOffset-blockSize); err != nil {
+		return nil, err
+	}
+	for len(data) > 0 {
+		if len(data) < 12 {
+			return nil, errors.New("invalid apk signing block pair")
+		}
+		pairSize := binary.LittleEndian.Uint64(data)
+		if pairSize < 4 || pairSize > uint64(len(data)-8) {
+			return nil, errors.New("invalid apk signing block pair size")
+		}
+		id := binary.LittleEndian.Uint32(data[8:])
+		blocks[id] = data[12 : 8+pairSize]
+		data = data[8+pairSize:]
+	}
+	return blocks, nil
+}
+
+// readLengthPrefixed read uint32 length prefixed bytes
+func readLengthPrefixed(data []byte) (value []byte, rest []byte, err error) {
+	if len(data) < 4 {
+		return nil, nil, errors.New("length prefixed data too short")
+	}
+	n := binary.LittleEndian.Uint32(data)
+	if uint64(n) > uint64(len(data)-4) {
+		return nil, nil, errors.New("length prefixed data out of range")
+	}
+	return data[4 : 4+n], data[4+n:], nil
+}
+
+// parseSignatureSchemeCertificates read certificates of v2 and v3 signers
+//
+//	signers: [signer]; signer: signed data, ...; signed data: digests, certificates, ...
+func parseSignatureSchemeCertificates(value []byte) (certs []*x509.Certificate, err error) {
+	signers, _, err := readLengthPrefixed(value)
+	if err != nil {
+		return nil, err
+	}
+	for len(signers) > 0 {
+		var signer, signedData, certsData, certData []byte
+		if signer, signers, err = readLengthPrefixed(signers); err != nil {
+			return nil, err
+		}
+		if signedData, _, err = readLengthPrefixed(signer); err != nil {
+			return nil, err
+		}
+		if _, signedData, err = readLengthPrefixed(signedData); err != nil { // skip digests
+			return nil, err
+		}
+		if certsData, _, err = readLengthPrefixed(signedData); err != nil {
+			return nil, err
+		}
+		for len(certsData) > 0 {
+			if certData, certsData, err = readLengthPrefixed(certsData); err != nil {
+				return nil, err
+			}
+			cert, err := x509.ParseCertificate(certData)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		}
+	}
+	return certs, nil
+}
+
+// packageApkPath return base apk path of the installed package
+func packageApkPath(packageName string) (string, error) {
+	output, err := runShell("pm", "path", packageName)
+	line := strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0])
+	if !strings.HasPrefix(line, "package:") {
+		if err != nil {
+			return "", err
+		}
+		return "", ErrPackageNotInstalled
+	}
+	return line[len("package:"):], nil
+}
+
+// inspectAPKFromRequest inspect apk of multipart file, form value path or request body
+func inspectAPKFromRequest(r *http.Request, tmpdir string) (ApkManifest, error) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType == "multipart/form-data" {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return ApkManifest{}, err
+		}
+		defer file.Close()
+		return inspectAPKFromReader(file, tmpdir)
+	}
+	// curl --data-binary send urlencoded Content-Type by default, check zip magic before parse form
+	body := bufio.NewReader(r.Body)
+	if magic, _ := body.Peek(4); bytes.Equal(magic, []byte("PK\x03\x04")) {
+		return inspectAPKFromReader(body, tmpdir)
+	}
+	if contentType == "application/x-www-form-urlencoded" {
+		r.Body = ioutil.NopCloser(body)
+		if fpath := r.FormValue("path"); fpath != "" {
+			return inspectAPK(fpath)
+		}
+		return ApkManifest{}, errors.New("file or path is required")
+	}
+	return inspectAPKFromReader(body, tmpdir)
+}
+
+// inspectAPKFromReader save apk into tmpdir and inspect, the file is removed after
+func inspectAPKFromReader(rd io.Reader, tmpdir string) (ApkManifest, error) {
+	os.MkdirAll(tmpdir, 0755)
+	dst := TempFileName(tmpdir, ".apk")
+	fd, err := os.Create(dst)
+	if err != nil {
+		return ApkManifest{}, err
+	}
+	defer os.Remove(dst)
+	_, err = io.Copy(fd, rd)
+	fd.Close()
+	if err != nil {
+		return ApkManifest{}, err
+	}
+	return inspectAPK(dst)
+}
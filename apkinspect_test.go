@@ -0,0 +1,185 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testCertificate(t *testing.T, cn string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	return der
+}
+
+// testPKCS7 build a SignedData with certificates only
+func testPKCS7(t *testing.T, cert []byte) []byte {
+	signedData, err := asn1.Marshal(struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      asn1.RawValue
+		Certificates     asn1.RawValue
+		SignerInfos      asn1.RawValue
+	}{
+		Version:          1,
+		DigestAlgorithms: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true},
+		ContentInfo:      asn1.RawValue{FullBytes: []byte{0x30, 0x0b, 0x06, 0x09, 0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x01, 0x07, 0x01}},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: cert},
+		SignerInfos:      asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true},
+	})
+	assert.NoError(t, err)
+	data, err := asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{
+		ContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2},
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData},
+	})
+	assert.NoError(t, err)
+	return data
+}
+
+func lengthPrefixed(parts ...[]byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	for _, p := range parts {
+		binary.Write(buf, binary.LittleEndian, uint32(len(p)))
+		buf.Write(p)
+	}
+	return buf.Bytes()
+}
+
+// testSigningBlock build APK Signing Block with one v2 signer
+func testSigningBlock(cert []byte) []byte {
+	signedData := append(lengthPrefixed(nil), lengthPrefixed(lengthPrefixed(cert))...) // digests, certificates
+	signer := lengthPrefixed(signedData, nil, nil)                                     // signed data, signatures, public key
+	value := lengthPrefixed(lengthPrefixed(signer))
+
+	pairs := bytes.NewBuffer(nil)
+	binary.Write(pairs, binary.LittleEndian, uint64(len(value)+4))
+	binary.Write(pairs, binary.LittleEndian, uint32(apkSignatureSchemeV2))
+	pairs.Write(value)
+
+	size := uint64(pairs.Len() + 24)
+	block := bytes.NewBuffer(nil)
+	binary.Write(block, binary.LittleEndian, size)
+	block.Write(pairs.Bytes())
+	binary.Write(block, binary.LittleEndian, size)
+	block.WriteString(apkSigningBlockMagic)
+	return block.Bytes()
+}
+
+// insertSigningBlock put block before central directory and fix offset in end of central directory
+func insertSigningBlock(data, block []byte) []byte {
+	eocd := bytes.LastIndex(data, []byte{0x50, 0x4b, 0x05, 0x06})
+	cdOffset := binary.LittleEndian.Uint32(data[eocd+16:])
+	out := append(append(append([]byte{}, data[:cdOffset]...), block...), data[cdOffset:]...)
+	binary.LittleEndian.PutUint32(out[eocd+len(block)+16:], cdOffset+uint32(len(block)))
+	return out
+}
+
+func TestApkCertificates(t *testing.T) {
+	cert := testCertificate(t, "release")
+	buf := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buf)
+	for name, content := range map[string][]byte{
+		"META-INF/CERT.RSA":            testPKCS7(t, cert),
+		"META-INF/MANIFEST.MF":         []byte("Manifest-Version: 1.0\n"),
+		"lib/arm64-v8a/libfoo.so":      nil,
+		"lib/armeabi-v7a/libfoo.so":    nil,
+		"lib/arm64-v8a/libbar.so":      nil,
+		"assets/lib/x86/libnot.so":     nil,
+		"classes.dex":                  nil,
+		"lib/x86_64/README.txt":        nil,
+		"res/drawable/lib/icon.so.png": nil,
+	} {
+		w, _ := zw.Create(name)
+		w.Write(content)
+	}
+	assert.NoError(t, zw.Close())
+	data := insertSigningBlock(buf.Bytes(), testSigningBlock(cert))
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"arm64-v8a", "armeabi-v7a"}, apkAbis(zr))
+
+	certs, err := apkCertificates(bytes.NewReader(data), int64(len(data)), zr)
+	assert.NoError(t, err)
+	digest := sha256.Sum256(cert)
+	if assert.Len(t, certs, 1) {
+		assert.Equal(t, []string{"v1", "v2"}, certs[0].Schemes)
+		assert.Equal(t, hex.EncodeToString(digest[:]), certs[0].Sha256)
+		assert.Equal(t, "CN=release", certs[0].Subject)
+		assert.Equal(t, "42", certs[0].Serial)
+		assert.Len(t, certs[0].Sha1, 40)
+	}
+}
+
+func TestReadSigningBlockV1Only(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buf)
+	zw.Create("classes.dex")
+	zw.Close()
+	blocks, err := readSigningBlock(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.NoError(t, err)
+	assert.Empty(t, blocks)
+
+	_, err = readSigningBlock(bytes.NewReader([]byte("not a zip file")), 14)
+	assert.Error(t, err)
+}
+
+func TestFullClassName(t *testing.T) {
+	assert.Equal(t, "com.example.MainActivity", fullClassName("com.example", ".MainActivity"))
+	assert.Equal(t, "com.example.MainActivity", fullClassName("com.example", "MainActivity"))
+	assert.Equal(t, "com.other.Service", fullClassName("com.example", "com.other.Service"))
+	assert.Equal(t, "", fullClassName("com.example", ""))
+}
+
+func TestInspectAPKFromRequest(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "atx-apk")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	buf := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buf)
+	zw.Create("classes.dex")
+	zw.Close()
+
+	// curl --data-binary use urlencoded Content-Type, body is still treated as apk
+	req := httptest.NewRequest("POST", "/apk/manifest", bytes.NewReader(buf.Bytes()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err = inspectAPKFromRequest(req, tmpdir)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "AndroidManifest.xml")
+	}
+	infos, _ := ioutil.ReadDir(tmpdir)
+	assert.Empty(t, infos)
+
+	req = httptest.NewRequest("POST", "/apk/manifest", strings.NewReader("path=/not-exists.apk"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err = inspectAPKFromRequest(req, tmpdir)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/pkg/errors"
 	"github.com/shogo82148/androidbinary/apk"
@@ -16,6 +17,193 @@ var canFixedInstallFails = map[string]bool{
 	"INSTALL_FAILED_VERSION_DOWNGRADE":          true,
 }
 
+var installFailureMessages = map[string]string{
+	"INSTALL_FAILED_ALREADY_EXISTS":                  "package is already installed",
+	"INSTALL_FAILED_INVALID_APK":                     "invalid apk file",
+	"INSTALL_FAILED_INSUFFICIENT_STORAGE":            "not enough storage space",
+	"INSTALL_FAILED_DUPLICATE_PACKAGE":               "package with the same name already exists",
+	"INSTALL_FAILED_UPDATE_INCOMPATIBLE":             "signatures do not match the installed package",
+	"INSTALL_FAILED_SHARED_USER_INCOMPATIBLE":        "shared user signatures do not match",
+	"INSTALL_FAILED_MISSING_SHARED_LIBRARY":          "required shared library is missing",
+	"INSTALL_FAILED_OLDER_SDK":                       "device sdk is older than minSdkVersion",
+	"INSTALL_FAILED_NEWER_SDK":                       "device sdk is newer than maxSdkVersion",
+	"INSTALL_FAILED_TEST_ONLY":                       "test only package, allowTest is required",
+	"INSTALL_FAILED_CPU_ABI_INCOMPATIBLE":            "native code does not match device abi",
+	"INSTALL_FAILED_NO_MATCHING_ABIS":                "native code does not match device abi",
+	"INSTALL_FAILED_VERSION_DOWNGRADE":               "installed version is newer, allowDowngrade is required",
+	"INSTALL_FAILED_PERMISSION_MODEL_DOWNGRADE":      "targetSdkVersion is lower than the installed package",
+	"INSTALL_FAILED_USER_RESTRICTED":                 "install is restricted by user, check developer options",
+	"INSTALL_FAILED_ABORTED":                         "install aborted",
+	"INSTALL_FAILED_VERIFICATION_FAILURE":            "package verification failed",
+	"INSTALL_PARSE_FAILED_NO_CERTIFICATES":           "apk is not signed",
+	"INSTALL_PARSE_FAILED_NOT_APK":                   "not an apk file",
+	"INSTALL_PARSE_FAILED_INCONSISTENT_CERTIFICATES": "certificates are inconsistent",
+}
+
+// InstallOptions map to pm install flags, unset options of requests keep the value of DefaultInstallOptions
+type InstallOptions struct {
+	AllowDowngrade       bool   `json:"allowDowngrade"`                 // -d
+	GrantPermissions     bool   `json:"grantPermissions"`               // -g, android 6.0+
+	KeepData             bool   `json:"keepData"`                       // pm uninstall -k when auto uninstall
+	AllowTest            bool   `json:"allowTest"`                      // -t
+	InstallerPackageName string `json:"installerPackageName,omitempty"` // -i
+	AutoUninstall        bool   `json:"autoUninstall"`                  // uninstall and retry when failure in canFixedInstallFails, app data is lost unless KeepData
+}
+
+// DefaultInstallOptions never uninstall the installed app, set AutoUninstall explicitly
+func DefaultInstallOptions() InstallOptions {
+	return InstallOptions{
+		AllowDowngrade:   true,
+		GrantPermissions: true,
+	}
+}
+
+// canAutoUninstall check if the install failure can be fixed by uninstall
+// downgrade is only fixed this way when AllowDowngrade is set
+func (o InstallOptions) canAutoUninstall(code string) bool {
+	if !o.AutoUninstall || !canFixedInstallFails[code] {
+		return false
+	}
+	return code != "INSTALL_FAILED_VERSION_DOWNGRADE" || o.AllowDowngrade
+}
+
+// args return flags of pm install and pm install-create
+func (o InstallOptions) args() []string {
+	args := []string{"-r"}
+	if o.AllowDowngrade {
+		args = append(args, "-d")
+	}
+	if o.AllowTest {
+		args = append(args, "-t")
+	}
+	if sdk, _ := strconv.Atoi(getCachedProperty("ro.build.version.sdk")); o.GrantPermissions && sdk >= 23 { // android 6.0
+		args = append(args, "-g")
+	}
+	if o.InstallerPackageName != "" {
+		args = append(args, "-i", o.InstallerPackageName)
+	}
+	return args
+}
+
+// installOptionsFromRequest read options from query or form
+func installOptionsFromRequest(r *http.Request) (opts InstallOptions, err error) {
+	opts = DefaultInstallOptions()
+	flags := map[string]*bool{
+		"allowDowngrade":   &opts.AllowDowngrade,
+		"grantPermissions": &opts.GrantPermissions,
+		"keepData":         &opts.KeepData,
+		"allowTest":        &opts.AllowTest,
+		"autoUninstall":    &opts.AutoUninstall,
+	}
+	for name, ptr := range flags {
+		value := r.FormValue(name)
+		if value == "" {
+			continue
+		}
+		if *ptr, err = strconv.ParseBool(value); err != nil {
+			return opts, errors.Errorf("invalid %s: %s", name, value)
+		}
+	}
+	opts.InstallerPackageName = r.FormValue("installerPackageName")
+	if opts.InstallerPackageName != "" && !packageNameRe.MatchString(opts.InstallerPackageName) {
+		return opts, errors.Errorf("invalid installerPackageName: %s", opts.InstallerPackageName)
+	}
+	return opts, nil
+}
+
+// InstallError is parsed from pm output, eg: Failure [INSTALL_FAILED_UPDATE_INCOMPATIBLE: Package com.example signatures do not match]
+type InstallError struct {
+	Code    string `json:"code"` // empty when output has no failure code
+	Message string `json:"message"`
+	Output  string `json:"output"`
+}
+
+func (e *InstallError) Error() string {
+	if e.Code == "" {
+		return e.Message
+	}
+	return "Failure [" + e.Code + "]: " + e.Message
+}
+
+var installFailureRe = regexp.MustCompile(`Failure \[([A-Z_]+)(?::\s*([^\]]*))?\]`)
+
+// newInstallError parse pm output, err is the exit error of pm
+func newInstallError(out []byte, err error) *InstallError {
+	output := strings.TrimSpace(string(out))
+	ie := &InstallError{Output: output}
+	matches := installFailureRe.FindStringSubmatch(output)
+	if matches == nil {
+		ie.Message = output
+		if ie.Message == "" && err != nil {
+			ie.Message = err.Error()
+		}
+		return ie
+	}
+	ie.Code = matches[1]
+	ie.Message = installFailureMessages[ie.Code]
+	if detail := strings.TrimSpace(matches[2]); detail != "" {
+		if ie.Message == "" {
+			ie.Message = detail
+		} else {
+			ie.Message += ": " + detail
+		}
+	}
+	if ie.Message == "" {
+		ie.Message = strings.ToLower(strings.Replace(strings.TrimPrefix(ie.Code, "INSTALL_"), "_", " ", -1))
+	}
+	return ie
+}
+
+// checkInstallOutput return nil when pm succeeded, old pm exit with 0 when install failed
+func checkInstallOutput(out []byte, err error) error {
+	if err != nil || !bytes.Contains(out, []byte("Success")) {
+		return newInstallError(out, err)
+	}
+	return nil
+}
+
+type InstallResult struct {
+	PackageName string `json:"packageName,omitempty"`
+	VersionCode int    `json:"versionCode,omitempty"` // installed version
+	VersionName string `json:"versionName,omitempty"`
+	FailureCode string `json:"failureCode,omitempty"`
+	Message     string `json:"message,omitempty"`
+	Retried     bool   `json:"retried"` // app was uninstalled and installed again
+}
+
+// installWithRetry uninstall the app and retry once when the failure can be fixed and opts.AutoUninstall is set
+func installWithRetry(opts InstallOptions, packageName func() (string, error), install func() error) (result InstallResult, err error) {
+	result.PackageName, _ = packageName()
+	err = install()
+	if ie, ok := err.(*InstallError); ok && opts.canAutoUninstall(ie.Code) && result.PackageName != "" {
+		args := []string{"pm", "uninstall"}
+		if opts.KeepData {
+			args = append(args, "-k")
+		}
+		log.Infof("install meet %v, uninstall %s", ie.Code, result.PackageName)
+		runShellQuote(append(args, result.PackageName)...)
+		result.Retried = true
+		err = install()
+	}
+	if err != nil {
+		result.Message = err.Error()
+		if ie, ok := err.(*InstallError); ok {
+			result.FailureCode = ie.Code
+			result.Message = ie.Message
+		}
+		return
+	}
+	result.Message = "success installed"
+	if result.PackageName == "" {
+		return
+	}
+	if info, err := readPackageInfo(result.PackageName); err == nil {
+		result.VersionCode = info.VersionCode
+		result.VersionName = info.VersionName
+	}
+	return
+}
+
 type APKManager struct {
 	Path         string
 	packageName  string
@@ -37,46 +225,35 @@ func (am *APKManager) PackageName() (string, error) {
 	return am.packageName, nil
 }
 
+// pmInstall return *InstallError when failed
+func (am *APKManager) pmInstall(opts InstallOptions) error {
+	args := append([]string{"pm", "install"}, opts.args()...)
+	out, err := runShellQuote(append(args, am.Path)...)
+	return checkInstallOutput(out, err)
+}
+
 func (am *APKManager) Install() error {
-	sdk, _ := strconv.Atoi(getCachedProperty("ro.build.version.sdk"))
-	cmds := []string{"pm", "install", "-d", "-r", am.Path}
-	if sdk >= 23 { // android 6.0
-		cmds = []string{"pm", "install", "-d", "-r", "-g", am.Path}
-	}
-	out, err := runShell(cmds...)
-	if err != nil {
-		matches := regexp.MustCompile(`Failure \[([\w_ ]+)\]`).FindStringSubmatch(string(out))
-		if len(matches) > 0 {
-			return errors.Wrap(err, matches[0])
-		}
-		return errors.Wrap(err, string(out))
-	}
-	return nil
+	_, err := am.InstallWithOptions(DefaultInstallOptions())
+	return err
 }
 
+// ForceInstall uninstall the app and retry when signatures or versions conflict
 func (am *APKManager) ForceInstall() error {
-	err := am.Install()
-	if err == nil {
-		return nil
-	}
-	errType := regexp.MustCompile(`INSTALL_FAILED_[\w_]+`).FindString(err.Error())
-	if !canFixedInstallFails[errType] {
-		return err
-	}
-	log.Infof("install meet %v, try to uninstall", errType)
-	packageName, err := am.PackageName()
-	if err != nil {
-		return errors.Wrap(err, "apk parse")
-	}
+	opts := DefaultInstallOptions()
+	opts.AutoUninstall = true
+	_, err := am.InstallWithOptions(opts)
+	return err
+}
 
-	log.Infof("uninstall %s", packageName)
-	runShell("pm", "uninstall", packageName)
-	return am.Install()
+func (am *APKManager) InstallWithOptions(opts InstallOptions) (InstallResult, error) {
+	return installWithRetry(opts, am.PackageName, func() error {
+		return am.pmInstall(opts)
+	})
 }
 
 type StartOptions struct {
-	Stop bool
-	Wait bool
+	Stop bool // force stop before start
+	Wait bool // wait until activity launched
 }
 
 func (am *APKManager) Start(opts StartOptions) error {
@@ -91,7 +268,12 @@ func (am *APKManager) Start(opts StartOptions) error {
 	if !strings.Contains(mainActivity, ".") {
 		mainActivity = "." + mainActivity
 	}
-	_, err = runShellTimeout(30*time.Second, "am", "start", "-n", packageName+"/"+mainActivity)
+	_, err = startIntent(IntentRequest{
+		Intent:  Intent{Component: packageName + "/" + mainActivity},
+		Wait:    &opts.Wait,
+		Stop:    opts.Stop,
+		Timeout: "30s",
+	})
 	return err
 }
 
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewInstallError(t *testing.T) {
+	ie := newInstallError([]byte("Failure [INSTALL_FAILED_UPDATE_INCOMPATIBLE: Package com.example signatures do not match]\n"), nil)
+	assert.Equal(t, "INSTALL_FAILED_UPDATE_INCOMPATIBLE", ie.Code)
+	assert.Equal(t, "signatures do not match the installed package: Package com.example signatures do not match", ie.Message)
+
+	ie = newInstallError([]byte("Failure [INSTALL_FAILED_SOMETHING_NEW]"), nil)
+	assert.Equal(t, "Failure [INSTALL_FAILED_SOMETHING_NEW]: failed something new", ie.Error())
+
+	ie = newInstallError(nil, errors.New("exit status 127"))
+	assert.Equal(t, "", ie.Code)
+	assert.Equal(t, "exit status 127", ie.Error())
+
+	assert.NoError(t, checkInstallOutput([]byte("Success\n"), nil))
+	assert.Error(t, checkInstallOutput([]byte("Failure [INSTALL_FAILED_INVALID_APK]"), nil))
+}
+
+func TestInstallWithRetry(t *testing.T) {
+	logPath, cleanup := fakePM(t, "Success")
+	defer cleanup()
+	packageName := func() (string, error) { return "com.example", nil }
+
+	attempts := 0
+	install := func() error {
+		attempts++
+		if attempts == 1 {
+			return newInstallError([]byte("Failure [INSTALL_FAILED_VERSION_DOWNGRADE]"), nil)
+		}
+		return nil
+	}
+	opts := DefaultInstallOptions()
+	opts.AutoUninstall = true
+	opts.KeepData = true
+	result, err := installWithRetry(opts, packageName, install)
+	assert.NoError(t, err)
+	assert.True(t, result.Retried)
+	assert.Equal(t, "com.example", result.PackageName)
+	data, _ := ioutil.ReadFile(logPath)
+	assert.Contains(t, string(data), "uninstall -k com.example")
+
+	// auto uninstall is not allowed
+	attempts = 0
+	opts.AutoUninstall = false
+	result, err = installWithRetry(opts, packageName, install)
+	assert.Error(t, err)
+	assert.False(t, result.Retried)
+	assert.Equal(t, "INSTALL_FAILED_VERSION_DOWNGRADE", result.FailureCode)
+	assert.Equal(t, 1, attempts)
+
+	// downgrade is not fixed by uninstall when allowDowngrade is false
+	attempts = 0
+	opts.AutoUninstall = true
+	opts.AllowDowngrade = false
+	result, err = installWithRetry(opts, packageName, install)
+	assert.Error(t, err)
+	assert.False(t, result.Retried)
+	assert.Equal(t, 1, attempts)
+	assert.False(t, DefaultInstallOptions().AutoUninstall)
+}
+
+func TestInstallOptionsFromRequest(t *testing.T) {
+	req := httptest.NewRequest("POST", "/install?allowDowngrade=false&allowTest=1&installerPackageName=com.android.vending", nil)
+	opts, err := installOptionsFromRequest(req)
+	assert.NoError(t, err)
+	assert.False(t, opts.AllowDowngrade)
+	assert.True(t, opts.AllowTest)
+	assert.True(t, opts.GrantPermissions)
+	assert.False(t, opts.AutoUninstall)
+	assert.Equal(t, "com.android.vending", opts.InstallerPackageName)
+	assert.Equal(t, []string{"-r", "-t", "-i", "com.android.vending"}, opts.args()) // no -g when sdk unknown
+
+	_, err = installOptionsFromRequest(httptest.NewRequest("POST", "/install?keepData=maybe", nil))
+	assert.Error(t, err)
+
+	_, err = installOptionsFromRequest(httptest.NewRequest("POST", "/install?installerPackageName=com.a%3Breboot", nil))
+	assert.Error(t, err)
+}
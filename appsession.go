@@ -0,0 +1,614 @@
+/*
+App session supervision, created by POST /session/{pkgname}
+
+Processes of the app are polled every second, crashes are detected from logcat
+(FATAL EXCEPTION, ANR in, native crash dump) and new files in /data/tombstones and /data/anr.
+The same crash or anr reported by logcat and file is counted once, see AppSessionEvent.DuplicateOf
+
+	$ curl $DEVICE_URL/sessions
+	$ curl $DEVICE_URL/sessions/{id}
+	$ curl -X DELETE $DEVICE_URL/sessions/{id}
+	ws://$DEVICE_URL/sessions/{id}/events
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/procfs"
+)
+
+const (
+	appSessionMaxEvents   = 500
+	appSessionMaxDetail   = 16 * 1024
+	appSessionMaxSessions = 20
+	appSessionDuration    = time.Hour
+	appSessionDedupWindow = time.Minute // logcat report and tombstone or anr trace of the same incident
+)
+
+var (
+	fatalProcessRe  = regexp.MustCompile(`^Process: ([^,\s]+), PID: (\d+)`)
+	anrProcessRe    = regexp.MustCompile(`^ANR in (\S+)`)
+	anrPidRe        = regexp.MustCompile(`^PID: (\d+)`)
+	nativeProcessRe = regexp.MustCompile(`pid: (\d+), tid: \d+, name: .*>>> (\S+) <<<`)
+)
+
+var appSessions = newAppSessionManager()
+
+// AppSessionEvent types: start, restart, died, crash, native-crash, anr, closed
+type AppSessionEvent struct {
+	Seq     int       `json:"seq"`
+	Type    string    `json:"type"`
+	Source  string    `json:"source,omitempty"` // process, logcat, tombstone, anr-trace
+	Pid     int       `json:"pid,omitempty"`
+	Process string    `json:"process,omitempty"`
+	Message string    `json:"message,omitempty"` // exception, ANR reason or signal
+	Detail  string    `json:"detail,omitempty"`  // stack trace
+	File    string    `json:"file,omitempty"`
+	Time    time.Time `json:"time"`
+	// DuplicateOf is seq of the event reporting the same incident from another source, not counted again
+	DuplicateOf int `json:"duplicateOf,omitempty"`
+}
+
+func (ev AppSessionEvent) eventSeq() int {
+	return ev.Seq
+}
+
+type appSessionState struct {
+	jobState
+	PackageName string            `json:"packageName"`
+	Status      string            `json:"status"` // running, restarted, died, crashed, anr, closed
+	Pid         int               `json:"pid"`    // main process, 0 when not running
+	Pids        []int             `json:"pids"`   // all main process pids in the session
+	Processes   map[string]int    `json:"processes"`
+	Crashes     int               `json:"crashes"`
+	ANRs        int               `json:"anrs"`
+	ExpiresAt   time.Time         `json:"expiresAt"`
+	Events      []AppSessionEvent `json:"events"`
+}
+
+type AppSession struct {
+	appSessionState
+	jobDone
+	mu        sync.Mutex
+	seq       int
+	pending   []AppSessionEvent // added but not published yet
+	publishMu sync.Mutex        // keep events published in seq order
+	publisher *eventPublisher
+	cancel    context.CancelFunc
+	detector  *crashDetector
+	seenFiles map[string]time.Time
+
+	procs     func(packageName string) map[int]string
+	crashDirs map[string]string // dir to event type
+}
+
+func newAppSession(packageName string) *AppSession {
+	s := &AppSession{
+		appSessionState: appSessionState{
+			jobState:    newJobState(),
+			PackageName: packageName,
+			Status:      "running",
+			Pids:        []int{},
+			Processes:   map[string]int{},
+			Events:      []AppSessionEvent{},
+		},
+		jobDone:   newJobDone(),
+		publisher: newEventPublisher(),
+		seenFiles: make(map[string]time.Time),
+		procs:     appProcesses,
+		crashDirs: map[string]string{
+			"/data/tombstones": "native-crash",
+			"/data/anr":        "anr",
+		},
+	}
+	s.detector = &crashDetector{onEvent: s.addCrashEvent}
+	return s
+}
+
+// State return a copy of session state
+func (s *AppSession) State() appSessionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.appSessionState
+	state.Pids = append([]int{}, s.Pids...)
+	state.Events = append([]AppSessionEvent{}, s.Events...)
+	state.Processes = make(map[string]int, len(s.Processes))
+	for name, pid := range s.Processes {
+		state.Processes[name] = pid
+	}
+	return state
+}
+
+func (s *AppSession) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.State())
+}
+
+// Subscribe return false if session already closed
+func (s *AppSession) Subscribe(ch chan interface{}) bool {
+	return s.publisher.Subscribe(ch)
+}
+
+func (s *AppSession) Unsubscribe(ch chan interface{}) {
+	s.publisher.Unsubscribe(ch)
+}
+
+func (s *AppSession) bufferedEvents() []seqEvent {
+	events := s.State().Events
+	evs := make([]seqEvent, 0, len(events))
+	for _, ev := range events {
+		evs = append(evs, ev)
+	}
+	return evs
+}
+
+// ownProcess check process name or pid belongs to the app
+func (s *AppSession) ownProcess(name string, pid int) bool {
+	if name == s.PackageName || strings.HasPrefix(name, s.PackageName+":") {
+		return true
+	}
+	if name != "" || pid == 0 {
+		return false
+	}
+	for _, p := range s.Pids {
+		if p == pid {
+			return true
+		}
+	}
+	for _, p := range s.Processes {
+		if p == pid {
+			return true
+		}
+	}
+	return false
+}
+
+// duplicateOf return seq of the buffered event of the same crash or anr reported by another source, 0 if not found
+func (s *AppSession) duplicateOf(ev AppSessionEvent) int {
+	for i := len(s.Events) - 1; i >= 0; i-- {
+		old := s.Events[i]
+		if old.Type != ev.Type || old.Source == ev.Source || old.DuplicateOf != 0 {
+			continue
+		}
+		if old.Pid != 0 && ev.Pid != 0 {
+			if old.Pid != ev.Pid {
+				continue
+			}
+		} else if old.Process != ev.Process {
+			continue
+		}
+		diff := ev.Time.Sub(old.Time)
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff <= appSessionDedupWindow {
+			return old.Seq
+		}
+	}
+	return 0
+}
+
+// addEvent must be called with lock held, call publish after unlock
+func (s *AppSession) addEvent(ev AppSessionEvent) {
+	s.seq++
+	ev.Seq = s.seq
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if len(ev.Detail) > appSessionMaxDetail {
+		ev.Detail = ev.Detail[:appSessionMaxDetail]
+	}
+	switch ev.Type {
+	case "crash", "native-crash", "anr":
+		ev.DuplicateOf = s.duplicateOf(ev)
+	}
+	switch {
+	case ev.DuplicateOf != 0:
+		// counted by the first report
+	case ev.Type == "start":
+		s.Status = "running"
+	case ev.Type == "restart":
+		s.Status = "restarted"
+	case ev.Type == "died":
+		if s.Status != "crashed" && s.Status != "anr" {
+			s.Status = "died"
+		}
+	case ev.Type == "crash" || ev.Type == "native-crash":
+		s.Crashes++
+		s.Status = "crashed"
+	case ev.Type == "anr":
+		s.ANRs++
+		s.Status = "anr"
+	case ev.Type == "closed":
+		s.Status = "closed"
+	}
+	s.Events = append(s.Events, ev)
+	if len(s.Events) > appSessionMaxEvents {
+		s.Events = s.Events[len(s.Events)-appSessionMaxEvents:]
+	}
+	s.pending = append(s.pending, ev)
+}
+
+// publish submit pending events without holding s.mu, a slow subscriber never blocks the session
+func (s *AppSession) publish() {
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+	s.mu.Lock()
+	events := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	for _, ev := range events {
+		s.publisher.Submit(ev)
+	}
+}
+
+func (s *AppSession) addCrashEvent(ev AppSessionEvent) {
+	defer s.publish()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Status == "closed" || !s.ownProcess(ev.Process, ev.Pid) {
+		return
+	}
+	if ev.Time.Before(s.CreatedAt.Add(-2 * time.Second)) {
+		return // logged before session created
+	}
+	s.addEvent(ev)
+}
+
+// poll processes of the app, record start, restart and died of main process
+func (s *AppSession) poll() {
+	procs := s.procs(s.PackageName)
+	defer s.publish()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Status == "closed" {
+		return
+	}
+	mainPid := 0
+	processes := make(map[string]int, len(procs))
+	for pid, name := range procs {
+		processes[name] = pid
+		if name == s.PackageName {
+			mainPid = pid
+		}
+	}
+	s.Processes = processes
+	if mainPid == s.Pid {
+		return
+	}
+	if s.Pid != 0 {
+		s.addEvent(AppSessionEvent{Type: "died", Source: "process", Pid: s.Pid, Process: s.PackageName})
+	}
+	if mainPid != 0 {
+		typ := "start"
+		if len(s.Pids) > 0 {
+			typ = "restart"
+		}
+		s.Pids = append(s.Pids, mainPid)
+		s.addEvent(AppSessionEvent{Type: typ, Source: "process", Pid: mainPid, Process: s.PackageName})
+	}
+	s.Pid = mainPid
+}
+
+// scanCrashFiles check new tombstones and anr traces, directories not readable are ignored
+func (s *AppSession) scanCrashFiles() {
+	for dir, typ := range s.crashDirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, finfo := range files {
+			path := filepath.Join(dir, finfo.Name())
+			if finfo.IsDir() || !finfo.ModTime().After(s.CreatedAt) {
+				continue
+			}
+			if seen, ok := s.seenFiles[path]; ok && seen.Equal(finfo.ModTime()) {
+				continue
+			}
+			s.seenFiles[path] = finfo.ModTime()
+			if ev, ok := parseCrashFile(path, typ, s.PackageName); ok {
+				ev.Time = finfo.ModTime()
+				s.mu.Lock()
+				if s.Status != "closed" {
+					s.addEvent(ev)
+				}
+				s.mu.Unlock()
+				s.publish()
+			}
+		}
+	}
+}
+
+// parseCrashFile read head of tombstone or anr trace, ok is false when file not belongs to the package
+//
+//	tombstone: pid: 1234, tid: 1250, name: Thread-2  >>> com.example <<<
+//	anr trace: Cmd line: com.example
+func parseCrashFile(path, typ, packageName string) (ev AppSessionEvent, ok bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ev, false
+	}
+	defer f.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(f, 256*1024))
+	content := string(data)
+	ev = AppSessionEvent{Type: typ, Source: "tombstone", File: path, Process: packageName}
+	if typ == "anr" {
+		ev.Source = "anr-trace"
+	}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if matches := nativeProcessRe.FindStringSubmatch(line); matches != nil {
+			if matches[2] == packageName || strings.HasPrefix(matches[2], packageName+":") {
+				ok = true
+				ev.Pid, _ = strconv.Atoi(matches[1])
+				ev.Process = matches[2]
+			}
+		}
+		if line == "Cmd line: "+packageName || strings.HasPrefix(line, "Cmd line: "+packageName+":") {
+			ok = true
+			ev.Process = strings.TrimPrefix(line, "Cmd line: ")
+		}
+		if strings.HasPrefix(line, "----- pid ") && ev.Pid == 0 {
+			ev.Pid, _ = strconv.Atoi(strings.Fields(line)[2])
+		}
+		if ev.Message == "" && (strings.HasPrefix(line, "signal ") || strings.HasPrefix(line, "Abort message: ") || strings.HasPrefix(line, "Subject: ")) {
+			ev.Message = line
+		}
+	}
+	if !ok {
+		return ev, false
+	}
+	ev.Detail = content
+	return ev, true
+}
+
+// start supervision until closed or duration passed
+func (s *AppSession) start(duration time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	s.cancel = cancel
+	s.ExpiresAt = s.CreatedAt.Add(duration)
+	go s.watchLogcat(ctx)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			s.poll()
+			s.detector.FlushIdle(500 * time.Millisecond)
+			if i%5 == 0 {
+				s.scanCrashFiles()
+			}
+			select {
+			case <-ctx.Done():
+				s.Close()
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (s *AppSession) watchLogcat(ctx context.Context) {
+	args := []string{"-T", "1"} // only new lines
+	for {
+		start := time.Now()
+		err := runLogcat(ctx, args, s.detector.Feed)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && time.Since(start) < time.Second && len(args) > 0 {
+			args = nil // -T not supported, old lines are filtered by time
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Close stop supervision, state and events are kept
+func (s *AppSession) Close() {
+	s.detector.FlushIdle(0) // pending crash report
+	s.mu.Lock()
+	if s.Status == "closed" {
+		s.mu.Unlock()
+		return
+	}
+	s.addEvent(AppSessionEvent{Type: "closed"})
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.mu.Unlock()
+	s.publish()
+	s.publisher.Close()
+	s.finish()
+}
+
+// crashDetector group continuous lines of a crash report with the same tag and pid
+type crashDetector struct {
+	mu      sync.Mutex
+	block   *crashBlock
+	onEvent func(AppSessionEvent)
+}
+
+type crashBlock struct {
+	typ     string
+	tag     string
+	pid     int
+	lines   []string
+	time    time.Time // time of the first line
+	updated time.Time
+}
+
+func (d *crashDetector) Feed(entry LogcatEntry) {
+	d.mu.Lock()
+	if b := d.block; b != nil {
+		if entry.Tag == b.tag && entry.Pid == b.pid {
+			b.lines = append(b.lines, entry.Message)
+			b.updated = time.Now()
+			d.mu.Unlock()
+			return
+		}
+	}
+	ev, ok := d.flushLocked()
+	switch {
+	case entry.Tag == "AndroidRuntime" && strings.HasPrefix(entry.Message, "FATAL EXCEPTION"):
+		d.block = &crashBlock{typ: "crash"}
+	case entry.Tag == "ActivityManager" && strings.HasPrefix(entry.Message, "ANR in "):
+		d.block = &crashBlock{typ: "anr"}
+	case entry.Tag == "DEBUG" && strings.HasPrefix(entry.Message, "*** *** ***"):
+		d.block = &crashBlock{typ: "native-crash"}
+	}
+	if d.block != nil {
+		d.block.tag = entry.Tag
+		d.block.pid = entry.Pid
+		d.block.lines = []string{entry.Message}
+		d.block.time = entry.Time
+		d.block.updated = time.Now()
+	}
+	d.mu.Unlock()
+	if ok {
+		d.onEvent(ev)
+	}
+}
+
+// FlushIdle emit the pending report when no more lines received after idle
+func (d *crashDetector) FlushIdle(idle time.Duration) {
+	d.mu.Lock()
+	if d.block == nil || time.Since(d.block.updated) < idle {
+		d.mu.Unlock()
+		return
+	}
+	ev, ok := d.flushLocked()
+	d.mu.Unlock()
+	if ok {
+		d.onEvent(ev)
+	}
+}
+
+func (d *crashDetector) flushLocked() (ev AppSessionEvent, ok bool) {
+	b := d.block
+	if b == nil {
+		return ev, false
+	}
+	d.block = nil
+	ev = AppSessionEvent{Type: b.typ, Source: "logcat", Time: b.time, Detail: strings.Join(b.lines, "\n")}
+	for i, line := range b.lines {
+		line = strings.TrimSpace(line)
+		switch b.typ {
+		case "crash":
+			if matches := fatalProcessRe.FindStringSubmatch(line); matches != nil {
+				ev.Process = matches[1]
+				ev.Pid, _ = strconv.Atoi(matches[2])
+				if i+1 < len(b.lines) {
+					ev.Message = strings.TrimSpace(b.lines[i+1])
+				}
+			}
+		case "anr":
+			if matches := anrProcessRe.FindStringSubmatch(line); matches != nil {
+				ev.Process = matches[1]
+			} else if matches := anrPidRe.FindStringSubmatch(line); matches != nil {
+				ev.Pid, _ = strconv.Atoi(matches[1])
+			} else if strings.HasPrefix(line, "Reason: ") {
+				ev.Message = strings.TrimPrefix(line, "Reason: ")
+			}
+		case "native-crash":
+			if matches := nativeProcessRe.FindStringSubmatch(line); matches != nil {
+				ev.Pid, _ = strconv.Atoi(matches[1])
+				ev.Process = matches[2]
+			} else if ev.Message == "" && strings.HasPrefix(line, "signal ") {
+				ev.Message = line
+			}
+		}
+	}
+	if ev.Type == "crash" && ev.Pid == 0 {
+		ev.Pid = b.pid // Process line missing on old devices
+	}
+	return ev, true
+}
+
+// appProcesses return pid to process name, which is com.example or com.example:remote
+func appProcesses(packageName string) map[int]string {
+	procs := make(map[int]string)
+	fs, err := procfs.NewFS(procfs.DefaultMountPoint)
+	if err != nil {
+		return procs
+	}
+	all, err := fs.AllProcs()
+	if err != nil {
+		return procs
+	}
+	for _, proc := range all {
+		cmdline, _ := proc.CmdLine()
+		if len(cmdline) != 1 {
+			continue
+		}
+		if cmdline[0] == packageName || strings.HasPrefix(cmdline[0], packageName+":") {
+			procs[proc.PID] = cmdline[0]
+		}
+	}
+	return procs
+}
+
+type appSessionManager struct {
+	mu       sync.Mutex // serialize Create
+	sessions *jobRegistry
+}
+
+func newAppSessionManager() *appSessionManager {
+	return &appSessionManager{
+		sessions: newJobRegistry(),
+	}
+}
+
+// Create start supervising the package, oldest sessions are removed when too many
+// Running session of the same package is closed, so the app is never supervised twice
+func (m *appSessionManager) Create(packageName string, duration time.Duration) *AppSession {
+	if duration <= 0 {
+		duration = appSessionDuration
+	}
+	s := newAppSession(packageName)
+	s.start(duration)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, old := range m.List() {
+		if old.PackageName == packageName {
+			old.Close() // kept for query
+		}
+	}
+	m.sessions.Add(s)
+	for _, old := range m.List() {
+		if m.sessions.Len() <= appSessionMaxSessions {
+			break
+		}
+		m.sessions.Remove(old.ID)
+		old.Close()
+	}
+	return s
+}
+
+// Get return nil if not found
+func (m *appSessionManager) Get(id string) *AppSession {
+	s, _ := m.sessions.Get(id).(*AppSession)
+	return s
+}
+
+func (m *appSessionManager) List() []*AppSession {
+	jobs := m.sessions.List()
+	sessions := make([]*AppSession, 0, len(jobs))
+	for _, j := range jobs {
+		sessions = append(sessions, j.(*AppSession))
+	}
+	return sessions
+}
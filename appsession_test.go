@@ -0,0 +1,256 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func feedLogcat(d *crashDetector, lines string) {
+	for _, line := range strings.Split(strings.TrimSpace(lines), "\n") {
+		if entry, ok := parseThreadtime(strings.TrimSpace(line), time.Now()); ok {
+			entry.Time = time.Now()
+			d.Feed(entry)
+		}
+	}
+}
+
+func eventTypes(events []AppSessionEvent) []string {
+	types := []string{}
+	for _, ev := range events {
+		types = append(types, ev.Type)
+	}
+	return types
+}
+
+func TestAppSessionProcesses(t *testing.T) {
+	procs := map[int]string{}
+	s := newAppSession("com.example")
+	s.procs = func(packageName string) map[int]string {
+		return procs
+	}
+	s.poll()
+	assert.Empty(t, s.State().Events)
+
+	procs = map[int]string{100: "com.example", 101: "com.example:push"}
+	s.poll()
+	procs = map[int]string{101: "com.example:push"}
+	s.poll()
+	procs = map[int]string{200: "com.example"}
+	s.poll()
+
+	state := s.State()
+	assert.Equal(t, []string{"start", "died", "restart"}, eventTypes(state.Events))
+	assert.Equal(t, []int{100, 200}, state.Pids)
+	assert.Equal(t, 200, state.Pid)
+	assert.Equal(t, "restarted", state.Status)
+	assert.Equal(t, map[string]int{"com.example": 200}, state.Processes)
+}
+
+func TestAppSessionCrashDetect(t *testing.T) {
+	s := newAppSession("com.example")
+	s.procs = func(packageName string) map[int]string {
+		return map[int]string{1234: "com.example"}
+	}
+	s.poll()
+
+	feedLogcat(s.detector, `
+		01-01 00:00:00.000  1234  1234 E AndroidRuntime: FATAL EXCEPTION: main
+		01-01 00:00:00.000  1234  1234 E AndroidRuntime: Process: com.example, PID: 1234
+		01-01 00:00:00.000  1234  1234 E AndroidRuntime: java.lang.RuntimeException: boom
+		01-01 00:00:00.000  1234  1234 E AndroidRuntime: 	at com.example.MainActivity.onCreate(MainActivity.java:10)
+		01-01 00:00:00.001   555   560 E AndroidRuntime: FATAL EXCEPTION: main
+		01-01 00:00:00.001   555   560 E AndroidRuntime: Process: com.other, PID: 555
+		01-01 00:00:00.001   555   560 E AndroidRuntime: java.lang.NullPointerException
+		01-01 00:00:00.002   900   950 E ActivityManager: ANR in com.example (com.example/.MainActivity)
+		01-01 00:00:00.002   900   950 E ActivityManager: PID: 1234
+		01-01 00:00:00.002   900   950 E ActivityManager: Reason: Input dispatching timed out
+		01-01 00:00:00.003   900   950 I ActivityManager: Process com.example (pid 1234) has died
+		01-01 00:00:00.004  3000  3000 F DEBUG   : *** *** *** *** *** *** *** *** *** *** *** *** *** *** *** ***
+		01-01 00:00:00.004  3000  3000 F DEBUG   : pid: 1234, tid: 1240, name: RenderThread  >>> com.example <<<
+		01-01 00:00:00.004  3000  3000 F DEBUG   : signal 11 (SIGSEGV), code 1 (SEGV_MAPERR), fault addr 0x0
+	`)
+	s.detector.FlushIdle(0)
+
+	state := s.State()
+	assert.Equal(t, []string{"start", "crash", "anr", "native-crash"}, eventTypes(state.Events))
+	assert.Equal(t, 2, state.Crashes)
+	assert.Equal(t, 1, state.ANRs)
+	assert.Equal(t, "crashed", state.Status)
+
+	crash := state.Events[1]
+	assert.Equal(t, 1234, crash.Pid)
+	assert.Equal(t, "java.lang.RuntimeException: boom", crash.Message)
+	assert.Contains(t, crash.Detail, "MainActivity.java:10")
+	assert.Equal(t, "Input dispatching timed out", state.Events[2].Message)
+	assert.Equal(t, 1234, state.Events[2].Pid)
+	assert.Equal(t, "signal 11 (SIGSEGV), code 1 (SEGV_MAPERR), fault addr 0x0", state.Events[3].Message)
+
+	s.Close()
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("session not done after closed")
+	}
+	assert.Equal(t, "closed", s.State().Status)
+	s.poll()
+	assert.Len(t, s.State().Events, 5)
+}
+
+func TestAppSessionCrashFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atx-tombstones")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := newAppSession("com.example")
+	s.crashDirs = map[string]string{dir: "native-crash"}
+
+	ioutil.WriteFile(filepath.Join(dir, "tombstone_00"), []byte(`*** *** *** *** ***
+pid: 1234, tid: 1240, name: RenderThread  >>> com.example <<<
+signal 6 (SIGABRT), code -6 (SI_TKILL), fault addr --------
+Abort message: 'boom'
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "tombstone_01"), []byte("pid: 1, tid: 1, name: x  >>> com.other <<<\n"), 0644)
+	old := filepath.Join(dir, "tombstone_02")
+	ioutil.WriteFile(old, []byte("pid: 1, tid: 1, name: x  >>> com.example <<<\n"), 0644)
+	os.Chtimes(old, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+	future := time.Now().Add(time.Second)
+	os.Chtimes(filepath.Join(dir, "tombstone_00"), future, future)
+	os.Chtimes(filepath.Join(dir, "tombstone_01"), future, future)
+
+	s.scanCrashFiles()
+	s.scanCrashFiles()
+	events := s.State().Events
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "native-crash", events[0].Type)
+		assert.Equal(t, "tombstone", events[0].Source)
+		assert.Equal(t, 1234, events[0].Pid)
+		assert.Equal(t, "signal 6 (SIGABRT), code -6 (SI_TKILL), fault addr --------", events[0].Message)
+	}
+
+	trace := writeTempFile(t, "----- pid 4321 at 2020-01-01 00:00:00 -----\nCmd line: com.example\nSubject: Input dispatching timed out\n")
+	defer os.Remove(trace)
+	ev, ok := parseCrashFile(trace, "anr", "com.example")
+	assert.True(t, ok)
+	assert.Equal(t, 4321, ev.Pid)
+	assert.Equal(t, "anr-trace", ev.Source)
+	assert.Equal(t, "Subject: Input dispatching timed out", ev.Message)
+}
+
+func TestAppSessionDuplicateCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atx-crash-files")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tombstones := filepath.Join(dir, "tombstones")
+	anr := filepath.Join(dir, "anr")
+	os.Mkdir(tombstones, 0755)
+	os.Mkdir(anr, 0755)
+	s := newAppSession("com.example")
+	s.crashDirs = map[string]string{tombstones: "native-crash", anr: "anr"}
+	s.procs = func(packageName string) map[int]string {
+		return map[int]string{1234: "com.example"}
+	}
+	s.poll()
+
+	feedLogcat(s.detector, `
+		01-01 00:00:00.002   900   950 E ActivityManager: ANR in com.example (com.example/.MainActivity)
+		01-01 00:00:00.002   900   950 E ActivityManager: PID: 1234
+		01-01 00:00:00.002   900   950 E ActivityManager: Reason: Input dispatching timed out
+		01-01 00:00:00.004  3000  3000 F DEBUG   : *** *** *** *** *** *** *** *** *** *** *** *** *** *** *** ***
+		01-01 00:00:00.004  3000  3000 F DEBUG   : pid: 1234, tid: 1240, name: RenderThread  >>> com.example <<<
+		01-01 00:00:00.004  3000  3000 F DEBUG   : signal 11 (SIGSEGV), code 1 (SEGV_MAPERR), fault addr 0x0
+	`)
+	s.detector.FlushIdle(0)
+
+	future := time.Now().Add(time.Second)
+	files := map[string]string{
+		filepath.Join(tombstones, "tombstone_00"): "pid: 1234, tid: 1240, name: RenderThread  >>> com.example <<<\n",
+		filepath.Join(tombstones, "tombstone_01"): "pid: 5678, tid: 5678, name: main  >>> com.example <<<\n",
+		filepath.Join(anr, "anr_00"):              "----- pid 1234 at 2020-01-01 00:00:00 -----\nCmd line: com.example\n",
+	}
+	for path, content := range files {
+		ioutil.WriteFile(path, []byte(content), 0644)
+		os.Chtimes(path, future, future)
+	}
+	s.scanCrashFiles()
+
+	state := s.State()
+	assert.Equal(t, 2, state.Crashes)
+	assert.Equal(t, 1, state.ANRs)
+	duplicates := map[string]int{}
+	for _, ev := range state.Events {
+		if ev.DuplicateOf != 0 {
+			duplicates[ev.Source+" "+ev.Type] = ev.DuplicateOf
+		}
+	}
+	assert.Equal(t, map[string]int{"tombstone native-crash": 3, "anr-trace anr": 2}, duplicates)
+}
+
+func TestAppSessionSlowSubscriber(t *testing.T) {
+	s := newAppSession("com.example")
+	pid := 0
+	s.procs = func(packageName string) map[int]string {
+		pid++
+		return map[int]string{pid: "com.example"}
+	}
+	ch := make(chan interface{}) // never read
+	s.Subscribe(ch)
+	polled := make(chan bool)
+	go func() {
+		for i := 0; i < 30; i++ {
+			s.poll()
+		}
+		close(polled)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	state := make(chan appSessionState)
+	go func() {
+		state <- s.State()
+	}()
+	select {
+	case st := <-state:
+		assert.NotEmpty(t, st.Events)
+	case <-time.After(time.Second):
+		t.Fatal("State blocked by slow subscriber")
+	}
+
+	s.Unsubscribe(ch)
+	<-polled
+	s.Close()
+}
+
+func writeTempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "atx-crash")
+	assert.NoError(t, err)
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func TestAppSessionManagerCreate(t *testing.T) {
+	m := newAppSessionManager()
+	first := m.Create("com.example", time.Minute)
+	other := m.Create("com.other", time.Minute)
+	second := m.Create("com.example", time.Minute)
+	defer other.Close()
+	defer second.Close()
+
+	select {
+	case <-first.Done():
+	default:
+		t.Fatal("previous session of the same package should be closed")
+	}
+	assert.Equal(t, "closed", first.State().Status)
+	assert.Equal(t, "running", other.State().Status)
+	assert.Equal(t, "running", second.State().Status)
+	assert.Len(t, m.List(), 3)
+
+	ch := make(chan interface{}, 10)
+	assert.False(t, first.Subscribe(ch))
+	first.Unsubscribe(ch) // not blocked
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var archiveContentTypes = map[string]string{
+	"tar":    "application/x-tar",
+	"tar.gz": "application/gzip",
+	"zip":    "application/zip",
+}
+
+// archiveFilter patterns are matched against both relative path and file name, eg: *.png, cache, logs/**
+// Directory matched by excludes will be skipped entirely. When includes is empty, every file is included
+type archiveFilter struct {
+	Includes []string
+	Excludes []string
+}
+
+func matchGlob(pattern, relPath string) bool {
+	if strings.HasSuffix(pattern, "/**") {
+		prefix := strings.TrimSuffix(pattern, "/**")
+		return relPath == prefix || strings.HasPrefix(relPath, prefix+"/")
+	}
+	if ok, _ := path.Match(pattern, relPath); ok {
+		return true
+	}
+	ok, _ := path.Match(pattern, path.Base(relPath))
+	return ok
+}
+
+func (f archiveFilter) excluded(relPath string) bool {
+	for _, pattern := range f.Excludes {
+		if matchGlob(pattern, relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f archiveFilter) included(relPath string) bool {
+	if len(f.Includes) == 0 {
+		return true
+	}
+	for _, pattern := range f.Includes {
+		if matchGlob(pattern, relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// walkArchiveFiles call fn with name in archive, name starts with base name of root
+func walkArchiveFiles(root string, filter archiveFilter, fn func(name string, fpath string, finfo os.FileInfo) error) error {
+	root = filepath.Clean(root)
+	base := filepath.Base(root)
+	return filepath.Walk(root, func(fpath string, finfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, fpath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		name := path.Join(base, rel)
+		if rel == "." {
+			if finfo.IsDir() {
+				return fn(name, fpath, finfo)
+			}
+			rel = base
+		}
+		if filter.excluded(rel) {
+			if finfo.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !finfo.IsDir() && !filter.included(rel) {
+			return nil
+		}
+		return fn(name, fpath, finfo)
+	})
+}
+
+// writeArchive stream directory or file as tar, tar.gz or zip.
+// The archive is left unfinished on error, so it is never taken as a complete one
+func writeArchive(w io.Writer, root string, format string, filter archiveFilter) error {
+	switch format {
+	case "tar":
+		return writeTarArchive(w, root, filter)
+	case "tar.gz":
+		gzw := gzip.NewWriter(w)
+		if err := writeTarArchive(gzw, root, filter); err != nil {
+			return err
+		}
+		return gzw.Close()
+	case "zip":
+		return writeZipArchive(w, root, filter)
+	}
+	return errors.New("unsupported archive format: " + format)
+}
+
+func writeTarArchive(w io.Writer, root string, filter archiveFilter) error {
+	tw := tar.NewWriter(w)
+	err := walkArchiveFiles(root, filter, func(name, fpath string, finfo os.FileInfo) error {
+		var link string
+		if finfo.Mode()&os.ModeSymlink != 0 {
+			link, _ = os.Readlink(fpath)
+		}
+		header, err := tar.FileInfoHeader(finfo, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if finfo.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !finfo.Mode().IsRegular() {
+			return nil
+		}
+		return copyFileTo(tw, fpath)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeZipArchive(w io.Writer, root string, filter archiveFilter) error {
+	zw := zip.NewWriter(w)
+	err := walkArchiveFiles(root, filter, func(name, fpath string, finfo os.FileInfo) error {
+		header, err := zip.FileInfoHeader(finfo)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if finfo.IsDir() {
+			header.Name += "/"
+		} else {
+			header.Method = zip.Deflate
+		}
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		switch {
+		case finfo.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(fpath)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(fw, link)
+			return err
+		case finfo.Mode().IsRegular():
+			return copyFileTo(fw, fpath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func copyFileTo(w io.Writer, fpath string) error {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// archiveFormatOf return format from name suffix, default zip
+func archiveFormatOf(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	}
+	return "zip"
+}
+
+// extractArchive extract zip, tar or tar.gz into directory dst.
+// Entries outside of dst and links pointing outside of dst are refused
+func extractArchive(rd io.Reader, format string, dst string) error {
+	switch format {
+	case "zip":
+		return extractZipArchive(rd, dst)
+	case "tar":
+		return extractTarArchive(tar.NewReader(rd), dst)
+	case "tar.gz", "tgz":
+		gzr, err := gzip.NewReader(rd)
+		if err != nil {
+			return err
+		}
+		defer gzr.Close()
+		return extractTarArchive(tar.NewReader(gzr), dst)
+	}
+	return errors.New("unsupported archive format: " + format)
+}
+
+func extractTarArchive(tr *tar.Reader, dst string) error {
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fpath, err := archiveEntryPath(dst, header.Name)
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(fpath, 0755)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeArchiveFile(fpath, tr, header.FileInfo().Mode())
+		case tar.TypeSymlink:
+			err = writeArchiveSymlink(dst, fpath, header.Linkname)
+		case tar.TypeLink:
+			var target string
+			if target, err = archiveEntryPath(dst, header.Linkname); err == nil {
+				err = createArchiveEntry(fpath, func() error {
+					return os.Link(target, fpath)
+				})
+			}
+		default:
+			log.Printf("extract %s skipped, type flag: %c", header.Name, header.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// extractZipArchive read whole zip into memory, because the central directory is at the end
+func extractZipArchive(rd io.Reader, dst string) error {
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		fpath, err := archiveEntryPath(dst, zf.Name)
+		if err != nil {
+			return err
+		}
+		if zf.FileInfo().IsDir() {
+			if err := os.MkdirAll(fpath, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := extractZipEntry(zf, dst, fpath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractZipEntry(zf *zip.File, dst, fpath string) error {
+	rc, err := zf.Open()
+	if err != nil {
+		return fmt.Errorf("%s: %v", zf.Name, err)
+	}
+	defer rc.Close()
+	if zf.Mode()&os.ModeSymlink != 0 {
+		link, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		return writeArchiveSymlink(dst, fpath, string(link))
+	}
+	return writeArchiveFile(fpath, rc, zf.Mode())
+}
+
+// archiveEntryPath return path of the entry in dst, error if it is outside of dst
+func archiveEntryPath(dst, name string) (string, error) {
+	fpath := filepath.Join(dst, name)
+	if !isSubPath(dst, fpath) {
+		return "", fmt.Errorf("%s: path is outside of %s", name, dst)
+	}
+	return fpath, nil
+}
+
+func writeArchiveFile(fpath string, rd io.Reader, mode os.FileMode) error {
+	var f *os.File
+	err := createArchiveEntry(fpath, func() (err error) {
+		f, err = os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+		return
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, rd); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeArchiveSymlink refuse link target outside of dst, relative target is resolved from the link directory
+func writeArchiveSymlink(dst, fpath, linkname string) error {
+	target := linkname
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(fpath), target)
+	}
+	if !isSubPath(dst, target) {
+		return fmt.Errorf("%s: link to %s is outside of %s", fpath, linkname, dst)
+	}
+	return createArchiveEntry(fpath, func() error {
+		return os.Symlink(linkname, fpath)
+	})
+}
+
+// createArchiveEntry create parent directory and remove existing file or link before create, so nothing is written through a link
+func createArchiveEntry(fpath string, create func() error) error {
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(fpath); err == nil && !info.IsDir() {
+		if err := os.Remove(fpath); err != nil {
+			return err
+		}
+	}
+	return create()
+}
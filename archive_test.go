@@ -0,0 +1,146 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeArchiveTestDir(t *testing.T) string {
+	tmpdir, err := ioutil.TempDir("", "atx-archive")
+	assert.NoError(t, err)
+	root := filepath.Join(tmpdir, "output")
+	for _, name := range []string{"a.png", "b.txt", "cache/c.png", "shots/d.png"} {
+		fpath := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(fpath), 0755)
+		assert.NoError(t, ioutil.WriteFile(fpath, []byte(name), 0644))
+	}
+	return root
+}
+
+func TestMatchGlob(t *testing.T) {
+	assert.True(t, matchGlob("*.png", "shots/d.png"))
+	assert.True(t, matchGlob("shots/*.png", "shots/d.png"))
+	assert.True(t, matchGlob("cache", "cache"))
+	assert.True(t, matchGlob("shots/**", "shots/x/y.png"))
+	assert.False(t, matchGlob("shots/**", "shots2/y.png"))
+	assert.False(t, matchGlob("*.txt", "a.png"))
+}
+
+func TestWriteTarGzArchive(t *testing.T) {
+	root := makeArchiveTestDir(t)
+	defer os.RemoveAll(filepath.Dir(root))
+
+	buf := bytes.NewBuffer(nil)
+	err := writeArchive(buf, root, "tar.gz", archiveFilter{
+		Includes: []string{"*.png"},
+		Excludes: []string{"cache"},
+	})
+	assert.NoError(t, err)
+
+	gzr, err := gzip.NewReader(buf)
+	assert.NoError(t, err)
+	tr := tar.NewReader(gzr)
+	var names []string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		names = append(names, header.Name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"output/", "output/a.png", "output/shots/", "output/shots/d.png"}, names)
+
+	// extract back with the same function used by /upload
+	dst, _ := ioutil.TempDir("", "atx-extract")
+	defer os.RemoveAll(dst)
+	buf.Reset()
+	assert.NoError(t, writeArchive(buf, root, "tar", archiveFilter{}))
+	assert.NoError(t, extractArchive(buf, archiveFormatOf("output.tar"), dst))
+	data, err := ioutil.ReadFile(filepath.Join(dst, "output", "cache", "c.png"))
+	assert.NoError(t, err)
+	assert.Equal(t, "cache/c.png", string(data))
+}
+
+func TestWriteZipArchive(t *testing.T) {
+	root := makeArchiveTestDir(t)
+	defer os.RemoveAll(filepath.Dir(root))
+
+	buf := bytes.NewBuffer(nil)
+	assert.NoError(t, writeArchive(buf, filepath.Join(root, "b.txt"), "zip", archiveFilter{}))
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.NoError(t, err)
+	assert.Len(t, zr.File, 1)
+	assert.Equal(t, "b.txt", zr.File[0].Name)
+
+	assert.Error(t, writeArchive(buf, root, "rar", archiveFilter{}))
+}
+
+func TestArchiveFormatOf(t *testing.T) {
+	assert.Equal(t, "tar.gz", archiveFormatOf("a.TGZ"))
+	assert.Equal(t, "tar.gz", archiveFormatOf("a.tar.gz"))
+	assert.Equal(t, "tar", archiveFormatOf("a.tar"))
+	assert.Equal(t, "zip", archiveFormatOf("a.zip"))
+	assert.Equal(t, "zip", archiveFormatOf(""))
+}
+
+func TestExtractArchiveOutsideDst(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "atx-extract")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	dst := filepath.Join(tmpdir, "dst")
+
+	tarOf := func(headers ...*tar.Header) *bytes.Buffer {
+		buf := bytes.NewBuffer(nil)
+		tw := tar.NewWriter(buf)
+		for _, h := range headers {
+			if h.Typeflag == tar.TypeReg {
+				h.Size = int64(len(h.Name))
+			}
+			assert.NoError(t, tw.WriteHeader(h))
+			if h.Typeflag == tar.TypeReg {
+				tw.Write([]byte(h.Name))
+			}
+		}
+		tw.Close()
+		return buf
+	}
+	file := func(name string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}
+	}
+	assert.NoError(t, extractArchive(tarOf(file("a.txt"), &tar.Header{Name: "sub/link", Typeflag: tar.TypeSymlink, Linkname: "../a.txt"},
+		&tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "a.txt"}), "tar", dst))
+	data, err := ioutil.ReadFile(filepath.Join(dst, "sub", "link"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a.txt", string(data))
+	assert.True(t, fileExists(filepath.Join(dst, "hard")))
+
+	for _, headers := range [][]*tar.Header{
+		{file("../evil.txt")},
+		{&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"}},
+		{&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../../evil"}},
+		{&tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "../evil.txt"}},
+	} {
+		assert.Error(t, extractArchive(tarOf(headers...), "tar", dst), headers[0].Name)
+	}
+	assert.False(t, fileExists(filepath.Join(tmpdir, "evil.txt")))
+
+	buf := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buf)
+	fw, _ := zw.Create("../evil.txt")
+	fw.Write([]byte("evil"))
+	zw.Close()
+	assert.Error(t, extractArchive(buf, "zip", dst))
+	assert.False(t, fileExists(filepath.Join(tmpdir, "evil.txt")))
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	termRecordDir     = "/sdcard/atx-term-records"
+	termRecordEnabled = false // record every /term session, set by server --term-record
+)
+
+// asciicast v2 format
+// Refs: https://github.com/asciinema/asciinema/blob/develop/doc/asciicast-v2.md
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// asciicastWriter record terminal events, safe for concurrent use
+// All methods are no-op when writer is nil, so callers need not check whether recording is enabled
+type asciicastWriter struct {
+	mu      sync.Mutex
+	wr      io.WriteCloser
+	enc     *json.Encoder
+	header  *asciicastHeader // written before the first event, nil after written
+	startAt time.Time
+	partial map[string][]byte // incomplete utf-8 bytes left from last write, key is event code
+	closed  bool
+}
+
+// newAsciicastWriter delay writing header until the first event.
+// When size is not set, the first resize event is used as the size, or 80x24 if output comes first
+func newAsciicastWriter(wr io.WriteCloser, header asciicastHeader) (*asciicastWriter, error) {
+	header.Version = 2
+	startAt := time.Now()
+	if header.Timestamp == 0 {
+		header.Timestamp = startAt.Unix()
+	}
+	enc := json.NewEncoder(wr)
+	enc.SetEscapeHTML(false)
+	return &asciicastWriter{
+		wr:      wr,
+		enc:     enc,
+		header:  &header,
+		startAt: startAt,
+		partial: make(map[string][]byte, 2),
+	}, nil
+}
+
+// createTermRecord create a new .cast file under termRecordDir
+func createTermRecord(remoteAddr string, header asciicastHeader) (*asciicastWriter, error) {
+	if err := os.MkdirAll(termRecordDir, 0755); err != nil {
+		return nil, err
+	}
+	host := remoteAddr
+	if idx := strings.LastIndex(host, ":"); idx != -1 {
+		host = host[:idx]
+	}
+	host = strings.Map(func(r rune) rune {
+		if r == '.' || r == '-' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, host)
+	name := time.Now().Format("20060102-150405.000") + "_" + host + ".cast"
+	f, err := os.Create(filepath.Join(termRecordDir, name))
+	if err != nil {
+		return nil, err
+	}
+	rec, err := newAsciicastWriter(f, header)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (a *asciicastWriter) writeHeader() error {
+	if a.header == nil {
+		return nil
+	}
+	if a.header.Width == 0 || a.header.Height == 0 {
+		a.header.Width, a.header.Height = 80, 24
+	}
+	if err := a.enc.Encode(a.header); err != nil {
+		return err
+	}
+	a.header = nil
+	return nil
+}
+
+func (a *asciicastWriter) writeEvent(code string, data string) error {
+	if err := a.writeHeader(); err != nil {
+		return err
+	}
+	elapsed := time.Since(a.startAt).Seconds()
+	elapsed, _ = strconv.ParseFloat(strconv.FormatFloat(elapsed, 'f', 6, 64), 64)
+	return a.enc.Encode([]interface{}{elapsed, code, data})
+}
+
+// writeData split incomplete utf-8 sequence at the end of data, and send it with the next write
+func (a *asciicastWriter) writeData(code string, data []byte) error {
+	if a == nil || len(data) == 0 {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return os.ErrClosed
+	}
+	if prev := a.partial[code]; len(prev) > 0 {
+		data = append(prev, data...)
+	}
+	complete, rest := splitIncompleteRune(data)
+	a.partial[code] = append([]byte(nil), rest...)
+	if len(complete) == 0 {
+		return nil
+	}
+	return a.writeEvent(code, string(complete))
+}
+
+// WriteOutput record data write to terminal
+func (a *asciicastWriter) WriteOutput(data []byte) error {
+	return a.writeData("o", data)
+}
+
+// WriteInput record data typed by user
+func (a *asciicastWriter) WriteInput(data []byte) error {
+	return a.writeData("i", data)
+}
+
+// WriteResize record terminal resize
+func (a *asciicastWriter) WriteResize(cols, rows int) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return os.ErrClosed
+	}
+	if a.header != nil && (a.header.Width == 0 || a.header.Height == 0) {
+		a.header.Width, a.header.Height = cols, rows
+		return a.writeHeader()
+	}
+	return a.writeEvent("r", strconv.Itoa(cols)+"x"+strconv.Itoa(rows))
+}
+
+// InputWriter return a writer for io.TeeReader
+func (a *asciicastWriter) InputWriter() io.Writer {
+	if a == nil {
+		return ioutil.Discard
+	}
+	return newFakeWriter(func(data []byte) (int, error) {
+		a.WriteInput(data)
+		return len(data), nil
+	})
+}
+
+func (a *asciicastWriter) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return os.ErrClosed
+	}
+	for code, rest := range a.partial {
+		if len(rest) > 0 {
+			a.writeEvent(code, string(rest))
+		}
+	}
+	a.writeHeader() // nothing recorded
+	a.closed = true
+	return a.wr.Close()
+}
+
+func splitIncompleteRune(data []byte) (complete, rest []byte) {
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		if !utf8.RuneStart(data[len(data)-i]) {
+			continue
+		}
+		if !utf8.FullRune(data[len(data)-i:]) {
+			return data[:len(data)-i], data[len(data)-i:]
+		}
+		break
+	}
+	return data, nil
+}
+
+type termRecordInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// listTermRecords return records, newest first
+func listTermRecords() ([]termRecordInfo, error) {
+	records := make([]termRecordInfo, 0)
+	files, err := ioutil.ReadDir(termRecordDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return records, nil
+		}
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".cast") {
+			continue
+		}
+		records = append(records, termRecordInfo{
+			Name:    f.Name(),
+			Size:    f.Size(),
+			ModTime: f.ModTime(),
+		})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ModTime.After(records[j].ModTime)
+	})
+	return records, nil
+}
+
+// termRecordPath return empty string if name is not a valid record name
+func termRecordPath(name string) string {
+	if name != filepath.Base(name) || !strings.HasSuffix(name, ".cast") || strings.HasPrefix(name, ".") {
+		return ""
+	}
+	return filepath.Join(termRecordDir, name)
+}
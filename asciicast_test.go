@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type nopWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestAsciicastWriter(t *testing.T) {
+	buf := nopWriteCloser{bytes.NewBuffer(nil)}
+	rec, err := newAsciicastWriter(buf, asciicastHeader{Title: "test"})
+	assert.NoError(t, err)
+
+	hello := []byte("你好")
+	rec.WriteOutput(hello[:4]) // split in the middle of 好
+	rec.WriteOutput(hello[4:])
+	rec.WriteInput([]byte("ls\r"))
+	rec.WriteResize(120, 40)
+	assert.NoError(t, rec.Close())
+	assert.Error(t, rec.WriteOutput([]byte("closed")))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 5)
+
+	var header asciicastHeader
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &header))
+	assert.Equal(t, 2, header.Version)
+	assert.Equal(t, 80, header.Width)
+	assert.Equal(t, 24, header.Height)
+
+	expects := [][2]string{{"o", "你"}, {"o", "好"}, {"i", "ls\r"}}
+	for i, expect := range expects {
+		var event []interface{}
+		assert.NoError(t, json.Unmarshal([]byte(lines[i+1]), &event))
+		assert.Equal(t, expect[0], event[1])
+		assert.Equal(t, expect[1], event[2])
+	}
+	assert.Contains(t, lines[4], `"r","120x40"`)
+}
+
+func TestAsciicastWriterHeaderSize(t *testing.T) {
+	buf := nopWriteCloser{bytes.NewBuffer(nil)}
+	rec, err := newAsciicastWriter(buf, asciicastHeader{})
+	assert.NoError(t, err)
+	assert.Equal(t, "", buf.String()) // header is written lazily
+
+	rec.WriteResize(120, 40) // first resize is the header size
+	rec.WriteOutput([]byte("$ "))
+	rec.WriteResize(100, 30)
+	assert.NoError(t, rec.Close())
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 3) {
+		var header asciicastHeader
+		assert.NoError(t, json.Unmarshal([]byte(lines[0]), &header))
+		assert.Equal(t, 120, header.Width)
+		assert.Equal(t, 40, header.Height)
+		assert.Contains(t, lines[1], `"o","$ "`)
+		assert.Contains(t, lines[2], `"r","100x30"`)
+	}
+
+	// header is still written when nothing recorded
+	buf.Reset()
+	rec, _ = newAsciicastWriter(buf, asciicastHeader{})
+	assert.NoError(t, rec.Close())
+	assert.Contains(t, buf.String(), `"width":80,"height":24`)
+}
+
+func TestAsciicastNilWriter(t *testing.T) {
+	var rec *asciicastWriter
+	assert.NoError(t, rec.WriteOutput([]byte("hello")))
+	assert.NoError(t, rec.WriteResize(80, 24))
+	assert.NoError(t, rec.Close())
+}
+
+func TestTermRecordPath(t *testing.T) {
+	assert.Equal(t, "", termRecordPath("../etc/passwd"))
+	assert.Equal(t, "", termRecordPath("a.txt"))
+	assert.NotEqual(t, "", termRecordPath("20200101-000000.000_127.0.0.1.cast"))
+}
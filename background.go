@@ -1,82 +1,461 @@
 /*
 Handle offline download and apk install
+
+Download job status: pending -> downloading -> downloaded | failure | canceled
+Install job continue with: installing -> success | failure
+
+Jobs are journaled to downloadJournalPath, unfinished jobs are resumed after agent restarted
 */
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+)
+
+const (
+	defaultDownloadTimeout     = 2 * time.Hour
+	defaultDownloadRetries     = 5
+	defaultDownloadConcurrency = 3
+	backgroundMaxFinishedJobs  = 100
+)
+
+var (
+	ErrDownloadCanceled = errors.New("download canceled")
+	ErrDownloadChecksum = errors.New("download checksum mismatch")
+	ErrDownloadSize     = errors.New("download size mismatch")
+)
 
-	"github.com/DeanThompson/syncmap"
-	"github.com/franela/goreq"
+var (
+	background          = newBackground(defaultDownloadConcurrency)
+	downloadJournalPath = "/data/local/tmp/atx-agent.downloads.json"
 )
 
-const defaultDownloadTimeout = 2 * time.Hour
+type DownloadOptions struct {
+	Mode    os.FileMode     `json:"mode"`
+	Sha256  string          `json:"sha256,omitempty"`  // expected checksum, verified after downloaded
+	Size    int64           `json:"size,omitempty"`    // expected size, 0 means unknown
+	Retries int             `json:"retries,omitempty"` // retry times after network error, 0 means default
+	Timeout time.Duration   `json:"timeout,omitempty"`
+	Kind    string          `json:"kind"`              // download(default) or install, install job is finished by the installer
+	Keep    bool            `json:"keep,omitempty"`    // keep apk file after installed
+	Install *InstallOptions `json:"install,omitempty"` // pm install options, nil means DefaultInstallOptions
+}
 
-var background = &Background{
-	sm: syncmap.New(),
+type backgroundJob struct {
+	Key         string         `json:"key"`
+	Kind        string         `json:"kind"`
+	URL         string         `json:"url,omitempty"`
+	Target      string         `json:"target,omitempty"`
+	Message     string         `json:"message"`
+	Error       string         `json:"error"`
+	Progress    interface{}    `json:"progress"`
+	PackageName string         `json:"packageName,omitempty"`
+	Status      string         `json:"status"`
+	Retries     int            `json:"retries"`
+	CreatedAt   time.Time      `json:"createdAt"`
+	FinishedAt  *time.Time     `json:"finishedAt,omitempty"`
+	Result      *InstallResult `json:"result,omitempty"` // set when install job finished
 }
 
 type BackgroundState struct {
-	Message     string      `json:"message"`
-	Error       string      `json:"error"`
-	Progress    interface{} `json:"progress"`
-	PackageName string      `json:"packageName,omitempty"`
-	Status      string      `json:"status"`
-	err         error
-	wg          sync.WaitGroup
+	backgroundJob
+	mu     sync.Mutex
+	err    error
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+	opts   DownloadOptions
+	bg     *Background
+}
+
+// State return a copy of job state
+func (s *BackgroundState) State() backgroundJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backgroundJob
+}
+
+func (s *BackgroundState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.State())
+}
+
+// SetStatus update status, message is not changed when empty.
+// Job is marked finished when status is success, failure or canceled
+func (s *BackgroundState) SetStatus(status string, message string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setStatus(status, message, err)
+}
+
+func (s *BackgroundState) setStatus(status string, message string, err error) {
+	s.Status = status
+	if message != "" {
+		s.Message = message
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	if s.bg != nil {
+		s.bg.markDirty()
+	}
+	switch status {
+	case "success", "failure", "canceled":
+	case "downloaded":
+		if s.Kind != "download" {
+			return
+		}
+	default:
+		return
+	}
+	now := time.Now()
+	s.FinishedAt = &now
+}
+
+func (s *BackgroundState) finished() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.FinishedAt != nil
+}
+
+// Cancel stop the downloading, and the installing after download
+func (s *BackgroundState) Cancel() {
+	s.cancel()
+}
+
+func (s *BackgroundState) Canceled() bool {
+	return s.ctx.Err() != nil
+}
+
+// wait until download finished
+func (s *BackgroundState) wait() error {
+	s.wg.Wait()
+	return s.err
 }
 
 type Background struct {
-	sm *syncmap.SyncMap
-	n  int
-	mu sync.Mutex
-	// timer *SafeTimer
+	mu          sync.Mutex
+	jobs        map[string]*BackgroundState
+	n           int
+	sem         chan struct{} // limit concurrent downloads
+	dirty       chan struct{} // notify journal to save
+	journalPath string
+}
+
+func newBackground(concurrency int) *Background {
+	return &Background{
+		jobs:  make(map[string]*BackgroundState),
+		sem:   make(chan struct{}, concurrency),
+		dirty: make(chan struct{}, 1),
+	}
 }
 
 // Get return nil if not found
 func (b *Background) Get(key string) (status *BackgroundState) {
-	value, ok := b.sm.Get(key)
-	if !ok {
-		return nil
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.jobs[key]
+}
+
+// List return all jobs sorted by key
+func (b *Background) List() []*BackgroundState {
+	b.mu.Lock()
+	states := make([]*BackgroundState, 0, len(b.jobs))
+	for _, state := range b.jobs {
+		states = append(states, state)
 	}
-	status = value.(*BackgroundState)
-	return status
+	b.mu.Unlock()
+	sort.Slice(states, func(i, j int) bool {
+		ki, _ := strconv.Atoi(states[i].Key)
+		kj, _ := strconv.Atoi(states[j].Key)
+		return ki < kj
+	})
+	return states
 }
 
-func (b *Background) genKey() (key string, state *BackgroundState) {
+// Cancel return error when job not found or already finished
+func (b *Background) Cancel(key string) error {
+	state := b.Get(key)
+	if state == nil {
+		return errors.New("not found key: " + key)
+	}
+	if state.finished() {
+		return errors.New("job already finished: " + key)
+	}
+	state.Cancel()
+	return nil
+}
+
+func (b *Background) genKey(urlStr, dst string, opts DownloadOptions) (key string, state *BackgroundState) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	b.n++
 	key = fmt.Sprintf("%d", b.n)
-	state = &BackgroundState{}
-	b.sm.Set(key, state)
+	state = b.newState(backgroundJob{
+		Key:       key,
+		Kind:      opts.Kind,
+		URL:       urlStr,
+		Target:    dst,
+		Status:    "pending",
+		Message:   "waiting for other downloads",
+		CreatedAt: time.Now(),
+	}, opts)
+	b.jobs[key] = state
+	b.prune()
 	return
 }
 
+func (b *Background) newState(job backgroundJob, opts DownloadOptions) *BackgroundState {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &BackgroundState{
+		backgroundJob: job,
+		ctx:           ctx,
+		cancel:        cancel,
+		opts:          opts,
+		bg:            b,
+	}
+}
+
+// prune remove the oldest finished jobs, should be called with lock held
+func (b *Background) prune() {
+	var finished []*BackgroundState
+	for _, state := range b.jobs {
+		if state.finished() {
+			finished = append(finished, state)
+		}
+	}
+	if len(finished) <= backgroundMaxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].CreatedAt.Before(finished[j].CreatedAt)
+	})
+	for _, state := range finished[:len(finished)-backgroundMaxFinishedJobs] {
+		delete(b.jobs, state.Key)
+	}
+	b.markDirty()
+}
+
 func (b *Background) HTTPDownload(urlStr string, dst string, mode os.FileMode) (key string) {
-	key, state := b.genKey()
+	return b.HTTPDownloadWithOptions(urlStr, dst, DownloadOptions{Mode: mode})
+}
+
+func (b *Background) HTTPDownloadWithOptions(urlStr string, dst string, opts DownloadOptions) (key string) {
+	if opts.Kind == "" {
+		opts.Kind = "download"
+	}
+	key, state := b.genKey(urlStr, dst, opts)
+	b.startDownload(state)
+	return
+}
+
+// HTTPInstall download apk to dst and install, dst is removed after installed
+func (b *Background) HTTPInstall(urlStr string, dst string, opts InstallOptions) (key string) {
+	key, state := b.genKey(urlStr, dst, DownloadOptions{Mode: 0644, Kind: "install", Install: &opts})
+	b.startDownload(state)
+	go b.install(state)
+	return
+}
+
+// LocalInstall install apk already on device, the file is removed after installed unless keep is true
+func (b *Background) LocalInstall(path string, keep bool, opts InstallOptions) (key string) {
+	key, state := b.genKey("", path, DownloadOptions{Kind: "install", Keep: keep, Install: &opts})
+	state.SetStatus("downloaded", "ready to install", nil)
 	state.wg.Add(1)
-	go func() {
-		defer time.AfterFunc(5*time.Minute, func() {
-			b.sm.Delete(key)
-		})
+	state.wg.Done() // nothing to download
+	go b.install(state)
+	return
+}
+
+func (b *Background) install(state *BackgroundState) {
+	if !state.opts.Keep {
+		defer os.RemoveAll(state.Target) // release sdcard space
+	}
+
+	if err := state.wait(); err != nil {
+		log.Println("http download error")
+		return
+	}
+	if state.Canceled() {
+		state.SetStatus("canceled", "install canceled", nil)
+		return
+	}
+	opts := DefaultInstallOptions()
+	if state.opts.Install != nil {
+		opts = *state.opts.Install
+	}
+	bundle, err := openAPKBundle(state.Target)
+	if err != nil {
+		state.SetStatus("failure", "error open split apks", err)
+		return
+	}
+	var result InstallResult
+	if bundle != nil {
+		defer bundle.Close()
+		result, err = b.installBundle(state, bundle, opts)
+	} else {
+		am := &APKManager{Path: state.Target}
+		b.setPackageName(state, am.PackageName)
+		state.SetStatus("installing", "installing", nil)
+		result, err = am.InstallWithOptions(opts)
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.Result = &result
+	switch err {
+	case nil:
+		state.setStatus("success", "success installed", nil)
+		packageIndex.Notify()
+	case ErrInstallCanceled:
+		state.setStatus("canceled", "install canceled", nil)
+	default:
+		state.setStatus("failure", "error install", err)
+	}
+}
+
+func (b *Background) setPackageName(state *BackgroundState, packageName func() (string, error)) {
+	if name, err := packageName(); err == nil {
+		state.mu.Lock()
+		state.PackageName = name
+		state.mu.Unlock()
+	}
+}
+
+// installBundle install split apks, progress is updated while writing splits into session
+func (b *Background) installBundle(state *BackgroundState, bundle *apkBundle, opts InstallOptions) (InstallResult, error) {
+	b.setPackageName(state, bundle.packageName)
+	state.SetStatus("installing", "installing split apks", nil)
+	return bundle.Install(state.ctx, deviceSplitSpec(), opts, func(progress splitInstallProgress) {
+		state.mu.Lock()
+		state.Progress = progress
+		state.mu.Unlock()
+	})
+}
+
+// installFromRequest start an install job, apk is read from one of
+//
+//	file: multipart form upload, multiple files are installed as split apks
+//	request body: Content-Type must be application/vnd.android.package-archive or application/octet-stream
+//	path: apk, .apks, .xapk or directory of split apks already on device, kept after installed
+//	url: downloaded by device
+//
+// install options are read from query or form, see installOptionsFromRequest
+func installFromRequest(r *http.Request, tmpdir string) (key string, err error) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType == "multipart/form-data" {
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			return "", err
+		}
+		defer r.MultipartForm.RemoveAll()
+	}
+	opts, err := installOptionsFromRequest(r)
+	if err != nil {
+		return "", err
+	}
+	switch contentType {
+	case "multipart/form-data":
+		if files := r.MultipartForm.File["file"]; len(files) > 1 {
+			return saveAndInstallSplits(files, tmpdir, opts)
+		}
+		file, _, err := r.FormFile("file")
+		if err == nil {
+			defer file.Close()
+			return saveAndInstall(file, tmpdir, opts)
+		}
+		if err != http.ErrMissingFile {
+			return "", err
+		}
+	case "application/vnd.android.package-archive", "application/octet-stream":
+		return saveAndInstall(r.Body, tmpdir, opts)
+	}
+	if lpath := r.FormValue("path"); lpath != "" {
+		if _, err := os.Stat(lpath); err != nil {
+			return "", err
+		}
+		return background.LocalInstall(lpath, true, opts), nil
+	}
+	if urlStr := r.FormValue("url"); urlStr != "" {
+		return background.HTTPInstall(urlStr, TempFileName(tmpdir, ".apk"), opts), nil
+	}
+	return "", errors.New("one of url, path, file or apk request body is required")
+}
+
+// saveAndInstall save apk, .apks or .xapk file, the format is detected when installing
+func saveAndInstall(rd io.Reader, tmpdir string, opts InstallOptions) (key string, err error) {
+	os.MkdirAll(tmpdir, 0755)
+	dst := TempFileName(tmpdir, ".apk")
+	if err := copyToFile(rd, dst); err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+	return background.LocalInstall(dst, false, opts), nil
+}
+
+// saveAndInstallSplits save uploaded split apks into one directory
+func saveAndInstallSplits(files []*multipart.FileHeader, tmpdir string, opts InstallOptions) (key string, err error) {
+	dir := TempFileName(tmpdir, ".splits")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	for _, fh := range files {
+		name := filepath.Base(fh.Filename)
+		if !strings.HasSuffix(name, ".apk") {
+			os.RemoveAll(dir)
+			return "", errors.New("split file must be .apk: " + fh.Filename)
+		}
+		file, err := fh.Open()
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+		err = copyToFile(file, filepath.Join(dir, name))
+		file.Close()
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	return background.LocalInstall(dir, false, opts), nil
+}
 
-		b.Get(key).Message = "downloading"
-		if err := b.doHTTPDownload(key, urlStr, dst, mode); err != nil {
-			b.Get(key).Message = "http download: " + err.Error()
-		} else {
-			b.Get(key).Message = "downloaded"
+func (b *Background) startDownload(state *BackgroundState) {
+	state.wg.Add(1)
+	go func() {
+		urlStr, dst := state.URL, state.Target
+		err := b.doHTTPDownload(state, urlStr, dst, state.opts)
+		if err == ErrDownloadCanceled {
+			os.Remove(dst + ".part")
+		}
+		state.mu.Lock()
+		state.err = err
+		switch {
+		case err == nil:
+			state.setStatus("downloaded", "downloaded", nil)
+		case err == ErrDownloadCanceled:
+			state.setStatus("canceled", "download canceled", err)
+		default:
+			state.setStatus("failure", "http download: "+err.Error(), err)
 		}
+		state.mu.Unlock()
+		state.wg.Done()
 	}()
-	return
 }
 
 func (b *Background) Wait(key string) error {
@@ -84,102 +463,431 @@ func (b *Background) Wait(key string) error {
 	if state == nil {
 		return errors.New("not found key: " + key)
 	}
-	state.wg.Wait()
-	return state.err
+	return state.wait()
 }
 
-// Default download timeout 30 minutes
-func (b *Background) doHTTPDownload(key, urlStr, dst string, fileMode os.FileMode) (err error) {
-	state := b.Get(key)
-	if state == nil {
-		panic("http download key invalid: " + key)
+type backgroundJournalRecord struct {
+	backgroundJob
+	Options DownloadOptions `json:"options"`
+}
+
+func (b *Background) markDirty() {
+	select {
+	case b.dirty <- struct{}{}:
+	default:
 	}
-	defer func() {
-		state.err = err
-		state.wg.Done()
-	}()
+}
+
+// EnableJournal restore jobs from path and save jobs into it.
+// Status change is saved immediately, progress is saved every 2 seconds
+func (b *Background) EnableJournal(path string) error {
+	b.mu.Lock()
+	b.journalPath = path
+	b.mu.Unlock()
+	err := b.restore(path)
+	go b.journalLoop()
+	return err
+}
+
+func (b *Background) journalLoop() {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.dirty:
+		case <-ticker.C:
+			if !b.hasUnfinished() {
+				continue
+			}
+		}
+		if err := b.saveJournal(); err != nil {
+			log.Printf("save download journal error: %v", err)
+		}
+	}
+}
+
+func (b *Background) hasUnfinished() bool {
+	for _, state := range b.List() {
+		if !state.finished() {
+			return true
+		}
+	}
+	return false
+}
+
+// saveJournal write to a temporary file first, so the journal is never truncated
+func (b *Background) saveJournal() error {
+	b.mu.Lock()
+	path := b.journalPath
+	b.mu.Unlock()
+	if path == "" {
+		return nil
+	}
+	states := b.List()
+	records := make([]backgroundJournalRecord, 0, len(states))
+	for _, state := range states {
+		records = append(records, backgroundJournalRecord{
+			backgroundJob: state.State(),
+			Options:       state.opts,
+		})
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
 
-	res, err := goreq.Request{
-		Uri:             urlStr,
-		MaxRedirects:    10,
-		RedirectHeaders: true,
-	}.Do()
+// restore jobs from journal, keys are kept so that clients can continue polling
+func (b *Background) restore(path string) error {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
 	}
-	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		body, err := res.Body.ToString()
-		if err != nil && err == bytes.ErrTooLarge {
-			return fmt.Errorf("Expected HTTP Status code: %d", res.StatusCode)
+	var records []backgroundJournalRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return err
+	}
+	var unfinished []*BackgroundState
+	b.mu.Lock()
+	for _, rec := range records {
+		if _, ok := b.jobs[rec.Key]; ok {
+			continue
+		}
+		if n, err := strconv.Atoi(rec.Key); err == nil && n > b.n {
+			b.n = n
+		}
+		state := b.newState(rec.backgroundJob, rec.Options)
+		b.jobs[rec.Key] = state
+		if rec.FinishedAt == nil {
+			unfinished = append(unfinished, state)
 		}
-		return errors.New(body)
 	}
+	b.mu.Unlock()
+
+	for _, state := range unfinished {
+		log.Printf("resume %s job %s: %s", state.Kind, state.Key, state.URL)
+		if state.Kind == "install" && (state.Status == "downloaded" || state.Status == "installing") {
+			state.wg.Add(1)
+			state.wg.Done() // download already finished
+			go b.install(state)
+			continue
+		}
+		state.mu.Lock()
+		state.Status = "pending"
+		state.Message = "resumed after agent restart"
+		state.mu.Unlock()
+		b.startDownload(state)
+		if state.Kind == "install" {
+			go b.install(state)
+		}
+	}
+	return nil
+}
+
+// doHTTPDownload write to dst.part first, and resume with Range header after network error
+func (b *Background) doHTTPDownload(state *BackgroundState, urlStr, dst string, opts DownloadOptions) (err error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultDownloadTimeout
+	}
+	if opts.Retries == 0 {
+		opts.Retries = defaultDownloadRetries
+	}
+	// waiting in queue is not counted in timeout
+	select {
+	case b.sem <- struct{}{}:
+		defer func() { <-b.sem }()
+	case <-state.ctx.Done():
+		return ErrDownloadCanceled
+	}
+	ctx, cancel := context.WithTimeout(state.ctx, opts.Timeout)
+	defer cancel()
+	state.SetStatus("downloading", "downloading", nil)
 
 	// mkdir is not exists
 	os.MkdirAll(filepath.Dir(dst), 0755)
+	partPath := dst + ".part"
 
-	file, err := os.Create(dst)
-	if err != nil {
+	wrproxy := newDownloadProxy(nil, int(opts.Size))
+	defer wrproxy.Done()
+	state.mu.Lock()
+	state.Progress = wrproxy
+	state.mu.Unlock()
+
+	backoff := time.Second
+	for retry := 0; ; retry++ {
+		var retryable bool
+		retryable, err = downloadOnce(ctx, urlStr, partPath, opts.Size, wrproxy)
+		if err == nil {
+			break
+		}
+		if state.Canceled() {
+			return ErrDownloadCanceled
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("download timeout after %v: %v", opts.Timeout, err)
+		}
+		if !retryable || retry >= opts.Retries {
+			return err
+		}
+		log.Printf("download %s error: %v, retry after %v", urlStr, err, backoff)
+		state.mu.Lock()
+		state.Retries = retry + 1
+		state.Message = fmt.Sprintf("retry %d: %v", retry+1, err)
+		state.mu.Unlock()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			if state.Canceled() {
+				return ErrDownloadCanceled
+			}
+			return err
+		}
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+
+	if err = verifyDownload(partPath, opts.Size, opts.Sha256); err != nil {
+		os.Remove(partPath)
+		return err
+	}
+	if err = os.Rename(partPath, dst); err != nil {
 		return
 	}
+	if opts.Mode != 0 {
+		os.Chmod(dst, opts.Mode)
+	}
+	return nil
+}
+
+// downloadOnce continue from the end of partPath, retryable is true for network error and 5xx
+func downloadOnce(ctx context.Context, urlStr, partPath string, expectSize int64, wrproxy *downloadProxy) (retryable bool, err error) {
+	file, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
 	defer file.Close()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+	if expectSize > 0 && offset == expectSize {
+		wrproxy.reset(file, offset, expectSize)
+		return false, nil
+	}
+	if expectSize > 0 && offset > expectSize {
+		file.Truncate(0)
+		offset, _ = file.Seek(0, io.SeekStart)
+	}
 
-	var totalSize int
-	fmt.Sscanf(res.Header.Get("Content-Length"), "%d", &totalSize)
-	wrproxy := newDownloadProxy(file, totalSize)
-	defer wrproxy.Done()
-	b.Get(key).Progress = wrproxy
+	req, err := http.NewRequest("GET", urlStr, nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	res, err := netHTTPClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
 
-	// timeout here
-	timer := time.AfterFunc(defaultDownloadTimeout, func() {
-		res.Body.Close()
-	})
-	defer timer.Stop()
+	var totalSize int64 = -1
+	switch res.StatusCode {
+	case http.StatusOK:
+		// server do not support range, start from beginning
+		if offset > 0 {
+			if err := file.Truncate(0); err != nil {
+				return false, err
+			}
+			offset, _ = file.Seek(0, io.SeekStart)
+		}
+		if res.ContentLength >= 0 {
+			totalSize = res.ContentLength
+		}
+	case http.StatusPartialContent:
+		var start, end int64
+		var totalStr string
+		if _, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-%d/%s", &start, &end, &totalStr); err != nil || start != offset {
+			file.Truncate(0)
+			return true, errors.New("invalid Content-Range: " + res.Header.Get("Content-Range"))
+		}
+		if total, err := strconv.ParseInt(totalStr, 10, 64); err == nil {
+			totalSize = total
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// file already complete when total size equals offset
+		var total int64
+		if _, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes */%d", &total); err == nil && total == offset {
+			wrproxy.reset(file, offset, offset)
+			return false, nil
+		}
+		file.Truncate(0)
+		return true, errors.New("range not satisfiable, restart download")
+	default:
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		err = fmt.Errorf("http status %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+		retryable = res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusRequestTimeout
+		return retryable, err
+	}
+	if expectSize > 0 && totalSize >= 0 && totalSize != expectSize {
+		return false, fmt.Errorf("%v, expected %d, server reported %d", ErrDownloadSize, expectSize, totalSize)
+	}
+	if totalSize < 0 {
+		totalSize = expectSize
+	}
+	wrproxy.reset(file, offset, totalSize)
+	if _, err = io.Copy(wrproxy, res.Body); err != nil {
+		return true, err
+	}
+	if totalSize > 0 && wrproxy.copied() != totalSize {
+		return true, io.ErrUnexpectedEOF
+	}
+	return false, nil
+}
 
-	_, err = io.Copy(wrproxy, res.Body)
+func verifyDownload(fpath string, size int64, sha256sum string) error {
+	finfo, err := os.Stat(fpath)
 	if err != nil {
-		return
+		return err
 	}
-	if fileMode != 0 {
-		os.Chmod(dst, fileMode)
+	if size > 0 && finfo.Size() != size {
+		return fmt.Errorf("%v, expected %d, got %d", ErrDownloadSize, size, finfo.Size())
 	}
-	return
+	if sha256sum == "" {
+		return nil
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return err
+	}
+	realChecksum := hex.EncodeToString(hasher.Sum(nil))
+	if !strings.EqualFold(realChecksum, sha256sum) {
+		return fmt.Errorf("%v, expected: %s, got: %s", ErrDownloadChecksum, sha256sum, realChecksum)
+	}
+	return nil
 }
 
 type downloadProxy struct {
+	mu         sync.Mutex
 	canceled   bool
 	writer     io.Writer
 	TotalSize  int    `json:"totalSize"`
 	CopiedSize int    `json:"copiedSize"`
+	Speed      int    `json:"speed"` // bytes per second
+	ETA        int    `json:"eta"`   // seconds left, -1 means unknown
 	Error      string `json:"error,omitempty"`
 	wg         sync.WaitGroup
+
+	lastTime   time.Time
+	lastCopied int
 }
 
 func newDownloadProxy(wr io.Writer, totalSize int) *downloadProxy {
 	di := &downloadProxy{
 		writer:    wr,
 		TotalSize: totalSize,
+		ETA:       -1,
+		lastTime:  time.Now(),
 	}
 	di.wg.Add(1)
 	return di
 }
 
+// reset is called when download is resumed from offset
+func (d *downloadProxy) reset(wr io.Writer, offset int64, totalSize int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.writer = wr
+	d.CopiedSize = int(offset)
+	if totalSize > 0 {
+		d.TotalSize = int(totalSize)
+	}
+	d.lastTime = time.Now()
+	d.lastCopied = d.CopiedSize
+}
+
+func (d *downloadProxy) copied() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return int64(d.CopiedSize)
+}
+
 func (d *downloadProxy) Cancel() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	d.canceled = true
 }
 
 func (d *downloadProxy) Write(data []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if d.canceled {
 		return 0, errors.New("download proxy was canceled")
 	}
 	n, err := d.writer.Write(data)
 	d.CopiedSize += n
+	agentMetrics.AddDownloadBytes(int64(n))
+	d.updateSpeed()
 	return n, err
 }
 
+// updateSpeed every second, smoothed with the previous speed
+func (d *downloadProxy) updateSpeed() {
+	elapsed := time.Since(d.lastTime)
+	if elapsed < time.Second {
+		return
+	}
+	speed := int(float64(d.CopiedSize-d.lastCopied) / elapsed.Seconds())
+	if d.Speed == 0 {
+		d.Speed = speed
+	} else {
+		d.Speed = (d.Speed + speed*3) / 4
+	}
+	d.lastTime = time.Now()
+	d.lastCopied = d.CopiedSize
+	d.ETA = -1
+	if d.Speed > 0 && d.TotalSize > 0 {
+		d.ETA = (d.TotalSize - d.CopiedSize) / d.Speed
+	}
+}
+
+func (d *downloadProxy) MarshalJSON() ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data := map[string]interface{}{
+		"totalSize":  d.TotalSize,
+		"copiedSize": d.CopiedSize,
+		"speed":      d.Speed,
+		"eta":        d.ETA,
+	}
+	if d.Error != "" {
+		data["error"] = d.Error
+	}
+	return json.Marshal(data)
+}
+
 // Should only call once
 func (d *downloadProxy) Done() {
+	d.mu.Lock()
+	d.Speed = 0
+	d.ETA = 0
+	d.mu.Unlock()
 	d.wg.Done()
 }
 
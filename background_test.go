@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackgroundDownloadResume(t *testing.T) {
+	content := bytes.Repeat([]byte("atx-agent"), 10000)
+	checksum := sha256.Sum256(content)
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// broken connection after half of data sent
+			w.Header().Set("Content-Length", "90000")
+			w.Write(content[:len(content)/2])
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "data.bin", time.Now(), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	tmpdir, err := ioutil.TempDir("", "atx-download")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	b := newBackground(2)
+	dst := filepath.Join(tmpdir, "data.bin")
+	key := b.HTTPDownloadWithOptions(ts.URL, dst, DownloadOptions{
+		Mode:   0600,
+		Sha256: hex.EncodeToString(checksum[:]),
+		Size:   int64(len(content)),
+	})
+	assert.NoError(t, b.Wait(key))
+	state := b.Get(key).State()
+	assert.Equal(t, "downloaded", state.Status)
+	assert.Equal(t, 1, state.Retries)
+	assert.NotNil(t, state.FinishedAt)
+
+	data, err := ioutil.ReadFile(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.False(t, fileExists(dst+".part"))
+
+	// checksum mismatch
+	key = b.HTTPDownloadWithOptions(ts.URL, filepath.Join(tmpdir, "bad.bin"), DownloadOptions{Sha256: "0000"})
+	assert.Error(t, b.Wait(key))
+	assert.Equal(t, "failure", b.Get(key).State().Status)
+	assert.False(t, fileExists(filepath.Join(tmpdir, "bad.bin")))
+
+	assert.Len(t, b.List(), 2)
+	assert.Equal(t, key, b.List()[1].Key)
+}
+
+func TestBackgroundDownloadCancel(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		w.Write([]byte("12345"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	tmpdir, err := ioutil.TempDir("", "atx-download")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	b := newBackground(1)
+	key1 := b.HTTPDownload(ts.URL, filepath.Join(tmpdir, "1.bin"), 0644)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "downloading", b.Get(key1).State().Status)
+	key2 := b.HTTPDownload(ts.URL, filepath.Join(tmpdir, "2.bin"), 0644)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "pending", b.Get(key2).State().Status)
+
+	assert.NoError(t, b.Cancel(key2))
+	assert.Equal(t, ErrDownloadCanceled, b.Wait(key2))
+	assert.Equal(t, "canceled", b.Get(key2).State().Status)
+	assert.Error(t, b.Cancel(key2))
+
+	assert.NoError(t, b.Cancel(key1))
+	assert.Equal(t, ErrDownloadCanceled, b.Wait(key1))
+	assert.False(t, fileExists(filepath.Join(tmpdir, "1.bin.part")))
+	assert.Error(t, b.Cancel("100"))
+}
+
+func TestBackgroundJournal(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.bin", time.Now(), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	tmpdir, err := ioutil.TempDir("", "atx-journal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	// agent was killed when half of data downloaded
+	dst := filepath.Join(tmpdir, "data.bin")
+	assert.NoError(t, ioutil.WriteFile(dst+".part", content[:5000], 0644))
+	journalPath := filepath.Join(tmpdir, "downloads.json")
+	b := newBackground(1)
+	b.journalPath = journalPath
+	state := b.newState(backgroundJob{
+		Key:       "7",
+		Kind:      "download",
+		URL:       ts.URL,
+		Target:    dst,
+		Status:    "downloading",
+		CreatedAt: time.Now(),
+	}, DownloadOptions{Mode: 0600, Size: int64(len(content)), Kind: "download"})
+	b.jobs["7"] = state
+	assert.NoError(t, b.saveJournal())
+
+	b = newBackground(1)
+	assert.NoError(t, b.restore(journalPath))
+	assert.NoError(t, b.Wait("7"))
+	data, err := ioutil.ReadFile(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, "downloaded", b.Get("7").State().Status)
+
+	// keys continue after restored ones
+	assert.Equal(t, "8", b.HTTPDownload(ts.URL, filepath.Join(tmpdir, "new.bin"), 0644))
+	assert.NoError(t, b.Wait("8"))
+
+	b.journalPath = journalPath
+	assert.NoError(t, b.saveJournal())
+	b = newBackground(1)
+	assert.NoError(t, b.restore(journalPath))
+	assert.Len(t, b.List(), 2)
+	assert.Equal(t, "downloaded", b.Get("8").State().Status)
+}
+
+func waitBackgroundFinished(t *testing.T, key string) backgroundJob {
+	for i := 0; i < 100; i++ {
+		if state := background.Get(key); state != nil && state.finished() {
+			return state.State()
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("wait job finished timeout: " + key)
+	return backgroundJob{}
+}
+
+func TestInstallFromRequest(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "atx-install")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	// raw body, apk is removed after install (fails here without pm)
+	req := httptest.NewRequest("POST", "/packages", bytes.NewReader([]byte("not an apk")))
+	req.Header.Set("Content-Type", "application/vnd.android.package-archive")
+	key, err := installFromRequest(req, tmpdir)
+	assert.NoError(t, err)
+	job := waitBackgroundFinished(t, key)
+	assert.Equal(t, "install", job.Kind)
+	assert.Equal(t, "failure", job.Status)
+	assert.Equal(t, tmpdir, filepath.Dir(job.Target))
+	assert.False(t, fileExists(job.Target))
+
+	// multipart upload
+	body := bytes.NewBuffer(nil)
+	mw := multipart.NewWriter(body)
+	fw, _ := mw.CreateFormFile("file", "app.apk")
+	fw.Write([]byte("not an apk"))
+	mw.Close()
+	req = httptest.NewRequest("POST", "/packages", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	key, err = installFromRequest(req, tmpdir)
+	assert.NoError(t, err)
+	assert.Equal(t, "failure", waitBackgroundFinished(t, key).Status)
+
+	// path on device is kept
+	apkPath := filepath.Join(tmpdir, "local.apk")
+	ioutil.WriteFile(apkPath, []byte("not an apk"), 0644)
+	req = httptest.NewRequest("POST", "/packages", nil)
+	req.Form = url.Values{"path": {apkPath}}
+	key, err = installFromRequest(req, tmpdir)
+	assert.NoError(t, err)
+	waitBackgroundFinished(t, key)
+	assert.True(t, fileExists(apkPath))
+
+	req = httptest.NewRequest("POST", "/packages", nil)
+	req.Form = url.Values{"path": {filepath.Join(tmpdir, "not-exists.apk")}}
+	_, err = installFromRequest(req, tmpdir)
+	assert.Error(t, err)
+
+	_, err = installFromRequest(httptest.NewRequest("POST", "/packages", nil), tmpdir)
+	assert.Error(t, err)
+}
+
+func TestBackgroundDownloadQueuedTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	tmpdir, err := ioutil.TempDir("", "atx-download")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	b := newBackground(1)
+	key1 := b.HTTPDownload(ts.URL+"/slow", filepath.Join(tmpdir, "1.bin"), 0644)
+	time.Sleep(50 * time.Millisecond)
+	// time waiting for the slow download is not counted in timeout
+	key2 := b.HTTPDownloadWithOptions(ts.URL, filepath.Join(tmpdir, "2.bin"), DownloadOptions{Mode: 0644, Timeout: 200 * time.Millisecond})
+	assert.NoError(t, b.Wait(key1))
+	assert.NoError(t, b.Wait(key2))
+	assert.True(t, fileExists(filepath.Join(tmpdir, "2.bin")))
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -142,6 +143,20 @@ func (cc *CommandCtrl) Stop(name string, waits ...bool) error {
 	return pkeeper.stop(wait)
 }
 
+// Remove stop the service and wait until program quited, then remove it
+func (cc *CommandCtrl) Remove(name string) error {
+	cc.rl.Lock()
+	pkeeper, ok := cc.cmds[name]
+	if !ok {
+		cc.rl.Unlock()
+		return errors.New("cmdctl not found: " + name)
+	}
+	delete(cc.cmds, name)
+	cc.rl.Unlock()
+	pkeeper.stop(true)
+	return nil
+}
+
 // StopAll command and wait until all program quited
 func (cc *CommandCtrl) StopAll() {
 	for _, pkeeper := range cc.cmds {
@@ -187,6 +202,39 @@ func (cc *CommandCtrl) Running(name string) bool {
 	return pkeeper.keeping
 }
 
+// ServiceStats is a snapshot of a service state
+type ServiceStats struct {
+	Name      string    `json:"name"`
+	Keeping   bool      `json:"keeping"`   // service is started
+	Running   bool      `json:"running"`   // program is running now
+	Starts    int       `json:"starts"`    // program launched times
+	Restarts  int       `json:"restarts"`  // relaunched after the program quited
+	StartedAt time.Time `json:"startedAt"` // last launch time
+}
+
+// Stats return all services sorted by name
+func (cc *CommandCtrl) Stats() []ServiceStats {
+	cc.rl.RLock()
+	defer cc.rl.RUnlock()
+	stats := make([]ServiceStats, 0, len(cc.cmds))
+	for name, pkeeper := range cc.cmds {
+		pkeeper.mu.Lock()
+		stats = append(stats, ServiceStats{
+			Name:      name,
+			Keeping:   pkeeper.keeping,
+			Running:   pkeeper.running,
+			Starts:    pkeeper.starts,
+			Restarts:  pkeeper.restarts,
+			StartedAt: pkeeper.runBeganAt,
+		})
+		pkeeper.mu.Unlock()
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
 // keep process running
 type processKeeper struct {
 	name       string
@@ -199,6 +247,8 @@ type processKeeper struct {
 	stopC      chan bool
 	runBeganAt time.Time
 	donewg     *sync.WaitGroup
+	starts     int
+	restarts   int
 }
 
 // keep cmd running
@@ -216,6 +266,7 @@ func (p *processKeeper) start() error {
 	p.mu.Unlock()
 
 	go func() {
+		launched := false
 		for {
 			if p.retries < 0 {
 				p.retries = 0
@@ -247,8 +298,15 @@ func (p *processKeeper) start() error {
 				goto CMD_DONE
 			}
 			log.Printf("[%s] program pid: %d", p.name, p.cmd.Process.Pid)
+			p.mu.Lock()
 			p.runBeganAt = time.Now()
 			p.running = true
+			p.starts++
+			if launched {
+				p.restarts++
+			}
+			launched = true
+			p.mu.Unlock()
 			cmdC := goFunc(p.cmd.Wait)
 			select {
 			case cmdErr := <-cmdC:
@@ -266,7 +324,9 @@ func (p *processKeeper) start() error {
 			}
 		CMD_IDLE:
 			log.Printf("[%s] idle for %v", p.name, p.cmdInfo.NextLaunchWait)
+			p.mu.Lock()
 			p.running = false
+			p.mu.Unlock()
 			select {
 			case <-p.stopC:
 				goto CMD_DONE
@@ -67,3 +67,51 @@ func TestCommandCtrl(t *testing.T) {
 	assert.Equal(service.cmds["mysleep"].cmdInfo.Args, []string{"sleep", "30"})
 	assert.Nil(service.Stop("mysleep"))
 }
+
+func TestCommandCtrlStats(t *testing.T) {
+	assert := assert.New(t)
+	service := New()
+	assert.Nil(service.Add("quick", CommandInfo{
+		Args:           []string{"true"},
+		MaxRetries:     2,
+		NextLaunchWait: 100 * time.Millisecond,
+	}))
+	assert.Nil(service.Add("idle", CommandInfo{
+		Args: []string{"sleep", "10"},
+	}))
+	assert.Nil(service.Start("quick"))
+	time.Sleep(time.Second)
+
+	stats := service.Stats()
+	if assert.Len(stats, 2) {
+		assert.Equal("idle", stats[0].Name)
+		assert.False(stats[0].Keeping)
+		assert.Equal(0, stats[0].Starts)
+
+		assert.Equal("quick", stats[1].Name)
+		assert.False(stats[1].Keeping) // exceed max retries
+		assert.False(stats[1].Running)
+		assert.Equal(3, stats[1].Starts)
+		assert.Equal(2, stats[1].Restarts)
+		assert.False(stats[1].StartedAt.IsZero())
+	}
+}
+
+func TestCommandCtrlRemove(t *testing.T) {
+	assert := assert.New(t)
+	service := New()
+	assert.Nil(service.Add("mysleep", CommandInfo{
+		Args: []string{"sleep", "10"},
+	}))
+	assert.Nil(service.Start("mysleep"))
+	pkeeper := service.cmds["mysleep"]
+	assert.Nil(service.Remove("mysleep"))
+	assert.False(pkeeper.keeping)
+	assert.False(service.Exists("mysleep"))
+	assert.NotNil(service.Remove("mysleep"))
+
+	// name can be added again
+	assert.Nil(service.Add("mysleep", CommandInfo{
+		Args: []string{"sleep", "10"},
+	}))
+}
@@ -0,0 +1,17 @@
+// +build !windows
+
+package main
+
+import "syscall"
+
+func statDiskSpace(path string) (space diskSpace, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(path, &st); err != nil {
+		return
+	}
+	bsize := uint64(st.Bsize)
+	space.Total = uint64(st.Blocks) * bsize
+	space.Free = uint64(st.Bfree) * bsize
+	space.Available = uint64(st.Bavail) * bsize
+	return
+}
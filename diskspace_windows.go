@@ -0,0 +1,7 @@
+package main
+
+import "errors"
+
+func statDiskSpace(path string) (space diskSpace, err error) {
+	return space, errors.New("statfs is not supported on windows")
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-broadcast"
+)
+
+// eventPublisher wrap broadcast.Broadcaster which can be closed while subscribers still exist.
+// Subscribe after Close is ignored, the broadcaster goroutine quit after the last subscriber left
+type eventPublisher struct {
+	mu          sync.RWMutex // read locked while submitting, so the broadcaster is never closed in the middle
+	broadcaster broadcast.Broadcaster
+	closed      bool
+	stopped     bool // broadcaster closed
+
+	subMu       sync.Mutex // never held while blocking, so Unsubscribe can always drain
+	subscribers map[chan interface{}]bool
+}
+
+func newEventPublisher() *eventPublisher {
+	return &eventPublisher{
+		broadcaster: broadcast.NewBroadcaster(10),
+		subscribers: make(map[chan interface{}]bool),
+	}
+}
+
+// Submit is ignored after closed, it blocks when a subscriber not read in time
+func (p *eventPublisher) Submit(v interface{}) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if !p.closed {
+		p.broadcaster.Submit(v)
+	}
+}
+
+// Subscribe return false if publisher already closed
+func (p *eventPublisher) Subscribe(ch chan interface{}) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return false
+	}
+	p.subMu.Lock()
+	p.subscribers[ch] = true
+	p.subMu.Unlock()
+	p.broadcaster.Register(ch)
+	return true
+}
+
+// Unsubscribe drain ch until unregistered, so the broadcaster never blocks on it
+func (p *eventPublisher) Unsubscribe(ch chan interface{}) {
+	p.subMu.Lock()
+	subscribed := p.subscribers[ch]
+	p.subMu.Unlock()
+	if !subscribed {
+		return
+	}
+
+	unregistered := make(chan bool)
+	go func() {
+		p.broadcaster.Unregister(ch)
+		close(unregistered)
+	}()
+	for {
+		select {
+		case <-ch:
+		case <-unregistered:
+			p.subMu.Lock()
+			delete(p.subscribers, ch)
+			p.subMu.Unlock()
+			p.mu.Lock()
+			p.stopIfDone()
+			p.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Close stop the broadcaster goroutine now or after the last subscriber left
+func (p *eventPublisher) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.stopIfDone()
+}
+
+// stopIfDone must be called with mu locked
+func (p *eventPublisher) stopIfDone() {
+	p.subMu.Lock()
+	defer p.subMu.Unlock()
+	if p.closed && !p.stopped && len(p.subscribers) == 0 {
+		p.broadcaster.Close()
+		p.stopped = true
+	}
+}
+
+// eventStreamWriteWait close the client which not read events in time, so the publisher is not blocked forever
+const eventStreamWriteWait = 10 * time.Second
+
+// seqEvent is published by eventStream, seq starts from 1 and increase by 1
+type seqEvent interface {
+	eventSeq() int
+}
+
+// eventStream is implemented by app sessions and perf samplers
+type eventStream interface {
+	Subscribe(ch chan interface{}) bool
+	Unsubscribe(ch chan interface{})
+	Done() <-chan struct{}
+	bufferedEvents() []seqEvent
+}
+
+// serveEventStream send buffered events through websocket, then new events until stream done or client closed.
+// Events both buffered and published are sent only once
+func serveEventStream(w http.ResponseWriter, r *http.Request, stream eventStream) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+	ch := make(chan interface{}, 10)
+	stream.Subscribe(ch) // subscribe before read buffered, so nothing is missed
+	defer stream.Unsubscribe(ch)
+
+	lastSeq := 0
+	send := func(events ...seqEvent) error {
+		for _, ev := range events {
+			if ev.eventSeq() <= lastSeq {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(eventStreamWriteWait))
+			if err := conn.WriteJSON(ev); err != nil {
+				return err
+			}
+			lastSeq = ev.eventSeq()
+		}
+		return nil
+	}
+	if send(stream.bufferedEvents()...) != nil {
+		return
+	}
+	done := make(chan bool)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				close(done)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case <-stream.Done():
+			send(stream.bufferedEvents()...)
+			return
+		case v := <-ch:
+			if send(v.(seqEvent)) != nil {
+				return
+			}
+		}
+	}
+}
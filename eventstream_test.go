@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventPublisher(t *testing.T) {
+	p := newEventPublisher()
+	ch := make(chan interface{}, 1)
+	assert.True(t, p.Subscribe(ch))
+	p.Submit(1)
+	select {
+	case v := <-ch:
+		assert.Equal(t, 1, v)
+	case <-time.After(time.Second):
+		t.Fatal("event not received")
+	}
+
+	// subscriber not reading does not block Unsubscribe
+	p.Submit(2)
+	p.Submit(3)
+	p.Close()
+	p.Submit(4) // ignored
+	done := make(chan bool)
+	go func() {
+		p.Unsubscribe(ch)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("unsubscribe blocked")
+	}
+	assert.False(t, p.Subscribe(make(chan interface{}, 1)))
+}
+
+func TestEventPublisherSlowSubscribers(t *testing.T) {
+	p := newEventPublisher()
+	slow := []chan interface{}{make(chan interface{}), make(chan interface{})} // never read
+	for _, ch := range slow {
+		assert.True(t, p.Subscribe(ch))
+	}
+	go func() {
+		for i := 0; i < 30; i++ {
+			p.Submit(i) // blocked until all slow subscribers left
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan bool)
+	go func() {
+		p.Close()
+		close(done)
+	}()
+	for _, ch := range slow {
+		go p.Unsubscribe(ch)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("close blocked by slow subscribers")
+	}
+}
+
+type testStream struct {
+	*eventPublisher
+	jobDone
+	events []seqEvent
+}
+
+func (s *testStream) bufferedEvents() []seqEvent {
+	return s.events
+}
+
+func TestServeEventStream(t *testing.T) {
+	stream := &testStream{
+		eventPublisher: newEventPublisher(),
+		jobDone:        newJobDone(),
+		events:         []seqEvent{AppSessionEvent{Seq: 1}, AppSessionEvent{Seq: 2}},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveEventStream(w, r, stream)
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	read := func() int {
+		var ev AppSessionEvent
+		assert.NoError(t, conn.ReadJSON(&ev))
+		return ev.Seq
+	}
+	assert.Equal(t, 1, read())
+	assert.Equal(t, 2, read())
+	stream.Submit(AppSessionEvent{Seq: 2}) // already sent
+	stream.Submit(AppSessionEvent{Seq: 3})
+	assert.Equal(t, 3, read())
+
+	// events buffered after done are sent before closed
+	stream.events = append(stream.events, AppSessionEvent{Seq: 3}, AppSessionEvent{Seq: 4})
+	stream.finish()
+	assert.Equal(t, 4, read())
+	_, _, err = conn.ReadMessage()
+	assert.Error(t, err)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const hashCacheMaxEntries = 20000
+
+// hashCache keep checksums of files, entry is invalid once size or mtime changed
+var hashCache = newFileHashCache()
+
+type fileHashEntry struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+type fileHashCache struct {
+	mu      sync.Mutex
+	entries map[string]fileHashEntry
+}
+
+func newFileHashCache() *fileHashCache {
+	return &fileHashCache{
+		entries: make(map[string]fileHashEntry),
+	}
+}
+
+func (c *fileHashCache) get(key string, finfo os.FileInfo) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || entry.size != finfo.Size() || !entry.modTime.Equal(finfo.ModTime()) {
+		return "", false
+	}
+	return entry.sum, true
+}
+
+func (c *fileHashCache) put(key string, finfo os.FileInfo, sum string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= hashCacheMaxEntries {
+		c.entries = make(map[string]fileHashEntry)
+	}
+	c.entries[key] = fileHashEntry{
+		size:    finfo.Size(),
+		modTime: finfo.ModTime(),
+		sum:     sum,
+	}
+}
+
+func newHasher(algo string) (hash.Hash, error) {
+	switch algo {
+	case "", "sha256":
+		return sha256.New(), nil
+	case "md5":
+		return md5.New(), nil
+	}
+	return nil, errors.New("unsupported hash algorithm: " + algo)
+}
+
+// fileChecksum return hex checksum of a regular file, algo can be sha256(default) or md5
+func fileChecksum(fpath string, algo string) (string, error) {
+	if algo == "" {
+		algo = "sha256"
+	}
+	hasher, err := newHasher(algo)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	finfo, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if finfo.IsDir() {
+		return "", &os.PathError{Op: "hash", Path: fpath, Err: syscall.EISDIR}
+	}
+	key := algo + ":" + fpath
+	if sum, ok := hashCache.get(key, finfo); ok {
+		return sum, nil
+	}
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	hashCache.put(key, finfo, sum)
+	return sum, nil
+}
+
+// hashTree return checksums of all regular files under root, key is relative path separated by /
+// A root not exists is treated as empty directory
+// Entries can not be read are skipped and returned in unreadable, sub directory included
+func hashTree(root string, algo string) (sums map[string]string, unreadable []string, err error) {
+	if _, err := newHasher(algo); err != nil {
+		return nil, nil, err
+	}
+	sums = make(map[string]string)
+	unreadable = []string{}
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return sums, unreadable, nil
+	}
+	err = filepath.Walk(root, func(fpath string, finfo os.FileInfo, err error) error {
+		if err != nil && fpath == root {
+			return err
+		}
+		rel, er := filepath.Rel(root, fpath)
+		if er != nil {
+			return er
+		}
+		if err != nil {
+			log.Printf("hash %s skipped: %v", fpath, err)
+			unreadable = append(unreadable, filepath.ToSlash(rel))
+			if finfo != nil && finfo.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !finfo.Mode().IsRegular() {
+			return nil
+		}
+		sum, err := fileChecksum(fpath, algo)
+		if err != nil {
+			log.Printf("hash %s skipped: %v", fpath, err)
+			unreadable = append(unreadable, filepath.ToSlash(rel))
+			return nil
+		}
+		sums[filepath.ToSlash(rel)] = sum
+		return nil
+	})
+	return sums, unreadable, err
+}
+
+// SyncManifest is posted by client, Files is relative path to checksum
+type SyncManifest struct {
+	Algo   string            `json:"algo"`
+	Files  map[string]string `json:"files"`
+	Delete bool              `json:"delete"` // delete files not in manifest
+}
+
+type SyncResult struct {
+	Algo       string   `json:"algo"`
+	Missing    []string `json:"missing"`
+	Changed    []string `json:"changed"`
+	Unchanged  []string `json:"unchanged"`
+	Deleted    []string `json:"deleted"`    // files and directories left empty
+	Unreadable []string `json:"unreadable"` // skipped local files, neither compared nor deleted
+}
+
+// cleanManifestPath reject absolute path and path out of root
+func cleanManifestPath(name string) (string, error) {
+	cleaned := path.Clean(filepath.ToSlash(name))
+	if name == "" || path.IsAbs(cleaned) || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", &os.PathError{Op: "sync", Path: name, Err: syscall.EINVAL}
+	}
+	return cleaned, nil
+}
+
+// inUnreadable return true if name is unreadable or inside an unreadable directory
+func inUnreadable(name string, unreadable []string) bool {
+	for _, u := range unreadable {
+		if name == u || strings.HasPrefix(name, u+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// removeEmptyParents remove parent directories of name which are empty now, root is kept
+func removeEmptyParents(root, name string) (removed []string) {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if err := os.Remove(filepath.Join(root, filepath.FromSlash(dir))); err != nil {
+			break // not empty
+		}
+		removed = append(removed, dir)
+	}
+	return
+}
+
+// syncDirectory compare manifest with files under root. Files need to be uploaded are
+// returned in Missing and Changed, which can be pushed with /upload afterwards.
+// Manifest files inside unreadable directories are returned in Unreadable
+func syncDirectory(root string, manifest SyncManifest) (*SyncResult, error) {
+	if manifest.Algo == "" {
+		manifest.Algo = "sha256"
+	}
+	if manifest.Delete {
+		if err := checkNotRoot("sync", root); err != nil {
+			return nil, err
+		}
+	}
+	files := make(map[string]string, len(manifest.Files))
+	for name, sum := range manifest.Files {
+		cleaned, err := cleanManifestPath(name)
+		if err != nil {
+			return nil, err
+		}
+		files[cleaned] = strings.ToLower(sum)
+	}
+	localSums, unreadable, err := hashTree(root, manifest.Algo)
+	if err != nil {
+		return nil, err
+	}
+	result := &SyncResult{
+		Algo:       manifest.Algo,
+		Missing:    []string{},
+		Changed:    []string{},
+		Unchanged:  []string{},
+		Deleted:    []string{},
+		Unreadable: unreadable,
+	}
+	for name, sum := range files {
+		localSum, ok := localSums[name]
+		switch {
+		case !ok && stringInSlice(name, unreadable):
+			// already reported in Unreadable
+		case !ok && inUnreadable(name, unreadable):
+			result.Unreadable = append(result.Unreadable, name)
+		case !ok:
+			result.Missing = append(result.Missing, name)
+		case localSum != sum:
+			result.Changed = append(result.Changed, name)
+		default:
+			result.Unchanged = append(result.Unchanged, name)
+		}
+	}
+	if manifest.Delete {
+		for name := range localSums {
+			if _, ok := files[name]; ok {
+				continue
+			}
+			if err := removePath(filepath.Join(root, filepath.FromSlash(name)), false); err != nil {
+				return nil, err
+			}
+			result.Deleted = append(result.Deleted, name)
+			result.Deleted = append(result.Deleted, removeEmptyParents(root, name)...)
+		}
+	}
+	sort.Strings(result.Missing)
+	sort.Strings(result.Changed)
+	sort.Strings(result.Unchanged)
+	sort.Strings(result.Deleted)
+	sort.Strings(result.Unreadable)
+	return result, nil
+}
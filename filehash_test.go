@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileChecksum(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "atx-hash")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	fpath := filepath.Join(tmpdir, "a.txt")
+	assert.NoError(t, ioutil.WriteFile(fpath, []byte("hello"), 0644))
+	sum, err := fileChecksum(fpath, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", sum)
+	sum, err = fileChecksum(fpath, "md5")
+	assert.NoError(t, err)
+	assert.Equal(t, "5d41402abc4b2a76b9719d911017c592", sum)
+
+	_, err = fileChecksum(fpath, "crc32")
+	assert.Error(t, err)
+	_, err = fileChecksum(tmpdir, "md5")
+	assert.Error(t, err)
+}
+
+func TestSyncDirectory(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "atx-sync")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	os.MkdirAll(filepath.Join(tmpdir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(tmpdir, "same.txt"), []byte("hello"), 0644)
+	ioutil.WriteFile(filepath.Join(tmpdir, "sub", "changed.txt"), []byte("old"), 0644)
+	ioutil.WriteFile(filepath.Join(tmpdir, "stale.txt"), []byte("stale"), 0644)
+
+	manifest := SyncManifest{
+		Files: map[string]string{
+			"same.txt":        "2CF24DBA5FB0A30E26E83B2AC5B9E29E1B161E5C1FA7425E73043362938B9824",
+			"sub/changed.txt": "0000",
+			"new/missing.txt": "0000",
+		},
+	}
+	result, err := syncDirectory(tmpdir, manifest)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"new/missing.txt"}, result.Missing)
+	assert.Equal(t, []string{"sub/changed.txt"}, result.Changed)
+	assert.Equal(t, []string{"same.txt"}, result.Unchanged)
+	assert.Empty(t, result.Deleted)
+	assert.True(t, fileExists(filepath.Join(tmpdir, "stale.txt")))
+
+	manifest.Delete = true
+	os.MkdirAll(filepath.Join(tmpdir, "old", "deep"), 0755)
+	ioutil.WriteFile(filepath.Join(tmpdir, "old", "deep", "stale.txt"), []byte("stale"), 0644)
+	result, err = syncDirectory(tmpdir, manifest)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"old", "old/deep", "old/deep/stale.txt", "stale.txt"}, result.Deleted)
+	assert.False(t, fileExists(filepath.Join(tmpdir, "stale.txt")))
+	assert.False(t, fileExists(filepath.Join(tmpdir, "old"))) // left empty
+	assert.True(t, fileExists(filepath.Join(tmpdir, "sub")))
+
+	// target directory not exists yet
+	result, err = syncDirectory(filepath.Join(tmpdir, "not-exists"), manifest)
+	assert.NoError(t, err)
+	assert.Len(t, result.Missing, 3)
+
+	manifest.Files["../escape.txt"] = "0000"
+	_, err = syncDirectory(tmpdir, manifest)
+	assert.Error(t, err)
+	delete(manifest.Files, "../escape.txt")
+
+	_, err = syncDirectory("/", manifest)
+	assert.Error(t, err)
+
+	// unreadable entries are reported and never deleted
+	if os.Geteuid() != 0 {
+		ioutil.WriteFile(filepath.Join(tmpdir, "secret.txt"), []byte("secret"), 0000)
+		result, err = syncDirectory(tmpdir, manifest)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"secret.txt"}, result.Unreadable)
+		assert.True(t, fileExists(filepath.Join(tmpdir, "secret.txt")))
+	}
+}
+
+func TestInUnreadable(t *testing.T) {
+	unreadable := []string{"secret", "a/b.txt"}
+	assert.True(t, inUnreadable("secret", unreadable))
+	assert.True(t, inUnreadable("secret/deep/c.txt", unreadable))
+	assert.True(t, inUnreadable("a/b.txt", unreadable))
+	assert.False(t, inUnreadable("secret.txt", unreadable))
+	assert.False(t, inUnreadable("a/c.txt", unreadable))
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// FileEntry is the detail information of file, directory or symlink
+type FileEntry struct {
+	Name        string    `json:"name"`
+	Path        string    `json:"path"`
+	IsDirectory bool      `json:"isDirectory"`
+	IsSymlink   bool      `json:"isSymlink"`
+	LinkTarget  string    `json:"linkTarget,omitempty"`
+	Size        int64     `json:"size"`
+	Mode        string    `json:"mode"`       // eg: 0644
+	ModeString  string    `json:"modeString"` // eg: -rw-r--r--
+	ModTime     time.Time `json:"modTime"`
+	Uid         int       `json:"uid"`
+	Gid         int       `json:"gid"`
+	Owner       string    `json:"owner,omitempty"`
+	Group       string    `json:"group,omitempty"`
+}
+
+func newFileEntry(path string, finfo os.FileInfo) FileEntry {
+	entry := FileEntry{
+		Name:        finfo.Name(),
+		Path:        path,
+		IsDirectory: finfo.IsDir(),
+		Size:        finfo.Size(),
+		Mode:        fmt.Sprintf("0%o", finfo.Mode().Perm()),
+		ModeString:  finfo.Mode().String(),
+		ModTime:     finfo.ModTime(),
+		Uid:         -1,
+		Gid:         -1,
+	}
+	if finfo.Mode()&os.ModeSymlink != 0 {
+		entry.IsSymlink = true
+		entry.LinkTarget, _ = os.Readlink(path)
+		if target, err := os.Stat(path); err == nil {
+			entry.IsDirectory = target.IsDir()
+		}
+	}
+	if uid, gid, ok := fileOwner(finfo); ok {
+		entry.Uid, entry.Gid = uid, gid
+		entry.Owner = lookupUserName(uid)
+		entry.Group = lookupGroupName(gid)
+	}
+	return entry
+}
+
+// statFile works like os.Lstat, symlink will not be followed
+func statFile(path string) (entry FileEntry, err error) {
+	finfo, err := os.Lstat(path)
+	if err != nil {
+		return
+	}
+	return newFileEntry(path, finfo), nil
+}
+
+func listDirectory(dir string) (entries []FileEntry, err error) {
+	finfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	entries = make([]FileEntry, 0, len(finfos))
+	for _, finfo := range finfos {
+		entries = append(entries, newFileEntry(filepath.Join(dir, finfo.Name()), finfo))
+	}
+	return entries, nil
+}
+
+// checkNotRoot refuse destructive operations on root directory
+func checkNotRoot(op, path string) error {
+	if filepath.Clean(path) == string(filepath.Separator) {
+		return &os.PathError{Op: op, Path: path, Err: syscall.EPERM}
+	}
+	return nil
+}
+
+// removePath refuse to remove root directory
+func removePath(path string, recursive bool) error {
+	if err := checkNotRoot("remove", path); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(path); err != nil {
+		return err
+	}
+	if recursive {
+		return os.RemoveAll(path)
+	}
+	return os.Remove(path)
+}
+
+// isSubPath return true if path is parent itself or inside parent
+func isSubPath(parent, path string) bool {
+	parent, path = filepath.Clean(parent), filepath.Clean(path)
+	if parent == string(filepath.Separator) {
+		return true
+	}
+	return path == parent || strings.HasPrefix(path, parent+string(filepath.Separator))
+}
+
+// resolveDestination works like mv and cp: when dst ends with / file will be put into dst directory
+// dst is checked before anything is changed, it must not be /, src, or inside or a parent of src
+func resolveDestination(src, dst string, overwrite bool) (string, error) {
+	if strings.HasSuffix(dst, "/") {
+		dst = filepath.Join(dst, filepath.Base(src))
+	}
+	if filepath.Clean(dst) == string(filepath.Separator) || isSubPath(src, dst) || isSubPath(dst, src) {
+		return "", &os.LinkError{Op: "move", Old: src, New: dst, Err: syscall.EINVAL}
+	}
+	if _, err := os.Lstat(dst); err == nil && !overwrite {
+		return "", &os.PathError{Op: "move", Path: dst, Err: syscall.EEXIST}
+	}
+	return dst, os.MkdirAll(filepath.Dir(dst), 0755)
+}
+
+// replaceDestination move the existing dst aside before fn create dst,
+// it is restored if fn failed, and removed after fn succeeded
+func replaceDestination(dst string, fn func() error) error {
+	backup := ""
+	if _, err := os.Lstat(dst); err == nil {
+		backup = filepath.Join(filepath.Dir(dst), fmt.Sprintf(".%s.replaced-%d", filepath.Base(dst), time.Now().UnixNano()))
+		if err := os.Rename(dst, backup); err != nil {
+			return err
+		}
+	}
+	if err := fn(); err != nil {
+		if backup != "" {
+			os.RemoveAll(dst)
+			os.Rename(backup, dst)
+		}
+		return err
+	}
+	if backup != "" {
+		return os.RemoveAll(backup)
+	}
+	return nil
+}
+
+// movePath fallback to copy and delete when rename across filesystems, eg: /data and /sdcard
+func movePath(src, dst string, overwrite bool) (string, error) {
+	if _, err := os.Lstat(src); err != nil {
+		return "", err
+	}
+	dst, err := resolveDestination(src, dst, overwrite)
+	if err != nil {
+		return "", err
+	}
+	err = replaceDestination(dst, func() error {
+		err := os.Rename(src, dst)
+		if errnoOf(err) != syscall.EXDEV {
+			return err
+		}
+		if err = copyRecursive(src, dst); err != nil {
+			os.RemoveAll(dst)
+			return err
+		}
+		return os.RemoveAll(src)
+	})
+	if err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+func copyPath(src, dst string, overwrite bool) (string, error) {
+	if _, err := os.Lstat(src); err != nil {
+		return "", err
+	}
+	dst, err := resolveDestination(src, dst, overwrite)
+	if err != nil {
+		return "", err
+	}
+	if err := replaceDestination(dst, func() error { return copyRecursive(src, dst) }); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// copyRecursive copy file or directory, file mode is preserved and symlinks are copied as symlinks
+func copyRecursive(src, dst string) error {
+	finfo, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case finfo.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	case finfo.IsDir():
+		if strings.HasPrefix(filepath.Clean(dst)+string(filepath.Separator), filepath.Clean(src)+string(filepath.Separator)) {
+			return &os.LinkError{Op: "copy", Old: src, New: dst, Err: syscall.EINVAL} // copy into itself
+		}
+		if err := os.MkdirAll(dst, finfo.Mode().Perm()); err != nil {
+			return err
+		}
+		finfos, err := ioutil.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, f := range finfos {
+			if err := copyRecursive(filepath.Join(src, f.Name()), filepath.Join(dst, f.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return copyFileMode(src, dst, finfo.Mode().Perm())
+	}
+}
+
+func copyFileMode(src, dst string, mode os.FileMode) error {
+	rd, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	wr, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(wr, rd); err != nil {
+		wr.Close()
+		return err
+	}
+	if err = wr.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(dst, mode)
+}
+
+// chmodPath symlinks are skipped when recursive
+func chmodPath(path string, mode os.FileMode, recursive bool) error {
+	if !recursive {
+		return os.Chmod(path, mode)
+	}
+	return filepath.Walk(path, func(p string, finfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if finfo.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		return os.Chmod(p, mode)
+	})
+}
+
+func parseFileMode(s string, defaultMode os.FileMode) os.FileMode {
+	var mode os.FileMode
+	if _, err := fmt.Sscanf(s, "%o", &mode); err != nil {
+		return defaultMode
+	} // %o base 8
+	return mode
+}
+
+func errnoOf(err error) syscall.Errno {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		return errno
+	}
+	return 0
+}
+
+// renderFileError return json like
+//
+//	{"success": false, "code": "ENOENT", "description": "stat /sdcard/a.txt: no such file or directory"}
+func renderFileError(w http.ResponseWriter, err error) {
+	code, status := "EIO", http.StatusInternalServerError
+	switch {
+	case os.IsNotExist(err):
+		code, status = "ENOENT", http.StatusNotFound
+	case os.IsPermission(err) || errnoOf(err) == syscall.EPERM || errnoOf(err) == syscall.EROFS:
+		code, status = "EACCES", http.StatusForbidden
+	case os.IsExist(err):
+		code, status = "EEXIST", http.StatusConflict
+	default:
+		switch errnoOf(err) {
+		case syscall.ENOTEMPTY:
+			code, status = "ENOTEMPTY", http.StatusConflict
+		case syscall.ENOTDIR:
+			code, status = "ENOTDIR", http.StatusBadRequest
+		case syscall.EISDIR:
+			code, status = "EISDIR", http.StatusBadRequest
+		case syscall.EINVAL:
+			code, status = "EINVAL", http.StatusBadRequest
+		case syscall.ENOSPC:
+			code, status = "ENOSPC", http.StatusInsufficientStorage
+		}
+	}
+	renderJSONWithStatus(w, status, map[string]interface{}{
+		"success":     false,
+		"code":        code,
+		"description": err.Error(),
+	})
+}
+
+// renderInvalidArgument response 400 in the same format as renderFileError
+func renderInvalidArgument(w http.ResponseWriter, description string) {
+	renderJSONWithStatus(w, http.StatusBadRequest, map[string]interface{}{
+		"success":     false,
+		"code":        "EINVAL",
+		"description": description,
+	})
+}
@@ -0,0 +1,110 @@
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileManager(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "atx-fs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	src := filepath.Join(tmpdir, "src")
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "sub"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(src, "sub", "a.txt"), []byte("hello"), 0600))
+	assert.NoError(t, os.Symlink("sub/a.txt", filepath.Join(src, "link")))
+
+	entries, err := listDirectory(src)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "link", entries[0].Name)
+	assert.True(t, entries[0].IsSymlink)
+	assert.Equal(t, "sub/a.txt", entries[0].LinkTarget)
+	assert.True(t, entries[1].IsDirectory)
+
+	// copy into directory
+	dst, err := copyPath(src, tmpdir+"/backup/", false)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(tmpdir, "backup", "src"), dst)
+	entry, err := statFile(filepath.Join(dst, "sub", "a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "0600", entry.Mode)
+	assert.Equal(t, int64(5), entry.Size)
+
+	_, err = copyPath(src, dst, false)
+	assert.True(t, os.IsExist(err))
+	_, err = copyPath(src, filepath.Join(src, "sub", "inner"), false)
+	assert.Error(t, err)
+
+	// move and overwrite
+	dst, err = movePath(src, dst, true)
+	assert.NoError(t, err)
+	assert.False(t, fileExists(src))
+	assert.True(t, fileExists(filepath.Join(dst, "link")))
+
+	assert.NoError(t, chmodPath(dst, 0700, true))
+	entry, _ = statFile(filepath.Join(dst, "sub", "a.txt"))
+	assert.Equal(t, "0700", entry.Mode)
+
+	err = removePath(dst, false)
+	assert.Error(t, err)
+	assert.NoError(t, removePath(dst, true))
+	assert.True(t, os.IsNotExist(removePath(dst, true)))
+	assert.Error(t, removePath("/", true))
+}
+
+func TestFileManagerOverwriteGuard(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "atx-fs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	src := filepath.Join(tmpdir, "a", "src")
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "sub"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(src, "sub", "a.txt"), []byte("hello"), 0644))
+
+	for _, dst := range []string{"/.", src, filepath.Join(tmpdir, "a"), tmpdir, filepath.Join(src, "sub")} {
+		_, err = movePath(src, dst, true)
+		assert.Error(t, err, dst)
+		_, err = copyPath(src, dst, true)
+		assert.Error(t, err, dst)
+	}
+	assert.True(t, fileExists(filepath.Join(src, "sub", "a.txt")))
+
+	// existing target is replaced, and no backup left
+	dst := filepath.Join(tmpdir, "dst")
+	assert.NoError(t, os.MkdirAll(dst, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dst, "keep.txt"), []byte("keep"), 0644))
+	_, err = copyPath(src, dst, true)
+	assert.NoError(t, err)
+	assert.False(t, fileExists(filepath.Join(dst, "keep.txt")))
+	assert.True(t, fileExists(filepath.Join(dst, "sub", "a.txt")))
+	infos, _ := ioutil.ReadDir(tmpdir)
+	assert.Len(t, infos, 2) // a and dst, no backup left
+}
+
+func TestRenderFileError(t *testing.T) {
+	_, err := statFile("/not-exists/a.txt")
+	w := httptest.NewRecorder()
+	renderFileError(w, err)
+	assert.Equal(t, 404, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"ENOENT"`)
+
+	w = httptest.NewRecorder()
+	renderInvalidArgument(w, "invalid file mode: abc")
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, "application/json; charset=UTF-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `"code":"EINVAL"`)
+}
+
+func TestAndroidIdName(t *testing.T) {
+	assert.Equal(t, "shell", androidIdName(2000))
+	assert.Equal(t, "u0_a57", androidIdName(10057))
+	assert.Equal(t, "u10_system", androidIdName(1001000))
+}
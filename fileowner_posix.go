@@ -0,0 +1,94 @@
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// Refs: https://android.googlesource.com/platform/system/core/+/master/libcutils/include/private/android_filesystem_config.h
+var androidIds = map[int]string{
+	0:    "root",
+	1000: "system",
+	1001: "radio",
+	1002: "bluetooth",
+	1003: "graphics",
+	1004: "input",
+	1005: "audio",
+	1006: "camera",
+	1007: "log",
+	1010: "wifi",
+	1013: "media",
+	1015: "sdcard_rw",
+	1023: "media_rw",
+	1028: "sdcard_r",
+	2000: "shell",
+	2001: "cache",
+	3003: "inet",
+	9997: "everybody",
+}
+
+var ownerNames = struct {
+	sync.Mutex
+	users  map[int]string
+	groups map[int]string
+}{
+	users:  make(map[int]string),
+	groups: make(map[int]string),
+}
+
+func fileOwner(finfo os.FileInfo) (uid, gid int, ok bool) {
+	stat, ok := finfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
+
+// androidIdName convert uid to name like ls does, eg: 10057 -> u0_a57
+func androidIdName(id int) string {
+	userId, appId := id/100000, id%100000
+	if name, ok := androidIds[appId]; ok {
+		if userId == 0 {
+			return name
+		}
+		return fmt.Sprintf("u%d_%s", userId, name)
+	}
+	if appId >= 10000 && appId < 20000 {
+		return fmt.Sprintf("u%d_a%d", userId, appId-10000)
+	}
+	return strconv.Itoa(id)
+}
+
+func lookupUserName(uid int) string {
+	ownerNames.Lock()
+	defer ownerNames.Unlock()
+	if name, ok := ownerNames.users[uid]; ok {
+		return name
+	}
+	name := androidIdName(uid)
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		name = u.Username
+	}
+	ownerNames.users[uid] = name
+	return name
+}
+
+func lookupGroupName(gid int) string {
+	ownerNames.Lock()
+	defer ownerNames.Unlock()
+	if name, ok := ownerNames.groups[gid]; ok {
+		return name
+	}
+	name := androidIdName(gid)
+	if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+		name = g.Name
+	}
+	ownerNames.groups[gid] = name
+	return name
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// FsEvent ops: create, modify, close_write, attrib, delete, moved_from, moved_to,
+// delete_self (watched path removed), overflow (events dropped by kernel), error
+type FsEvent struct {
+	Op          string    `json:"op"`
+	Path        string    `json:"path"`
+	Root        string    `json:"root"` // watched path which the event belongs to
+	IsDirectory bool      `json:"isDirectory"`
+	Cookie      uint32    `json:"cookie,omitempty"` // pair moved_from and moved_to
+	Error       string    `json:"error,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// fsWatchFilter is specified per client, empty means match all
+type fsWatchFilter struct {
+	Ops      map[string]bool
+	Patterns []string // glob matched against relative path or file name
+}
+
+func newFsWatchFilter(events string, patterns []string) fsWatchFilter {
+	filter := fsWatchFilter{Patterns: patterns}
+	for _, op := range strings.Split(events, ",") {
+		op = strings.TrimSpace(op)
+		if op == "" {
+			continue
+		}
+		if filter.Ops == nil {
+			filter.Ops = make(map[string]bool)
+		}
+		filter.Ops[op] = true
+	}
+	return filter
+}
+
+func (f fsWatchFilter) match(ev FsEvent) bool {
+	switch ev.Op {
+	case "overflow", "error", "delete_self":
+		return true // always notify client
+	}
+	if f.Ops != nil && !f.Ops[ev.Op] {
+		return false
+	}
+	if len(f.Patterns) == 0 {
+		return true
+	}
+	rel, err := filepath.Rel(ev.Root, ev.Path)
+	if err != nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	for _, pattern := range f.Patterns {
+		if matchGlob(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveFsWatch send matched events as json until websocket closed
+func serveFsWatch(conn *websocket.Conn, watcher *fsWatcher, filter fsWatchFilter) {
+	defer conn.Close()
+	defer watcher.Close()
+
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				watcher.Close()
+				return
+			}
+		}
+	}()
+	for ev := range watcher.Events() {
+		if !filter.match(ev) {
+			continue
+		}
+		if err := conn.WriteJSON(ev); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// +build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const fsWatchMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+var fsWatchOps = []struct {
+	mask uint32
+	op   string
+}{
+	{syscall.IN_CREATE, "create"},
+	{syscall.IN_MODIFY, "modify"},
+	{syscall.IN_CLOSE_WRITE, "close_write"},
+	{syscall.IN_ATTRIB, "attrib"},
+	{syscall.IN_DELETE, "delete"},
+	{syscall.IN_MOVED_FROM, "moved_from"},
+	{syscall.IN_MOVED_TO, "moved_to"},
+	{syscall.IN_DELETE_SELF, "delete_self"},
+	{syscall.IN_MOVE_SELF, "move_self"},
+}
+
+type fsWatch struct {
+	path string
+	root string
+}
+
+// fsWatcher is based on inotify, one instance per client.
+// In recursive mode, newly created directories are watched automatically
+type fsWatcher struct {
+	file      *os.File
+	fd        int
+	recursive bool
+	mu        sync.Mutex
+	watches   map[int]fsWatch
+	closed    bool
+	events    chan FsEvent
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newFsWatcher(recursive bool) (*fsWatcher, error) {
+	// non-blocking fd is registered to go runtime poller, so that Close can interrupt Read
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &fsWatcher{
+		file:      os.NewFile(uintptr(fd), "inotify"),
+		fd:        fd,
+		recursive: recursive,
+		watches:   make(map[int]fsWatch),
+		events:    make(chan FsEvent, 100),
+		done:      make(chan struct{}),
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+// Add watch file or directory, subdirectories are also watched when recursive
+func (w *fsWatcher) Add(path string) error {
+	path = filepath.Clean(path)
+	finfo, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !w.recursive || !finfo.IsDir() {
+		return w.addWatch(path, path)
+	}
+	return w.addTree(path, path)
+}
+
+func (w *fsWatcher) addWatch(path, root string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	wd, err := syscall.InotifyAddWatch(w.fd, path, fsWatchMask)
+	if err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: path, Err: err}
+	}
+	w.watches[wd] = fsWatch{path: path, root: root}
+	return nil
+}
+
+// addTree ignore subdirectories which can not be watched, eg: permission denied
+func (w *fsWatcher) addTree(dir, root string) error {
+	if err := w.addWatch(dir, root); err != nil {
+		return err
+	}
+	return filepath.Walk(dir, func(path string, finfo os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return nil
+		}
+		if !finfo.IsDir() {
+			return nil
+		}
+		if err := w.addWatch(path, root); err != nil {
+			if err == os.ErrClosed {
+				return err
+			}
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// Events channel is closed after watcher closed
+func (w *fsWatcher) Events() <-chan FsEvent {
+	return w.events
+}
+
+func (w *fsWatcher) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.done)
+		w.mu.Lock()
+		w.closed = true
+		w.file.Close()
+		w.mu.Unlock()
+	})
+	return nil
+}
+
+func (w *fsWatcher) send(ev FsEvent) bool {
+	select {
+	case w.events <- ev:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func (w *fsWatcher) readEvents() {
+	defer close(w.events)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			select {
+			case <-w.done:
+			default:
+				w.send(FsEvent{Op: "error", Error: err.Error(), Time: time.Now()})
+			}
+			return
+		}
+		offset := 0
+		for offset+syscall.SizeofInotifyEvent <= n {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			offset = nameStart + int(raw.Len)
+			var name string
+			if raw.Len > 0 && offset <= n {
+				name = strings.TrimRight(string(buf[nameStart:offset]), "\x00")
+			}
+			if !w.handleEvent(int(raw.Wd), raw.Mask, raw.Cookie, name) {
+				return
+			}
+		}
+	}
+}
+
+func (w *fsWatcher) handleEvent(wd int, mask, cookie uint32, name string) bool {
+	now := time.Now()
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		return w.send(FsEvent{Op: "overflow", Time: now})
+	}
+	w.mu.Lock()
+	watch, ok := w.watches[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.watches, wd)
+	}
+	w.mu.Unlock()
+	if !ok {
+		return true
+	}
+	ev := FsEvent{
+		Path:        watch.path,
+		Root:        watch.root,
+		IsDirectory: mask&syscall.IN_ISDIR != 0,
+		Cookie:      cookie,
+		Time:        now,
+	}
+	if name != "" {
+		ev.Path = filepath.Join(watch.path, name)
+	}
+	for _, item := range fsWatchOps {
+		if mask&item.mask == 0 {
+			continue
+		}
+		ev.Op = item.op
+		switch ev.Op {
+		case "delete_self", "move_self":
+			// subdirectories removal is already reported by parent
+			if watch.path != watch.root {
+				continue
+			}
+		case "create", "moved_to":
+			if w.recursive && ev.IsDirectory {
+				w.addTree(ev.Path, watch.root)
+			}
+		}
+		if !w.send(ev) {
+			return false
+		}
+	}
+	return true
+}
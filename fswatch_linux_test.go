@@ -0,0 +1,71 @@
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func waitFsEvent(t *testing.T, watcher *fsWatcher, filter fsWatchFilter) FsEvent {
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case ev, ok := <-watcher.Events():
+			if !ok {
+				t.Fatal("watcher closed")
+			}
+			if filter.match(ev) {
+				return ev
+			}
+		case <-timeout:
+			t.Fatal("wait fs event timeout")
+		}
+	}
+}
+
+func TestFsWatcher(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "atx-watch")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	watcher, err := newFsWatcher(true)
+	assert.NoError(t, err)
+	assert.NoError(t, watcher.Add(tmpdir))
+
+	// new directory is watched in recursive mode
+	subdir := filepath.Join(tmpdir, "sub")
+	assert.NoError(t, os.Mkdir(subdir, 0755))
+	ev := waitFsEvent(t, watcher, newFsWatchFilter("create", nil))
+	assert.Equal(t, subdir, ev.Path)
+	assert.Equal(t, tmpdir, ev.Root)
+	assert.True(t, ev.IsDirectory)
+
+	fpath := filepath.Join(subdir, "a.png")
+	assert.NoError(t, ioutil.WriteFile(fpath, []byte("png"), 0644))
+	ev = waitFsEvent(t, watcher, newFsWatchFilter("close_write", []string{"*.png"}))
+	assert.Equal(t, fpath, ev.Path)
+
+	assert.NoError(t, os.Remove(fpath))
+	ev = waitFsEvent(t, watcher, newFsWatchFilter("delete", []string{"sub/**"}))
+	assert.Equal(t, fpath, ev.Path)
+
+	watcher.Close()
+	for range watcher.Events() {
+	}
+	assert.Equal(t, os.ErrClosed, watcher.Add(tmpdir))
+}
+
+func TestFsWatchFilter(t *testing.T) {
+	filter := newFsWatchFilter("create, delete", []string{"*.txt"})
+	assert.True(t, filter.match(FsEvent{Op: "create", Root: "/sdcard", Path: "/sdcard/a/b.txt"}))
+	assert.False(t, filter.match(FsEvent{Op: "modify", Root: "/sdcard", Path: "/sdcard/a/b.txt"}))
+	assert.False(t, filter.match(FsEvent{Op: "delete", Root: "/sdcard", Path: "/sdcard/a/b.png"}))
+	assert.True(t, filter.match(FsEvent{Op: "overflow"}))
+	assert.True(t, newFsWatchFilter("", nil).match(FsEvent{Op: "attrib"}))
+}
@@ -0,0 +1,27 @@
+// +build !linux
+
+package main
+
+import "errors"
+
+var errFsWatchNotSupported = errors.New("fs watch is only supported on linux")
+
+type fsWatcher struct {
+	events chan FsEvent
+}
+
+func newFsWatcher(recursive bool) (*fsWatcher, error) {
+	return nil, errFsWatchNotSupported
+}
+
+func (w *fsWatcher) Add(path string) error {
+	return errFsWatchNotSupported
+}
+
+func (w *fsWatcher) Events() <-chan FsEvent {
+	return w.events
+}
+
+func (w *fsWatcher) Close() error {
+	return nil
+}
@@ -0,0 +1,298 @@
+/*
+Frame rendering stats, collected from dumpsys gfxinfo <package> framestats
+
+	$ curl "$DEVICE_URL/packages/com.example/framestats?duration=5s"
+*/
+package main
+
+import (
+	"bufio"
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// framestats only keeps the last 120 frames, poll before they are overwritten
+	frameStatsPollInterval = 500 * time.Millisecond
+	frameStatsBufferSize   = 120
+	defaultRefreshPeriod   = 1000.0 / 60 // milliseconds
+	frozenFrameThreshold   = 700.0       // milliseconds, same as android vitals
+)
+
+type FrameTimeStats struct {
+	Min  float64 `json:"min"` // milliseconds
+	Max  float64 `json:"max"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+}
+
+type FrameStats struct {
+	Duration      float64         `json:"duration"` // seconds
+	Frames        int             `json:"frames"`
+	FPS           float64         `json:"fps"`
+	JankyFrames   int             `json:"jankyFrames"` // frame time longer than refresh period
+	JankPercent   float64         `json:"jankPercent"`
+	FrozenFrames  int             `json:"frozenFrames"`  // frame time longer than 700ms
+	RefreshPeriod float64         `json:"refreshPeriod"` // milliseconds
+	FrameTime     *FrameTimeStats `json:"frameTime,omitempty"`
+	Warning       string          `json:"warning,omitempty"`
+}
+
+func roundMs(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// percentile use nearest rank, values should be sorted
+func percentile(sorted []float64, p float64) float64 {
+	return sorted[int(math.Ceil(p*float64(len(sorted))))-1]
+}
+
+// calculateFrameStats frame times are in milliseconds
+func calculateFrameStats(frameTimes []float64, duration time.Duration, refreshPeriod float64) FrameStats {
+	stats := FrameStats{
+		Duration:      math.Round(duration.Seconds()*1000) / 1000,
+		Frames:        len(frameTimes),
+		RefreshPeriod: roundMs(refreshPeriod),
+	}
+	if len(frameTimes) == 0 {
+		return stats
+	}
+	if duration > 0 {
+		stats.FPS = math.Round(float64(len(frameTimes))/duration.Seconds()*10) / 10
+	}
+	sorted := append([]float64{}, frameTimes...)
+	sort.Float64s(sorted)
+	sum := 0.0
+	for _, v := range sorted {
+		sum += v
+		if v > refreshPeriod {
+			stats.JankyFrames++
+		}
+		if v > frozenFrameThreshold {
+			stats.FrozenFrames++
+		}
+	}
+	n := len(sorted)
+	stats.JankPercent = math.Round(float64(stats.JankyFrames)/float64(n)*10000) / 100
+	stats.FrameTime = &FrameTimeStats{
+		Min:  roundMs(sorted[0]),
+		Max:  roundMs(sorted[n-1]),
+		Mean: roundMs(sum / float64(n)),
+		P50:  roundMs(percentile(sorted, 0.5)),
+		P90:  roundMs(percentile(sorted, 0.9)),
+		P95:  roundMs(percentile(sorted, 0.95)),
+		P99:  roundMs(percentile(sorted, 0.99)),
+	}
+	return stats
+}
+
+type frameKey struct {
+	intendedVsync  int64
+	frameCompleted int64
+}
+
+type frameRecord struct {
+	frameKey
+	frameTime float64 // milliseconds
+}
+
+// parseFramestats parse PROFILEDATA blocks of dumpsys gfxinfo framestats,
+// frames with non-zero flags (first frame of a window, layout changed) are ignored
+//
+//	---PROFILEDATA---
+//	Flags,IntendedVsync,Vsync,OldestInputEvent,...,FrameCompleted,...
+//	0,10158314881426,10158314881426,9223372036854775807,...,10158322390312,...
+//	---PROFILEDATA---
+func parseFramestats(output string) []frameRecord {
+	frames := []frameRecord{}
+	var columns map[string]int
+	inBlock := false
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "---PROFILEDATA---" {
+			inBlock = !inBlock
+			columns = nil
+			continue
+		}
+		if !inBlock || line == "" {
+			continue
+		}
+		fields := strings.Split(strings.TrimSuffix(line, ","), ",")
+		if columns == nil {
+			columns = make(map[string]int, len(fields))
+			for i, name := range fields {
+				columns[name] = i
+			}
+			continue
+		}
+		flagsIdx, ok1 := columns["Flags"]
+		vsyncIdx, ok2 := columns["IntendedVsync"]
+		completedIdx, ok3 := columns["FrameCompleted"]
+		if !ok1 || !ok2 || !ok3 || len(fields) <= completedIdx {
+			continue
+		}
+		if fields[flagsIdx] != "0" {
+			continue
+		}
+		vsync, err1 := strconv.ParseInt(fields[vsyncIdx], 10, 64)
+		completed, err2 := strconv.ParseInt(fields[completedIdx], 10, 64)
+		if err1 != nil || err2 != nil || completed <= vsync {
+			continue
+		}
+		frames = append(frames, frameRecord{
+			frameKey:  frameKey{vsync, completed},
+			frameTime: float64(completed-vsync) / 1e6,
+		})
+	}
+	return frames
+}
+
+// parseRefreshPeriod first line of dumpsys SurfaceFlinger --latency is the refresh period in nanoseconds
+func parseRefreshPeriod(output string) float64 {
+	line := strings.TrimSpace(strings.SplitN(output, "\n", 2)[0])
+	ns, err := strconv.ParseInt(line, 10, 64)
+	if err != nil || ns <= 0 {
+		return defaultRefreshPeriod
+	}
+	return float64(ns) / 1e6
+}
+
+// frameCollector poll framestats and keep frame times until flush
+type frameCollector struct {
+	packageName   string
+	pollMu        sync.Mutex // serialize polls, frames must be compared with the latest dump
+	mu            sync.Mutex
+	refreshPeriod float64
+	seen          map[frameKey]bool
+	frameTimes    []float64
+	since         time.Time
+	overflow      bool
+	lastErr       error
+
+	dumpsys func(args ...string) (string, error)
+}
+
+func newFrameCollector(packageName string) *frameCollector {
+	return &frameCollector{
+		packageName:   packageName,
+		refreshPeriod: defaultRefreshPeriod,
+		seen:          make(map[frameKey]bool),
+		dumpsys: func(args ...string) (string, error) {
+			return Command{
+				Args:    append([]string{"dumpsys"}, args...),
+				Timeout: 10 * time.Second,
+			}.CombinedOutputString()
+		},
+	}
+}
+
+// Reset clear framestats of the app and start collecting
+func (c *frameCollector) Reset() error {
+	c.pollMu.Lock()
+	defer c.pollMu.Unlock()
+	refreshPeriod := defaultRefreshPeriod
+	if output, err := c.dumpsys("SurfaceFlinger", "--latency"); err == nil {
+		refreshPeriod = parseRefreshPeriod(output)
+	}
+	_, err := c.dumpsys("gfxinfo", c.packageName, "reset")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshPeriod = refreshPeriod
+	c.seen = make(map[frameKey]bool)
+	c.frameTimes = nil
+	c.overflow = false
+	c.lastErr = err
+	c.since = time.Now()
+	return errors.Wrap(err, "dumpsys gfxinfo reset")
+}
+
+// Poll add frames which are not seen in the last poll
+func (c *frameCollector) Poll() error {
+	c.pollMu.Lock()
+	defer c.pollMu.Unlock()
+	output, err := c.dumpsys("gfxinfo", c.packageName, "framestats")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.lastErr = errors.Wrap(err, "dumpsys gfxinfo framestats")
+		return c.lastErr
+	}
+	frames := parseFramestats(output)
+	seen := make(map[frameKey]bool, len(frames))
+	newFrames := 0
+	for _, f := range frames {
+		seen[f.frameKey] = true
+		if c.seen[f.frameKey] {
+			continue
+		}
+		newFrames++
+		c.frameTimes = append(c.frameTimes, f.frameTime)
+	}
+	// all frames in the buffer are new, older frames might be overwritten
+	if len(c.seen) > 0 && newFrames >= frameStatsBufferSize {
+		c.overflow = true
+	}
+	c.seen = seen
+	c.lastErr = nil
+	return nil
+}
+
+// Watch poll until ctx done
+func (c *frameCollector) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Poll()
+		}
+	}
+}
+
+// Flush return stats of frames since last flush or reset
+func (c *frameCollector) Flush() FrameStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	stats := calculateFrameStats(c.frameTimes, now.Sub(c.since), c.refreshPeriod)
+	switch {
+	case c.lastErr != nil:
+		stats.Warning = c.lastErr.Error()
+	case c.overflow:
+		stats.Warning = "some frames might be missed, framestats only keeps the last 120 frames"
+	}
+	c.frameTimes = nil
+	c.overflow = false
+	c.since = now
+	return stats
+}
+
+// collectFrameStats reset framestats, wait for duration and calculate stats
+func collectFrameStats(ctx context.Context, c *frameCollector, duration time.Duration) (FrameStats, error) {
+	if err := c.Reset(); err != nil {
+		return FrameStats{}, err
+	}
+	watchCtx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	c.Watch(watchCtx, frameStatsPollInterval)
+	if err := ctx.Err(); err != nil {
+		return FrameStats{}, err
+	}
+	if err := c.Poll(); err != nil {
+		return FrameStats{}, err
+	}
+	return c.Flush(), nil
+}
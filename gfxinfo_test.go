@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const framestatsHeader = "Flags,IntendedVsync,Vsync,OldestInputEvent,NewestInputEvent,HandleInputStart,AnimationStart,PerformTraversalsStart,DrawStart,SyncQueued,SyncStart,IssueDrawCommandsStart,SwapBuffers,FrameCompleted,DequeueBufferDuration,QueueBufferDuration,"
+
+// framestatsOutput frames are (flags, intendedVsync, frameCompleted) in nanoseconds
+func framestatsOutput(frames ...[3]int64) string {
+	lines := []string{"Applications Graphics Acceleration Info:", "", "---PROFILEDATA---", framestatsHeader}
+	for _, f := range frames {
+		lines = append(lines, fmt.Sprintf("%d,%d,%d,9223372036854775807,0,0,0,0,0,0,0,0,0,%d,0,0,", f[0], f[1], f[1], f[2]))
+	}
+	lines = append(lines, "---PROFILEDATA---", "", "View hierarchy:")
+	return strings.Join(lines, "\n")
+}
+
+func TestParseFramestats(t *testing.T) {
+	output := framestatsOutput(
+		[3]int64{1, 1000000000, 1050000000}, // first frame, ignored
+		[3]int64{0, 1016000000, 1024500000},
+		[3]int64{0, 1032000000, 1052000000},
+		[3]int64{0, 1048000000, 1040000000}, // invalid
+	) + "\n---PROFILEDATA---\n" + framestatsHeader + "\n0,2000000000,0,0,0,0,0,0,0,0,0,0,0,2004000000,0,0,\n---PROFILEDATA---\n"
+	frames := parseFramestats(output)
+	if assert.Len(t, frames, 3) {
+		assert.Equal(t, frameKey{1016000000, 1024500000}, frames[0].frameKey)
+		assert.Equal(t, 8.5, frames[0].frameTime)
+		assert.Equal(t, 20.0, frames[1].frameTime)
+		assert.Equal(t, 4.0, frames[2].frameTime)
+	}
+	assert.Empty(t, parseFramestats("No process found for: com.example"))
+
+	assert.InDelta(t, 8.33, parseRefreshPeriod("8333333\n0\t0\t0\n"), 0.01)
+	assert.InDelta(t, 16.67, parseRefreshPeriod(""), 0.01)
+}
+
+func TestCalculateFrameStats(t *testing.T) {
+	frameTimes := []float64{}
+	for i := 1; i <= 100; i++ {
+		frameTimes = append(frameTimes, float64(i)/5) // 0.2ms to 20ms
+	}
+	frameTimes = append(frameTimes, 800)
+	stats := calculateFrameStats(frameTimes, 2*time.Second, 1000.0/60)
+	assert.Equal(t, 101, stats.Frames)
+	assert.Equal(t, 50.5, stats.FPS)
+	assert.Equal(t, 18, stats.JankyFrames) // 16.8ms to 20ms and 800ms
+	assert.Equal(t, 17.82, stats.JankPercent)
+	assert.Equal(t, 1, stats.FrozenFrames)
+	assert.Equal(t, 16.67, stats.RefreshPeriod)
+	if assert.NotNil(t, stats.FrameTime) {
+		assert.Equal(t, 0.2, stats.FrameTime.Min)
+		assert.Equal(t, 800.0, stats.FrameTime.Max)
+		assert.Equal(t, 10.2, stats.FrameTime.P50)
+		assert.Equal(t, 18.2, stats.FrameTime.P90)
+		assert.Equal(t, 20.0, stats.FrameTime.P99)
+	}
+
+	stats = calculateFrameStats(nil, time.Second, 1000.0/60)
+	assert.Equal(t, 0, stats.Frames)
+	assert.Equal(t, 0.0, stats.FPS)
+	assert.Nil(t, stats.FrameTime)
+}
+
+func TestFrameCollector(t *testing.T) {
+	var calls []string
+	dumps := []string{
+		framestatsOutput([3]int64{0, 100, 8000100}, [3]int64{0, 200, 20000200}),
+		framestatsOutput([3]int64{0, 200, 20000200}, [3]int64{0, 300, 10000300}),
+	}
+	c := newFrameCollector("com.example")
+	c.dumpsys = func(args ...string) (string, error) {
+		calls = append(calls, strings.Join(args, " "))
+		switch args[len(args)-1] {
+		case "--latency":
+			return "11111111\n", nil
+		case "framestats":
+			output := dumps[0]
+			if len(dumps) > 1 {
+				dumps = dumps[1:]
+			}
+			return output, nil
+		}
+		return "", nil
+	}
+	stats, err := collectFrameStats(context.Background(), c, 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"SurfaceFlinger --latency", "gfxinfo com.example reset"}, calls[:2])
+	assert.Equal(t, 2, stats.Frames)
+	assert.Equal(t, 11.11, stats.RefreshPeriod)
+	assert.Equal(t, 1, stats.JankyFrames)
+	assert.Empty(t, stats.Warning)
+
+	// the frame in both dumps is counted once
+	assert.NoError(t, c.Poll())
+	stats = c.Flush()
+	assert.Equal(t, 1, stats.Frames)
+	assert.Equal(t, 0, stats.JankyFrames)
+	assert.NoError(t, c.Poll())
+	assert.Equal(t, 0, c.Flush().Frames)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = collectFrameStats(ctx, c, time.Second)
+	assert.Error(t, err)
+}
+
+func TestFrameCollectorOverflow(t *testing.T) {
+	vsync := int64(0)
+	c := newFrameCollector("com.example")
+	c.dumpsys = func(args ...string) (string, error) {
+		frames := [][3]int64{}
+		for i := 0; i < frameStatsBufferSize; i++ {
+			vsync += 16000000
+			frames = append(frames, [3]int64{0, vsync, vsync + 8000000})
+		}
+		return framestatsOutput(frames...), nil
+	}
+	assert.NoError(t, c.Poll())
+	assert.NoError(t, c.Poll())
+	stats := c.Flush()
+	assert.Equal(t, 2*frameStatsBufferSize, stats.Frames)
+	assert.Contains(t, stats.Warning, "missed")
+}
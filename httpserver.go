@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"image/jpeg"
 	"io"
 	"io/ioutil"
 	"net"
@@ -24,7 +23,6 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	"github.com/mholt/archiver"
 	"github.com/openatx/androidutils"
 	"github.com/openatx/atx-agent/cmdctrl"
 	"github.com/prometheus/procfs"
@@ -44,6 +42,7 @@ func NewServer() *Server {
 
 func (server *Server) initHTTPServer() {
 	m := mux.NewRouter()
+	m.Use(agentMetrics.Middleware)
 
 	m.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		renderHTML(w, "index.html")
@@ -276,13 +275,90 @@ func (server *Server) initHTTPServer() {
 				"output":       string(output),
 				"mainActivity": mainActivity,
 			})
-		} else {
-			renderJSON(w, map[string]interface{}{
-				"success":      true,
-				"mainActivity": mainActivity,
-				"output":       string(output),
+			return
+		}
+		result := map[string]interface{}{
+			"success":      true,
+			"mainActivity": mainActivity,
+			"output":       string(output),
+		}
+		// supervise: false(default), true(1h) or duration like 30m
+		supervise := r.FormValue("supervise")
+		if enabled, err := strconv.ParseBool(supervise); supervise != "" && (err != nil || enabled) {
+			superviseDuration, _ := time.ParseDuration(supervise)
+			result["session"] = appSessions.Create(packageName, superviseDuration).ID
+		}
+		renderJSON(w, result)
+	}).Methods("POST")
+
+	m.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		renderJSON(w, appSessions.List())
+	}).Methods("GET")
+
+	m.HandleFunc("/sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		session := appSessions.Get(mux.Vars(r)["id"])
+		if session == nil {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		renderJSON(w, session)
+	}).Methods("GET")
+
+	// stop supervision, the session is kept for query
+	m.HandleFunc("/sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		session := appSessions.Get(mux.Vars(r)["id"])
+		if session == nil {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		session.Close()
+		renderJSON(w, session)
+	}).Methods("DELETE")
+
+	/*
+	 # events of the session are sent first, websocket is closed after session closed
+	 ws://$DEVICE_URL/sessions/{id}/events
+	*/
+	m.HandleFunc("/sessions/{id}/events", func(w http.ResponseWriter, r *http.Request) {
+		session := appSessions.Get(mux.Vars(r)["id"])
+		if session == nil {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		serveEventStream(w, r, session)
+	}).Methods("GET")
+
+	/*
+	 # type: start-activity(default), start-service, start-foreground-service, broadcast
+	 # extras: {"key": value} with type inferred, or [{"key": "id", "type": "long", "value": 1}]
+	 $ curl -X POST $DEVICE_URL/intent -d '{"component": "com.example/.MainActivity", "stop": true, "extras": {"count": 3}}'
+	*/
+	m.HandleFunc("/intent", func(w http.ResponseWriter, r *http.Request) {
+		var req IntentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			renderJSONWithStatus(w, http.StatusBadRequest, map[string]interface{}{
+				"success":     false,
+				"description": "invalid intent: " + err.Error(),
+			})
+			return
+		}
+		result, err := startIntent(req)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if result.Command == nil {
+				status = http.StatusBadRequest
+			}
+			renderJSONWithStatus(w, status, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+				"data":        result,
 			})
+			return
 		}
+		renderJSON(w, map[string]interface{}{
+			"success": true,
+			"data":    result,
+		})
 	}).Methods("POST")
 
 	m.HandleFunc("/session/{pid:[0-9]+}:{pkgname}/{url:ping|jsonrpc/0}", func(w http.ResponseWriter, r *http.Request) {
@@ -394,6 +470,193 @@ func (server *Server) initHTTPServer() {
 		log.Println("program quit")
 	})
 
+	/*
+	 # lines are json of {time, pid, tid, level, tag, message}, or the original line with format=raw
+	 # buffer: main,system,crash,events,...  filter: tag:priority specs  level: shortcut of *:<level>
+	 # pid or package (follows restarts)  regex, exclude: matched against "tag: message"
+	 # since: RFC3339, unix timestamp or duration like 5m, default now
+	 $ curl "$DEVICE_URL/logcat?package=com.example&filter=ActivityManager:I,*:W"
+	 $ curl "$DEVICE_URL/logcat?buffer=crash&since=10m&format=raw"
+	 ws://$DEVICE_URL/logcat?regex=Exception
+	*/
+	m.HandleFunc("/logcat", func(w http.ResponseWriter, r *http.Request) {
+		opts, err := logcatOptionsFromRequest(r.FormValue, time.Now())
+		if err != nil {
+			renderJSONWithStatus(w, http.StatusBadRequest, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+			})
+			return
+		}
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel() // kill logcat when client is gone
+
+		var conn *websocket.Conn
+		if websocket.IsWebSocketUpgrade(r) {
+			if conn, err = upgrader.Upgrade(w, r, nil); err != nil {
+				log.Println(err)
+				return
+			}
+			defer conn.Close()
+			go func() {
+				for {
+					if _, _, err := conn.ReadMessage(); err != nil {
+						cancel()
+						return
+					}
+				}
+			}()
+		} else {
+			if opts.Raw {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			} else {
+				w.Header().Set("Content-Type", "application/x-ndjson")
+			}
+			w.WriteHeader(http.StatusOK)
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+
+		lines := make(chan logcatLine, 256)
+		errC := make(chan error, 1)
+		go func() {
+			errC <- streamLogcat(ctx, opts, lines)
+			close(lines)
+		}()
+		for line := range lines {
+			if conn != nil {
+				err = conn.WriteMessage(websocket.TextMessage, line.Bytes(opts.Raw))
+			} else {
+				_, err = w.Write(append(line.Bytes(opts.Raw), '\n'))
+				if f, ok := w.(http.Flusher); ok && err == nil && len(lines) == 0 {
+					f.Flush()
+				}
+			}
+			if err != nil {
+				cancel()
+				break
+			}
+		}
+		for range lines {
+		}
+		if err := <-errC; err != nil && ctx.Err() == nil {
+			log.Println("logcat stream:", err)
+			if conn != nil {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error()))
+			} else if opts.Raw {
+				io.WriteString(w, "error: "+err.Error()+"\n")
+			} else {
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			}
+		}
+	}).Methods("GET")
+
+	/*
+	 # capture in background, files are rotated when larger than maxSize(MB, default 10),
+	 # rotated files are compressed, and removed when more than maxBackups(default 10) or older than maxAge(days, default 7)
+	 $ curl -X POST -d buffer=main,crash -d level=I -d maxSize=20 $DEVICE_URL/logcat/captures
+	 $ curl $DEVICE_URL/logcat/captures
+	*/
+	m.HandleFunc("/logcat/captures", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			renderJSON(w, logcatCaptures.List())
+			return
+		}
+		opts, err := logcatCaptureOptionsFromRequest(r.FormValue)
+		if err != nil {
+			renderJSONWithStatus(w, http.StatusBadRequest, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+			})
+			return
+		}
+		capture, err := logcatCaptures.Start(opts)
+		if err != nil {
+			renderJSONWithStatus(w, http.StatusInternalServerError, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+			})
+			return
+		}
+		renderJSON(w, map[string]interface{}{
+			"success": true,
+			"data":    capture,
+		})
+	}).Methods("GET", "POST")
+
+	/*
+	 # DELETE stop the capture, files are kept unless purge=true
+	 $ curl -X DELETE "$DEVICE_URL/logcat/captures/{id}?purge=true"
+	*/
+	m.HandleFunc("/logcat/captures/{id}", func(w http.ResponseWriter, r *http.Request) {
+		capture := logcatCaptures.Get(mux.Vars(r)["id"])
+		if capture == nil {
+			http.Error(w, "capture not found", http.StatusNotFound)
+			return
+		}
+		if r.Method == "DELETE" {
+			if purge, _ := strconv.ParseBool(r.FormValue("purge")); purge {
+				if err := logcatCaptures.Remove(capture); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				renderJSON(w, map[string]interface{}{
+					"success": true,
+				})
+				return
+			}
+			logcatCaptures.Stop(capture)
+		}
+		renderJSON(w, capture)
+	}).Methods("GET", "DELETE")
+
+	/*
+	 # lines between since and until, both support RFC3339, unix timestamp or duration before now
+	 $ curl -o logcat.log "$DEVICE_URL/logcat/captures/{id}/logs?since=2020-03-01T03:00:00Z&until=10m"
+	*/
+	m.HandleFunc("/logcat/captures/{id}/logs", func(w http.ResponseWriter, r *http.Request) {
+		capture := logcatCaptures.Get(mux.Vars(r)["id"])
+		if capture == nil {
+			http.Error(w, "capture not found", http.StatusNotFound)
+			return
+		}
+		var since, until time.Time
+		now := time.Now()
+		for name, t := range map[string]*time.Time{"since": &since, "until": &until} {
+			if v := r.FormValue(name); v != "" {
+				var err error
+				if *t, err = parseLogcatSince(v, now); err != nil {
+					http.Error(w, name+": "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=logcat-"+capture.ID+".log")
+		if err := capture.ReadRange(w, since, until); err != nil {
+			log.Printf("read logcat capture %s error: %v", capture.ID, err)
+		}
+	}).Methods("GET")
+
+	// original files, rotated files are gzip compressed
+	m.HandleFunc("/logcat/captures/{id}/files/{name}", func(w http.ResponseWriter, r *http.Request) {
+		capture := logcatCaptures.Get(mux.Vars(r)["id"])
+		if capture == nil {
+			http.Error(w, "capture not found", http.StatusNotFound)
+			return
+		}
+		files, _ := capture.Files()
+		for _, file := range files {
+			if file.Name == mux.Vars(r)["name"] {
+				w.Header().Set("Content-Disposition", "attachment; filename="+file.Name)
+				http.ServeFile(w, r, capture.FilePath(file.Name))
+				return
+			}
+		}
+		http.Error(w, "file not found", http.StatusNotFound)
+	}).Methods("GET")
+
 	m.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
 		log.Println("stop all service")
 		service.StopAll()
@@ -410,8 +673,7 @@ func (server *Server) initHTTPServer() {
 		name := mux.Vars(r)["name"]
 		var resp map[string]interface{}
 		if !service.Exists(name) {
-			w.WriteHeader(400) // bad request
-			renderJSON(w, map[string]interface{}{
+			renderJSONWithStatus(w, 400, map[string]interface{}{
 				"success":     false,
 				"description": fmt.Sprintf("service %s does not exist", strconv.Quote(name)),
 			})
@@ -467,12 +729,11 @@ func (server *Server) initHTTPServer() {
 				"description": "invalid request method: " + r.Method,
 			}
 		}
-		if ok, success := resp["success"].(bool); ok {
-			if !success {
-				w.WriteHeader(400) // bad request
-			}
+		status := http.StatusOK
+		if ok, success := resp["success"].(bool); ok && !success {
+			status = http.StatusBadRequest
 		}
-		renderJSON(w, resp)
+		renderJSONWithStatus(w, status, resp)
 	}).Methods("GET", "POST", "DELETE")
 
 	// Deprecated use /services/{name} instead
@@ -546,6 +807,236 @@ func (server *Server) initHTTPServer() {
 		renderJSON(w, data)
 	})
 
+	m.HandleFunc("/fs/stat/{lpath:.*}", func(w http.ResponseWriter, r *http.Request) {
+		entry, err := statFile("/" + mux.Vars(r)["lpath"])
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		renderJSON(w, entry)
+	}).Methods("GET")
+
+	m.HandleFunc("/fs/list/{lpath:.*}", func(w http.ResponseWriter, r *http.Request) {
+		entries, err := listDirectory("/" + mux.Vars(r)["lpath"])
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		renderJSON(w, entries)
+	}).Methods("GET")
+
+	m.HandleFunc("/fs/remove/{lpath:.*}", func(w http.ResponseWriter, r *http.Request) {
+		lpath := "/" + mux.Vars(r)["lpath"]
+		if err := removePath(lpath, r.FormValue("recursive") == "true"); err != nil {
+			renderFileError(w, err)
+			return
+		}
+		renderJSON(w, map[string]interface{}{
+			"success": true,
+			"path":    lpath,
+		})
+	}).Methods("DELETE", "POST")
+
+	m.HandleFunc("/fs/mkdir/{lpath:.*}", func(w http.ResponseWriter, r *http.Request) {
+		lpath := "/" + mux.Vars(r)["lpath"]
+		if err := os.MkdirAll(lpath, parseFileMode(r.FormValue("mode"), 0755)); err != nil {
+			renderFileError(w, err)
+			return
+		}
+		entry, err := statFile(lpath)
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		renderJSON(w, entry)
+	}).Methods("POST")
+
+	m.HandleFunc("/fs/chmod/{lpath:.*}", func(w http.ResponseWriter, r *http.Request) {
+		lpath := "/" + mux.Vars(r)["lpath"]
+		var mode os.FileMode
+		if _, err := fmt.Sscanf(r.FormValue("mode"), "%o", &mode); err != nil {
+			renderInvalidArgument(w, "invalid file mode: "+r.FormValue("mode"))
+			return
+		}
+		if err := chmodPath(lpath, mode, r.FormValue("recursive") == "true"); err != nil {
+			renderFileError(w, err)
+			return
+		}
+		entry, err := statFile(lpath)
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		renderJSON(w, entry)
+	}).Methods("POST")
+
+	/*
+	 # Download directory as archive, format: zip(default), tar, tar.gz
+	 # include and exclude can be specified multi times
+	 $ curl -o dcim.tar.gz "$DEVICE_URL/fs/archive/sdcard/DCIM?format=tar.gz&include=*.jpg&exclude=.thumbnails"
+	*/
+	m.HandleFunc("/fs/archive/{lpath:.*}", func(w http.ResponseWriter, r *http.Request) {
+		lpath := "/" + mux.Vars(r)["lpath"]
+		format := r.FormValue("format")
+		if format == "" {
+			format = "zip"
+		}
+		if format == "tgz" {
+			format = "tar.gz"
+		}
+		contentType, ok := archiveContentTypes[format]
+		if !ok {
+			http.Error(w, "unsupported archive format: "+format, http.StatusBadRequest)
+			return
+		}
+		if _, err := os.Stat(lpath); err != nil {
+			renderFileError(w, err)
+			return
+		}
+		r.ParseForm()
+		filter := archiveFilter{
+			Includes: r.Form["include"],
+			Excludes: r.Form["exclude"],
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(filepath.Base(lpath)+"."+format))
+		if err := writeArchive(w, lpath, format, filter); err != nil {
+			// header already sent, abort the connection so the client get an error instead of a truncated archive
+			log.Printf("archive %s error: %v", lpath, err)
+			panic(http.ErrAbortHandler)
+		}
+	}).Methods("GET")
+
+	/*
+	 # Checksum of file, or all files under directory, algo: sha256(default), md5
+	 $ curl "$DEVICE_URL/fs/hash/sdcard/fixtures?algo=md5"
+	*/
+	m.HandleFunc("/fs/hash/{lpath:.*}", func(w http.ResponseWriter, r *http.Request) {
+		lpath := "/" + mux.Vars(r)["lpath"]
+		algo := r.FormValue("algo")
+		if algo == "" {
+			algo = "sha256"
+		}
+		if _, err := newHasher(algo); err != nil {
+			renderInvalidArgument(w, err.Error())
+			return
+		}
+		finfo, err := os.Stat(lpath)
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		data := map[string]interface{}{
+			"path":        lpath,
+			"algo":        algo,
+			"isDirectory": finfo.IsDir(),
+		}
+		if finfo.IsDir() {
+			files, unreadable, err := hashTree(lpath, algo)
+			if err != nil {
+				renderFileError(w, err)
+				return
+			}
+			data["files"] = files
+			data["unreadable"] = unreadable
+		} else {
+			sum, err := fileChecksum(lpath, algo)
+			if err != nil {
+				renderFileError(w, err)
+				return
+			}
+			data["size"] = finfo.Size()
+			data["hash"] = sum
+		}
+		renderJSON(w, data)
+	}).Methods("GET")
+
+	/*
+	 # Compare manifest with directory, then upload missing and changed files with /upload
+	 $ curl -X POST -d '{"algo": "sha256", "files": {"a.txt": "2cf24d..."}, "delete": true}' $DEVICE_URL/fs/sync/sdcard/fixtures
+	*/
+	m.HandleFunc("/fs/sync/{lpath:.*}", func(w http.ResponseWriter, r *http.Request) {
+		lpath := "/" + mux.Vars(r)["lpath"]
+		var manifest SyncManifest
+		if err := json.NewDecoder(r.Body).Decode(&manifest); err != nil {
+			renderInvalidArgument(w, "invalid manifest: "+err.Error())
+			return
+		}
+		if _, err := newHasher(manifest.Algo); err != nil {
+			renderInvalidArgument(w, err.Error())
+			return
+		}
+		result, err := syncDirectory(lpath, manifest)
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		renderJSON(w, result)
+	}).Methods("POST")
+
+	/*
+	 # Watch file changes through websocket, path can be specified multi times
+	 # events: create,modify,close_write,attrib,delete,moved_from,moved_to (default all)
+	 # pattern: glob matched against relative path or file name, eg: *.png
+	 ws://$DEVICE_URL/fs/watch?path=/sdcard/Download&recursive=true&events=create,delete&pattern=*.png
+	*/
+	m.HandleFunc("/fs/watch", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		paths := r.Form["path"]
+		if len(paths) == 0 {
+			http.Error(w, "path is required", http.StatusBadRequest)
+			return
+		}
+		watcher, err := newFsWatcher(r.FormValue("recursive") == "true")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		for _, lpath := range paths {
+			if err := watcher.Add(lpath); err != nil {
+				watcher.Close()
+				renderFileError(w, err)
+				return
+			}
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			watcher.Close()
+			return
+		}
+		serveFsWatch(conn, watcher, newFsWatchFilter(r.FormValue("events"), r.Form["pattern"]))
+	}).Methods("GET")
+
+	/*
+	 # Move or copy, dst ends with / means put into that directory
+	 $ curl -X POST -F src=/sdcard/a.txt -F dst=/data/local/tmp/ $DEVICE_URL/fs/move
+	 $ curl -X POST -F src=/sdcard/dir -F dst=/sdcard/dir2 -F overwrite=true $DEVICE_URL/fs/copy
+	*/
+	m.HandleFunc("/fs/{action:move|copy}", func(w http.ResponseWriter, r *http.Request) {
+		src, dst := r.FormValue("src"), r.FormValue("dst")
+		if src == "" || dst == "" {
+			renderInvalidArgument(w, "src and dst are required")
+			return
+		}
+		overwrite := r.FormValue("overwrite") == "true"
+		var err error
+		if mux.Vars(r)["action"] == "move" {
+			dst, err = movePath(src, dst, overwrite)
+		} else {
+			dst, err = copyPath(src, dst, overwrite)
+		}
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		entry, err := statFile(dst)
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		renderJSON(w, entry)
+	}).Methods("POST")
+
 	// keep ApkService always running
 	// if no activity in 5min, then restart apk service
 	const apkServiceTimeout = 5 * time.Minute
@@ -565,6 +1056,32 @@ func (server *Server) initHTTPServer() {
 		json.NewEncoder(w).Encode(deviceInfo)
 	})
 
+	/*
+	 # cpu usage is calculated since boot, or since the snapshot of a previous call
+	 $ curl $DEVICE_URL/system/stats
+	 $ curl $DEVICE_URL/system/stats?since=5e0c9d6a1f2b3c4d
+	*/
+	m.HandleFunc("/system/stats", func(w http.ResponseWriter, r *http.Request) {
+		stats, err := systemStats.Collect(r.FormValue("since"))
+		if err != nil {
+			renderJSONWithStatus(w, http.StatusNotFound, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+			})
+			return
+		}
+		renderJSON(w, stats)
+	}).Methods("GET")
+
+	/*
+	 # prometheus text exposition format
+	 $ curl $DEVICE_URL/metrics
+	*/
+	m.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		agentMetrics.WriteTo(w)
+	}).Methods("GET")
+
 	m.HandleFunc("/info/battery", func(w http.ResponseWriter, r *http.Request) {
 		apkServiceTimer.Reset(apkServiceTimeout)
 		deviceInfo.Battery.Update()
@@ -633,7 +1150,8 @@ func (server *Server) initHTTPServer() {
 	 # Upload a file to destination
 	 $ curl -X POST -F file=@file.txt -F mode=0755 $DEVICE_URL/upload/sdcard/a.txt
 
-	 # Upload a directory (file must be zip), URLPath must ends with /
+	 # Upload a directory (file can be zip, tar or tar.gz), URLPath must ends with /
+	 # format is detected from filename, or specified by -F format=tar.gz
 	 $ curl -X POST -F file=@dir.zip -F dir=true $DEVICE_URL/upload/sdcard/atx-stuffs/
 	*/
 	m.HandleFunc("/upload/{target:.*}", func(w http.ResponseWriter, r *http.Request) {
@@ -675,7 +1193,11 @@ func (server *Server) initHTTPServer() {
 		}
 
 		if isDir {
-			err = archiver.Zip.Read(file, target)
+			format := r.FormValue("format")
+			if format == "" {
+				format = archiveFormatOf(header.Filename)
+			}
+			err = extractArchive(file, format, target)
 		} else {
 			err = copyToFile(file, target)
 		}
@@ -698,6 +1220,104 @@ func (server *Server) initHTTPServer() {
 		})
 	})
 
+	m.HandleFunc("/upload-sessions", func(w http.ResponseWriter, r *http.Request) {
+		size := int64(-1)
+		if r.FormValue("size") != "" {
+			if _, err := fmt.Sscanf(r.FormValue("size"), "%d", &size); err != nil {
+				http.Error(w, "invalid size: "+r.FormValue("size"), http.StatusBadRequest)
+				return
+			}
+		}
+		session, err := uploadSessions.Create(r.FormValue("target"), size, r.FormValue("sha256"), parseFileMode(r.FormValue("mode"), 0644))
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		w.Header().Set("Location", "/upload-sessions/"+session.ID)
+		renderJSON(w, session)
+	}).Methods("POST")
+
+	m.HandleFunc("/upload-sessions", func(w http.ResponseWriter, r *http.Request) {
+		renderJSON(w, uploadSessions.List())
+	}).Methods("GET")
+
+	m.HandleFunc("/upload-sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		session := uploadSessions.Get(mux.Vars(r)["id"])
+		if session == nil {
+			http.Error(w, "upload session not found", http.StatusNotFound)
+			return
+		}
+		state := session.State()
+		w.Header().Set("Upload-Offset", strconv.FormatInt(state.Offset, 10))
+		renderJSON(w, state)
+	}).Methods("GET")
+
+	m.HandleFunc("/upload-sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		session := uploadSessions.Get(mux.Vars(r)["id"])
+		if session == nil {
+			http.Error(w, "upload session not found", http.StatusNotFound)
+			return
+		}
+		offset, length, total, err := parseUploadOffset(r.Header.Get("Content-Range"), r.Header.Get("Upload-Offset"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if length >= 0 && r.ContentLength >= 0 && r.ContentLength != length {
+			http.Error(w, fmt.Sprintf("Content-Range length %d does not match Content-Length %d", length, r.ContentLength), http.StatusBadRequest)
+			return
+		}
+		_, err = session.Append(offset, length, total, r.Body)
+		switch err {
+		case nil:
+			renderJSON(w, session)
+		case ErrUploadOffsetMismatch:
+			renderJSONWithStatus(w, http.StatusConflict, session)
+		case ErrUploadSizeExceeded:
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		default:
+			log.Printf("upload session %s append error: %v", session.ID, err)
+			renderFileError(w, err)
+		}
+	}).Methods("PUT")
+
+	m.HandleFunc("/upload-sessions/{id}/finish", func(w http.ResponseWriter, r *http.Request) {
+		session, err := uploadSessions.Finish(mux.Vars(r)["id"], r.FormValue("sha256"))
+		if session == nil {
+			http.Error(w, "upload session not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			renderJSONWithStatus(w, http.StatusConflict, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+				"session":     session,
+			})
+			return
+		}
+		state := session.State()
+		renderJSON(w, map[string]interface{}{
+			"success": true,
+			"target":  state.Target,
+			"size":    state.Size,
+			"sha256":  state.Sha256,
+			"mode":    state.Mode,
+		})
+	}).Methods("POST")
+
+	m.HandleFunc("/upload-sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if uploadSessions.Get(id) == nil {
+			http.Error(w, "upload session not found", http.StatusNotFound)
+			return
+		}
+		uploadSessions.Remove(id)
+		renderJSON(w, map[string]interface{}{
+			"success":     true,
+			"description": "upload session " + id + " removed",
+		})
+	}).Methods("DELETE")
+
 	m.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
 		dst := r.FormValue("filepath")
 		url := r.FormValue("url")
@@ -706,42 +1326,102 @@ func (server *Server) initHTTPServer() {
 			log.Printf("invalid file mode: %s", r.FormValue("mode"))
 			fileMode = 0644
 		} // %o base 8
-		key := background.HTTPDownload(url, dst, fileMode)
+		var size int64
+		fmt.Sscanf(r.FormValue("size"), "%d", &size)
+		key := background.HTTPDownloadWithOptions(url, dst, DownloadOptions{
+			Mode:   fileMode,
+			Sha256: r.FormValue("sha256"),
+			Size:   size,
+		})
 		io.WriteString(w, key)
 	}).Methods("POST")
 
+	m.HandleFunc("/downloads", func(w http.ResponseWriter, r *http.Request) {
+		renderJSON(w, background.List())
+	}).Methods("GET")
+
+	m.HandleFunc("/config/network", func(w http.ResponseWriter, r *http.Request) {
+		renderJSON(w, netTransport.Config().Masked())
+	}).Methods("GET")
+
+	// Outbound network settings, saved and applied immediately
+	m.HandleFunc("/config/network", func(w http.ResponseWriter, r *http.Request) {
+		var config NetworkConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			renderJSONWithStatus(w, http.StatusBadRequest, map[string]interface{}{
+				"success":     false,
+				"description": "invalid network config: " + err.Error(),
+			})
+			return
+		}
+		if err := netTransport.Apply(config); err != nil {
+			renderJSONWithStatus(w, http.StatusBadRequest, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+			})
+			return
+		}
+		if err := saveNetworkConfig(netConfigPath, config); err != nil {
+			log.Printf("save network config error: %v", err)
+		}
+		renderJSON(w, netTransport.Config().Masked())
+	}).Methods("PUT")
+
 	m.HandleFunc("/download/{key}", func(w http.ResponseWriter, r *http.Request) {
 		key := mux.Vars(r)["key"]
 		status := background.Get(key)
+		if status == nil {
+			renderJSONWithStatus(w, http.StatusNotFound, map[string]interface{}{
+				"success":     false,
+				"description": "download not found: " + key,
+			})
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(status)
 	}).Methods("GET")
 
-	m.HandleFunc("/packages", func(w http.ResponseWriter, r *http.Request) {
-		var url = r.FormValue("url")
-		filepath := TempFileName("/sdcard/tmp", ".apk")
-		key := background.HTTPDownload(url, filepath, 0644)
-		go func() {
-			defer os.Remove(filepath) // release sdcard space
-
-			state := background.Get(key)
-			state.Status = "downloading"
-			if err := background.Wait(key); err != nil {
-				log.Println("http download error")
-				state.Error = err.Error()
-				state.Status = "failure"
-				state.Message = "http download error"
-				return
+	m.HandleFunc("/download/{key}", func(w http.ResponseWriter, r *http.Request) {
+		key := mux.Vars(r)["key"]
+		if err := background.Cancel(key); err != nil {
+			status := http.StatusConflict
+			if background.Get(key) == nil {
+				status = http.StatusNotFound
 			}
+			renderJSONWithStatus(w, status, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+			})
+			return
+		}
+		renderJSON(w, map[string]interface{}{
+			"success":     true,
+			"description": "download " + key + " canceled",
+		})
+	}).Methods("DELETE")
 
-			state.Status = "installing"
-			if err := forceInstallAPK(filepath); err != nil {
-				state.Error = err.Error()
-				state.Status = "failure"
-			} else {
-				state.Status = "success"
-			}
-		}()
+	/*
+	 # install from url, uploaded file, request body or path on device
+	 $ curl -X POST -F url=http://example.com/app.apk $DEVICE_URL/packages
+	 $ curl -X POST -F file=@app.apk $DEVICE_URL/packages
+	 $ curl -X POST -H "Content-Type: application/vnd.android.package-archive" --data-binary @app.apk $DEVICE_URL/packages
+	 $ curl -X POST -F path=/sdcard/app.apk $DEVICE_URL/packages
+	 # install options: allowDowngrade, grantPermissions, keepData, allowTest, installerPackageName, autoUninstall
+	 $ curl -X POST -F url=http://example.com/app.apk -F autoUninstall=true $DEVICE_URL/packages
+	*/
+	m.HandleFunc("/packages", func(w http.ResponseWriter, r *http.Request) {
+		var tmpdir = r.FormValue("tmpdir")
+		if tmpdir == "" {
+			tmpdir = "/sdcard/tmp"
+		}
+		key, err := installFromRequest(r, tmpdir)
+		if err != nil {
+			renderJSONWithStatus(w, http.StatusBadRequest, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+			})
+			return
+		}
 		renderJSON(w, map[string]interface{}{
 			"success": true,
 			"data": map[string]string{
@@ -750,27 +1430,81 @@ func (server *Server) initHTTPServer() {
 		})
 	}).Methods("POST")
 
+	/*
+	 # events: {"type": "installed|updated|removed", "packageName": "com.example", "path": "...", "package": {...}}
+	 ws://$DEVICE_URL/packages/events
+	*/
+	m.HandleFunc("/packages/events", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer conn.Close()
+		ch := make(chan interface{}, 10)
+		packageIndex.Subscribe(ch)
+		defer packageIndex.Unsubscribe(ch)
+
+		done := make(chan bool)
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					close(done)
+					return
+				}
+			}
+		}()
+		for {
+			select {
+			case <-done:
+				return
+			case ev := <-ch:
+				if err := conn.WriteJSON(ev); err != nil {
+					return
+				}
+			}
+		}
+	}).Methods("GET")
+
 	// id: int
 	m.HandleFunc("/packages/{id}", func(w http.ResponseWriter, r *http.Request) {
 		id := mux.Vars(r)["id"]
 		state := background.Get(id)
-		w.Header().Set("Content-Type", "application/json")
-		data, _ := json.Marshal(state.Progress)
+		if state == nil {
+			renderJSONWithStatus(w, http.StatusNotFound, map[string]interface{}{
+				"success":     false,
+				"description": "install job not found: " + id,
+			})
+			return
+		}
+		job := state.State()
+		data, _ := json.Marshal(job.Progress)
 		renderJSON(w, map[string]interface{}{
 			"success": true,
-			"data": map[string]string{
-				"status":      state.Status,
+			"data": map[string]interface{}{
+				"status":      job.Status,
 				"description": string(data),
+				"result":      job.Result,
 			},
 		})
-		json.NewEncoder(w).Encode(state)
 	}).Methods("GET")
 
+	/*
+	 # filter: type=all|system|third-party(default), disabled=true, prefix=com.android
+	 $ curl "$DEVICE_URL/packages?type=system&disabled=true"
+	*/
 	m.HandleFunc("/packages", func(w http.ResponseWriter, r *http.Request) {
-		pkgs, err := listPackages()
+		filter, err := packageFilterFromQuery(r)
 		if err != nil {
-			w.WriteHeader(500)
-			renderJSON(w, map[string]interface{}{
+			renderJSONWithStatus(w, http.StatusBadRequest, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+			})
+			return
+		}
+		pkgs, err := listPackages(filter)
+		if err != nil {
+			renderJSONWithStatus(w, 500, map[string]interface{}{
 				"success":     false,
 				"description": err.Error(),
 			})
@@ -779,9 +1513,294 @@ func (server *Server) initHTTPServer() {
 		renderJSON(w, pkgs)
 	}).Methods("GET")
 
+	/*
+	 $ curl -X DELETE "$DEVICE_URL/packages/com.example?keepData=true"
+	*/
+	m.HandleFunc("/packages/{pkgname}", func(w http.ResponseWriter, r *http.Request) {
+		action := "uninstall"
+		if keepData, _ := strconv.ParseBool(r.FormValue("keepData")); keepData {
+			action = "uninstall-keep-data"
+		}
+		renderPackageAction(w, mux.Vars(r)["pkgname"], action)
+	}).Methods("DELETE")
+
+	/*
+	 $ curl -X POST $DEVICE_URL/packages/com.example/clear
+	 $ curl -X POST $DEVICE_URL/packages/com.example/force-stop
+	 $ curl -X POST $DEVICE_URL/packages/com.example/disable
+	*/
+	m.HandleFunc("/packages/{pkgname}/{action:clear|force-stop|enable|disable|suspend|unsuspend}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		renderPackageAction(w, vars["pkgname"], vars["action"])
+	}).Methods("POST")
+
+	m.HandleFunc("/packages/{pkgname}/permissions", func(w http.ResponseWriter, r *http.Request) {
+		pkgname := mux.Vars(r)["pkgname"]
+		if !checkPackageName(w, pkgname) {
+			return
+		}
+		perms, err := readPackagePermissions(pkgname)
+		renderPackageResult(w, perms, err)
+	}).Methods("GET")
+
+	// reset runtime permissions
+	m.HandleFunc("/packages/{pkgname}/permissions", func(w http.ResponseWriter, r *http.Request) {
+		pkgname := mux.Vars(r)["pkgname"]
+		if !checkPackageName(w, pkgname) {
+			return
+		}
+		results, err := resetPermissions(pkgname)
+		renderPackageResult(w, results, err)
+	}).Methods("DELETE")
+
+	/*
+	 $ curl -X PUT -d mode=allow $DEVICE_URL/packages/com.example/permissions/appops/SYSTEM_ALERT_WINDOW
+	*/
+	m.HandleFunc("/packages/{pkgname}/permissions/appops/{op:[A-Z][A-Z0-9_]*|[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if !checkPackageName(w, vars["pkgname"]) {
+			return
+		}
+		mode := r.FormValue("mode")
+		if !appOpModes[mode] {
+			renderJSONWithStatus(w, http.StatusBadRequest, map[string]interface{}{
+				"success":     false,
+				"description": "mode should be one of allow, ignore, deny, default or foreground",
+			})
+			return
+		}
+		result, err := setAppOp(vars["pkgname"], vars["op"], mode)
+		renderPackageResult(w, result, err)
+	}).Methods("PUT")
+
+	/*
+	 # PUT to grant, DELETE to revoke
+	 $ curl -X PUT $DEVICE_URL/packages/com.example/permissions/android.permission.CAMERA
+	*/
+	m.HandleFunc("/packages/{pkgname}/permissions/{permission:[a-zA-Z][a-zA-Z0-9_.]*}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if !checkPackageName(w, vars["pkgname"]) {
+			return
+		}
+		result, err := setPermission(vars["pkgname"], vars["permission"], r.Method == "PUT")
+		renderPackageResult(w, result, err)
+	}).Methods("PUT", "DELETE")
+
+	/*
+	 # mode: cold(default, force-stop before launch), warm(press home, then recreate activities) or hot(press home before launch)
+	 # iterations: 1-100 (default 10), dropCaches: true (root required), delay: 1s, timeout: 60s, activity: .MainActivity
+	 # wait: true to response after benchmark finished
+	 $ curl -X POST -d iterations=5 -d wait=true $DEVICE_URL/packages/com.example/benchmark
+	*/
+	m.HandleFunc("/packages/{pkgname}/benchmark", func(w http.ResponseWriter, r *http.Request) {
+		pkgname := mux.Vars(r)["pkgname"]
+		if !checkPackageName(w, pkgname) {
+			return
+		}
+		opts, err := launchBenchmarkOptionsFromRequest(pkgname, r.FormValue)
+		if err != nil {
+			renderJSONWithStatus(w, http.StatusBadRequest, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+			})
+			return
+		}
+		benchmark, err := launchBenchmarks.Start(opts)
+		if err != nil {
+			renderPackageResult(w, nil, err)
+			return
+		}
+		if wait, _ := strconv.ParseBool(r.FormValue("wait")); wait {
+			select {
+			case <-benchmark.Done():
+			case <-r.Context().Done():
+				benchmark.Cancel()
+				<-benchmark.Done()
+			}
+		}
+		renderJSON(w, map[string]interface{}{
+			"success": true,
+			"data":    benchmark,
+		})
+	}).Methods("POST")
+
+	m.HandleFunc("/benchmarks", func(w http.ResponseWriter, r *http.Request) {
+		renderJSON(w, launchBenchmarks.List())
+	}).Methods("GET")
+
+	m.HandleFunc("/benchmarks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		benchmark := launchBenchmarks.Get(mux.Vars(r)["id"])
+		if benchmark == nil {
+			http.Error(w, "benchmark not found", http.StatusNotFound)
+			return
+		}
+		if r.Method == "DELETE" {
+			benchmark.Cancel()
+			<-benchmark.Done()
+		}
+		renderJSON(w, benchmark)
+	}).Methods("GET", "DELETE")
+
+	/*
+	 # reset framestats, collect frames rendered in duration (default 5s, max 10m)
+	 $ curl "$DEVICE_URL/packages/com.example/framestats?duration=10s"
+	*/
+	m.HandleFunc("/packages/{pkgname}/framestats", func(w http.ResponseWriter, r *http.Request) {
+		pkgname := mux.Vars(r)["pkgname"]
+		if !checkPackageName(w, pkgname) {
+			return
+		}
+		duration := 5 * time.Second
+		if v := r.FormValue("duration"); v != "" {
+			var err error
+			if duration, err = time.ParseDuration(v); err != nil || duration <= 0 || duration > 10*time.Minute {
+				renderJSONWithStatus(w, http.StatusBadRequest, map[string]interface{}{
+					"success":     false,
+					"description": "duration should be between 0 and 10m",
+				})
+				return
+			}
+		}
+		if !packageInstalled(pkgname) {
+			renderPackageResult(w, nil, ErrPackageNotInstalled)
+			return
+		}
+		stats, err := collectFrameStats(r.Context(), newFrameCollector(pkgname), duration)
+		if err != nil {
+			renderPackageResult(w, nil, err)
+			return
+		}
+		renderPackageResult(w, stats, nil)
+	}).Methods("GET")
+
+	/*
+	 # metrics: cpu,thread-cpu,memory,threads,fds,network,frames (default all)
+	 # interval: 1s(default, min 200ms), duration: 1h(default), bufferSize: 3600(default)
+	 $ curl -X POST -d interval=1s -d metrics=cpu,memory $DEVICE_URL/packages/com.example/perf
+	*/
+	m.HandleFunc("/packages/{pkgname}/perf", func(w http.ResponseWriter, r *http.Request) {
+		pkgname := mux.Vars(r)["pkgname"]
+		if !checkPackageName(w, pkgname) {
+			return
+		}
+		opts, err := perfSamplerOptionsFromRequest(pkgname, r.FormValue)
+		if err != nil {
+			renderJSONWithStatus(w, http.StatusBadRequest, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+			})
+			return
+		}
+		sampler, err := perfSamplers.Start(opts)
+		if err != nil {
+			renderPackageResult(w, nil, err)
+			return
+		}
+		renderJSON(w, map[string]interface{}{
+			"success": true,
+			"data":    sampler,
+		})
+	}).Methods("POST")
+
+	m.HandleFunc("/perf", func(w http.ResponseWriter, r *http.Request) {
+		renderJSON(w, perfSamplers.List())
+	}).Methods("GET")
+
+	// DELETE to stop sampling, samples are kept for download
+	m.HandleFunc("/perf/{id}", func(w http.ResponseWriter, r *http.Request) {
+		sampler := perfSamplers.Get(mux.Vars(r)["id"])
+		if sampler == nil {
+			http.Error(w, "sampler not found", http.StatusNotFound)
+			return
+		}
+		if r.Method == "DELETE" {
+			sampler.Stop()
+		}
+		renderJSON(w, sampler)
+	}).Methods("GET", "DELETE")
+
+	/*
+	 # format: json(default) or csv
+	 $ curl -o perf.csv "$DEVICE_URL/perf/{id}/samples?format=csv"
+	*/
+	m.HandleFunc("/perf/{id}/samples", func(w http.ResponseWriter, r *http.Request) {
+		sampler := perfSamplers.Get(mux.Vars(r)["id"])
+		if sampler == nil {
+			http.Error(w, "sampler not found", http.StatusNotFound)
+			return
+		}
+		filename := "perf-" + sampler.Options.PackageName + "-" + sampler.ID
+		switch r.FormValue("format") {
+		case "", "json":
+			w.Header().Set("Content-Disposition", "attachment; filename="+filename+".json")
+			renderJSON(w, sampler.Samples())
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", "attachment; filename="+filename+".csv")
+			if err := writePerfSamplesCSV(w, sampler.Samples()); err != nil {
+				log.Println("write perf csv:", err)
+			}
+		default:
+			http.Error(w, "format should be json or csv", http.StatusBadRequest)
+		}
+	}).Methods("GET")
+
+	/*
+	 # buffered samples are sent first, websocket is closed after sampling stopped
+	 ws://$DEVICE_URL/perf/{id}/stream
+	*/
+	m.HandleFunc("/perf/{id}/stream", func(w http.ResponseWriter, r *http.Request) {
+		sampler := perfSamplers.Get(mux.Vars(r)["id"])
+		if sampler == nil {
+			http.Error(w, "sampler not found", http.StatusNotFound)
+			return
+		}
+		serveEventStream(w, r, sampler)
+	}).Methods("GET")
+
+	m.HandleFunc("/packages/{pkgname}/manifest", func(w http.ResponseWriter, r *http.Request) {
+		pkgname := mux.Vars(r)["pkgname"]
+		if !checkPackageName(w, pkgname) {
+			return
+		}
+		apkpath, err := packageApkPath(pkgname)
+		if err != nil {
+			renderPackageResult(w, nil, err)
+			return
+		}
+		manifest, err := inspectAPK(apkpath)
+		renderPackageResult(w, manifest, err)
+	}).Methods("GET")
+
+	/*
+		# upload apk file, or send raw body, or inspect apk on device
+		$ curl -F file=@app.apk $DEVICE_URL/apk/manifest
+		$ curl --data-binary @app.apk "$DEVICE_URL/apk/manifest?tmpdir=/data/local/tmp"
+		$ curl -d path=/sdcard/app.apk $DEVICE_URL/apk/manifest
+	*/
+	m.HandleFunc("/apk/manifest", func(w http.ResponseWriter, r *http.Request) {
+		// read from query only, parse form here will consume the raw apk body
+		var tmpdir = r.URL.Query().Get("tmpdir")
+		if tmpdir == "" {
+			tmpdir = "/data/local/tmp"
+		}
+		manifest, err := inspectAPKFromRequest(r, tmpdir)
+		if err != nil {
+			renderJSONWithStatus(w, http.StatusBadRequest, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+			})
+			return
+		}
+		renderJSON(w, map[string]interface{}{
+			"success": true,
+			"data":    manifest,
+		})
+	}).Methods("POST")
+
 	m.HandleFunc("/packages/{pkgname}/info", func(w http.ResponseWriter, r *http.Request) {
 		pkgname := mux.Vars(r)["pkgname"]
-		info, err := readPackageInfo(pkgname)
+		entry, err := packageIndex.Get(pkgname)
 		if err != nil {
 			renderJSON(w, map[string]interface{}{
 				"success":     false,
@@ -791,59 +1810,37 @@ func (server *Server) initHTTPServer() {
 		}
 		renderJSON(w, map[string]interface{}{
 			"success": true,
-			"data":    info,
+			"data":    entry.Info,
 		})
 	})
 
 	m.HandleFunc("/packages/{pkgname}/icon", func(w http.ResponseWriter, r *http.Request) {
 		pkgname := mux.Vars(r)["pkgname"]
-		info, err := readPackageInfo(pkgname)
+		entry, err := packageIndex.Get(pkgname)
 		if err != nil {
 			http.Error(w, "package not found", 403)
 			return
 		}
-		if info.Icon == nil {
+		if entry.Icon == nil {
 			http.Error(w, "package not found", 400)
 			return
 		}
 		w.Header().Set("Content-Type", "image/jpeg")
-		jpeg.Encode(w, info.Icon, &jpeg.Options{Quality: 80})
+		w.Write(entry.Icon)
 	})
 
 	// deprecated
 	m.HandleFunc("/install", func(w http.ResponseWriter, r *http.Request) {
-		var url = r.FormValue("url")
 		var tmpdir = r.FormValue("tmpdir")
 		if tmpdir == "" {
 			tmpdir = "/data/local/tmp"
 		}
 
-		filepath := TempFileName(tmpdir, ".apk")
-		key := background.HTTPDownload(url, filepath, 0644)
-		go func() {
-			defer os.Remove(filepath) // release sdcard space
-
-			state := background.Get(key)
-			state.Status = "downloading"
-			if err := background.Wait(key); err != nil {
-				log.Println("http download error")
-				state.Error = err.Error()
-				state.Message = "http download error"
-				state.Status = "failure"
-				return
-			}
-
-			state.Message = "installing"
-			state.Status = "installing"
-			if err := forceInstallAPK(filepath); err != nil {
-				state.Error = err.Error()
-				state.Message = "error install"
-				state.Status = "failure"
-			} else {
-				state.Message = "success installed"
-				state.Status = "success"
-			}
-		}()
+		key, err := installFromRequest(r, tmpdir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		io.WriteString(w, key)
 	}).Methods("POST")
 
@@ -858,15 +1855,11 @@ func (server *Server) initHTTPServer() {
 	// deprecated
 	m.HandleFunc("/install/{id}", func(w http.ResponseWriter, r *http.Request) {
 		id := mux.Vars(r)["id"]
-		state := background.Get(id)
-		if state.Progress != nil {
-			if dproxy, ok := state.Progress.(*downloadProxy); ok {
-				dproxy.Cancel()
-				io.WriteString(w, "Cancelled")
-				return
-			}
+		if err := background.Cancel(id); err != nil {
+			io.WriteString(w, "Unable to canceled")
+			return
 		}
-		io.WriteString(w, "Unable to canceled")
+		io.WriteString(w, "Cancelled")
 	}).Methods("DELETE")
 
 	// fix minitouch
@@ -963,7 +1956,7 @@ func (server *Server) initHTTPServer() {
 		}
 	}).Methods("PUT")
 
-	minicapHandler := broadcastWebsocket()
+	minicapHandler := broadcastWebsocket("minicap")
 	m.HandleFunc("/minicap/broadcast", minicapHandler).Methods("GET")
 	m.HandleFunc("/minicap", minicapHandler).Methods("GET")
 
@@ -1066,6 +2059,29 @@ func (server *Server) initHTTPServer() {
 		renderHTML(w, "terminal.html")
 	})
 
+	m.HandleFunc("/term/records", func(w http.ResponseWriter, r *http.Request) {
+		records, err := listTermRecords()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		renderJSON(w, records)
+	}).Methods("GET")
+
+	m.HandleFunc("/term/records/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		recordPath := termRecordPath(name)
+		if recordPath == "" || !fileExists(recordPath) {
+			http.Error(w, "record not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-asciicast")
+		if r.FormValue("download") != "false" {
+			w.Header().Set("Content-Disposition", "attachment; filename="+name)
+		}
+		http.ServeFile(w, r, recordPath)
+	}).Methods("GET")
+
 	screenshotIndex := -1
 	nextScreenshotFilename := func() string {
 		targetFolder := "/data/local/tmp/minicap-images"
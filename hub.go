@@ -6,25 +6,44 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 type Hub struct {
+	name       string
+	numClients int32            // len(clients), can be read from other goroutines
 	clients    map[*Client]bool // Registered clients.
 	broadcast  chan []byte      // Inbound messages from the clients.
 	register   chan *Client     // Register requests from the clients.
 	unregister chan *Client     // Unregister requests from clients.
 }
 
-func newHub() *Hub {
-	return &Hub{
+var (
+	hubsMu sync.Mutex
+	hubs   []*Hub
+)
+
+func newHub(name string) *Hub {
+	h := &Hub{
+		name:       name,
 		broadcast:  make(chan []byte, 10),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		clients:    make(map[*Client]bool),
 	}
+	hubsMu.Lock()
+	hubs = append(hubs, h)
+	hubsMu.Unlock()
+	return h
+}
+
+// ClientCount return number of registered clients
+func (h *Hub) ClientCount() int {
+	return int(atomic.LoadInt32(&h.numClients))
 }
 
 func (h *Hub) _startTranslate(ctx context.Context) {
@@ -99,6 +118,7 @@ func (h *Hub) run() {
 				}
 			}
 		}
+		atomic.StoreInt32(&h.numClients, int32(len(h.clients)))
 	}
 }
 
@@ -172,8 +192,8 @@ func (c *Client) readPump() {
 	}
 }
 
-func broadcastWebsocket() func(http.ResponseWriter, *http.Request) {
-	hub := newHub()
+func broadcastWebsocket(name string) func(http.ResponseWriter, *http.Request) {
+	hub := newHub(name)
 	go hub.run() // start read images from unix:@minicap
 
 	return func(w http.ResponseWriter, r *http.Request) {
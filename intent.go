@@ -0,0 +1,468 @@
+/*
+Send intent with am start, startservice, start-foreground-service or broadcast
+
+	$ curl -X POST $DEVICE_URL/intent -d '{"action": "android.intent.action.VIEW", "data": "https://example.com"}'
+	$ curl -X POST $DEVICE_URL/intent -d '{"type": "broadcast", "action": "com.example.PING", "extras": {"count": 3}}'
+*/
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	componentRe   = regexp.MustCompile(`^[a-zA-Z][\w.]*/[\w.$]+$`)
+	intentUserRe  = regexp.MustCompile(`^(\d+|current|all)$`)
+	amTimeRe      = regexp.MustCompile(`^(ThisTime|TotalTime|WaitTime): (-?\d+)`)
+	amBroadcastRe = regexp.MustCompile(`^Broadcast completed: result=(-?\d+)(?:, data="(.*)")?`)
+)
+
+// intentFlags only common ones, other flags can be set with number
+var intentFlags = map[string]uint32{
+	"FLAG_GRANT_READ_URI_PERMISSION":      0x00000001,
+	"FLAG_GRANT_WRITE_URI_PERMISSION":     0x00000002,
+	"FLAG_FROM_BACKGROUND":                0x00000004,
+	"FLAG_DEBUG_LOG_RESOLUTION":           0x00000008,
+	"FLAG_EXCLUDE_STOPPED_PACKAGES":       0x00000010,
+	"FLAG_INCLUDE_STOPPED_PACKAGES":       0x00000020,
+	"FLAG_ACTIVITY_LAUNCH_ADJACENT":       0x00001000,
+	"FLAG_ACTIVITY_RETAIN_IN_RECENTS":     0x00002000,
+	"FLAG_ACTIVITY_TASK_ON_HOME":          0x00004000,
+	"FLAG_ACTIVITY_CLEAR_TASK":            0x00008000,
+	"FLAG_ACTIVITY_NO_ANIMATION":          0x00010000,
+	"FLAG_ACTIVITY_REORDER_TO_FRONT":      0x00020000,
+	"FLAG_ACTIVITY_NO_USER_ACTION":        0x00040000,
+	"FLAG_ACTIVITY_NEW_DOCUMENT":          0x00080000,
+	"FLAG_ACTIVITY_RESET_TASK_IF_NEEDED":  0x00200000,
+	"FLAG_ACTIVITY_EXCLUDE_FROM_RECENTS":  0x00800000,
+	"FLAG_ACTIVITY_PREVIOUS_IS_TOP":       0x01000000,
+	"FLAG_ACTIVITY_FORWARD_RESULT":        0x02000000,
+	"FLAG_ACTIVITY_CLEAR_TOP":             0x04000000,
+	"FLAG_ACTIVITY_MULTIPLE_TASK":         0x08000000,
+	"FLAG_ACTIVITY_NEW_TASK":              0x10000000,
+	"FLAG_ACTIVITY_SINGLE_TOP":            0x20000000,
+	"FLAG_ACTIVITY_NO_HISTORY":            0x40000000,
+	"FLAG_RECEIVER_FOREGROUND":            0x10000000,
+	"FLAG_RECEIVER_REPLACE_PENDING":       0x20000000,
+	"FLAG_RECEIVER_REGISTERED_ONLY":       0x40000000,
+	"FLAG_RECEIVER_INCLUDE_BACKGROUND":    0x01000000,
+	"FLAG_RECEIVER_NO_ABORT":              0x08000000,
+	"FLAG_ACTIVITY_REQUIRE_NON_BROWSER":   0x00000400,
+	"FLAG_ACTIVITY_REQUIRE_DEFAULT":       0x00000200,
+	"FLAG_ACTIVITY_MATCH_EXTERNAL":        0x00000800,
+	"FLAG_ACTIVITY_LAUNCHED_FROM_HISTORY": 0x00100000,
+}
+
+// extraOptions map extra type to am option, value of arrays are joined with comma
+var extraOptions = map[string]string{
+	"string":       "--es",
+	"null":         "--esn",
+	"bool":         "--ez",
+	"int":          "--ei",
+	"long":         "--el",
+	"float":        "--ef",
+	"uri":          "--eu",
+	"component":    "--ecn",
+	"string-array": "--esa",
+	"int-array":    "--eia",
+	"long-array":   "--ela",
+	"float-array":  "--efa",
+}
+
+// intentCommands map request type to am subcommand
+var intentCommands = map[string]string{
+	"start-activity":           "start",
+	"start-service":            "startservice",
+	"start-foreground-service": "start-foreground-service", // android 8.0+
+	"broadcast":                "broadcast",
+}
+
+type IntentExtra struct {
+	Key   string      `json:"key"`
+	Type  string      `json:"type,omitempty"` // inferred from value when empty
+	Value interface{} `json:"value"`
+}
+
+// IntentExtras can be decoded from list of IntentExtra or object with types inferred
+//
+//	[{"key": "id", "type": "long", "value": 1}]
+//	{"id": 1, "name": "atx", "debug": true, "tags": ["a", "b"]}
+type IntentExtras []IntentExtra
+
+func (extras *IntentExtras) UnmarshalJSON(data []byte) error {
+	var list []IntentExtra
+	if err := json.Unmarshal(data, &list); err == nil {
+		*extras = list
+		return nil
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return errors.New("extras should be list or object")
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	*extras = make(IntentExtras, 0, len(keys))
+	for _, key := range keys {
+		*extras = append(*extras, IntentExtra{Key: key, Value: values[key]})
+	}
+	return nil
+}
+
+type Intent struct {
+	Action     string       `json:"action"`
+	Data       string       `json:"data"` // uri
+	MimeType   string       `json:"mimeType"`
+	Categories []string     `json:"categories"`
+	Component  string       `json:"component"` // com.example/.MainActivity
+	Package    string       `json:"package"`
+	Flags      []string     `json:"flags"` // FLAG_ACTIVITY_NEW_TASK, 0x10000000 or 268435456
+	Extras     IntentExtras `json:"extras"`
+}
+
+type IntentRequest struct {
+	Intent
+	Type    string `json:"type"`    // start-activity(default), start-service, start-foreground-service, broadcast
+	Wait    *bool  `json:"wait"`    // am start -W, default true
+	Stop    bool   `json:"stop"`    // am start -S, force stop before start
+	User    string `json:"user"`    // --user
+	Timeout string `json:"timeout"` // default 60s
+}
+
+type IntentResult struct {
+	Type            string   `json:"type"`
+	Command         []string `json:"command"`
+	Status          string   `json:"status,omitempty"`      // ok, timeout
+	LaunchState     string   `json:"launchState,omitempty"` // COLD, WARM, HOT, android 10.0+
+	Activity        string   `json:"activity,omitempty"`
+	ThisTime        int      `json:"thisTime,omitempty"` // milliseconds
+	TotalTime       int      `json:"totalTime,omitempty"`
+	WaitTime        int      `json:"waitTime,omitempty"`
+	BroadcastResult *int     `json:"broadcastResult,omitempty"`
+	BroadcastData   string   `json:"broadcastData,omitempty"`
+	Warning         string   `json:"warning,omitempty"`
+	Error           string   `json:"error,omitempty"`
+	Output          string   `json:"output"`
+}
+
+// parseIntentFlags combine flag names and numbers
+func parseIntentFlags(flags []string) (value uint32, err error) {
+	for _, flag := range flags {
+		flag = strings.TrimSpace(flag)
+		name := strings.ToUpper(flag)
+		if !strings.HasPrefix(name, "FLAG_") {
+			name = "FLAG_" + name
+		}
+		if v, ok := intentFlags[name]; ok {
+			value |= v
+			continue
+		}
+		v, err := strconv.ParseUint(flag, 0, 32)
+		if err != nil {
+			return 0, errors.New("unknown intent flag: " + strconv.Quote(flag))
+		}
+		value |= uint32(v)
+	}
+	return value, nil
+}
+
+// inferExtraType by json value: string, bool, int, long, float or arrays
+func inferExtraType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case string:
+		return "string"
+	case float64:
+		if v != math.Trunc(v) {
+			return "float"
+		}
+		if v > math.MaxInt32 || v < math.MinInt32 {
+			return "long"
+		}
+		return "int"
+	case []interface{}:
+		elemType := "string"
+		for _, elem := range v {
+			switch t := inferExtraType(elem); t {
+			case "float":
+				elemType = t
+			case "long":
+				if elemType != "float" {
+					elemType = t
+				}
+			case "int":
+				if elemType == "string" {
+					elemType = t
+				}
+			default:
+				return "string-array"
+			}
+		}
+		if len(v) == 0 {
+			return "string-array"
+		}
+		return elemType + "-array"
+	}
+	return ""
+}
+
+func formatExtraScalar(typ string, value interface{}) (string, error) {
+	switch typ {
+	case "string", "uri", "component":
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+	case "bool":
+		switch v := value.(type) {
+		case bool:
+			return strconv.FormatBool(v), nil
+		case string:
+			if b, err := strconv.ParseBool(v); err == nil {
+				return strconv.FormatBool(b), nil
+			}
+		}
+	case "int", "long":
+		bitSize := 32
+		if typ == "long" {
+			bitSize = 64
+		}
+		switch v := value.(type) {
+		case float64:
+			if v == math.Trunc(v) {
+				return strconv.FormatInt(int64(v), 10), nil
+			}
+		case string:
+			if _, err := strconv.ParseInt(v, 10, bitSize); err == nil {
+				return v, nil
+			}
+		}
+	case "float":
+		switch v := value.(type) {
+		case float64:
+			return strconv.FormatFloat(v, 'g', -1, 32), nil
+		case string:
+			if _, err := strconv.ParseFloat(v, 32); err == nil {
+				return v, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("invalid %s value: %v", typ, value)
+}
+
+// args return am arguments of extra, eg: --ei count 3
+func (e IntentExtra) args() ([]string, error) {
+	if e.Key == "" {
+		return nil, errors.New("extra key is required")
+	}
+	typ := e.Type
+	if typ == "" {
+		typ = inferExtraType(e.Value)
+	}
+	option, ok := extraOptions[typ]
+	if !ok {
+		return nil, errors.New("unknown extra type of " + e.Key + ": " + strconv.Quote(typ))
+	}
+	if typ == "null" {
+		return []string{option, e.Key}, nil
+	}
+	if !strings.HasSuffix(typ, "-array") {
+		value, err := formatExtraScalar(typ, e.Value)
+		if err != nil {
+			return nil, errors.Wrap(err, e.Key)
+		}
+		return []string{option, e.Key, value}, nil
+	}
+	elems, ok := e.Value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: %s value should be list", e.Key, typ)
+	}
+	elemType := strings.TrimSuffix(typ, "-array")
+	values := make([]string, 0, len(elems))
+	for _, elem := range elems {
+		value, err := formatExtraScalar(elemType, elem)
+		if err != nil {
+			return nil, errors.Wrap(err, e.Key)
+		}
+		values = append(values, strings.Replace(value, ",", `\,`, -1))
+	}
+	return []string{option, e.Key, strings.Join(values, ",")}, nil
+}
+
+// args return am intent arguments
+func (intent Intent) args() ([]string, error) {
+	args := []string{}
+	if intent.Action != "" {
+		args = append(args, "-a", intent.Action)
+	}
+	if intent.Data != "" {
+		args = append(args, "-d", intent.Data)
+	}
+	if intent.MimeType != "" {
+		args = append(args, "-t", intent.MimeType)
+	}
+	for _, category := range intent.Categories {
+		args = append(args, "-c", category)
+	}
+	if intent.Component != "" {
+		if !componentRe.MatchString(intent.Component) {
+			return nil, errors.New("invalid component: " + strconv.Quote(intent.Component))
+		}
+		args = append(args, "-n", intent.Component)
+	}
+	if intent.Package != "" {
+		if !packageNameRe.MatchString(intent.Package) {
+			return nil, errors.New("invalid package name: " + strconv.Quote(intent.Package))
+		}
+		args = append(args, "-p", intent.Package)
+	}
+	if len(intent.Flags) > 0 {
+		flags, err := parseIntentFlags(intent.Flags)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-f", fmt.Sprintf("0x%08x", flags))
+	}
+	for _, extra := range intent.Extras {
+		extraArgs, err := extra.args()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, extraArgs...)
+	}
+	if len(args) == 0 {
+		return nil, errors.New("intent is empty")
+	}
+	return args, nil
+}
+
+// command return am command of the request
+func (req IntentRequest) command() ([]string, error) {
+	if req.Type == "" {
+		req.Type = "start-activity"
+	}
+	subcommand, ok := intentCommands[req.Type]
+	if !ok {
+		return nil, errors.New("type should be one of start-activity, start-service, start-foreground-service or broadcast")
+	}
+	args := []string{"am", subcommand}
+	if req.Type == "start-activity" {
+		if req.Wait == nil || *req.Wait {
+			args = append(args, "-W")
+		}
+		if req.Stop {
+			args = append(args, "-S")
+		}
+	}
+	if req.User != "" {
+		if !intentUserRe.MatchString(req.User) {
+			return nil, errors.New("invalid user: " + strconv.Quote(req.User))
+		}
+		args = append(args, "--user", req.User)
+	}
+	intentArgs, err := req.Intent.args()
+	if err != nil {
+		return nil, err
+	}
+	return append(args, intentArgs...), nil
+}
+
+// parseAmOutput fill result from output of am start -W, am startservice and am broadcast
+//
+//	Starting: Intent { cmp=com.example/.MainActivity }
+//	Status: ok
+//	LaunchState: COLD
+//	Activity: com.example/.MainActivity
+//	ThisTime: 317
+//	TotalTime: 317
+//	WaitTime: 331
+//	Complete
+func parseAmOutput(result *IntentResult, output string) {
+	result.Output = strings.TrimSpace(output)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if matches := amTimeRe.FindStringSubmatch(line); matches != nil {
+			value, _ := strconv.Atoi(matches[2])
+			switch matches[1] {
+			case "ThisTime":
+				result.ThisTime = value
+			case "TotalTime":
+				result.TotalTime = value
+			case "WaitTime":
+				result.WaitTime = value
+			}
+			continue
+		}
+		if matches := amBroadcastRe.FindStringSubmatch(line); matches != nil {
+			code, _ := strconv.Atoi(matches[1])
+			result.BroadcastResult = &code
+			result.BroadcastData = matches[2]
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "Status: "):
+			result.Status = strings.TrimPrefix(line, "Status: ")
+		case strings.HasPrefix(line, "LaunchState: "):
+			result.LaunchState = strings.TrimPrefix(line, "LaunchState: ")
+		case strings.HasPrefix(line, "Activity: "):
+			result.Activity = strings.TrimPrefix(line, "Activity: ")
+		case strings.HasPrefix(line, "Warning: "):
+			result.Warning = strings.TrimPrefix(line, "Warning: ")
+		case strings.HasPrefix(line, "Error: "), strings.HasPrefix(line, "Exception"), strings.HasPrefix(line, "java.lang."):
+			if result.Error == "" {
+				result.Error = strings.TrimPrefix(line, "Error: ")
+			}
+		}
+	}
+}
+
+// startIntent run am command and parse output, error is returned when am reports an error
+func startIntent(req IntentRequest) (result IntentResult, err error) {
+	result.Type = req.Type
+	if result.Type == "" {
+		result.Type = "start-activity"
+	}
+	args, err := req.command()
+	if err != nil {
+		return result, err
+	}
+	result.Command = args
+	timeout, err := time.ParseDuration(req.Timeout)
+	if err != nil || timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+	output, err := Command{
+		Args:       args,
+		Shell:      true,
+		ShellQuote: true,
+		Timeout:    timeout,
+	}.CombinedOutput()
+	parseAmOutput(&result, string(output))
+	if result.Error != "" {
+		return result, errors.New(result.Error)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result, err
+	}
+	if result.Status != "" && result.Status != "ok" {
+		result.Error = "status: " + result.Status
+		return result, errors.New(result.Error)
+	}
+	return result, nil
+}
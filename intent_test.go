@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntentRequestCommand(t *testing.T) {
+	var req IntentRequest
+	err := json.Unmarshal([]byte(`{
+		"action": "android.intent.action.VIEW",
+		"data": "https://example.com/?a=1&b=2",
+		"categories": ["android.intent.category.BROWSABLE"],
+		"component": "com.example/.MainActivity",
+		"flags": ["FLAG_ACTIVITY_NEW_TASK", "activity_clear_top", "0x1"],
+		"stop": true,
+		"extras": {"name": "a,b", "count": 3, "big": 5000000000, "ratio": 0.5, "debug": true, "ids": [1, 2], "tags": ["x", "y,z"], "empty": null}
+	}`), &req)
+	assert.NoError(t, err)
+	args, err := req.command()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"am", "start", "-W", "-S",
+		"-a", "android.intent.action.VIEW",
+		"-d", "https://example.com/?a=1&b=2",
+		"-c", "android.intent.category.BROWSABLE",
+		"-n", "com.example/.MainActivity",
+		"-f", "0x14000001",
+		"--el", "big", "5000000000",
+		"--ei", "count", "3",
+		"--ez", "debug", "true",
+		"--esn", "empty",
+		"--eia", "ids", "1,2",
+		"--es", "name", "a,b",
+		"--ef", "ratio", "0.5",
+		"--esa", "tags", `x,y\,z`,
+	}, args)
+
+	req = IntentRequest{}
+	err = json.Unmarshal([]byte(`{"type": "broadcast", "action": "com.example.PING", "wait": true, "user": "0",
+		"extras": [{"key": "id", "type": "long", "value": 7}, {"key": "on", "type": "bool", "value": "false"}]}`), &req)
+	assert.NoError(t, err)
+	args, err = req.command()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"am", "broadcast", "--user", "0", "-a", "com.example.PING", "--el", "id", "7", "--ez", "on", "false"}, args)
+}
+
+func TestIntentRequestInvalid(t *testing.T) {
+	for _, req := range []IntentRequest{
+		{},
+		{Type: "start", Intent: Intent{Action: "a"}},
+		{User: "0; reboot", Intent: Intent{Action: "a"}},
+		{Intent: Intent{Component: "com.example"}},
+		{Intent: Intent{Action: "a", Flags: []string{"FLAG_UNKNOWN"}}},
+		{Intent: Intent{Action: "a", Extras: IntentExtras{{Key: "n", Type: "int", Value: 1.5}}}},
+		{Intent: Intent{Action: "a", Extras: IntentExtras{{Key: "n", Type: "short", Value: 1}}}},
+		{Intent: Intent{Action: "a", Extras: IntentExtras{{Key: "n", Type: "int-array", Value: "1,2"}}}},
+	} {
+		_, err := req.command()
+		assert.Error(t, err, "%+v", req)
+	}
+}
+
+func TestParseAmOutput(t *testing.T) {
+	var result IntentResult
+	parseAmOutput(&result, `Starting: Intent { cmp=com.example/.MainActivity }
+Status: ok
+LaunchState: COLD
+Activity: com.example/.MainActivity
+ThisTime: 317
+TotalTime: 318
+WaitTime: 331
+Complete
+`)
+	assert.Equal(t, "ok", result.Status)
+	assert.Equal(t, "COLD", result.LaunchState)
+	assert.Equal(t, "com.example/.MainActivity", result.Activity)
+	assert.Equal(t, 317, result.ThisTime)
+	assert.Equal(t, 318, result.TotalTime)
+	assert.Equal(t, 331, result.WaitTime)
+	assert.Empty(t, result.Error)
+
+	result = IntentResult{}
+	parseAmOutput(&result, "Starting: Intent { cmp=com.example/.Nope }\nError type 3\nError: Activity class {com.example/com.example.Nope} does not exist.\n")
+	assert.Equal(t, "Activity class {com.example/com.example.Nope} does not exist.", result.Error)
+
+	result = IntentResult{}
+	parseAmOutput(&result, "Broadcasting: Intent { act=com.example.PING flg=0x400000 }\nBroadcast completed: result=-1, data=\"pong\"\n")
+	if assert.NotNil(t, result.BroadcastResult) {
+		assert.Equal(t, -1, *result.BroadcastResult)
+	}
+	assert.Equal(t, "pong", result.BroadcastData)
+}
+
+func TestStartIntent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atx-am")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "am.log")
+	script := `#!/bin/sh
+for arg in "$@"; do printf '%s\n' "$arg" >> ` + logPath + `; done
+case "$4" in
+*Missing) echo "Error: Activity class {$4} does not exist.";;
+*) printf 'Status: ok\nTotalTime: 120\n';;
+esac
+`
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "am"), []byte(script), 0755))
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	result, err := startIntent(IntentRequest{Intent: Intent{
+		Component: "com.example/.Main",
+		Extras:    IntentExtras{{Key: "msg", Value: "hello world; exit 1"}},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, "start-activity", result.Type)
+	assert.Equal(t, 120, result.TotalTime)
+	data, _ := ioutil.ReadFile(logPath)
+	assert.Equal(t, "start\n-W\n-n\ncom.example/.Main\n--es\nmsg\nhello world; exit 1\n", string(data))
+
+	result, err = startIntent(IntentRequest{Intent: Intent{Component: "com.example/.Missing"}})
+	assert.Error(t, err)
+	assert.Contains(t, result.Error, "does not exist")
+}
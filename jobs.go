@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+)
+
+// jobState is embedded in state of background jobs, eg: app sessions, launch benchmarks, perf samplers
+type jobState struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func newJobState() jobState {
+	randBytes := make([]byte, 8)
+	rand.Read(randBytes)
+	return jobState{
+		ID:        hex.EncodeToString(randBytes),
+		CreatedAt: time.Now(),
+	}
+}
+
+// info never changes after created, so no lock is needed
+func (s jobState) info() jobState {
+	return s
+}
+
+// jobDone is closed once when the job finished
+type jobDone struct {
+	done chan struct{}
+	once sync.Once
+}
+
+func newJobDone() jobDone {
+	return jobDone{done: make(chan struct{})}
+}
+
+// Done is closed when the job finished
+func (d *jobDone) Done() <-chan struct{} {
+	return d.done
+}
+
+func (d *jobDone) finish() {
+	d.once.Do(func() {
+		close(d.done)
+	})
+}
+
+type job interface {
+	info() jobState
+	Done() <-chan struct{}
+}
+
+// jobRegistry keep jobs by id
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs map[string]job
+}
+
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{
+		jobs: make(map[string]job),
+	}
+}
+
+func (r *jobRegistry) Add(j job) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.jobs[j.info().ID] = j
+}
+
+// Get return nil if not found
+func (r *jobRegistry) Get(id string) job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.jobs[id]
+}
+
+func (r *jobRegistry) Remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.jobs, id)
+}
+
+func (r *jobRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.jobs)
+}
+
+// List return jobs sorted by created time
+func (r *jobRegistry) List() []job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	jobs := make([]job, 0, len(r.jobs))
+	for _, j := range r.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].info().CreatedAt.Before(jobs[j].info().CreatedAt)
+	})
+	return jobs
+}
+
+// OldestDone return the oldest finished job, nil if all jobs are running
+func (r *jobRegistry) OldestDone() job {
+	for _, j := range r.List() {
+		select {
+		case <-j.Done():
+			return j
+		default:
+		}
+	}
+	return nil
+}
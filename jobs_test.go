@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testJob struct {
+	jobState
+	jobDone
+}
+
+func TestJobRegistry(t *testing.T) {
+	r := newJobRegistry()
+	var jobs []*testJob
+	for i := 0; i < 3; i++ {
+		j := &testJob{jobState: newJobState(), jobDone: newJobDone()}
+		j.CreatedAt = time.Now().Add(time.Duration(-i) * time.Minute)
+		jobs = append(jobs, j)
+		r.Add(j)
+	}
+	assert.Len(t, jobs[0].ID, 16)
+	assert.NotEqual(t, jobs[0].ID, jobs[1].ID)
+	assert.Equal(t, 3, r.Len())
+	assert.Equal(t, []job{jobs[2], jobs[1], jobs[0]}, r.List())
+	assert.Equal(t, jobs[1], r.Get(jobs[1].ID))
+	assert.Nil(t, r.Get("not-exists"))
+
+	assert.Nil(t, r.OldestDone())
+	jobs[0].finish()
+	jobs[0].finish() // closed only once
+	jobs[1].finish()
+	assert.Equal(t, jobs[1], r.OldestDone())
+	r.Remove(jobs[1].ID)
+	assert.Equal(t, jobs[0], r.OldestDone())
+	assert.Equal(t, 2, r.Len())
+}
@@ -0,0 +1,401 @@
+/*
+Launch benchmark, start the app repeatedly and collect am start -W timings and Displayed time from logcat
+
+	$ curl -X POST -d iterations=10 -d mode=cold $DEVICE_URL/packages/com.example/benchmark
+	$ curl $DEVICE_URL/benchmarks/{id}
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const launchBenchmarkMaxJobs = 10
+
+var (
+	// Displayed com.example/.MainActivity: +1s234ms (total +2s5ms)
+	displayedRe    = regexp.MustCompile(`^Displayed (\S+?): \+((?:\d+s)?\d+ms)`)
+	activityNameRe = regexp.MustCompile(`^[\w.$]+$`)
+)
+
+var launchBenchmarks = newLaunchBenchmarkManager()
+
+type LaunchBenchmarkOptions struct {
+	PackageName string        `json:"packageName"`
+	Activity    string        `json:"activity"` // main activity when empty
+	Mode        string        `json:"mode"`     // cold(default), warm or hot
+	Iterations  int           `json:"iterations"`
+	DropCaches  bool          `json:"dropCaches"` // requires root
+	Delay       time.Duration `json:"delay"`      // sleep before each launch
+	Timeout     time.Duration `json:"timeout"`    // of each launch
+}
+
+type LaunchIteration struct {
+	Index       int    `json:"index"`
+	LaunchState string `json:"launchState,omitempty"` // COLD, WARM, HOT, android 10.0+
+	ThisTime    int    `json:"thisTime"`              // milliseconds
+	TotalTime   int    `json:"totalTime"`
+	WaitTime    int    `json:"waitTime"`
+	Displayed   int    `json:"displayed"` // from logcat, 0 when not found
+	Error       string `json:"error,omitempty"`
+}
+
+type LaunchStats struct {
+	Count  int     `json:"count"`
+	Min    int     `json:"min"`
+	Max    int     `json:"max"`
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+	P90    int     `json:"p90"`
+}
+
+type launchBenchmarkState struct {
+	jobState
+	Options    LaunchBenchmarkOptions  `json:"options"`
+	Component  string                  `json:"component"`
+	Status     string                  `json:"status"` // running, success, failure, canceled
+	Error      string                  `json:"error,omitempty"`
+	Warnings   []string                `json:"warnings,omitempty"`
+	Iterations []LaunchIteration       `json:"iterations"`
+	Stats      map[string]*LaunchStats `json:"stats"` // thisTime, totalTime, waitTime, displayed
+	FinishedAt *time.Time              `json:"finishedAt,omitempty"`
+}
+
+type LaunchBenchmark struct {
+	launchBenchmarkState
+	jobDone
+	mu            sync.Mutex
+	cancel        context.CancelFunc
+	displayedWait time.Duration // wait Displayed line after am start returned
+}
+
+func newLaunchBenchmark(opts LaunchBenchmarkOptions, component string) *LaunchBenchmark {
+	return &LaunchBenchmark{
+		launchBenchmarkState: launchBenchmarkState{
+			jobState:   newJobState(),
+			Options:    opts,
+			Component:  component,
+			Status:     "running",
+			Iterations: []LaunchIteration{},
+			Stats:      map[string]*LaunchStats{},
+		},
+		jobDone:       newJobDone(),
+		displayedWait: 3 * time.Second,
+	}
+}
+
+// State return a copy of benchmark state
+func (b *LaunchBenchmark) State() launchBenchmarkState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := b.launchBenchmarkState
+	state.Iterations = append([]LaunchIteration{}, b.Iterations...)
+	state.Warnings = append([]string(nil), b.Warnings...)
+	return state
+}
+
+func (b *LaunchBenchmark) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.State())
+}
+
+func (b *LaunchBenchmark) Cancel() {
+	b.cancel()
+}
+
+func (b *LaunchBenchmark) warn(message string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, w := range b.Warnings {
+		if w == message {
+			return
+		}
+	}
+	b.Warnings = append(b.Warnings, message)
+}
+
+// parseDisplayedDuration convert +1s234ms, +345ms to milliseconds
+func parseDisplayedDuration(value string) int {
+	d, err := time.ParseDuration(strings.TrimPrefix(value, "+"))
+	if err != nil {
+		return 0
+	}
+	return int(d / time.Millisecond)
+}
+
+// launchStats calculate stats of values, zero values are ignored
+func launchStats(values []int) *LaunchStats {
+	sorted := []int{}
+	for _, v := range values {
+		if v > 0 {
+			sorted = append(sorted, v)
+		}
+	}
+	if len(sorted) == 0 {
+		return nil
+	}
+	sort.Ints(sorted)
+	n := len(sorted)
+	sum := 0
+	for _, v := range sorted {
+		sum += v
+	}
+	stats := &LaunchStats{
+		Count: n,
+		Min:   sorted[0],
+		Max:   sorted[n-1],
+		Mean:  math.Round(float64(sum)/float64(n)*10) / 10,
+		P90:   sorted[int(math.Ceil(0.9*float64(n)))-1], // nearest rank
+	}
+	if n%2 == 1 {
+		stats.Median = float64(sorted[n/2])
+	} else {
+		stats.Median = float64(sorted[n/2-1]+sorted[n/2]) / 2
+	}
+	return stats
+}
+
+func calculateLaunchStats(iterations []LaunchIteration) map[string]*LaunchStats {
+	fields := map[string][]int{}
+	for _, it := range iterations {
+		if it.Error != "" {
+			continue
+		}
+		fields["thisTime"] = append(fields["thisTime"], it.ThisTime)
+		fields["totalTime"] = append(fields["totalTime"], it.TotalTime)
+		fields["waitTime"] = append(fields["waitTime"], it.WaitTime)
+		fields["displayed"] = append(fields["displayed"], it.Displayed)
+	}
+	stats := make(map[string]*LaunchStats)
+	for name, values := range fields {
+		if s := launchStats(values); s != nil {
+			stats[name] = s
+		}
+	}
+	return stats
+}
+
+// launchComponent return package/activity, main activity is used when activity is empty
+func launchComponent(packageName, activity string) (string, error) {
+	if activity == "" {
+		var err error
+		if activity, err = mainActivityOf(packageName); err != nil {
+			return "", err
+		}
+	}
+	// MainActivity convert to .MainActivity, see POST /session/{pkgname}
+	if !strings.Contains(activity, ".") {
+		activity = "." + activity
+	}
+	return packageName + "/" + activity, nil
+}
+
+// watchDisplayed send Displayed time of the package from logcat to ch
+func watchDisplayed(ctx context.Context, packageName string, ch chan<- int) {
+	runLogcat(ctx, []string{"-T", "1", "-s", "ActivityManager:I", "ActivityTaskManager:I"}, func(entry LogcatEntry) {
+		matches := displayedRe.FindStringSubmatch(entry.Message)
+		if matches == nil || !strings.HasPrefix(matches[1], packageName+"/") {
+			return
+		}
+		select {
+		case ch <- parseDisplayedDuration(matches[2]):
+		default:
+		}
+	})
+}
+
+// prepare stop app in cold mode, or return to home in warm and hot mode
+func (b *LaunchBenchmark) prepare(ctx context.Context) {
+	opts := b.Options
+	if opts.Mode != "cold" {
+		runShell("input", "keyevent", "KEYCODE_HOME")
+	} else {
+		runShell("am", "force-stop", opts.PackageName)
+		if opts.DropCaches {
+			output, err := runShell("sync; echo 3 > /proc/sys/vm/drop_caches")
+			if err != nil || len(strings.TrimSpace(string(output))) > 0 {
+				b.warn("drop caches failed, root is required: " + strings.TrimSpace(string(output)))
+			}
+		}
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(opts.Delay):
+	}
+}
+
+func (b *LaunchBenchmark) launch(index int, displayed chan int) LaunchIteration {
+	it := LaunchIteration{Index: index}
+	for len(displayed) > 0 {
+		<-displayed // from previous launch
+	}
+	intent := Intent{Component: b.Component}
+	if b.Options.Mode == "warm" {
+		// activities are destroyed and created again, the process is kept
+		intent.Flags = []string{"FLAG_ACTIVITY_NEW_TASK", "FLAG_ACTIVITY_CLEAR_TASK"}
+	}
+	result, err := startIntent(IntentRequest{
+		Intent:  intent,
+		Timeout: b.Options.Timeout.String(),
+	})
+	it.LaunchState = result.LaunchState
+	it.ThisTime = result.ThisTime
+	it.TotalTime = result.TotalTime
+	it.WaitTime = result.WaitTime
+	if err != nil {
+		it.Error = err.Error()
+		return it
+	}
+	select {
+	case it.Displayed = <-displayed:
+	case <-time.After(b.displayedWait):
+	}
+	return it
+}
+
+func (b *LaunchBenchmark) run(ctx context.Context) {
+	defer b.finish()
+	displayed := make(chan int, 10)
+	logcatCtx, stopLogcat := context.WithCancel(ctx)
+	defer stopLogcat()
+	go watchDisplayed(logcatCtx, b.Options.PackageName, displayed)
+
+	var err error
+	if b.Options.Mode != "cold" {
+		// make sure process exists
+		if _, err = startIntent(IntentRequest{Intent: Intent{Component: b.Component}, Timeout: b.Options.Timeout.String()}); err != nil {
+			err = errors.Wrap(err, "warm up")
+		}
+	}
+	for i := 0; err == nil && i < b.Options.Iterations; i++ {
+		b.prepare(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+		it := b.launch(i, displayed)
+		b.mu.Lock()
+		b.Iterations = append(b.Iterations, it)
+		b.Stats = calculateLaunchStats(b.Iterations)
+		b.mu.Unlock()
+	}
+
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.FinishedAt = &now
+	switch {
+	case ctx.Err() != nil:
+		b.Status = "canceled"
+	case err != nil:
+		b.Status, b.Error = "failure", err.Error()
+	case len(b.Stats) == 0:
+		b.Status, b.Error = "failure", "all launches failed"
+	default:
+		b.Status = "success"
+	}
+}
+
+// launchBenchmarkOptionsFromRequest parse iterations, mode, activity, dropCaches, delay and timeout
+func launchBenchmarkOptionsFromRequest(packageName string, form func(string) string) (opts LaunchBenchmarkOptions, err error) {
+	opts = LaunchBenchmarkOptions{
+		PackageName: packageName,
+		Activity:    form("activity"),
+		Mode:        form("mode"),
+		Iterations:  10,
+		Delay:       time.Second,
+		Timeout:     60 * time.Second,
+	}
+	switch opts.Mode {
+	case "":
+		opts.Mode = "cold"
+	case "cold", "warm", "hot":
+	default:
+		return opts, errors.New("mode should be cold, warm or hot")
+	}
+	if v := form("iterations"); v != "" {
+		if opts.Iterations, err = strconv.Atoi(v); err != nil || opts.Iterations < 1 || opts.Iterations > 100 {
+			return opts, errors.New("iterations should be between 1 and 100")
+		}
+	}
+	if v := form("dropCaches"); v != "" {
+		if opts.DropCaches, err = strconv.ParseBool(v); err != nil {
+			return opts, errors.New("invalid dropCaches: " + v)
+		}
+	}
+	for name, d := range map[string]*time.Duration{"delay": &opts.Delay, "timeout": &opts.Timeout} {
+		if v := form(name); v != "" {
+			if *d, err = time.ParseDuration(v); err != nil || *d < 0 {
+				return opts, errors.New("invalid " + name + ": " + v)
+			}
+		}
+	}
+	if opts.Activity != "" && !activityNameRe.MatchString(opts.Activity) {
+		return opts, errors.New("invalid activity: " + strconv.Quote(opts.Activity))
+	}
+	return opts, nil
+}
+
+type launchBenchmarkManager struct {
+	mu         sync.Mutex // serialize Start
+	benchmarks *jobRegistry
+}
+
+func newLaunchBenchmarkManager() *launchBenchmarkManager {
+	return &launchBenchmarkManager{
+		benchmarks: newJobRegistry(),
+	}
+}
+
+// Start benchmark in background, only one benchmark can run at the same time
+func (m *launchBenchmarkManager) Start(opts LaunchBenchmarkOptions) (*LaunchBenchmark, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, b := range m.List() {
+		if b.State().Status == "running" {
+			return nil, errors.New("benchmark " + b.ID + " is running")
+		}
+	}
+	if !packageInstalled(opts.PackageName) {
+		return nil, ErrPackageNotInstalled
+	}
+	component, err := launchComponent(opts.PackageName, opts.Activity)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.benchmarks.Len() >= launchBenchmarkMaxJobs {
+		if oldest := m.benchmarks.OldestDone(); oldest != nil {
+			m.benchmarks.Remove(oldest.info().ID)
+		}
+	}
+	b := newLaunchBenchmark(opts, component)
+	var ctx context.Context
+	ctx, b.cancel = context.WithCancel(context.Background())
+	m.benchmarks.Add(b)
+	go b.run(ctx)
+	return b, nil
+}
+
+// Get return nil if not found
+func (m *launchBenchmarkManager) Get(id string) *LaunchBenchmark {
+	b, _ := m.benchmarks.Get(id).(*LaunchBenchmark)
+	return b
+}
+
+func (m *launchBenchmarkManager) List() []*LaunchBenchmark {
+	jobs := m.benchmarks.List()
+	benchmarks := make([]*LaunchBenchmark, 0, len(jobs))
+	for _, j := range jobs {
+		benchmarks = append(benchmarks, j.(*LaunchBenchmark))
+	}
+	return benchmarks
+}
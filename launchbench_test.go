@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLaunchStats(t *testing.T) {
+	stats := launchStats([]int{300, 100, 0, 200, 400})
+	assert.Equal(t, &LaunchStats{Count: 4, Min: 100, Max: 400, Mean: 250, Median: 250, P90: 400}, stats)
+
+	stats = launchStats([]int{5, 1, 3, 2, 4, 6, 7, 8, 9, 10})
+	assert.Equal(t, 5.5, stats.Median)
+	assert.Equal(t, 9, stats.P90)
+
+	assert.Equal(t, 3.0, launchStats([]int{3}).Median)
+	assert.Nil(t, launchStats([]int{0, 0}))
+}
+
+func TestParseDisplayed(t *testing.T) {
+	matches := displayedRe.FindStringSubmatch("Displayed com.example/.MainActivity: +1s234ms (total +2s5ms)")
+	if assert.NotNil(t, matches) {
+		assert.Equal(t, "com.example/.MainActivity", matches[1])
+		assert.Equal(t, 1234, parseDisplayedDuration(matches[2]))
+	}
+	assert.Equal(t, 345, parseDisplayedDuration("+345ms"))
+	assert.Equal(t, 0, parseDisplayedDuration("+abc"))
+}
+
+func TestLaunchBenchmarkOptions(t *testing.T) {
+	form := func(values map[string]string) func(string) string {
+		return func(key string) string { return values[key] }
+	}
+	opts, err := launchBenchmarkOptionsFromRequest("com.example", form(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "cold", opts.Mode)
+	assert.Equal(t, 10, opts.Iterations)
+	assert.Equal(t, time.Second, opts.Delay)
+
+	opts, err = launchBenchmarkOptionsFromRequest("com.example", form(map[string]string{
+		"mode": "warm", "iterations": "3", "dropCaches": "true", "delay": "0s", "activity": ".Splash",
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, LaunchBenchmarkOptions{PackageName: "com.example", Activity: ".Splash", Mode: "warm",
+		Iterations: 3, DropCaches: true, Delay: 0, Timeout: 60 * time.Second}, opts)
+
+	for _, values := range []map[string]string{
+		{"mode": "lukewarm"},
+		{"iterations": "0"},
+		{"iterations": "101"},
+		{"delay": "1"},
+		{"activity": ".Main; reboot"},
+	} {
+		_, err := launchBenchmarkOptionsFromRequest("com.example", form(values))
+		assert.Error(t, err, "%v", values)
+	}
+}
+
+func TestLaunchBenchmarkRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atx-bench")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "am.log")
+	script := `#!/bin/sh
+echo "$@" >> ` + logPath + `
+case "$1" in
+start) n=$(grep -c '^start' ` + logPath + `); printf 'Status: ok\nLaunchState: COLD\nThisTime: %d00\nTotalTime: %d00\nWaitTime: %d10\nComplete\n' $n $n $n;;
+esac
+`
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "am"), []byte(script), 0755))
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	b := newLaunchBenchmark(LaunchBenchmarkOptions{PackageName: "com.example", Mode: "cold", Iterations: 3, Timeout: 10 * time.Second}, "com.example/.Main")
+	b.displayedWait = 10 * time.Millisecond
+	b.run(context.Background())
+
+	state := b.State()
+	assert.Equal(t, "success", state.Status)
+	assert.Len(t, state.Iterations, 3)
+	assert.Equal(t, &LaunchStats{Count: 3, Min: 100, Max: 300, Mean: 200, Median: 200, P90: 300}, state.Stats["totalTime"])
+	assert.Equal(t, 110, state.Stats["waitTime"].Min)
+	assert.Nil(t, state.Stats["displayed"])
+
+	data, _ := ioutil.ReadFile(logPath)
+	assert.Equal(t, []string{
+		"force-stop com.example", "start -W -n com.example/.Main",
+		"force-stop com.example", "start -W -n com.example/.Main",
+		"force-stop com.example", "start -W -n com.example/.Main",
+	}, strings.Split(strings.TrimSpace(string(data)), "\n"))
+
+	// warm start recreate the activity, hot start only bring it to front
+	for mode, start := range map[string]string{
+		"warm": "start -W -n com.example/.Main -f 0x10008000",
+		"hot":  "start -W -n com.example/.Main",
+	} {
+		os.Remove(logPath)
+		b = newLaunchBenchmark(LaunchBenchmarkOptions{PackageName: "com.example", Mode: mode, Iterations: 1, Timeout: 10 * time.Second}, "com.example/.Main")
+		b.displayedWait = 10 * time.Millisecond
+		b.run(context.Background())
+		assert.Equal(t, "success", b.State().Status)
+		data, _ = ioutil.ReadFile(logPath)
+		assert.Equal(t, []string{"start -W -n com.example/.Main", start}, strings.Split(strings.TrimSpace(string(data)), "\n"), mode)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 10-19 08:20:29.123  1234  1250 E AndroidRuntime: FATAL EXCEPTION: main
+var threadtimeRe = regexp.MustCompile(`^(\d\d-\d\d \d\d:\d\d:\d\d\.\d+)\s+(\d+)\s+(\d+)\s+([VDIWEFS])\s+(.*?)\s*: (.*)$`)
+
+// LogcatEntry is a line of logcat -v threadtime
+type LogcatEntry struct {
+	Time    time.Time `json:"time"`
+	Pid     int       `json:"pid"`
+	Tid     int       `json:"tid"`
+	Level   string    `json:"level"` // V, D, I, W, E, F
+	Tag     string    `json:"tag"`
+	Message string    `json:"message"`
+}
+
+// parseLogcatTime threadtime has no year, the year of now is used
+func parseLogcatTime(value string, now time.Time) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02 15:04:05.000", strconv.Itoa(now.Year())+"-"+value, time.Local)
+	if err != nil {
+		return t, err
+	}
+	if t.Sub(now) > 24*time.Hour { // logged in last year
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t, nil
+}
+
+func parseThreadtime(line string, now time.Time) (entry LogcatEntry, ok bool) {
+	matches := threadtimeRe.FindStringSubmatch(strings.TrimRight(line, "\r"))
+	if matches == nil {
+		return entry, false
+	}
+	var err error
+	if entry.Time, err = parseLogcatTime(matches[1], now); err != nil {
+		return entry, false
+	}
+	entry.Pid, _ = strconv.Atoi(matches[2])
+	entry.Tid, _ = strconv.Atoi(matches[3])
+	entry.Level = matches[4]
+	entry.Tag = matches[5]
+	entry.Message = matches[6]
+	return entry, true
+}
+
+// runLogcat call fn with each parsed line of logcat -v threadtime until ctx done or logcat exited
+func runLogcat(ctx context.Context, args []string, fn func(LogcatEntry)) error {
+	return runLogcatLines(ctx, args, func(line string) {
+		if entry, ok := parseThreadtime(line, time.Now()); ok {
+			fn(entry)
+		}
+	})
+}
+
+// runLogcatLines call fn with each raw line of logcat -v threadtime, logcat is killed when ctx done
+func runLogcatLines(ctx context.Context, args []string, fn func(line string)) error {
+	cmd := exec.CommandContext(ctx, "logcat", append([]string{"-v", "threadtime"}, args...)...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fn(scanner.Text())
+	}
+	return cmd.Wait()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseThreadtime(t *testing.T) {
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.Local)
+	entry, ok := parseThreadtime("03-01 11:59:58.123  1234  1250 E AndroidRuntime: FATAL EXCEPTION: main", now)
+	assert.True(t, ok)
+	assert.Equal(t, 1234, entry.Pid)
+	assert.Equal(t, 1250, entry.Tid)
+	assert.Equal(t, "E", entry.Level)
+	assert.Equal(t, "AndroidRuntime", entry.Tag)
+	assert.Equal(t, "FATAL EXCEPTION: main", entry.Message)
+	assert.Equal(t, time.Date(2020, 3, 1, 11, 59, 58, 123000000, time.Local), entry.Time)
+
+	entry, ok = parseThreadtime("03-01 11:59:58.123  1234  1250 I chatty  : uid=1000 expire 3 lines\r", now)
+	assert.True(t, ok)
+	assert.Equal(t, "chatty", entry.Tag)
+	assert.Equal(t, "uid=1000 expire 3 lines", entry.Message)
+
+	// logged in last year
+	entry, ok = parseThreadtime("12-31 23:59:59.000   1   1 W init: time: a: b", time.Date(2021, 1, 1, 0, 0, 1, 0, time.Local))
+	assert.True(t, ok)
+	assert.Equal(t, 2020, entry.Time.Year())
+	assert.Equal(t, "time: a: b", entry.Message)
+
+	_, ok = parseThreadtime("--------- beginning of crash", now)
+	assert.False(t, ok)
+}
@@ -0,0 +1,505 @@
+/*
+Background logcat captures, logcat runs as a cmdctrl service and writes to rotated files.
+Captures are kept in logcatCaptureRoot and resumed after agent restarted.
+
+	$ curl -X POST -d buffer=main,crash -d maxSize=20 $DEVICE_URL/logcat/captures
+	$ curl -o logcat.log "$DEVICE_URL/logcat/captures/{id}/logs?since=2020-03-01T03:00:00Z&until=2020-03-01T03:10:00Z"
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openatx/atx-agent/cmdctrl"
+	"github.com/pkg/errors"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	logcatCaptureMaxRunning     = 5
+	logcatCaptureServicePrefix  = "logcat-capture-"
+	logcatCaptureFilename       = "logcat.log"
+	logcatCaptureStateFilename  = "capture.json"
+	logcatCaptureBackupTimeFmt  = "2006-01-02T15-04-05.000" // same as lumberjack
+	logcatCaptureDefaultMaxSize = 10                        // megabytes
+)
+
+var (
+	logcatCaptureRoot = "/data/local/tmp/atx-logcat"
+	logcatCaptures    = newLogcatCaptureManager(logcatCaptureRoot, service)
+)
+
+type LogcatCaptureOptions struct {
+	Buffers    []string `json:"buffers,omitempty"`
+	Filters    []string `json:"filters,omitempty"`
+	MaxSize    int      `json:"maxSize"`    // megabytes of a file before it gets rotated
+	MaxBackups int      `json:"maxBackups"` // rotated files to keep, 0 means all
+	MaxAge     int      `json:"maxAge"`     // days to keep rotated files, 0 means forever
+	Compress   bool     `json:"compress"`   // gzip rotated files
+}
+
+// logcatCaptureOptionsFromRequest parse buffer, filter, level, maxSize, maxBackups, maxAge and compress
+func logcatCaptureOptionsFromRequest(form func(string) string) (opts LogcatCaptureOptions, err error) {
+	opts = LogcatCaptureOptions{
+		MaxSize:    logcatCaptureDefaultMaxSize,
+		MaxBackups: 10,
+		MaxAge:     7,
+		Compress:   true,
+	}
+	logcatOpts, err := logcatOptionsFromRequest(func(name string) string {
+		if stringInSlice(name, []string{"buffer", "filter", "level"}) {
+			return form(name)
+		}
+		return ""
+	}, time.Now())
+	if err != nil {
+		return opts, err
+	}
+	opts.Buffers, opts.Filters = logcatOpts.Buffers, logcatOpts.Filters
+	limits := []struct {
+		name     string
+		value    *int
+		min, max int
+	}{
+		{"maxSize", &opts.MaxSize, 1, 1024},
+		{"maxBackups", &opts.MaxBackups, 0, 1000},
+		{"maxAge", &opts.MaxAge, 0, 365},
+	}
+	for _, limit := range limits {
+		if v := form(limit.name); v != "" {
+			if *limit.value, err = strconv.Atoi(v); err != nil || *limit.value < limit.min || *limit.value > limit.max {
+				return opts, errors.Errorf("%s should be between %d and %d", limit.name, limit.min, limit.max)
+			}
+		}
+	}
+	if v := form("compress"); v != "" {
+		if opts.Compress, err = strconv.ParseBool(v); err != nil {
+			return opts, errors.New("invalid compress: " + v)
+		}
+	}
+	return opts, nil
+}
+
+type LogcatCaptureFile struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	Compressed bool      `json:"compressed"`
+	StartTime  time.Time `json:"startTime"` // time of the first line
+	EndTime    time.Time `json:"endTime"`   // rotated time, or modified time of the current file
+}
+
+type logcatCaptureState struct {
+	ID        string               `json:"id"`
+	Options   LogcatCaptureOptions `json:"options"`
+	Status    string               `json:"status"` // running, stopped, failed(logcat keeps quiting)
+	CreatedAt time.Time            `json:"createdAt"`
+	StoppedAt *time.Time           `json:"stoppedAt,omitempty"`
+	LastWrite time.Time            `json:"lastWrite"` // logcat is resumed from here after restarted
+}
+
+type LogcatCapture struct {
+	logcatCaptureState
+	mu      sync.Mutex
+	dir     string
+	writer  *lumberjack.Logger
+	pending []byte // incomplete line, lines are not split into different files
+	logcat  string
+}
+
+func (c *LogcatCapture) State() logcatCaptureState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.logcatCaptureState
+}
+
+func (c *LogcatCapture) MarshalJSON() ([]byte, error) {
+	files, _ := c.Files()
+	return json.Marshal(struct {
+		logcatCaptureState
+		Files []LogcatCaptureFile `json:"files"`
+	}{c.State(), files})
+}
+
+func (c *LogcatCapture) serviceName() string {
+	return logcatCaptureServicePrefix + c.ID
+}
+
+// args of logcat, lines before the last write are skipped after relaunched
+func (c *LogcatCapture) args() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	since := c.LastWrite
+	if since.IsZero() {
+		since = c.CreatedAt
+	}
+	opts := logcatOptions{Buffers: c.Options.Buffers, Filters: c.Options.Filters, Since: since}
+	return append([]string{c.logcat, "-v", "threadtime"}, opts.args(true)...)
+}
+
+// Write only complete lines to the rotated file
+func (c *LogcatCapture) Write(data []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.LastWrite = time.Now()
+	c.pending = append(c.pending, data...)
+	idx := bytes.LastIndexByte(c.pending, '\n')
+	if idx < 0 {
+		return len(data), nil
+	}
+	if _, err := c.writer.Write(c.pending[:idx+1]); err != nil {
+		return 0, err
+	}
+	c.pending = append([]byte{}, c.pending[idx+1:]...)
+	return len(data), nil
+}
+
+// onStop is called when the service is stopped or logcat exceeded max retries
+func (c *LogcatCapture) onStop() {
+	c.mu.Lock()
+	if c.Status == "running" {
+		c.Status = "failed"
+	}
+	if c.StoppedAt == nil {
+		now := time.Now()
+		c.StoppedAt = &now
+	}
+	if len(c.pending) > 0 {
+		c.writer.Write(append(c.pending, '\n'))
+		c.pending = nil
+	}
+	c.writer.Close()
+	c.mu.Unlock()
+	if err := c.save(); err != nil {
+		log.Printf("save logcat capture %s error: %v", c.ID, err)
+	}
+}
+
+// save state to a temporary file first, so it is never truncated
+func (c *LogcatCapture) save() error {
+	data, err := json.Marshal(c.State())
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(c.dir, logcatCaptureStateFilename)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// backupTime parse rotated time from names like logcat-2020-03-01T03-00-00.000.log.gz
+func backupTime(name string) (t time.Time, ok bool) {
+	ext := filepath.Ext(logcatCaptureFilename)
+	prefix := strings.TrimSuffix(logcatCaptureFilename, ext) + "-"
+	value := strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ext)
+	if !strings.HasPrefix(value, prefix) || value == name {
+		return t, false
+	}
+	t, err := time.Parse(logcatCaptureBackupTimeFmt, strings.TrimPrefix(value, prefix))
+	return t, err == nil
+}
+
+func openLogFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil || !strings.HasSuffix(path, ".gz") {
+		return f, err
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, f}, nil
+}
+
+// scanLogFile call fn with each line until fn return false
+func scanLogFile(path string, fn func(line string) bool) error {
+	rd, err := openLogFile(path)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if !fn(scanner.Text()) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+func (c *LogcatCapture) FilePath(name string) string {
+	return filepath.Join(c.dir, name)
+}
+
+// Files return log files ordered by time, the current file is the last one
+func (c *LogcatCapture) Files() ([]LogcatCaptureFile, error) {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []LogcatCaptureFile{}
+	var current *LogcatCaptureFile
+	for _, info := range infos {
+		file := LogcatCaptureFile{
+			Name:       info.Name(),
+			Size:       info.Size(),
+			Compressed: strings.HasSuffix(info.Name(), ".gz"),
+		}
+		if info.Name() == logcatCaptureFilename {
+			file.EndTime = info.ModTime()
+			current = &file
+		} else if t, ok := backupTime(info.Name()); ok {
+			file.EndTime = t
+			files = append(files, file)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].EndTime.Before(files[j].EndTime)
+	})
+	if current != nil {
+		files = append(files, *current)
+	}
+	for i := range files {
+		if i > 0 {
+			files[i].StartTime = files[i-1].EndTime
+			continue
+		}
+		// older files might be removed, read from the first line
+		now := time.Now()
+		scanLogFile(filepath.Join(c.dir, files[i].Name), func(line string) bool {
+			if entry, ok := parseThreadtime(line, now); ok {
+				files[i].StartTime = entry.Time
+				return false
+			}
+			return true
+		})
+	}
+	return files, nil
+}
+
+// ReadRange write lines logged between since and until, zero time means no limit.
+// Lines can not be parsed (like stack traces of the events buffer) follow the previous line.
+func (c *LogcatCapture) ReadRange(w io.Writer, since, until time.Time) error {
+	files, err := c.Files()
+	if err != nil {
+		return err
+	}
+	bufw := bufio.NewWriter(w)
+	now := time.Now()
+	for _, file := range files {
+		if !since.IsZero() && file.EndTime.Before(since) {
+			continue
+		}
+		if !until.IsZero() && file.StartTime.After(until) {
+			break
+		}
+		include := false
+		var writeErr error
+		err := scanLogFile(filepath.Join(c.dir, file.Name), func(line string) bool {
+			if entry, ok := parseThreadtime(line, now); ok {
+				include = (since.IsZero() || !entry.Time.Before(since)) && (until.IsZero() || !entry.Time.After(until))
+			}
+			if include {
+				_, writeErr = bufw.WriteString(line + "\n")
+			}
+			return writeErr == nil
+		})
+		if writeErr != nil {
+			return writeErr
+		}
+		if err != nil {
+			return errors.Wrap(err, file.Name)
+		}
+	}
+	return bufw.Flush()
+}
+
+type logcatCaptureManager struct {
+	mu       sync.Mutex
+	root     string
+	service  *cmdctrl.CommandCtrl
+	captures map[string]*LogcatCapture
+	logcat   string
+}
+
+func newLogcatCaptureManager(root string, service *cmdctrl.CommandCtrl) *logcatCaptureManager {
+	return &logcatCaptureManager{
+		root:     root,
+		service:  service,
+		captures: make(map[string]*LogcatCapture),
+		logcat:   "logcat",
+	}
+}
+
+func (m *logcatCaptureManager) newCapture(state logcatCaptureState) *LogcatCapture {
+	return &LogcatCapture{
+		logcatCaptureState: state,
+		dir:                filepath.Join(m.root, state.ID),
+		logcat:             m.logcat,
+	}
+}
+
+// run register the capture as a service and start it
+func (m *logcatCaptureManager) run(c *LogcatCapture) error {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	c.writer = &lumberjack.Logger{
+		Filename:   filepath.Join(c.dir, logcatCaptureFilename),
+		MaxSize:    c.Options.MaxSize,
+		MaxBackups: c.Options.MaxBackups,
+		MaxAge:     c.Options.MaxAge,
+		Compress:   c.Options.Compress,
+	}
+	c.Status, c.StoppedAt = "running", nil
+	err := m.service.Add(c.serviceName(), cmdctrl.CommandInfo{
+		ArgsFunc: func() ([]string, error) {
+			return c.args(), nil
+		},
+		Stdout:          c,
+		MaxRetries:      10,
+		NextLaunchWait:  time.Second,
+		RecoverDuration: 30 * time.Second,
+		OnStop:          c.onStop,
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.save(); err != nil {
+		m.service.Remove(c.serviceName())
+		return err
+	}
+	if err := m.service.Start(c.serviceName()); err != nil {
+		m.service.Remove(c.serviceName())
+		return err
+	}
+	return nil
+}
+
+func (m *logcatCaptureManager) runningCount() int {
+	count := 0
+	for _, c := range m.captures {
+		if c.State().Status == "running" {
+			count++
+		}
+	}
+	return count
+}
+
+func (m *logcatCaptureManager) Start(opts LogcatCaptureOptions) (*LogcatCapture, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.runningCount() >= logcatCaptureMaxRunning {
+		return nil, errors.Errorf("too many running captures, max %d", logcatCaptureMaxRunning)
+	}
+	randBytes := make([]byte, 8)
+	rand.Read(randBytes)
+	c := m.newCapture(logcatCaptureState{
+		ID:        hex.EncodeToString(randBytes),
+		Options:   opts,
+		CreatedAt: time.Now(),
+	})
+	if err := m.run(c); err != nil {
+		return nil, errors.Wrap(err, "start logcat capture")
+	}
+	m.captures[c.ID] = c
+	return c, nil
+}
+
+// Restore load captures from root, captures running when agent quited are resumed
+func (m *logcatCaptureManager) Restore() error {
+	paths, err := filepath.Glob(filepath.Join(m.root, "*", logcatCaptureStateFilename))
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("skip logcat capture %s: %v", path, err)
+			continue
+		}
+		var state logcatCaptureState
+		if err := json.Unmarshal(data, &state); err != nil || state.ID == "" || m.captures[state.ID] != nil {
+			log.Printf("skip logcat capture %s: %v", path, err)
+			continue
+		}
+		c := m.newCapture(state)
+		if state.Status == "running" {
+			// state is not saved on every write
+			if info, err := os.Stat(filepath.Join(c.dir, logcatCaptureFilename)); err == nil && info.ModTime().After(c.LastWrite) {
+				c.LastWrite = info.ModTime()
+			}
+			// keep the failed capture, so the files can still be downloaded or removed
+			if err := m.run(c); err != nil {
+				log.Printf("resume logcat capture %s error: %v", state.ID, err)
+				now := time.Now()
+				c.Status, c.StoppedAt = "failed", &now
+				if err := c.save(); err != nil {
+					log.Printf("save logcat capture %s error: %v", c.ID, err)
+				}
+			}
+		}
+		m.captures[c.ID] = c
+	}
+	return nil
+}
+
+// Get return nil if not found
+func (m *logcatCaptureManager) Get(id string) *LogcatCapture {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.captures[id]
+}
+
+func (m *logcatCaptureManager) List() []*LogcatCapture {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	captures := make([]*LogcatCapture, 0, len(m.captures))
+	for _, c := range m.captures {
+		captures = append(captures, c)
+	}
+	sort.Slice(captures, func(i, j int) bool {
+		return captures[i].CreatedAt.Before(captures[j].CreatedAt)
+	})
+	return captures
+}
+
+// Stop logcat and wait until the files are closed, files are kept
+func (m *logcatCaptureManager) Stop(c *LogcatCapture) {
+	c.mu.Lock()
+	if c.Status == "running" {
+		c.Status = "stopped"
+	}
+	c.mu.Unlock()
+	m.service.Remove(c.serviceName()) // onStop is called if still running
+}
+
+// Remove stop the capture and delete its files
+func (m *logcatCaptureManager) Remove(c *LogcatCapture) error {
+	m.Stop(c)
+	m.mu.Lock()
+	delete(m.captures, c.ID)
+	m.mu.Unlock()
+	return os.RemoveAll(c.dir)
+}
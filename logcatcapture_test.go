@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openatx/atx-agent/cmdctrl"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogcatCaptureOptionsFromRequest(t *testing.T) {
+	opts, err := logcatCaptureOptionsFromRequest(func(string) string { return "" })
+	assert.NoError(t, err)
+	assert.Equal(t, LogcatCaptureOptions{MaxSize: 10, MaxBackups: 10, MaxAge: 7, Compress: true}, opts)
+
+	values := map[string]string{"buffer": "main,crash", "level": "I", "pid": "abc", "maxSize": "20", "maxBackups": "0", "compress": "false"}
+	opts, err = logcatCaptureOptionsFromRequest(func(name string) string { return values[name] })
+	assert.NoError(t, err) // pid is not used
+	assert.Equal(t, LogcatCaptureOptions{Buffers: []string{"main", "crash"}, Filters: []string{"*:I"}, MaxSize: 20, MaxAge: 7}, opts)
+
+	for _, values := range []map[string]string{
+		{"buffer": "unknown"},
+		{"maxSize": "0"},
+		{"maxBackups": "-1"},
+		{"maxAge": "abc"},
+		{"compress": "maybe"},
+	} {
+		_, err := logcatCaptureOptionsFromRequest(func(name string) string { return values[name] })
+		assert.Error(t, err, values)
+	}
+}
+
+func waitUntil(t *testing.T, cond func() bool) {
+	for i := 0; i < 50 && !cond(); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.True(t, cond())
+}
+
+func TestLogcatCaptureManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atx-logcat")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// fake logcat record args, and write a partial line before sleep
+	script := filepath.Join(dir, "logcat")
+	assert.NoError(t, ioutil.WriteFile(script, []byte(`#!/bin/sh
+echo "$@" >> `+dir+`/args
+printf '03-01 12:00:01.000  1234  1250 I MyApp: hello\n03-01 12:00:02.000  1234  1250 W MyApp: par'
+exec sleep 10
+`), 0755))
+
+	root := filepath.Join(dir, "captures")
+	m := newLogcatCaptureManager(root, cmdctrl.New())
+	m.logcat = script
+	c, err := m.Start(LogcatCaptureOptions{Buffers: []string{"crash"}, Filters: []string{"*:W"}, MaxSize: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, "running", c.State().Status)
+	assert.True(t, m.service.Running(c.serviceName()))
+	logPath := filepath.Join(root, c.ID, logcatCaptureFilename)
+	waitUntil(t, func() bool {
+		data, _ := ioutil.ReadFile(logPath)
+		return len(data) > 0
+	})
+	data, _ := ioutil.ReadFile(logPath)
+	assert.Equal(t, "03-01 12:00:01.000  1234  1250 I MyApp: hello\n", string(data))
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+	assert.Contains(t, string(args), "-v threadtime -b crash -T ")
+	assert.Contains(t, string(args), " *:W")
+
+	m.Stop(c)
+	state := c.State()
+	assert.Equal(t, "stopped", state.Status)
+	assert.NotNil(t, state.StoppedAt)
+	assert.False(t, m.service.Exists(c.serviceName()))
+	data, _ = ioutil.ReadFile(logPath)
+	assert.True(t, strings.HasSuffix(string(data), "W MyApp: par\n")) // pending line is flushed
+	assert.Len(t, m.List(), 1)
+
+	// restored after agent restart, running captures are resumed
+	other, err := m.Start(LogcatCaptureOptions{MaxSize: 1})
+	assert.NoError(t, err)
+	m2 := newLogcatCaptureManager(root, cmdctrl.New())
+	m2.logcat = script
+	assert.NoError(t, m2.Restore())
+	if assert.Len(t, m2.List(), 2) {
+		assert.Equal(t, "stopped", m2.Get(c.ID).State().Status)
+		assert.Equal(t, "running", m2.Get(other.ID).State().Status)
+		assert.True(t, m2.service.Running(other.serviceName()))
+	}
+	m.Stop(other)
+
+	assert.NoError(t, m2.Remove(m2.Get(other.ID)))
+	assert.Nil(t, m2.Get(other.ID))
+	_, err = os.Stat(filepath.Join(root, other.ID))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLogcatCaptureRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atx-logcat")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	write := func(id, state string) {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, id), 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, id, logcatCaptureStateFilename), []byte(state), 0644))
+	}
+	write("stopped", `{"id":"stopped","status":"stopped"}`)
+	write("running", `{"id":"running","status":"running","options":{"maxSize":1}}`)
+	write("broken", `{`)
+	// state file can not be read
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "unreadable", logcatCaptureStateFilename), 0755))
+
+	m := newLogcatCaptureManager(dir, cmdctrl.New())
+	// service name conflict, so the running capture can not be resumed
+	assert.NoError(t, m.service.Add(logcatCaptureServicePrefix+"running", cmdctrl.CommandInfo{Args: []string{"true"}}))
+	assert.NoError(t, m.Restore())
+	if assert.Len(t, m.List(), 2) {
+		assert.Equal(t, "stopped", m.Get("stopped").State().Status)
+		state := m.Get("running").State()
+		assert.Equal(t, "failed", state.Status)
+		assert.NotNil(t, state.StoppedAt)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "running", logcatCaptureStateFilename))
+	assert.Contains(t, string(data), `"status":"failed"`)
+}
+
+func TestLogcatCaptureReadRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atx-logcat")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	m := newLogcatCaptureManager(dir, cmdctrl.New())
+	c := m.newCapture(logcatCaptureState{ID: "abcd"})
+	assert.NoError(t, os.MkdirAll(c.dir, 0755))
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	at := func(sec int) time.Time {
+		return base.Add(time.Duration(sec) * time.Second)
+	}
+	line := func(sec int, message string) string {
+		return at(sec).Format("01-02 15:04:05.000") + "  1234  1250 I MyApp: " + message + "\n"
+	}
+
+	// oldest backup is compressed
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(line(1, "one") + line(2, "two")))
+	gz.Close()
+	write := func(name string, data []byte) {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(c.dir, name), data, 0644))
+	}
+	write("logcat-"+at(3).UTC().Format(logcatCaptureBackupTimeFmt)+".log.gz", buf.Bytes())
+	write("logcat-"+at(5).UTC().Format(logcatCaptureBackupTimeFmt)+".log", []byte(line(3, "three")+"--------- beginning of crash\n"+line(4, "four")))
+	write(logcatCaptureFilename, []byte(line(6, "six")))
+	write(logcatCaptureStateFilename, []byte("{}"))
+
+	files, err := c.Files()
+	assert.NoError(t, err)
+	if assert.Len(t, files, 3) {
+		assert.True(t, files[0].Compressed)
+		assert.True(t, files[0].StartTime.Equal(at(1)))
+		assert.True(t, files[0].EndTime.Equal(at(3)))
+		assert.True(t, files[1].StartTime.Equal(at(3)))
+		assert.Equal(t, logcatCaptureFilename, files[2].Name)
+	}
+
+	read := func(since, until time.Time) string {
+		var out bytes.Buffer
+		assert.NoError(t, c.ReadRange(&out, since, until))
+		return out.String()
+	}
+	assert.Equal(t, line(1, "one")+line(2, "two")+line(3, "three")+"--------- beginning of crash\n"+line(4, "four")+line(6, "six"), read(time.Time{}, time.Time{}))
+	assert.Equal(t, line(2, "two")+line(3, "three")+"--------- beginning of crash\n", read(at(2), at(3)))
+	assert.Equal(t, line(6, "six"), read(at(5), time.Time{}))
+	assert.Equal(t, "", read(at(7), time.Time{}))
+}
@@ -0,0 +1,268 @@
+/*
+Logcat streaming with server side filters
+
+	$ curl "$DEVICE_URL/logcat?package=com.example&filter=*:W"
+	ws://$DEVICE_URL/logcat?format=raw&regex=Exception
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const logcatPidRecheckInterval = 5 * time.Second
+
+var (
+	logcatBuffers       = []string{"main", "system", "radio", "events", "crash", "kernel", "security", "default", "all"}
+	logcatFilterSpecRe  = regexp.MustCompile(`^[^\s:]+:[VDIWEFS]$`)
+	logcatTimeArgFormat = "01-02 15:04:05.000" // -T 'MM-DD hh:mm:ss.mmm'
+)
+
+type logcatOptions struct {
+	Buffers     []string
+	Filters     []string // tag:priority, passed to logcat
+	Pid         int
+	PackageName string // follow restarts of the app
+	Regex       *regexp.Regexp
+	Exclude     *regexp.Regexp
+	Since       time.Time
+	Raw         bool
+}
+
+// parseLogcatSince accept RFC3339, unix timestamp in seconds, or duration before now like 5m
+func parseLogcatSince(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	if sec, err := strconv.ParseFloat(value, 64); err == nil && sec > 0 {
+		return time.Unix(0, int64(sec*1e9)), nil
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, errors.New("invalid since: " + value + ", should be RFC3339, unix timestamp or duration")
+}
+
+// logcatOptionsFromRequest parse buffer, filter, level, pid, package, regex, exclude, since and format
+func logcatOptionsFromRequest(form func(string) string, now time.Time) (opts logcatOptions, err error) {
+	opts.Since = now
+	if v := form("buffer"); v != "" {
+		for _, buffer := range strings.Split(v, ",") {
+			buffer = strings.TrimSpace(buffer)
+			if !stringInSlice(buffer, logcatBuffers) {
+				return opts, errors.New("unknown buffer: " + strconv.Quote(buffer) + ", available: " + strings.Join(logcatBuffers, ","))
+			}
+			if !stringInSlice(buffer, opts.Buffers) {
+				opts.Buffers = append(opts.Buffers, buffer)
+			}
+		}
+	}
+	for _, spec := range strings.FieldsFunc(form("filter"), func(r rune) bool { return r == ',' || r == ' ' }) {
+		if !logcatFilterSpecRe.MatchString(spec) {
+			return opts, errors.New("invalid filter spec: " + strconv.Quote(spec) + ", should be tag:priority like ActivityManager:I or *:W")
+		}
+		opts.Filters = append(opts.Filters, spec)
+	}
+	if v := form("level"); v != "" {
+		if !logcatFilterSpecRe.MatchString("*:" + v) {
+			return opts, errors.New("invalid level: " + v + ", should be one of V,D,I,W,E,F,S")
+		}
+		opts.Filters = append(opts.Filters, "*:"+v)
+	}
+	if v := form("pid"); v != "" {
+		if opts.Pid, err = strconv.Atoi(v); err != nil || opts.Pid <= 0 {
+			return opts, errors.New("invalid pid: " + v)
+		}
+	}
+	if v := form("package"); v != "" {
+		if opts.Pid != 0 {
+			return opts, errors.New("pid and package can not be used together")
+		}
+		if !packageNameRe.MatchString(v) {
+			return opts, errors.New("invalid package name: " + strconv.Quote(v))
+		}
+		opts.PackageName = v
+	}
+	for name, re := range map[string]**regexp.Regexp{"regex": &opts.Regex, "exclude": &opts.Exclude} {
+		if v := form(name); v != "" {
+			if *re, err = regexp.Compile(v); err != nil {
+				return opts, errors.Wrap(err, "invalid "+name)
+			}
+		}
+	}
+	if v := form("since"); v != "" {
+		if opts.Since, err = parseLogcatSince(v, now); err != nil {
+			return opts, err
+		}
+	}
+	switch form("format") {
+	case "", "json":
+	case "raw":
+		opts.Raw = true
+	default:
+		return opts, errors.New("invalid format: " + form("format") + ", should be json or raw")
+	}
+	return opts, nil
+}
+
+// args of logcat, without -T when withSince is false
+func (o logcatOptions) args(withSince bool) []string {
+	args := []string{}
+	for _, buffer := range o.Buffers {
+		args = append(args, "-b", buffer)
+	}
+	if withSince {
+		args = append(args, "-T", o.Since.In(time.Local).Format(logcatTimeArgFormat))
+	}
+	return append(args, o.Filters...)
+}
+
+// logcatLine is sent to the client, raw or as json of the entry
+type logcatLine struct {
+	LogcatEntry
+	raw    string
+	parsed bool
+}
+
+func (l logcatLine) Bytes(raw bool) []byte {
+	if raw {
+		return []byte(l.raw)
+	}
+	data, _ := json.Marshal(l.LogcatEntry)
+	return data
+}
+
+// logcatPidMatcher check if a pid belongs to the package, new processes after restart are found by cmdline.
+// Matched pids are kept after the process died, so the last lines of a crash are not lost.
+type logcatPidMatcher struct {
+	packageName string
+	procRoot    string
+	pids        map[int]bool
+	checkedAt   time.Time
+}
+
+func newLogcatPidMatcher(packageName string) *logcatPidMatcher {
+	return &logcatPidMatcher{
+		packageName: packageName,
+		procRoot:    "/proc",
+		pids:        make(map[int]bool),
+		checkedAt:   time.Now(),
+	}
+}
+
+// processName return the first field of /proc/<pid>/cmdline
+func (m *logcatPidMatcher) processName(pid int) (name string, ok bool) {
+	data, err := ioutil.ReadFile(filepath.Join(m.procRoot, strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return "", false
+	}
+	return strings.SplitN(string(data), "\x00", 2)[0], true
+}
+
+func (m *logcatPidMatcher) belongs(name string) bool {
+	return name == m.packageName || strings.HasPrefix(name, m.packageName+":")
+}
+
+func (m *logcatPidMatcher) Match(pid int) bool {
+	if time.Since(m.checkedAt) > logcatPidRecheckInterval {
+		// pids might be reused by other processes
+		for p, matched := range m.pids {
+			if name, ok := m.processName(p); ok {
+				m.pids[p] = m.belongs(name)
+			} else if !matched {
+				delete(m.pids, p)
+			}
+		}
+		m.checkedAt = time.Now()
+	}
+	if matched, ok := m.pids[pid]; ok {
+		return matched
+	}
+	name, ok := m.processName(pid)
+	if !ok {
+		return false // not cached, the pid might be used by the app later
+	}
+	m.pids[pid] = m.belongs(name)
+	return m.pids[pid]
+}
+
+// logcatFilter apply filters which logcat can not do
+type logcatFilter struct {
+	opts logcatOptions
+	pids *logcatPidMatcher
+}
+
+func newLogcatFilter(opts logcatOptions) *logcatFilter {
+	f := &logcatFilter{opts: opts}
+	if opts.PackageName != "" {
+		f.pids = newLogcatPidMatcher(opts.PackageName)
+	}
+	return f
+}
+
+// Match parse the line, lines can not be parsed (like "--------- beginning of main") are only kept
+// in raw format without pid filters
+func (f *logcatFilter) Match(raw string, now time.Time) (line logcatLine, ok bool) {
+	line.raw = strings.TrimRight(raw, "\r")
+	line.LogcatEntry, line.parsed = parseThreadtime(line.raw, now)
+	text := line.raw
+	if line.parsed {
+		if line.Time.Before(f.opts.Since.Truncate(time.Millisecond)) {
+			return line, false
+		}
+		if f.opts.Pid != 0 && line.Pid != f.opts.Pid {
+			return line, false
+		}
+		if f.pids != nil && !f.pids.Match(line.Pid) {
+			return line, false
+		}
+		text = line.Tag + ": " + line.Message
+	} else if !f.opts.Raw || f.opts.Pid != 0 || f.pids != nil {
+		return line, false
+	}
+	if f.opts.Regex != nil && !f.opts.Regex.MatchString(text) {
+		return line, false
+	}
+	if f.opts.Exclude != nil && f.opts.Exclude.MatchString(text) {
+		return line, false
+	}
+	return line, true
+}
+
+// streamLogcat send matched lines until ctx done or logcat exited, logcat is killed when ctx done
+func streamLogcat(ctx context.Context, opts logcatOptions, lines chan<- logcatLine) error {
+	filter := newLogcatFilter(opts)
+	withSince := true
+	for {
+		start := time.Now()
+		received := false
+		err := runLogcatLines(ctx, opts.args(withSince), func(raw string) {
+			received = true
+			line, ok := filter.Match(raw, time.Now())
+			if !ok {
+				return
+			}
+			select {
+			case lines <- line:
+			case <-ctx.Done():
+			}
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil && withSince && !received && time.Since(start) < time.Second {
+			withSince = false // -T not supported, old lines are filtered by time
+			continue
+		}
+		return errors.Wrap(err, "logcat")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogcatOptionsFromRequest(t *testing.T) {
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.Local)
+	form := func(values map[string]string) func(string) string {
+		return func(name string) string { return values[name] }
+	}
+	opts, err := logcatOptionsFromRequest(form(nil), now)
+	assert.NoError(t, err)
+	assert.Equal(t, now, opts.Since)
+	assert.False(t, opts.Raw)
+	assert.Equal(t, []string{"-T", "03-01 12:00:00.000"}, opts.args(true))
+
+	opts, err = logcatOptionsFromRequest(form(map[string]string{
+		"buffer":  "main, crash,main",
+		"filter":  "ActivityManager:I,*:S",
+		"level":   "W",
+		"package": "com.example",
+		"regex":   "Exception",
+		"since":   "5m",
+		"format":  "raw",
+	}), now)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-b", "main", "-b", "crash", "ActivityManager:I", "*:S", "*:W"}, opts.args(false))
+	assert.Equal(t, "com.example", opts.PackageName)
+	assert.Equal(t, now.Add(-5*time.Minute), opts.Since)
+	assert.True(t, opts.Raw)
+
+	opts, err = logcatOptionsFromRequest(form(map[string]string{"since": "2020-03-01T03:00:00Z", "pid": "1234"}), now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1234, opts.Pid)
+	assert.True(t, opts.Since.Equal(time.Date(2020, 3, 1, 3, 0, 0, 0, time.UTC)))
+
+	opts, err = logcatOptionsFromRequest(form(map[string]string{"since": "1583020800.5"}), now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1583020800500), opts.Since.UnixNano()/1e6)
+
+	for _, values := range []map[string]string{
+		{"buffer": "unknown"},
+		{"filter": "ActivityManager"},
+		{"filter": "ActivityManager:X"},
+		{"level": "verbose"},
+		{"pid": "abc"},
+		{"pid": "1", "package": "com.example"},
+		{"package": "com.example;reboot"},
+		{"regex": "("},
+		{"since": "yesterday"},
+		{"format": "xml"},
+	} {
+		_, err := logcatOptionsFromRequest(form(values), now)
+		assert.Error(t, err, values)
+	}
+}
+
+func TestLogcatFilter(t *testing.T) {
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.Local)
+	opts, err := logcatOptionsFromRequest(func(name string) string {
+		return map[string]string{"since": "1m", "regex": "Exception", "exclude": "ignored"}[name]
+	}, now)
+	assert.NoError(t, err)
+	f := newLogcatFilter(opts)
+
+	line, ok := f.Match("03-01 11:59:30.000  1234  1250 E AndroidRuntime: java.lang.RuntimeException\r", now)
+	assert.True(t, ok)
+	assert.Equal(t, "03-01 11:59:30.000  1234  1250 E AndroidRuntime: java.lang.RuntimeException", string(line.Bytes(true)))
+	assert.Contains(t, string(line.Bytes(false)), `"tag":"AndroidRuntime","message":"java.lang.RuntimeException"`)
+
+	_, ok = f.Match("03-01 11:58:30.000  1234  1250 E AndroidRuntime: java.lang.RuntimeException", now) // before since
+	assert.False(t, ok)
+	_, ok = f.Match("03-01 11:59:30.000  1234  1250 I MyApp: start", now) // regex
+	assert.False(t, ok)
+	_, ok = f.Match("03-01 11:59:30.000  1234  1250 W MyApp: Exception ignored", now) // exclude
+	assert.False(t, ok)
+	_, ok = f.Match("--------- beginning of crash Exception", now) // only in raw format
+	assert.False(t, ok)
+	f.opts.Raw = true
+	_, ok = f.Match("--------- beginning of crash Exception", now)
+	assert.True(t, ok)
+
+	f.opts.Pid = 1000
+	_, ok = f.Match("03-01 11:59:30.000  1234  1250 E AndroidRuntime: Exception", now)
+	assert.False(t, ok)
+	_, ok = f.Match("--------- beginning of crash Exception", now)
+	assert.False(t, ok)
+}
+
+func TestLogcatPidMatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atx-logcat")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	proc := fakeProcRoot(dir)
+	proc.write(t, "100/cmdline", "com.example\x00")
+	proc.write(t, "101/cmdline", "com.example:remote\x00")
+	proc.write(t, "102/cmdline", "com.example.other\x00")
+
+	m := newLogcatPidMatcher("com.example")
+	m.procRoot = dir
+	assert.True(t, m.Match(100))
+	assert.True(t, m.Match(101))
+	assert.False(t, m.Match(102))
+	assert.False(t, m.Match(103))
+
+	// app restarted with a new pid, the old process is gone
+	assert.NoError(t, os.RemoveAll(dir+"/100"))
+	proc.write(t, "103/cmdline", "com.example\x00")
+	assert.True(t, m.Match(103))
+	assert.True(t, m.Match(100)) // lines of the dead process are still kept
+
+	// pid reused by another app
+	proc.write(t, "101/cmdline", "com.other\x00")
+	proc.write(t, "102/cmdline", "com.example\x00")
+	assert.True(t, m.Match(101)) // cached until recheck
+	m.checkedAt = time.Now().Add(-logcatPidRecheckInterval - time.Second)
+	assert.True(t, m.Match(100))
+	assert.False(t, m.Match(101))
+	assert.True(t, m.Match(102))
+}
@@ -0,0 +1,394 @@
+/*
+Prometheus metrics of the agent and the device, in text exposition format
+
+	$ curl $DEVICE_URL/metrics
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/openatx/atx-agent/cmdctrl"
+	"github.com/pkg/errors"
+)
+
+const (
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+	userHZ             = 100 // jiffies per second of /proc/stat
+)
+
+// memory fields of /proc/meminfo exported as atx_device_memory_bytes
+var metricsMemoryFields = []string{"MemTotal", "MemFree", "MemAvailable", "Buffers", "Cached", "SwapTotal", "SwapFree"}
+
+var agentMetrics = newMetricsCollector()
+
+// promWriter write samples in prometheus text format, samples of a metric must be written right after its header
+type promWriter struct {
+	buf bytes.Buffer
+}
+
+func (p *promWriter) header(name, typ, help string) {
+	fmt.Fprintf(&p.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample labels are key, value pairs
+func (p *promWriter) sample(name string, value float64, labels ...string) {
+	p.buf.WriteString(name)
+	if len(labels) > 0 {
+		p.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				p.buf.WriteByte(',')
+			}
+			p.buf.WriteString(labels[i] + `="` + escapeLabelValue(labels[i+1]) + `"`)
+		}
+		p.buf.WriteByte('}')
+	}
+	p.buf.WriteString(" " + formatMetricValue(value) + "\n")
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+type httpRequestKey struct {
+	method string
+	route  string
+	code   int
+}
+
+type httpRequestStat struct {
+	count   uint64
+	seconds float64
+}
+
+// metricsCollector keep counters of the agent, gauges are read when scraped
+type metricsCollector struct {
+	downloadBytes int64 // atomic, keep it first for 64-bit alignment on arm
+	startTime     time.Time
+
+	mu         sync.Mutex
+	requests   map[httpRequestKey]*httpRequestStat
+	websockets map[string]int // open websocket connections by route
+}
+
+func newMetricsCollector() *metricsCollector {
+	return &metricsCollector{
+		startTime:  time.Now(),
+		requests:   make(map[httpRequestKey]*httpRequestStat),
+		websockets: make(map[string]int),
+	}
+}
+
+func (m *metricsCollector) AddDownloadBytes(n int64) {
+	atomic.AddInt64(&m.downloadBytes, n)
+}
+
+func (m *metricsCollector) observeRequest(method, route string, code int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := httpRequestKey{method, route, code}
+	stat := m.requests[key]
+	if stat == nil {
+		stat = &httpRequestStat{}
+		m.requests[key] = stat
+	}
+	stat.count++
+	stat.seconds += duration.Seconds()
+}
+
+func (m *metricsCollector) websocketChanged(route string, delta int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.websockets[route] += delta
+}
+
+// statusRecorder keep the response code, http.Hijacker and http.Flusher are still supported
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("webserver don't support hijacking")
+	}
+	if r.code == 0 {
+		r.code = http.StatusSwitchingProtocols
+	}
+	return hj.Hijack()
+}
+
+func (r *statusRecorder) Code() int {
+	if r.code == 0 {
+		return http.StatusOK
+	}
+	return r.code
+}
+
+// Middleware count requests by route template, so that path variables do not create new series
+func (m *metricsCollector) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if cur := mux.CurrentRoute(r); cur != nil {
+			if tpl, err := cur.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		if websocket.IsWebSocketUpgrade(r) {
+			m.websocketChanged(route, 1)
+			defer m.websocketChanged(route, -1)
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		m.observeRequest(r.Method, route, rec.Code(), time.Since(start))
+	})
+}
+
+func (m *metricsCollector) writeAgentMetrics(p *promWriter) {
+	p.header("atx_agent_info", "gauge", "Version of atx-agent.")
+	p.sample("atx_agent_info", 1, "version", version)
+	p.header("atx_agent_start_time_seconds", "gauge", "Start time of atx-agent since unix epoch in seconds.")
+	p.sample("atx_agent_start_time_seconds", float64(m.startTime.UnixNano())/1e9)
+	p.header("atx_agent_goroutines", "gauge", "Number of goroutines.")
+	p.sample("atx_agent_goroutines", float64(runtime.NumGoroutine()))
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	p.header("atx_agent_memory_alloc_bytes", "gauge", "Bytes of allocated heap objects.")
+	p.sample("atx_agent_memory_alloc_bytes", float64(memStats.Alloc))
+	p.header("atx_agent_memory_sys_bytes", "gauge", "Bytes of memory obtained from the OS.")
+	p.sample("atx_agent_memory_sys_bytes", float64(memStats.Sys))
+
+	m.mu.Lock()
+	keys := make([]httpRequestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	p.header("atx_http_requests_total", "counter", "Number of HTTP requests by route, method and status code.")
+	for _, key := range keys {
+		p.sample("atx_http_requests_total", float64(m.requests[key].count),
+			"route", key.route, "method", key.method, "code", strconv.Itoa(key.code))
+	}
+	p.header("atx_http_request_duration_seconds", "summary", "Time spent serving HTTP requests.")
+	for i := 0; i < len(keys); {
+		key := keys[i]
+		stat := httpRequestStat{}
+		for ; i < len(keys) && keys[i].route == key.route && keys[i].method == key.method; i++ {
+			stat.count += m.requests[keys[i]].count
+			stat.seconds += m.requests[keys[i]].seconds
+		}
+		p.sample("atx_http_request_duration_seconds_sum", stat.seconds, "route", key.route, "method", key.method)
+		p.sample("atx_http_request_duration_seconds_count", float64(stat.count), "route", key.route, "method", key.method)
+	}
+	routes := make([]string, 0, len(m.websockets))
+	for route := range m.websockets {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	p.header("atx_websocket_connections", "gauge", "Number of open websocket connections by route.")
+	for _, route := range routes {
+		p.sample("atx_websocket_connections", float64(m.websockets[route]), "route", route)
+	}
+	m.mu.Unlock()
+
+	p.header("atx_hub_clients", "gauge", "Number of websocket clients registered to a broadcast hub.")
+	hubsMu.Lock()
+	for _, h := range hubs {
+		p.sample("atx_hub_clients", float64(h.ClientCount()), "hub", h.name)
+	}
+	hubsMu.Unlock()
+
+	p.header("atx_download_bytes_total", "counter", "Bytes downloaded by the agent.")
+	p.sample("atx_download_bytes_total", float64(atomic.LoadInt64(&m.downloadBytes)))
+}
+
+func writeServiceMetrics(p *promWriter, stats []cmdctrl.ServiceStats) {
+	p.header("atx_service_up", "gauge", "Whether the program of a service is running.")
+	for _, s := range stats {
+		p.sample("atx_service_up", boolValue(s.Running), "service", s.Name)
+	}
+	p.header("atx_service_enabled", "gauge", "Whether a service is started and kept running.")
+	for _, s := range stats {
+		p.sample("atx_service_enabled", boolValue(s.Keeping), "service", s.Name)
+	}
+	p.header("atx_service_starts_total", "counter", "Number of times the program of a service was launched.")
+	for _, s := range stats {
+		p.sample("atx_service_starts_total", float64(s.Starts), "service", s.Name)
+	}
+	p.header("atx_service_restarts_total", "counter", "Number of times the program of a service was relaunched after it quited.")
+	for _, s := range stats {
+		p.sample("atx_service_restarts_total", float64(s.Restarts), "service", s.Name)
+	}
+}
+
+// writeDeviceMetrics read the device state directly, the snapshots of /system/stats are not touched
+func writeDeviceMetrics(p *promWriter, c *systemStatsCollector) {
+	if sys, err := readSystemCPU(c.procRoot); err == nil {
+		p.header("atx_device_uptime_seconds", "gauge", "Seconds since the device booted.")
+		p.sample("atx_device_uptime_seconds", sys.Uptime)
+
+		names := make([]string, 0, len(sys.Cpus))
+		for name := range sys.Cpus {
+			if name != "cpu" {
+				names = append(names, name)
+			}
+		}
+		sort.Slice(names, func(i, j int) bool {
+			a, _ := strconv.Atoi(strings.TrimPrefix(names[i], "cpu"))
+			b, _ := strconv.Atoi(strings.TrimPrefix(names[j], "cpu"))
+			return a < b
+		})
+		p.header("atx_device_cpu_seconds_total", "counter", "Seconds the cpus spent in each mode.")
+		for _, name := range append([]string{"cpu"}, names...) {
+			t := sys.Cpus[name]
+			label := "all"
+			if name != "cpu" {
+				label = strings.TrimPrefix(name, "cpu")
+			}
+			for _, mode := range []struct {
+				name    string
+				jiffies uint64
+			}{
+				{"user", t.User}, {"nice", t.Nice}, {"system", t.System}, {"idle", t.Idle},
+				{"iowait", t.IOWait}, {"irq", t.IRQ}, {"softirq", t.SoftIRQ}, {"steal", t.Steal},
+			} {
+				p.sample("atx_device_cpu_seconds_total", float64(mode.jiffies)/userHZ, "cpu", label, "mode", mode.name)
+			}
+		}
+		cpu := c.cpuStats(&systemSnapshot{systemCPU: sys}, nil)
+		p.header("atx_device_cpu_online", "gauge", "Whether a cpu core is online.")
+		for _, core := range cpu.Cores {
+			p.sample("atx_device_cpu_online", boolValue(core.Online), "cpu", strings.TrimPrefix(core.Name, "cpu"))
+		}
+		p.header("atx_device_cpu_frequency_hertz", "gauge", "Current frequency of a cpu core.")
+		for _, core := range cpu.Cores {
+			if core.CurFreq > 0 {
+				p.sample("atx_device_cpu_frequency_hertz", float64(core.CurFreq)*1000, "cpu", strings.TrimPrefix(core.Name, "cpu"))
+			}
+		}
+	}
+
+	if load, err := readLoadAvg(filepath.Join(c.procRoot, "loadavg")); err == nil {
+		p.header("atx_device_load1", "gauge", "1m load average.")
+		p.sample("atx_device_load1", load.Load1)
+		p.header("atx_device_load5", "gauge", "5m load average.")
+		p.sample("atx_device_load5", load.Load5)
+		p.header("atx_device_load15", "gauge", "15m load average.")
+		p.sample("atx_device_load15", load.Load15)
+	}
+
+	if meminfo, err := readMeminfo(filepath.Join(c.procRoot, "meminfo")); err == nil {
+		p.header("atx_device_memory_bytes", "gauge", "Memory information from /proc/meminfo.")
+		for _, field := range metricsMemoryFields {
+			if v, ok := meminfo[field]; ok {
+				p.sample("atx_device_memory_bytes", float64(v*1024), "field", field)
+			}
+		}
+	}
+
+	if disks, err := c.readDisks(); err == nil {
+		p.header("atx_device_filesystem_size_bytes", "gauge", "Filesystem size in bytes.")
+		for _, d := range disks {
+			p.sample("atx_device_filesystem_size_bytes", float64(d.Total), "device", d.Device, "mountpoint", d.MountPoint, "fstype", d.FsType)
+		}
+		p.header("atx_device_filesystem_free_bytes", "gauge", "Filesystem free space in bytes.")
+		for _, d := range disks {
+			p.sample("atx_device_filesystem_free_bytes", float64(d.Free), "device", d.Device, "mountpoint", d.MountPoint, "fstype", d.FsType)
+		}
+		p.header("atx_device_filesystem_avail_bytes", "gauge", "Filesystem space available to non-root users in bytes.")
+		for _, d := range disks {
+			p.sample("atx_device_filesystem_avail_bytes", float64(d.Available), "device", d.Device, "mountpoint", d.MountPoint, "fstype", d.FsType)
+		}
+	}
+
+	p.header("atx_device_thermal_celsius", "gauge", "Temperature of a thermal zone.")
+	for _, zone := range c.readThermal() {
+		p.sample("atx_device_thermal_celsius", zone.Temperature, "zone", zone.Zone, "type", zone.Type)
+	}
+
+	if battery, err := c.readBattery(); err == nil {
+		p.header("atx_device_battery_level_percent", "gauge", "Battery level.")
+		p.sample("atx_device_battery_level_percent", float64(battery.Level))
+		p.header("atx_device_battery_temperature_celsius", "gauge", "Battery temperature.")
+		p.sample("atx_device_battery_temperature_celsius", battery.Temperature)
+		p.header("atx_device_battery_voltage_volts", "gauge", "Battery voltage.")
+		p.sample("atx_device_battery_voltage_volts", battery.Voltage/1000)
+		p.header("atx_device_battery_charging", "gauge", "Whether the battery is charging.")
+		p.sample("atx_device_battery_charging", boolValue(battery.Status == "charging" || battery.Status == "full"))
+	}
+}
+
+func (m *metricsCollector) WriteTo(w io.Writer) (int64, error) {
+	p := &promWriter{}
+	m.writeAgentMetrics(p)
+	writeServiceMetrics(p, service.Stats())
+	writeDeviceMetrics(p, systemStats)
+	return p.buf.WriteTo(w)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/openatx/atx-agent/cmdctrl"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPromWriter(t *testing.T) {
+	p := &promWriter{}
+	p.header("atx_test", "gauge", "Test metric.")
+	p.sample("atx_test", 1.5, "path", `C:\a"b`+"\n", "code", "200")
+	p.sample("atx_test", 3e9)
+	assert.Equal(t, `# HELP atx_test Test metric.
+# TYPE atx_test gauge
+atx_test{path="C:\\a\"b\n",code="200"} 1.5
+atx_test 3e+09
+`, p.buf.String())
+	assert.Equal(t, "+Inf", formatMetricValue(math.Inf(1)))
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	m := newMetricsCollector()
+	router := mux.NewRouter()
+	router.Use(m.Middleware)
+	router.HandleFunc("/packages/{pkgname}/info", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["pkgname"] == "missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte("ok"))
+	})
+	wsOpened := make(chan bool)
+	router.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		wsOpened <- true
+		conn.ReadMessage()
+	})
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	for _, pkg := range []string{"com.a", "com.b", "missing"} {
+		res, err := http.Get(ts.URL + "/packages/" + pkg + "/info")
+		assert.NoError(t, err)
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	<-wsOpened
+
+	p := &promWriter{}
+	m.writeAgentMetrics(p)
+	output := p.buf.String()
+	assert.Contains(t, output, `atx_http_requests_total{route="/packages/{pkgname}/info",method="GET",code="200"} 2`)
+	assert.Contains(t, output, `atx_http_requests_total{route="/packages/{pkgname}/info",method="GET",code="404"} 1`)
+	assert.Contains(t, output, `atx_http_request_duration_seconds_count{route="/packages/{pkgname}/info",method="GET"} 3`)
+	assert.Contains(t, output, `atx_websocket_connections{route="/ws"} 1`)
+
+	conn.Close()
+	for i := 0; i < 20; i++ {
+		m.mu.Lock()
+		open := m.websockets["/ws"]
+		m.mu.Unlock()
+		if open == 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	p = &promWriter{}
+	m.writeAgentMetrics(p)
+	output = p.buf.String()
+	assert.Contains(t, output, `atx_websocket_connections{route="/ws"} 0`)
+	assert.Contains(t, output, `atx_http_requests_total{route="/ws",method="GET",code="101"} 1`)
+}
+
+func TestWriteServiceMetrics(t *testing.T) {
+	p := &promWriter{}
+	writeServiceMetrics(p, []cmdctrl.ServiceStats{
+		{Name: "minicap", Keeping: true, Running: false, Starts: 3, Restarts: 2},
+	})
+	output := p.buf.String()
+	assert.Contains(t, output, `atx_service_up{service="minicap"} 0`)
+	assert.Contains(t, output, `atx_service_enabled{service="minicap"} 1`)
+	assert.Contains(t, output, `atx_service_restarts_total{service="minicap"} 2`)
+}
+
+func TestWriteDeviceMetrics(t *testing.T) {
+	c, _, _, cleanup := newTestSystemStatsCollector(t)
+	defer cleanup()
+
+	p := &promWriter{}
+	writeDeviceMetrics(p, c)
+	output := p.buf.String()
+	for _, line := range []string{
+		`atx_device_uptime_seconds 10`,
+		`atx_device_cpu_seconds_total{cpu="all",mode="user"} 4`,
+		`atx_device_cpu_seconds_total{cpu="1",mode="idle"} 6`,
+		`atx_device_cpu_online{cpu="10"} 0`,
+		`atx_device_cpu_frequency_hertz{cpu="0"} 1.8048e+09`,
+		`atx_device_load1 0.85`,
+		`atx_device_memory_bytes{field="MemTotal"} 3.9369728e+09`,
+		`atx_device_filesystem_avail_bytes{device="/dev/block/dm-2",mountpoint="/data",fstype="f2fs"} 200`,
+		`atx_device_thermal_celsius{zone="thermal_zone2",type="cpu-0-0"} 45.3`,
+		`atx_device_battery_level_percent 80`,
+		`atx_device_battery_temperature_celsius 30.5`,
+		`atx_device_battery_charging 1`,
+	} {
+		assert.Contains(t, output, line+"\n")
+	}
+	assert.Empty(t, c.snapshots)
+}
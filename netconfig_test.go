@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUseProxy(t *testing.T) {
+	noProxy := []string{"example.com", ".lan", "*.corp", "10.0.0.0/8"}
+	assert.False(t, useProxy("localhost", nil))
+	assert.False(t, useProxy("127.0.0.1", nil))
+	assert.False(t, useProxy("example.com", noProxy))
+	assert.False(t, useProxy("api.example.com", noProxy))
+	assert.False(t, useProxy("nas.lan", noProxy))
+	assert.False(t, useProxy("git.corp", noProxy))
+	assert.False(t, useProxy("10.1.2.3", noProxy))
+	assert.True(t, useProxy("notexample.com", noProxy))
+	assert.True(t, useProxy("github.com", noProxy))
+	assert.False(t, useProxy("github.com", []string{"*"}))
+}
+
+func TestOutboundTransport(t *testing.T) {
+	// proxy server check authorization, and reply the requested url
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") == "" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		w.Write([]byte("proxy:" + r.URL.String()))
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("atx", "secret")
+	config := NetworkConfig{Proxy: proxyURL.String(), NoProxy: []string{"direct.example.com"}}
+	assert.Contains(t, config.Masked().Proxy, "atx:xxxxx@")
+
+	transport := &outboundTransport{}
+	assert.NoError(t, transport.Apply(config))
+	client := &http.Client{Transport: transport}
+	res, err := client.Get("http://download.example.com/a.apk")
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "proxy:http://download.example.com/a.apk", string(body))
+
+	req, _ := http.NewRequest("GET", "http://direct.example.com/a.apk", nil)
+	u, err := transport.transport.Proxy(req)
+	assert.NoError(t, err)
+	assert.Nil(t, u)
+
+	assert.Error(t, transport.Apply(NetworkConfig{Proxy: "10.0.0.1:3128"}))
+	assert.Error(t, transport.Apply(NetworkConfig{CABundle: "/not-exists.pem"}))
+	assert.Equal(t, config.Proxy, transport.Config().Proxy) // unchanged
+}
+
+func TestSaveNetworkConfig(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "atx-netconfig")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	path := filepath.Join(tmpdir, "network.json")
+	config, err := loadNetworkConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, NetworkConfig{}, config)
+
+	config.Proxy = "http://10.0.0.1:3128"
+	config.ConnectTimeout = 5
+	assert.NoError(t, saveNetworkConfig(path, config))
+	loaded, err := loadNetworkConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, config, loaded)
+}
@@ -0,0 +1,255 @@
+/*
+Cached package index, parsed apk info and icons are reused until the apk file changed
+
+	$ curl $DEVICE_URL/packages
+	ws://$DEVICE_URL/packages/events
+*/
+package main
+
+import (
+	"bytes"
+	"image/jpeg"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PackageEvent types: installed, updated, removed
+type PackageEvent struct {
+	Type        string       `json:"type"`
+	PackageName string       `json:"packageName"`
+	Path        string       `json:"path"`
+	Package     *PackageInfo `json:"package,omitempty"` // nil when removed
+	Time        time.Time    `json:"time"`
+}
+
+type apkStamp struct {
+	Path    string
+	ModTime time.Time
+	Size    int64
+}
+
+func statApk(path string) (apkStamp, error) {
+	finfo, err := os.Stat(path)
+	if err != nil {
+		return apkStamp{}, err
+	}
+	return apkStamp{Path: path, ModTime: finfo.ModTime(), Size: finfo.Size()}, nil
+}
+
+type packageEntry struct {
+	apkStamp
+	Info PackageInfo // Icon is dropped after encoded
+	Icon []byte      // jpeg, nil when apk has no icon
+}
+
+type PackageIndex struct {
+	Interval time.Duration // poll interval when there are subscribers
+
+	mu          sync.Mutex
+	cache       map[string]*packageEntry // key: apk path
+	snapshot    map[string]apkStamp      // key: package name, nil before first refresh
+	subscribers int
+	watchLoop   bool // poll goroutine running
+	refreshMu   sync.Mutex
+	publisher   *eventPublisher
+
+	list  func(args ...string) ([]packagePath, error)
+	parse func(path string) (PackageInfo, error)
+}
+
+func newPackageIndex() *PackageIndex {
+	return &PackageIndex{
+		Interval:  5 * time.Second,
+		cache:     make(map[string]*packageEntry),
+		publisher: newEventPublisher(),
+		list:      listPackagePaths,
+		parse:     readPackageInfoFromPath,
+	}
+}
+
+// lookup return cached entry when mtime and size of apk not changed, or parse it again
+func (idx *PackageIndex) lookup(path string) (*packageEntry, error) {
+	stamp, err := statApk(path)
+	if err != nil {
+		return nil, err
+	}
+	idx.mu.Lock()
+	entry, ok := idx.cache[path]
+	idx.mu.Unlock()
+	if ok && entry.apkStamp == stamp {
+		return entry, nil
+	}
+
+	info, err := idx.parse(path)
+	if err != nil {
+		return nil, err
+	}
+	entry = &packageEntry{apkStamp: stamp, Info: info}
+	if info.Icon != nil {
+		buf := bytes.NewBuffer(nil)
+		if err := jpeg.Encode(buf, info.Icon, &jpeg.Options{Quality: 80}); err == nil {
+			entry.Icon = buf.Bytes()
+		}
+		entry.Info.Icon = nil
+	}
+	idx.mu.Lock()
+	idx.cache[path] = entry
+	idx.mu.Unlock()
+	return entry, nil
+}
+
+// List packages matched filter, apks failed to parse are skipped
+func (idx *PackageIndex) List(filter PackageFilter) ([]PackageInfo, error) {
+	paths, err := idx.list(filter.args()...)
+	if err != nil {
+		return nil, err
+	}
+	pkgs := []PackageInfo{}
+	for _, p := range paths {
+		if !strings.HasPrefix(p.Name, filter.Prefix) {
+			continue
+		}
+		entry, err := idx.lookup(p.Path)
+		if err != nil {
+			log.Printf("Read package %s error %v", p.Name, err)
+			continue
+		}
+		pkgs = append(pkgs, entry.Info)
+	}
+	return pkgs, nil
+}
+
+// Get return cached entry of installed package
+func (idx *PackageIndex) Get(packageName string) (*packageEntry, error) {
+	path, err := packageApkPath(packageName)
+	if err != nil {
+		return nil, err
+	}
+	return idx.lookup(path)
+}
+
+// Refresh diff packages with last snapshot and publish events.
+// The first refresh only records the snapshot
+func (idx *PackageIndex) Refresh() ([]PackageEvent, error) {
+	idx.refreshMu.Lock()
+	defer idx.refreshMu.Unlock()
+
+	paths, err := idx.list()
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]apkStamp, len(paths))
+	alive := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		stamp, err := statApk(p.Path)
+		if err != nil {
+			stamp = apkStamp{Path: p.Path} // system apk may not be readable
+		}
+		current[p.Name] = stamp
+		alive[p.Path] = true
+	}
+
+	idx.mu.Lock()
+	previous := idx.snapshot
+	idx.snapshot = current
+	for path := range idx.cache {
+		if !alive[path] {
+			delete(idx.cache, path)
+		}
+	}
+	idx.mu.Unlock()
+	if previous == nil {
+		return nil, nil
+	}
+
+	events := diffPackageSnapshots(previous, current)
+	for i := range events {
+		ev := &events[i]
+		if ev.Type != "removed" {
+			if entry, err := idx.lookup(ev.Path); err == nil {
+				info := entry.Info
+				ev.Package = &info
+			}
+		}
+		idx.publisher.Submit(*ev)
+	}
+	return events, nil
+}
+
+// diffPackageSnapshots compare package name to apk stamp, apk path changes when updated on most devices
+func diffPackageSnapshots(previous, current map[string]apkStamp) []PackageEvent {
+	events := []PackageEvent{}
+	now := time.Now()
+	for name, stamp := range current {
+		old, ok := previous[name]
+		switch {
+		case !ok:
+			events = append(events, PackageEvent{Type: "installed", PackageName: name, Path: stamp.Path, Time: now})
+		case old.Path != stamp.Path || !old.ModTime.Equal(stamp.ModTime) || old.Size != stamp.Size:
+			events = append(events, PackageEvent{Type: "updated", PackageName: name, Path: stamp.Path, Time: now})
+		}
+	}
+	for name, stamp := range previous {
+		if _, ok := current[name]; !ok {
+			events = append(events, PackageEvent{Type: "removed", PackageName: name, Path: stamp.Path, Time: now})
+		}
+	}
+	return events
+}
+
+// Subscribe receive PackageEvent from ch, packages are polled until all subscribers gone
+func (idx *PackageIndex) Subscribe(ch chan interface{}) {
+	idx.publisher.Subscribe(ch)
+	idx.mu.Lock()
+	idx.subscribers++
+	start := !idx.watchLoop
+	idx.watchLoop = true
+	idx.mu.Unlock()
+	if start {
+		go idx.watch()
+	}
+}
+
+func (idx *PackageIndex) Unsubscribe(ch chan interface{}) {
+	idx.publisher.Unsubscribe(ch)
+	idx.mu.Lock()
+	idx.subscribers--
+	idx.mu.Unlock()
+}
+
+func (idx *PackageIndex) watching() bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.subscribers > 0
+}
+
+func (idx *PackageIndex) watch() {
+	if _, err := idx.Refresh(); err != nil {
+		log.Println("package index refresh error:", err)
+	}
+	ticker := time.NewTicker(idx.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		idx.mu.Lock()
+		if idx.subscribers == 0 {
+			// next subscriber starts with a new snapshot
+			idx.watchLoop = false
+			idx.snapshot = nil
+			idx.mu.Unlock()
+			return
+		}
+		idx.mu.Unlock()
+		if _, err := idx.Refresh(); err != nil {
+			log.Println("package index refresh error:", err)
+		}
+	}
+}
+
+// Notify refresh immediately after packages installed or removed by atx-agent
+func (idx *PackageIndex) Notify() {
+	if idx.watching() {
+		go idx.Refresh()
+	}
+}
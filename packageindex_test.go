@@ -0,0 +1,141 @@
+package main
+
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakePackages struct {
+	paths  []packagePath
+	parsed map[string]int
+}
+
+func newTestPackageIndex(t *testing.T) (*PackageIndex, *fakePackages, string) {
+	tmpdir, err := ioutil.TempDir("", "atx-packages")
+	assert.NoError(t, err)
+	fake := &fakePackages{parsed: make(map[string]int)}
+	idx := newPackageIndex()
+	idx.list = func(args ...string) ([]packagePath, error) {
+		return fake.paths, nil
+	}
+	idx.parse = func(path string) (PackageInfo, error) {
+		fake.parsed[path]++
+		return PackageInfo{
+			PackageName: filepath.Base(filepath.Dir(path)),
+			Icon:        image.NewRGBA(image.Rect(0, 0, 8, 8)),
+		}, nil
+	}
+	return idx, fake, tmpdir
+}
+
+func writeTestApk(t *testing.T, dir, name, content string) packagePath {
+	path := filepath.Join(dir, name, "base.apk")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return packagePath{Name: name, Path: path}
+}
+
+func TestPackageIndexList(t *testing.T) {
+	idx, fake, tmpdir := newTestPackageIndex(t)
+	defer os.RemoveAll(tmpdir)
+	a := writeTestApk(t, tmpdir, "com.example.a", "a")
+	b := writeTestApk(t, tmpdir, "org.example.b", "b")
+	fake.paths = []packagePath{a, b}
+
+	pkgs, err := idx.List(PackageFilter{})
+	assert.NoError(t, err)
+	assert.Len(t, pkgs, 2)
+	assert.Nil(t, pkgs[0].Icon)
+
+	pkgs, err = idx.List(PackageFilter{Prefix: "com."})
+	assert.NoError(t, err)
+	if assert.Len(t, pkgs, 1) {
+		assert.Equal(t, "com.example.a", pkgs[0].PackageName)
+	}
+	assert.Equal(t, 1, fake.parsed[a.Path])
+	assert.Equal(t, 1, fake.parsed[b.Path])
+
+	entry, err := idx.lookup(a.Path)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, entry.Icon)
+
+	// changed apk is parsed again
+	assert.NoError(t, ioutil.WriteFile(a.Path, []byte("a2"), 0644))
+	_, err = idx.List(PackageFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fake.parsed[a.Path])
+	assert.Equal(t, 1, fake.parsed[b.Path])
+}
+
+func TestPackageIndexRefresh(t *testing.T) {
+	idx, fake, tmpdir := newTestPackageIndex(t)
+	defer os.RemoveAll(tmpdir)
+	a := writeTestApk(t, tmpdir, "com.example.a", "a")
+	b := writeTestApk(t, tmpdir, "com.example.b", "b")
+	fake.paths = []packagePath{a, b}
+
+	events, err := idx.Refresh()
+	assert.NoError(t, err)
+	assert.Empty(t, events, "first refresh only records snapshot")
+
+	ch := make(chan interface{}, 10)
+	idx.publisher.Subscribe(ch)
+	defer idx.publisher.Unsubscribe(ch)
+
+	c := writeTestApk(t, tmpdir, "com.example.c", "c")
+	assert.NoError(t, ioutil.WriteFile(b.Path, []byte("b-updated"), 0644))
+	fake.paths = []packagePath{b, c}
+	events, err = idx.Refresh()
+	assert.NoError(t, err)
+	sort.Slice(events, func(i, j int) bool { return events[i].PackageName < events[j].PackageName })
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, "removed", events[0].Type)
+		assert.Equal(t, "com.example.a", events[0].PackageName)
+		assert.Nil(t, events[0].Package)
+		assert.Equal(t, "updated", events[1].Type)
+		assert.Equal(t, "installed", events[2].Type)
+		if assert.NotNil(t, events[2].Package) {
+			assert.Equal(t, "com.example.c", events[2].Package.PackageName)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case ev := <-ch:
+			assert.IsType(t, PackageEvent{}, ev)
+		case <-time.After(time.Second):
+			t.Fatal("package event not published")
+		}
+	}
+
+	events, err = idx.Refresh()
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+}
+
+func TestPackageIndexUnsubscribe(t *testing.T) {
+	idx := newPackageIndex()
+	ch := make(chan interface{}) // never read, broadcaster blocks on it
+	idx.publisher.Subscribe(ch)
+	idx.subscribers++
+	idx.publisher.Submit(PackageEvent{Type: "installed"})
+	idx.publisher.Submit(PackageEvent{Type: "removed"})
+
+	done := make(chan bool)
+	go func() {
+		idx.Unsubscribe(ch)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Unsubscribe blocked by pending events")
+	}
+	assert.False(t, idx.watching())
+}
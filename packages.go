@@ -0,0 +1,204 @@
+/*
+Package lifecycle management
+
+	$ curl -X DELETE "$DEVICE_URL/packages/com.example?keepData=true"
+	$ curl -X POST $DEVICE_URL/packages/com.example/clear
+	$ curl -X POST $DEVICE_URL/packages/com.example/force-stop
+	$ curl -X POST $DEVICE_URL/packages/com.example/disable
+*/
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	packageNameRe      = regexp.MustCompile(`^[a-zA-Z][\w]*(\.[a-zA-Z_][\w]*)+$`)
+	packageStateRe     = regexp.MustCompile(`new state: ([\w-]+)`)
+	packageSuspendedRe = regexp.MustCompile(`new suspended state: (\w+)`)
+	packageFailureRe   = regexp.MustCompile(`Failure \[([^\]]*)\]`)
+)
+
+var ErrPackageNotInstalled = errors.New("package not installed")
+
+// PackageFilter select packages by pm list packages flags
+type PackageFilter struct {
+	Type     string // all, system, third-party(default)
+	Disabled bool   // only disabled packages
+	Prefix   string
+}
+
+func (f PackageFilter) args() []string {
+	args := []string{}
+	switch f.Type {
+	case "system":
+		args = append(args, "-s")
+	case "all":
+	default:
+		args = append(args, "-3")
+	}
+	if f.Disabled {
+		args = append(args, "-d")
+	}
+	return args
+}
+
+// packageFilterFromQuery parse ?type=system&disabled=true&prefix=com.android
+func packageFilterFromQuery(r *http.Request) (filter PackageFilter, err error) {
+	filter.Type = r.FormValue("type")
+	switch filter.Type {
+	case "", "all", "system", "third-party":
+	default:
+		return filter, errors.New("type should be one of all, system or third-party")
+	}
+	if disabled := r.FormValue("disabled"); disabled != "" {
+		if filter.Disabled, err = strconv.ParseBool(disabled); err != nil {
+			return filter, errors.New("invalid disabled: " + disabled)
+		}
+	}
+	filter.Prefix = r.FormValue("prefix")
+	return
+}
+
+type PackageActionResult struct {
+	PackageName string `json:"packageName"`
+	Action      string `json:"action"`
+	State       string `json:"state,omitempty"` // enabled, disabled-user, suspended or unsuspended
+	FailureCode string `json:"failureCode,omitempty"`
+	Message     string `json:"message"`
+	Output      string `json:"output"`
+}
+
+// packageActions map action to command, package name is appended
+var packageActions = map[string][]string{
+	"uninstall":           {"pm", "uninstall"},
+	"uninstall-keep-data": {"pm", "uninstall", "-k"},
+	"clear":               {"pm", "clear"},
+	"force-stop":          {"am", "force-stop"},
+	"enable":              {"pm", "enable"},
+	"disable":             {"pm", "disable-user", "--user", "0"}, // pm disable requires root
+	"suspend":             {"pm", "suspend"},                     // android 7.0+
+	"unsuspend":           {"pm", "unsuspend"},
+}
+
+func packageInstalled(packageName string) bool {
+	output, _ := runShell("pm", "path", packageName)
+	return strings.HasPrefix(strings.TrimSpace(string(output)), "package:")
+}
+
+// runPackageAction return ErrPackageNotInstalled, or error parsed from output
+func runPackageAction(packageName, action string) (result PackageActionResult, err error) {
+	args, ok := packageActions[action]
+	if !ok {
+		return PackageActionResult{PackageName: packageName, Action: action}, errors.New("unknown package action: " + action)
+	}
+	result, err = runPackageCommand(packageName, action, args)
+	if err == nil && strings.HasPrefix(action, "uninstall") {
+		packageIndex.Notify()
+	}
+	return
+}
+
+// runPackageCommand run args with package name and extra arguments appended
+func runPackageCommand(packageName, action string, args []string, extra ...string) (result PackageActionResult, err error) {
+	result = PackageActionResult{PackageName: packageName, Action: action}
+	if !packageNameRe.MatchString(packageName) {
+		return result, errors.New("invalid package name: " + strconv.Quote(packageName))
+	}
+	if !packageInstalled(packageName) {
+		result.Message = ErrPackageNotInstalled.Error()
+		return result, ErrPackageNotInstalled
+	}
+	cmdArgs := append(append(append([]string{}, args...), packageName), extra...)
+	output, err := runShell(cmdArgs...)
+	return parsePackageActionOutput(result, output, err)
+}
+
+// parsePackageActionOutput pm exit with 0 on old devices even if failed, so the output is checked
+//
+//	pm uninstall: Success, Failure [DELETE_FAILED_INTERNAL_ERROR]
+//	pm clear: Success, Failed
+//	pm enable: Package com.example new state: enabled
+//	pm suspend: Package com.example new suspended state: true
+//	am force-stop: no output
+func parsePackageActionOutput(result PackageActionResult, output []byte, err error) (PackageActionResult, error) {
+	result.Output = strings.TrimSpace(string(output))
+	if matches := packageFailureRe.FindStringSubmatch(result.Output); matches != nil {
+		result.FailureCode = matches[1]
+		result.Message = "failure: " + matches[1]
+		return result, errors.New(result.Message)
+	}
+	if err != nil {
+		result.Message = err.Error()
+		if result.Output != "" {
+			result.Message = result.Output
+		}
+		return result, errors.New(result.Message)
+	}
+	if matches := packageStateRe.FindStringSubmatch(result.Output); matches != nil {
+		result.State = matches[1]
+	}
+	if matches := packageSuspendedRe.FindStringSubmatch(result.Output); matches != nil {
+		result.State = "unsuspended"
+		if matches[1] == "true" {
+			result.State = "suspended"
+		}
+	}
+	switch {
+	case strings.HasPrefix(result.Output, "Failed"),
+		strings.HasPrefix(result.Output, "Error"),
+		strings.HasPrefix(result.Output, "Bad argument"),
+		strings.HasPrefix(result.Output, "Operation not allowed"),
+		strings.Contains(result.Output, "Exception"),
+		strings.Contains(result.Output, "Unknown command"):
+		result.Message = result.Output
+		return result, errors.New(result.Message)
+	}
+	result.Message = result.Action + " success"
+	return result, nil
+}
+
+// checkPackageName response 400 when package name is invalid
+func checkPackageName(w http.ResponseWriter, packageName string) bool {
+	if packageNameRe.MatchString(packageName) {
+		return true
+	}
+	renderJSONWithStatus(w, http.StatusBadRequest, map[string]interface{}{
+		"success":     false,
+		"description": "invalid package name: " + strconv.Quote(packageName),
+	})
+	return false
+}
+
+func renderPackageAction(w http.ResponseWriter, packageName, action string) {
+	if !checkPackageName(w, packageName) {
+		return
+	}
+	result, err := runPackageAction(packageName, action)
+	renderPackageResult(w, result, err)
+}
+
+// renderPackageResult response 404 when package not installed
+func renderPackageResult(w http.ResponseWriter, result interface{}, err error) {
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrPackageNotInstalled {
+			status = http.StatusNotFound
+		}
+		renderJSONWithStatus(w, status, map[string]interface{}{
+			"success":     false,
+			"description": err.Error(),
+			"data":        result,
+		})
+		return
+	}
+	renderJSON(w, map[string]interface{}{
+		"success": true,
+		"data":    result,
+	})
+}
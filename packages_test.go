@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPackageFilter(t *testing.T) {
+	filter, err := packageFilterFromQuery(httptest.NewRequest("GET", "/packages", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-3"}, filter.args())
+
+	filter, err = packageFilterFromQuery(httptest.NewRequest("GET", "/packages?type=system&disabled=true&prefix=com.android", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-s", "-d"}, filter.args())
+	assert.Equal(t, "com.android", filter.Prefix)
+
+	filter, _ = packageFilterFromQuery(httptest.NewRequest("GET", "/packages?type=all", nil))
+	assert.Equal(t, []string{}, filter.args())
+
+	_, err = packageFilterFromQuery(httptest.NewRequest("GET", "/packages?type=user", nil))
+	assert.Error(t, err)
+}
+
+func TestParsePackageActionOutput(t *testing.T) {
+	result, err := parsePackageActionOutput(PackageActionResult{Action: "uninstall"}, []byte("Success\n"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "uninstall success", result.Message)
+
+	result, err = parsePackageActionOutput(PackageActionResult{Action: "uninstall"}, []byte("Failure [DELETE_FAILED_DEVICE_POLICY_MANAGER]\n"), errors.New("exit status 1"))
+	assert.Error(t, err)
+	assert.Equal(t, "DELETE_FAILED_DEVICE_POLICY_MANAGER", result.FailureCode)
+
+	_, err = parsePackageActionOutput(PackageActionResult{Action: "clear"}, []byte("Failed\n"), nil)
+	assert.Error(t, err)
+
+	result, err = parsePackageActionOutput(PackageActionResult{Action: "disable"}, []byte("Package com.example new state: disabled-user\n"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "disabled-user", result.State)
+
+	result, err = parsePackageActionOutput(PackageActionResult{Action: "suspend"}, []byte("Package com.example new suspended state: true\n"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "suspended", result.State)
+
+	result, err = parsePackageActionOutput(PackageActionResult{Action: "force-stop"}, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "", result.Output)
+}
+
+func TestRunPackageAction(t *testing.T) {
+	_, err := runPackageAction("com.example; reboot", "clear")
+	assert.Error(t, err)
+	_, err = runPackageAction("com.example", "reboot")
+	assert.Error(t, err)
+}
@@ -0,0 +1,626 @@
+/*
+Perf sampling, collect cpu, memory, threads, fds, network bytes and frame stats of app processes periodically
+
+	$ curl -X POST -d interval=1s -d metrics=cpu,memory $DEVICE_URL/packages/com.example/perf
+	ws://$DEVICE_URL/perf/{id}/stream
+	$ curl -X DELETE $DEVICE_URL/perf/{id}
+	$ curl $DEVICE_URL/perf/{id}/samples?format=csv
+*/
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/procfs"
+)
+
+const (
+	perfSamplerMaxJobs    = 10
+	perfSamplerBufferSize = 3600
+)
+
+// perfMetrics thread-cpu is the cpu percent of every thread, memory is the PSS summary of dumpsys meminfo,
+// frames is the fps and jank of dumpsys gfxinfo framestats
+var perfMetrics = []string{"cpu", "thread-cpu", "memory", "threads", "fds", "network", "frames"}
+
+var perfSamplers = newPerfSamplerManager()
+
+type PerfSamplerOptions struct {
+	PackageName string        `json:"packageName"`
+	Interval    time.Duration `json:"interval"`
+	Duration    time.Duration `json:"duration"` // stop sampling after duration
+	Metrics     []string      `json:"metrics"`
+	BufferSize  int           `json:"bufferSize"` // oldest samples are dropped when buffer is full
+}
+
+type PerfThread struct {
+	Tid  int     `json:"tid"`
+	Name string  `json:"name"`
+	CPU  float64 `json:"cpu"`
+}
+
+type PerfProcess struct {
+	Pid       int            `json:"pid"`
+	Name      string         `json:"name"`
+	CPU       *float64       `json:"cpu,omitempty"` // percent of all cores
+	Threads   int            `json:"threads,omitempty"`
+	Fds       int            `json:"fds,omitempty"`
+	Memory    map[string]int `json:"memory,omitempty"`    // unit KB
+	ThreadCPU []PerfThread   `json:"threadCpu,omitempty"` // sorted by cpu desc
+}
+
+type PerfNetwork struct {
+	Source  string  `json:"source"`  // uid(traffic of the app) or device(traffic of all apps)
+	RxBytes uint64  `json:"rxBytes"` // since sampling started
+	TxBytes uint64  `json:"txBytes"`
+	RxSpeed float64 `json:"rxSpeed"` // bytes per second
+	TxSpeed float64 `json:"txSpeed"`
+}
+
+type PerfSample struct {
+	Seq       int           `json:"seq"`
+	Time      time.Time     `json:"time"`
+	Processes []PerfProcess `json:"processes"`
+	Network   *PerfNetwork  `json:"network,omitempty"`
+	Frames    *FrameStats   `json:"frames,omitempty"` // frames rendered since last sample
+}
+
+func (sample PerfSample) eventSeq() int {
+	return sample.Seq
+}
+
+type perfSamplerState struct {
+	jobState
+	Options     PerfSamplerOptions `json:"options"`
+	Status      string             `json:"status"` // running, finished, stopped
+	Warnings    []string           `json:"warnings,omitempty"`
+	SampleCount int                `json:"sampleCount"`
+	Dropped     int                `json:"dropped"` // samples removed from buffer
+	Latest      *PerfSample        `json:"latest,omitempty"`
+	FinishedAt  *time.Time         `json:"finishedAt,omitempty"`
+}
+
+type netCounter struct {
+	source string
+	rx, tx uint64
+	time   time.Time
+}
+
+type PerfSampler struct {
+	perfSamplerState
+	jobDone
+	mu        sync.Mutex
+	samples   []PerfSample
+	publisher *eventPublisher
+	cancel    context.CancelFunc
+
+	procHistory map[int]*CPUStat
+	taskHistory map[int]*CPUStat
+	netTotal    *netCounter // bytes since sampling started
+	netLast     *netCounter
+	frames      *frameCollector
+
+	procRoot string
+	procs    func(packageName string) map[int]string
+	meminfo  func(pid int) (map[string]int, error)
+}
+
+func newPerfSampler(opts PerfSamplerOptions) *PerfSampler {
+	return &PerfSampler{
+		perfSamplerState: perfSamplerState{
+			jobState: newJobState(),
+			Options:  opts,
+			Status:   "running",
+		},
+		jobDone:     newJobDone(),
+		samples:     []PerfSample{},
+		publisher:   newEventPublisher(),
+		procHistory: make(map[int]*CPUStat),
+		taskHistory: make(map[int]*CPUStat),
+		procRoot:    procfs.DefaultMountPoint,
+		frames:      newFrameCollector(opts.PackageName),
+		procs:       appProcesses,
+		meminfo: func(pid int) (map[string]int, error) {
+			return parseMemoryInfo(strconv.Itoa(pid))
+		},
+	}
+}
+
+// State return a copy of sampler state
+func (s *PerfSampler) State() perfSamplerState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.perfSamplerState
+	state.Warnings = append([]string(nil), s.Warnings...)
+	return state
+}
+
+func (s *PerfSampler) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.State())
+}
+
+// Samples return a copy of buffered samples
+func (s *PerfSampler) Samples() []PerfSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]PerfSample{}, s.samples...)
+}
+
+func (s *PerfSampler) Stop() {
+	s.cancel()
+	<-s.Done()
+}
+
+// Subscribe return false if sampling already stopped
+func (s *PerfSampler) Subscribe(ch chan interface{}) bool {
+	return s.publisher.Subscribe(ch)
+}
+
+func (s *PerfSampler) Unsubscribe(ch chan interface{}) {
+	s.publisher.Unsubscribe(ch)
+}
+
+func (s *PerfSampler) bufferedEvents() []seqEvent {
+	samples := s.Samples()
+	evs := make([]seqEvent, 0, len(samples))
+	for _, sample := range samples {
+		evs = append(evs, sample)
+	}
+	return evs
+}
+
+func (s *PerfSampler) enabled(metric string) bool {
+	return stringInSlice(metric, s.Options.Metrics)
+}
+
+func (s *PerfSampler) warn(message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range s.Warnings {
+		if w == message {
+			return
+		}
+	}
+	s.Warnings = append(s.Warnings, message)
+}
+
+// cpuPercent compare with history, or average since started for new process and thread
+func cpuPercent(history map[int]*CPUStat, cur *CPUStat) float64 {
+	last, ok := history[cur.Pid]
+	if !ok || last.StartTime != cur.StartTime {
+		last = cur.SinceStart()
+	}
+	return cur.CPUPercent(last)
+}
+
+// collect must not be called concurrently, history of cpu and network is updated
+func (s *PerfSampler) collect() PerfSample {
+	sample := PerfSample{Time: time.Now(), Processes: []PerfProcess{}}
+	sys, err := readSystemCPU(s.procRoot)
+	if err != nil {
+		s.warn("cpu: " + err.Error())
+	}
+	fs, err := procfs.NewFS(s.procRoot)
+	if err != nil {
+		s.warn(err.Error())
+		return sample
+	}
+
+	names := s.procs(s.Options.PackageName)
+	pids := make([]int, 0, len(names))
+	for pid := range names {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+
+	procHistory := make(map[int]*CPUStat)
+	taskHistory := make(map[int]*CPUStat)
+	for _, pid := range pids {
+		proc, err := fs.NewProc(pid)
+		if err != nil {
+			continue // process exited
+		}
+		stat, err := proc.NewStat()
+		if err != nil {
+			continue
+		}
+		p := PerfProcess{Pid: pid, Name: names[pid]}
+		if s.enabled("cpu") {
+			cur := &CPUStat{Pid: pid}
+			cur.setSystemCPU(sys)
+			cur.setProcStat(stat)
+			percent := cpuPercent(s.procHistory, cur)
+			p.CPU = &percent
+			procHistory[pid] = cur
+		}
+		if s.enabled("threads") {
+			p.Threads = stat.NumThreads
+		}
+		if s.enabled("fds") {
+			if p.Fds, err = proc.FileDescriptorsLen(); err != nil {
+				s.warn("fds: " + err.Error())
+			}
+		}
+		if s.enabled("thread-cpu") {
+			p.ThreadCPU = s.collectTasks(pid, sys, taskHistory)
+		}
+		if s.enabled("memory") {
+			if p.Memory, err = s.meminfo(pid); err != nil {
+				s.warn("memory: " + err.Error())
+			}
+		}
+		sample.Processes = append(sample.Processes, p)
+	}
+	s.procHistory = procHistory
+	s.taskHistory = taskHistory
+
+	if s.enabled("network") && len(sample.Processes) > 0 {
+		sample.Network = s.collectNetwork(sample.Processes[0].Pid, sample.Time)
+	}
+	if s.enabled("frames") {
+		s.frames.Poll()
+		stats := s.frames.Flush()
+		sample.Frames = &stats
+	}
+	return sample
+}
+
+func (s *PerfSampler) collectTasks(pid int, sys systemCPU, history map[int]*CPUStat) []PerfThread {
+	taskFS, err := procfs.NewFS(filepath.Join(s.procRoot, strconv.Itoa(pid), "task"))
+	if err != nil {
+		return nil
+	}
+	tasks, err := taskFS.AllProcs()
+	if err != nil {
+		return nil
+	}
+	threads := make([]PerfThread, 0, len(tasks))
+	for _, task := range tasks {
+		stat, err := task.NewStat()
+		if err != nil {
+			continue
+		}
+		cur := &CPUStat{Pid: task.PID}
+		cur.setSystemCPU(sys)
+		cur.setProcStat(stat)
+		threads = append(threads, PerfThread{
+			Tid:  task.PID,
+			Name: stat.Comm,
+			CPU:  cpuPercent(s.taskHistory, cur),
+		})
+		history[task.PID] = cur
+	}
+	sort.SliceStable(threads, func(i, j int) bool {
+		return threads[i].CPU > threads[j].CPU
+	})
+	return threads
+}
+
+func (s *PerfSampler) collectNetwork(pid int, now time.Time) *PerfNetwork {
+	cur, err := s.readNetCounter(pid)
+	if err != nil {
+		s.warn("network: " + err.Error())
+		return nil
+	}
+	cur.time = now
+	if s.netLast == nil || s.netLast.source != cur.source {
+		s.netTotal, s.netLast = &netCounter{source: cur.source}, cur
+	}
+	diff := func(a, b uint64) uint64 {
+		if a < b { // counter reset when interface down or stats cleared
+			return 0
+		}
+		return a - b
+	}
+	rx, tx := diff(cur.rx, s.netLast.rx), diff(cur.tx, s.netLast.tx)
+	s.netTotal.rx += rx
+	s.netTotal.tx += tx
+	network := &PerfNetwork{
+		Source:  cur.source,
+		RxBytes: s.netTotal.rx,
+		TxBytes: s.netTotal.tx,
+	}
+	if elapsed := cur.time.Sub(s.netLast.time).Seconds(); elapsed > 0 {
+		network.RxSpeed = float64(rx) / elapsed
+		network.TxSpeed = float64(tx) / elapsed
+	}
+	s.netLast = cur
+	return network
+}
+
+// readNetCounter use xt_qtaguid stats of the app uid when available (removed since android 9),
+// otherwise the total bytes of all interfaces except lo
+func (s *PerfSampler) readNetCounter(pid int) (*netCounter, error) {
+	if uid, err := readProcUid(filepath.Join(s.procRoot, strconv.Itoa(pid), "status")); err == nil {
+		if rx, tx, err := readQtaguidStats(filepath.Join(s.procRoot, "net/xt_qtaguid/stats"), uid); err == nil {
+			return &netCounter{source: "uid", rx: rx, tx: tx}, nil
+		}
+	}
+	fs, err := procfs.NewFS(s.procRoot)
+	if err != nil {
+		return nil, err
+	}
+	proc, err := fs.NewProc(pid)
+	if err != nil {
+		return nil, err
+	}
+	netDev, err := proc.NetDev()
+	if err != nil {
+		return nil, err
+	}
+	counter := &netCounter{source: "device"}
+	for name, line := range netDev {
+		if name == "lo" {
+			continue
+		}
+		counter.rx += line.RxBytes
+		counter.tx += line.TxBytes
+	}
+	return counter, nil
+}
+
+// readProcUid parse real uid from the line: Uid:	10086	10086	10086	10086
+func readProcUid(statusPath string) (string, error) {
+	data, err := ioutil.ReadFile(statusPath)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "Uid:" {
+			return fields[1], nil
+		}
+	}
+	return "", errors.New("no Uid in " + statusPath)
+}
+
+// readQtaguidStats sum bytes of untagged traffic, columns:
+// idx iface acct_tag_hex uid_tag_int cnt_set rx_bytes rx_packets tx_bytes ...
+func readQtaguidStats(path string, uid string) (rx, tx uint64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[0] == "idx" {
+			continue
+		}
+		if fields[1] == "lo" || fields[2] != "0x0" || fields[3] != uid {
+			continue
+		}
+		r, _ := strconv.ParseUint(fields[5], 10, 64)
+		t, _ := strconv.ParseUint(fields[7], 10, 64)
+		rx, tx = rx+r, tx+t
+	}
+	return rx, tx, scanner.Err()
+}
+
+func (s *PerfSampler) add(sample PerfSample) {
+	s.mu.Lock()
+	s.SampleCount++
+	sample.Seq = s.SampleCount
+	s.samples = append(s.samples, sample)
+	if len(s.samples) > s.Options.BufferSize {
+		s.samples = s.samples[1:]
+		s.Dropped++
+	}
+	s.Latest = &sample
+	s.mu.Unlock()
+	s.publisher.Submit(sample)
+}
+
+func (s *PerfSampler) run(ctx context.Context) {
+	defer s.finish()
+	defer s.publisher.Close()
+	if s.enabled("frames") {
+		if err := s.frames.Reset(); err != nil {
+			s.warn("frames: " + err.Error())
+		}
+		go s.frames.Watch(ctx, frameStatsPollInterval)
+	}
+	s.collect() // history data for cpu percent and network speed
+
+	ticker := time.NewTicker(s.Options.Interval)
+	defer ticker.Stop()
+	timer := time.NewTimer(s.Options.Duration)
+	defer timer.Stop()
+	status := "finished"
+LOOP:
+	for {
+		select {
+		case <-ctx.Done():
+			status = "stopped"
+			break LOOP
+		case <-timer.C:
+			break LOOP
+		case <-ticker.C:
+			s.add(s.collect())
+		}
+	}
+	now := time.Now()
+	s.mu.Lock()
+	s.Status = status
+	s.FinishedAt = &now
+	s.mu.Unlock()
+}
+
+// perfSamplerOptionsFromRequest parse interval, duration, metrics(comma separated) and bufferSize
+func perfSamplerOptionsFromRequest(packageName string, form func(string) string) (opts PerfSamplerOptions, err error) {
+	opts = PerfSamplerOptions{
+		PackageName: packageName,
+		Interval:    time.Second,
+		Duration:    time.Hour,
+		Metrics:     perfMetrics,
+		BufferSize:  perfSamplerBufferSize,
+	}
+	for name, d := range map[string]*time.Duration{"interval": &opts.Interval, "duration": &opts.Duration} {
+		if v := form(name); v != "" {
+			if *d, err = time.ParseDuration(v); err != nil || *d <= 0 {
+				return opts, errors.New("invalid " + name + ": " + v)
+			}
+		}
+	}
+	if opts.Interval < 200*time.Millisecond {
+		return opts, errors.New("interval should not be less than 200ms")
+	}
+	if v := form("bufferSize"); v != "" {
+		if opts.BufferSize, err = strconv.Atoi(v); err != nil || opts.BufferSize < 1 || opts.BufferSize > 100000 {
+			return opts, errors.New("bufferSize should be between 1 and 100000")
+		}
+	}
+	if v := form("metrics"); v != "" {
+		opts.Metrics = []string{}
+		for _, metric := range strings.Split(v, ",") {
+			metric = strings.TrimSpace(metric)
+			if !stringInSlice(metric, perfMetrics) {
+				return opts, errors.New("unknown metric: " + strconv.Quote(metric) + ", available: " + strings.Join(perfMetrics, ","))
+			}
+			if !stringInSlice(metric, opts.Metrics) {
+				opts.Metrics = append(opts.Metrics, metric)
+			}
+		}
+	}
+	return opts, nil
+}
+
+// writePerfSamplesCSV write one row per process and one row per thread,
+// thread rows only have tid, thread and cpu
+func writePerfSamplesCSV(w io.Writer, samples []PerfSample) error {
+	memKeys := []string{}
+	for _, sample := range samples {
+		for _, p := range sample.Processes {
+			for key := range p.Memory {
+				if !stringInSlice(key, memKeys) {
+					memKeys = append(memKeys, key)
+				}
+			}
+		}
+	}
+	sort.Strings(memKeys)
+
+	cw := csv.NewWriter(w)
+	header := []string{"seq", "time", "pid", "process", "tid", "thread", "cpu", "threads", "fds"}
+	for _, key := range memKeys {
+		header = append(header, "memory:"+key)
+	}
+	header = append(header, "network", "rxBytes", "txBytes", "rxSpeed", "txSpeed",
+		"fps", "frames", "jankyFrames", "frozenFrames", "frameTimeP50", "frameTimeP90", "frameTimeP99")
+	cw.Write(header)
+
+	formatFloat := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 2, 64)
+	}
+	formatInt := func(v int) string {
+		if v == 0 {
+			return ""
+		}
+		return strconv.Itoa(v)
+	}
+	for _, sample := range samples {
+		prefix := []string{strconv.Itoa(sample.Seq), sample.Time.Format("2006-01-02T15:04:05.000Z07:00")}
+		for _, p := range sample.Processes {
+			row := append(prefix, strconv.Itoa(p.Pid), p.Name, "", "")
+			if p.CPU != nil {
+				row = append(row, formatFloat(*p.CPU))
+			} else {
+				row = append(row, "")
+			}
+			row = append(row, formatInt(p.Threads), formatInt(p.Fds))
+			for _, key := range memKeys {
+				if v, ok := p.Memory[key]; ok {
+					row = append(row, strconv.Itoa(v))
+				} else {
+					row = append(row, "")
+				}
+			}
+			if n := sample.Network; n != nil {
+				row = append(row, n.Source,
+					strconv.FormatUint(n.RxBytes, 10), strconv.FormatUint(n.TxBytes, 10),
+					formatFloat(n.RxSpeed), formatFloat(n.TxSpeed))
+			} else {
+				row = append(row, "", "", "", "", "")
+			}
+			if f := sample.Frames; f != nil && f.FrameTime != nil {
+				row = append(row, formatFloat(f.FPS), strconv.Itoa(f.Frames),
+					strconv.Itoa(f.JankyFrames), strconv.Itoa(f.FrozenFrames),
+					formatFloat(f.FrameTime.P50), formatFloat(f.FrameTime.P90), formatFloat(f.FrameTime.P99))
+			} else if f != nil {
+				row = append(row, "0.00", "0", "0", "0", "", "", "")
+			} else {
+				row = append(row, "", "", "", "", "", "", "")
+			}
+			cw.Write(row)
+
+			for _, t := range p.ThreadCPU {
+				row := append(prefix, strconv.Itoa(p.Pid), p.Name, strconv.Itoa(t.Tid), t.Name, formatFloat(t.CPU))
+				cw.Write(append(row, make([]string, len(header)-len(row))...))
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+type perfSamplerManager struct {
+	mu       sync.Mutex // serialize Start
+	samplers *jobRegistry
+}
+
+func newPerfSamplerManager() *perfSamplerManager {
+	return &perfSamplerManager{
+		samplers: newJobRegistry(),
+	}
+}
+
+// Start sampling in background, the oldest stopped sampler is removed when too many
+func (m *perfSamplerManager) Start(opts PerfSamplerOptions) (*PerfSampler, error) {
+	if !packageInstalled(opts.PackageName) {
+		return nil, ErrPackageNotInstalled
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.samplers.Len() >= perfSamplerMaxJobs {
+		oldest := m.samplers.OldestDone()
+		if oldest == nil {
+			return nil, errors.Errorf("too many running samplers, max %d", perfSamplerMaxJobs)
+		}
+		m.samplers.Remove(oldest.info().ID)
+	}
+	s := newPerfSampler(opts)
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	m.samplers.Add(s)
+	go s.run(ctx)
+	return s, nil
+}
+
+// Get return nil if not found
+func (m *perfSamplerManager) Get(id string) *PerfSampler {
+	s, _ := m.samplers.Get(id).(*PerfSampler)
+	return s
+}
+
+func (m *perfSamplerManager) List() []*PerfSampler {
+	jobs := m.samplers.List()
+	samplers := make([]*PerfSampler, 0, len(jobs))
+	for _, j := range jobs {
+		samplers = append(samplers, j.(*PerfSampler))
+	}
+	return samplers
+}
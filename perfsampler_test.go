@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeProcRoot string
+
+func (root fakeProcRoot) write(t *testing.T, name, content string) {
+	path := filepath.Join(string(root), name)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+}
+
+// system: total and idle jiffies of all cores
+func (root fakeProcRoot) system(t *testing.T, total, idle uint, uptime float64) {
+	root.write(t, "stat", fmt.Sprintf("cpu  %d 0 0 %d 0 0 0 0 0 0\ncpu0 1 0 0 1 0 0 0 0 0 0\n", total-idle, idle))
+	root.write(t, "uptime", fmt.Sprintf("%.2f 100.00\n", uptime))
+}
+
+func (root fakeProcRoot) stat(t *testing.T, name string, pid int, comm string, utime, stime uint, threads int, start uint64) {
+	root.write(t, name, fmt.Sprintf("%d (%s) S 1 1 0 0 -1 0 0 0 0 0 %d %d 0 0 20 0 %d 0 %d 0 0\n",
+		pid, comm, utime, stime, threads, start))
+}
+
+func TestCPUStatSinceStart(t *testing.T) {
+	stat := &CPUStat{SystemTotal: 4000, SystemIdle: 2000, ProcUser: 60, ProcSystem: 40, StartTime: 500, Uptime: 10}
+	start := stat.SinceStart()
+	assert.Equal(t, uint(2000), start.SystemTotal)
+	assert.Equal(t, uint(1000), start.SystemIdle)
+	assert.InDelta(t, 5.0, stat.CPUPercent(start), 0.001)
+	assert.InDelta(t, 50.0, stat.SystemCPUPercent(start), 0.001)
+
+	stat.Uptime = 0
+	assert.Equal(t, 0.0, stat.CPUPercent(stat.SinceStart()))
+}
+
+func TestPerfSamplerCollect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atx-proc")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := fakeProcRoot(dir)
+
+	root.system(t, 10000, 5000, 30)
+	root.stat(t, "100/stat", 100, "com.example", 100, 50, 2, 1000)
+	root.stat(t, "100/task/100/stat", 100, "com.example", 80, 40, 1, 1000)
+	root.stat(t, "100/task/101/stat", 101, "RenderThread", 20, 10, 1, 1000)
+	root.write(t, "100/status", "Name:\tcom.example\nUid:\t10086\t10086\t10086\t10086\n")
+	root.write(t, "100/fd/0", "")
+	root.write(t, "100/fd/1", "")
+	root.write(t, "net/xt_qtaguid/stats", `idx iface acct_tag_hex uid_tag_int cnt_set rx_bytes rx_packets tx_bytes tx_packets
+2 wlan0 0x0 10086 0 1000 10 500 5
+3 wlan0 0x0 10086 1 2000 20 1000 10
+4 wlan0 0x3e800000000 10086 0 300 3 100 1
+5 lo 0x0 10086 0 9999 1 9999 1
+6 wlan0 0x0 10010 0 7777 7 7777 7
+`)
+
+	s := newPerfSampler(PerfSamplerOptions{PackageName: "com.example", Metrics: perfMetrics})
+	s.procRoot = dir
+	s.procs = func(string) map[int]string {
+		return map[int]string{100: "com.example"}
+	}
+	s.meminfo = func(pid int) (map[string]int, error) {
+		return map[string]int{"java heap": 1024, "total": 4096}, nil
+	}
+	s.frames.dumpsys = func(args ...string) (string, error) {
+		return "", nil
+	}
+
+	first := s.collect()
+	if assert.Len(t, first.Processes, 1) {
+		assert.Equal(t, 2, first.Processes[0].Fds)
+		assert.Equal(t, 2, first.Processes[0].Threads)
+	}
+	if assert.NotNil(t, first.Network) {
+		assert.Equal(t, "uid", first.Network.Source)
+		assert.Equal(t, uint64(0), first.Network.RxBytes)
+	}
+
+	root.system(t, 11000, 5500, 31)
+	root.stat(t, "100/stat", 100, "com.example", 150, 100, 3, 1000)
+	root.stat(t, "100/task/100/stat", 100, "com.example", 100, 40, 1, 1000)
+	root.stat(t, "100/task/101/stat", 101, "RenderThread", 60, 30, 1, 1000)
+	root.stat(t, "100/task/102/stat", 102, "OkHttp", 10, 0, 1, 3050)
+	root.write(t, "net/xt_qtaguid/stats", "2 wlan0 0x0 10086 0 3000 10 700 5\n3 wlan0 0x0 10086 1 2000 20 1000 10\n")
+	s.netLast.time = s.netLast.time.Add(-time.Second)
+
+	sample := s.collect()
+	if !assert.Len(t, sample.Processes, 1) {
+		return
+	}
+	p := sample.Processes[0]
+	assert.Equal(t, "com.example", p.Name)
+	if assert.NotNil(t, p.CPU) {
+		assert.InDelta(t, 10.0, *p.CPU, 0.001) // 100 jiffies of 1000
+	}
+	assert.Equal(t, 3, p.Threads)
+	assert.Equal(t, 4096, p.Memory["total"])
+	if assert.Len(t, p.ThreadCPU, 3) {
+		assert.Equal(t, PerfThread{Tid: 101, Name: "RenderThread", CPU: 6}, p.ThreadCPU[0])
+		assert.Equal(t, "OkHttp", p.ThreadCPU[1].Name) // started after last sample, averaged since start
+		assert.InDelta(t, 5.6, p.ThreadCPU[1].CPU, 0.1)
+		assert.Equal(t, 100, p.ThreadCPU[2].Tid)
+		assert.InDelta(t, 2.0, p.ThreadCPU[2].CPU, 0.001)
+	}
+	if assert.NotNil(t, sample.Network) {
+		assert.Equal(t, uint64(2000), sample.Network.RxBytes)
+		assert.Equal(t, uint64(200), sample.Network.TxBytes)
+		assert.InDelta(t, 2000.0, sample.Network.RxSpeed, 100)
+	}
+	if assert.NotNil(t, sample.Frames) {
+		assert.Equal(t, 0, sample.Frames.Frames)
+	}
+	assert.Empty(t, s.State().Warnings)
+
+	// metrics not selected are omitted
+	s.Options.Metrics = []string{"threads"}
+	sample = s.collect()
+	assert.Nil(t, sample.Processes[0].CPU)
+	assert.Nil(t, sample.Network)
+	assert.Nil(t, sample.Processes[0].Memory)
+}
+
+func TestPerfSamplerNetworkDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atx-proc")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := fakeProcRoot(dir)
+	root.write(t, "100/net/dev", `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:    9999      10    0    0    0     0          0         0     9999      10    0    0    0     0       0          0
+ wlan0:    1000      10    0    0    0     0          0         0      400       5    0    0    0     0       0          0
+rmnet0:     500       5    0    0    0     0          0         0      100       1    0    0    0     0       0          0
+`)
+	s := newPerfSampler(PerfSamplerOptions{})
+	s.procRoot = dir
+	counter, err := s.readNetCounter(100)
+	assert.NoError(t, err)
+	assert.Equal(t, &netCounter{source: "device", rx: 1500, tx: 500}, counter)
+
+	now := time.Now()
+	assert.Equal(t, &PerfNetwork{Source: "device"}, s.collectNetwork(100, now))
+	// counters reset after interface down, no wrap around
+	root.write(t, "100/net/dev", `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+ wlan0:     100       1    0    0    0     0          0         0       50       1    0    0    0     0       0          0
+`)
+	assert.Equal(t, &PerfNetwork{Source: "device"}, s.collectNetwork(100, now.Add(time.Second)))
+	root.write(t, "100/net/dev", `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+ wlan0:     300       3    0    0    0     0          0         0       90       2    0    0    0     0       0          0
+`)
+	assert.Equal(t, &PerfNetwork{Source: "device", RxBytes: 200, TxBytes: 40, RxSpeed: 200, TxSpeed: 40}, s.collectNetwork(100, now.Add(2*time.Second)))
+}
+
+func TestPerfSamplerBuffer(t *testing.T) {
+	s := newPerfSampler(PerfSamplerOptions{BufferSize: 2})
+	ch := make(chan interface{}, 10)
+	s.Subscribe(ch)
+	defer s.Unsubscribe(ch)
+	for i := 0; i < 3; i++ {
+		s.add(PerfSample{Time: time.Now()})
+	}
+	samples := s.Samples()
+	assert.Len(t, samples, 2)
+	assert.Equal(t, 2, samples[0].Seq)
+	state := s.State()
+	assert.Equal(t, 3, state.SampleCount)
+	assert.Equal(t, 1, state.Dropped)
+	assert.Equal(t, 3, state.Latest.Seq)
+	assert.Equal(t, 1, (<-ch).(PerfSample).Seq)
+}
+
+func TestPerfSamplerOptionsFromRequest(t *testing.T) {
+	form := func(values map[string]string) func(string) string {
+		return func(key string) string { return values[key] }
+	}
+	opts, err := perfSamplerOptionsFromRequest("com.example", form(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, opts.Interval)
+	assert.Equal(t, perfMetrics, opts.Metrics)
+
+	opts, err = perfSamplerOptionsFromRequest("com.example", form(map[string]string{
+		"interval": "500ms", "duration": "10m", "metrics": "cpu, memory,cpu", "bufferSize": "100"}))
+	assert.NoError(t, err)
+	assert.Equal(t, 500*time.Millisecond, opts.Interval)
+	assert.Equal(t, 10*time.Minute, opts.Duration)
+	assert.Equal(t, []string{"cpu", "memory"}, opts.Metrics)
+	assert.Equal(t, 100, opts.BufferSize)
+
+	for _, values := range []map[string]string{
+		{"interval": "10ms"},
+		{"interval": "abc"},
+		{"duration": "-1s"},
+		{"metrics": "cpu,gpu"},
+		{"bufferSize": "0"},
+	} {
+		_, err := perfSamplerOptionsFromRequest("com.example", form(values))
+		assert.Error(t, err, "%v", values)
+	}
+}
+
+func TestWritePerfSamplesCSV(t *testing.T) {
+	cpu := 12.345
+	now := time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)
+	samples := []PerfSample{{
+		Seq:  1,
+		Time: now,
+		Processes: []PerfProcess{{
+			Pid: 100, Name: "com.example", CPU: &cpu, Threads: 20, Fds: 64,
+			Memory:    map[string]int{"total": 4096, "java heap": 1024},
+			ThreadCPU: []PerfThread{{Tid: 101, Name: "RenderThread", CPU: 5}},
+		}, {
+			Pid: 200, Name: "com.example:push", Threads: 5,
+		}},
+		Network: &PerfNetwork{Source: "uid", RxBytes: 100, TxBytes: 50, RxSpeed: 10, TxSpeed: 5},
+		Frames:  &FrameStats{Frames: 58, FPS: 58, JankyFrames: 2, FrameTime: &FrameTimeStats{P50: 8.5, P90: 12, P99: 20.25}},
+	}, {
+		Seq:       2,
+		Time:      now.Add(time.Second),
+		Processes: []PerfProcess{{Pid: 100, Name: "com.example"}},
+		Frames:    &FrameStats{},
+	}}
+	buf := bytes.NewBuffer(nil)
+	assert.NoError(t, writePerfSamplesCSV(buf, samples))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, []string{
+		"seq,time,pid,process,tid,thread,cpu,threads,fds,memory:java heap,memory:total,network,rxBytes,txBytes,rxSpeed,txSpeed," +
+			"fps,frames,jankyFrames,frozenFrames,frameTimeP50,frameTimeP90,frameTimeP99",
+		"1,2020-01-02T03:04:05.006Z,100,com.example,,,12.35,20,64,1024,4096,uid,100,50,10.00,5.00,58.00,58,2,0,8.50,12.00,20.25",
+		"1,2020-01-02T03:04:05.006Z,100,com.example,101,RenderThread,5.00,,,,,,,,,,,,,,,,",
+		"1,2020-01-02T03:04:05.006Z,200,com.example:push,,,,5,,,,uid,100,50,10.00,5.00,58.00,58,2,0,8.50,12.00,20.25",
+		"2,2020-01-02T03:04:06.006Z,100,com.example,,,,,,,,,,,,,0.00,0,0,0,,,",
+	}, lines)
+}
@@ -0,0 +1,241 @@
+/*
+Runtime permission and appops management
+
+	$ curl $DEVICE_URL/packages/com.example/permissions
+	$ curl -X PUT $DEVICE_URL/packages/com.example/permissions/android.permission.CAMERA    # grant
+	$ curl -X DELETE $DEVICE_URL/packages/com.example/permissions/android.permission.CAMERA # revoke
+	$ curl -X DELETE $DEVICE_URL/packages/com.example/permissions                           # reset
+	$ curl -X PUT -d mode=allow $DEVICE_URL/packages/com.example/permissions/appops/SYSTEM_ALERT_WINDOW
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	permissionNameRe = regexp.MustCompile(`^[a-zA-Z][\w.]*$`)
+	appOpRe          = regexp.MustCompile(`^([A-Z][A-Z0-9_]*|\d+)$`)
+	appOpLineRe      = regexp.MustCompile(`^(?:Uid mode: )?([A-Z][A-Z0-9_]*): ([a-z]+)`)
+	permissionLineRe = regexp.MustCompile(`^([\w.]+)(?:: granted=(true|false))?(?:, flags=\[\s*([^\]]*)\])?`)
+)
+
+var appOpModes = map[string]bool{
+	"allow":      true,
+	"ignore":     true,
+	"deny":       true,
+	"default":    true,
+	"foreground": true, // android 9.0+
+}
+
+type PermissionState struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type,omitempty"` // runtime, install, empty when not known by package manager
+	Granted bool     `json:"granted"`
+	Flags   []string `json:"flags,omitempty"` // eg: USER_SET, USER_FIXED, SYSTEM_FIXED
+}
+
+// fixed permissions can not be changed by pm grant and revoke
+func (p PermissionState) fixed() bool {
+	for _, flag := range p.Flags {
+		if flag == "SYSTEM_FIXED" || flag == "POLICY_FIXED" {
+			return true
+		}
+	}
+	return false
+}
+
+type AppOpState struct {
+	Op   string `json:"op"`
+	Mode string `json:"mode"`
+}
+
+type PackagePermissions struct {
+	PackageName string            `json:"packageName"`
+	Permissions []PermissionState `json:"permissions"`
+	AppOps      []AppOpState      `json:"appops"`
+}
+
+// parseDumpsysPermissions parse output of dumpsys package $PACKAGE, only the first package block is used
+//
+//	requested permissions:
+//	  android.permission.CAMERA
+//	install permissions:
+//	  android.permission.INTERNET: granted=true
+//	User 0: ceDataInode=1234 installed=true
+//	  runtime permissions:
+//	    android.permission.CAMERA: granted=false, flags=[ USER_SET|USER_FIXED ]
+//
+// Devices before android 6.0 list permissions in grantedPermissions
+func parseDumpsysPermissions(output []byte, packageName string) (requested []string, states map[string]PermissionState) {
+	states = make(map[string]PermissionState)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	inPackage := false
+	section, sectionIndent := "", 0
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \r")
+		content := strings.TrimLeft(line, " ")
+		indent := len(line) - len(content)
+		if strings.HasPrefix(content, "Package [") {
+			if inPackage {
+				break // hidden system package or another package
+			}
+			inPackage = strings.HasPrefix(content, "Package ["+packageName+"]")
+			continue
+		}
+		if !inPackage || content == "" {
+			continue
+		}
+		if indent == 0 {
+			break
+		}
+		if section != "" && indent <= sectionIndent {
+			section = ""
+		}
+		switch content {
+		case "requested permissions:":
+			section, sectionIndent = "requested", indent
+			continue
+		case "install permissions:":
+			section, sectionIndent = "install", indent
+			continue
+		case "runtime permissions:":
+			section, sectionIndent = "runtime", indent
+			continue
+		case "grantedPermissions:":
+			section, sectionIndent = "granted", indent
+			continue
+		}
+		if section == "" {
+			continue
+		}
+		matches := permissionLineRe.FindStringSubmatch(content)
+		if matches == nil {
+			continue
+		}
+		name := matches[1]
+		switch section {
+		case "requested":
+			requested = append(requested, name)
+		case "granted":
+			states[name] = PermissionState{Name: name, Granted: true}
+		default:
+			state := PermissionState{Name: name, Type: section, Granted: matches[2] == "true"}
+			if flags := strings.TrimSpace(matches[3]); flags != "" {
+				state.Flags = strings.Split(flags, "|")
+			}
+			states[name] = state
+		}
+	}
+	return
+}
+
+// parseAppOps parse output of appops get $PACKAGE
+//
+//	SYSTEM_ALERT_WINDOW: allow; time=+1d2h ago
+//	Uid mode: COARSE_LOCATION: ignore
+func parseAppOps(output []byte) []AppOpState {
+	ops := []AppOpState{}
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(output), "\n") {
+		matches := appOpLineRe.FindStringSubmatch(strings.TrimSpace(line))
+		if matches == nil || seen[matches[1]] {
+			continue
+		}
+		seen[matches[1]] = true
+		ops = append(ops, AppOpState{Op: matches[1], Mode: matches[2]})
+	}
+	return ops
+}
+
+func readPackagePermissions(packageName string) (perms PackagePermissions, err error) {
+	perms = PackagePermissions{PackageName: packageName, Permissions: []PermissionState{}, AppOps: []AppOpState{}}
+	if !packageNameRe.MatchString(packageName) {
+		return perms, errors.New("invalid package name: " + strconv.Quote(packageName))
+	}
+	if !packageInstalled(packageName) {
+		return perms, ErrPackageNotInstalled
+	}
+	output, err := runShell("dumpsys", "package", packageName)
+	if err != nil {
+		return perms, errors.Wrap(err, "dumpsys package")
+	}
+	requested, states := parseDumpsysPermissions(output, packageName)
+	if info, err := readPackageInfo(packageName); err == nil {
+		requested = append(requested, info.Permissions...)
+	}
+	for _, name := range requested {
+		if _, ok := states[name]; !ok {
+			states[name] = PermissionState{Name: name}
+		}
+	}
+	for _, state := range states {
+		perms.Permissions = append(perms.Permissions, state)
+	}
+	sort.Slice(perms.Permissions, func(i, j int) bool {
+		return perms.Permissions[i].Name < perms.Permissions[j].Name
+	})
+
+	if output, err := runShell("appops", "get", packageName); err == nil {
+		perms.AppOps = parseAppOps(output)
+	}
+	return perms, nil
+}
+
+func setPermission(packageName, permission string, grant bool) (PackageActionResult, error) {
+	action := "revoke"
+	if grant {
+		action = "grant"
+	}
+	if !permissionNameRe.MatchString(permission) {
+		return PackageActionResult{PackageName: packageName, Action: action}, errors.New("invalid permission: " + strconv.Quote(permission))
+	}
+	return runPackageCommand(packageName, action, []string{"pm", action}, permission)
+}
+
+// resetPermissions revoke all granted runtime permissions except system or policy fixed ones,
+// and clear user-set and user-fixed flags (android 10.0+)
+func resetPermissions(packageName string) (results []PackageActionResult, err error) {
+	perms, err := readPackagePermissions(packageName)
+	if err != nil {
+		return nil, err
+	}
+	results = []PackageActionResult{}
+	for _, perm := range perms.Permissions {
+		if perm.Type != "runtime" || perm.fixed() {
+			continue
+		}
+		if perm.Granted {
+			result, err := setPermission(packageName, perm.Name, false)
+			results = append(results, result)
+			if err != nil {
+				return results, err
+			}
+		}
+		runShell("pm", "clear-permission-flags", packageName, perm.Name, "user-set", "user-fixed")
+	}
+	return results, nil
+}
+
+func setAppOp(packageName, op, mode string) (PackageActionResult, error) {
+	result := PackageActionResult{PackageName: packageName, Action: "appops " + op}
+	if !appOpRe.MatchString(op) {
+		return result, errors.New("invalid appops: " + strconv.Quote(op))
+	}
+	if !appOpModes[mode] {
+		return result, errors.New("mode should be one of allow, ignore, deny, default or foreground")
+	}
+	result, err := runPackageCommand(packageName, result.Action, []string{"appops", "set"}, op, mode)
+	if err == nil {
+		result.State = mode
+	}
+	return result, err
+}
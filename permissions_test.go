@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const dumpsysPackageOutput = `Activity Resolver Table:
+  Non-Data Actions:
+      android.intent.action.MAIN:
+        1b2c3d com.example/.MainActivity filter 4e5f6a
+
+Packages:
+  Package [com.example] (8a9b0c):
+    userId=10123
+    pkg=Package{8a9b0c com.example}
+    requested permissions:
+      android.permission.INTERNET
+      android.permission.CAMERA
+      android.permission.ACCESS_FINE_LOCATION
+      android.permission.READ_CONTACTS
+    install permissions:
+      android.permission.INTERNET: granted=true
+    User 0: ceDataInode=12345 installed=true hidden=false suspended=false stopped=false
+      gids=[3003]
+      runtime permissions:
+        android.permission.CAMERA: granted=true, flags=[ USER_SET|USER_SENSITIVE_WHEN_GRANTED ]
+        android.permission.ACCESS_FINE_LOCATION: granted=false, flags=[ USER_SET|USER_FIXED ]
+        android.permission.READ_CONTACTS: granted=true, flags=[ SYSTEM_FIXED ]
+
+Hidden system packages:
+  Package [com.example] (1d2e3f):
+    install permissions:
+      android.permission.WAKE_LOCK: granted=true
+`
+
+func TestParseDumpsysPermissions(t *testing.T) {
+	requested, states := parseDumpsysPermissions([]byte(dumpsysPackageOutput), "com.example")
+	assert.Len(t, requested, 4)
+	assert.Len(t, states, 4)
+	assert.Equal(t, PermissionState{Name: "android.permission.INTERNET", Type: "install", Granted: true}, states["android.permission.INTERNET"])
+	camera := states["android.permission.CAMERA"]
+	assert.Equal(t, "runtime", camera.Type)
+	assert.True(t, camera.Granted)
+	assert.Equal(t, []string{"USER_SET", "USER_SENSITIVE_WHEN_GRANTED"}, camera.Flags)
+	assert.False(t, states["android.permission.ACCESS_FINE_LOCATION"].Granted)
+	assert.True(t, states["android.permission.READ_CONTACTS"].fixed())
+	assert.False(t, camera.fixed())
+	_, ok := states["android.permission.WAKE_LOCK"]
+	assert.False(t, ok)
+
+	// android 5.x
+	requested, states = parseDumpsysPermissions([]byte(`Packages:
+  Package [com.example] (8a9b0c):
+    grantedPermissions:
+      android.permission.INTERNET
+`), "com.example")
+	assert.Empty(t, requested)
+	assert.True(t, states["android.permission.INTERNET"].Granted)
+}
+
+func TestParseAppOps(t *testing.T) {
+	ops := parseAppOps([]byte(`Uid mode: SYSTEM_ALERT_WINDOW: allow
+COARSE_LOCATION: ignore; rejectTime=+2h3m ago
+GET_USAGE_STATS: default
+SYSTEM_ALERT_WINDOW: allow; time=+1d ago
+`))
+	assert.Equal(t, []AppOpState{
+		{Op: "SYSTEM_ALERT_WINDOW", Mode: "allow"},
+		{Op: "COARSE_LOCATION", Mode: "ignore"},
+		{Op: "GET_USAGE_STATS", Mode: "default"},
+	}, ops)
+
+	_, err := setAppOp("com.example", "SYSTEM_ALERT_WINDOW", "always")
+	assert.Error(t, err)
+	_, err = setPermission("com.example", "android.permission.CAMERA; reboot", true)
+	assert.Error(t, err)
+}
@@ -41,6 +41,9 @@ type DeviceInfo struct {
 	Memory                 *MemoryInfo           `json:"memory,omitempty"` // proc/meminfo
 	Cpu                    *CpuInfo              `json:"cpu,omitempty"`    // proc/cpuinfo
 	Arch                   string                `json:"arch"`
+	Abis                   []string              `json:"abis,omitempty"`    // ro.product.cpu.abilist
+	Density                int                   `json:"density,omitempty"` // ro.sf.lcd_density
+	Locale                 string                `json:"locale,omitempty"`  // persist.sys.locale, eg: zh-CN
 
 	Owner    *OwnerInfo `json:"owner" gorethink:"owner,omitempty"`
 	Reserved string     `json:"reserved,omitempty"`
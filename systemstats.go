@@ -0,0 +1,494 @@
+/*
+System wide resource stats, read from /proc and /sys
+
+	$ curl $DEVICE_URL/system/stats
+	# cpu usage since the snapshot of the last call
+	$ curl $DEVICE_URL/system/stats?since={snapshot}
+*/
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openatx/androidutils"
+	"github.com/pkg/errors"
+)
+
+const systemStatsMaxSnapshots = 32
+
+var (
+	cpuDirRe      = regexp.MustCompile(`^cpu\d+$`)
+	diskFsTypes   = []string{"ext2", "ext3", "ext4", "f2fs", "vfat", "exfat", "sdcardfs", "fuse", "erofs", "squashfs", "btrfs", "xfs"}
+	errNoSnapshot = errors.New("snapshot not found")
+)
+
+var systemStats = newSystemStatsCollector()
+
+type CoreStats struct {
+	Name    string  `json:"name"` // cpu for all cores, cpu0, cpu1 ...
+	Online  bool    `json:"online"`
+	Usage   float64 `json:"usage"` // percent
+	User    float64 `json:"user"`
+	System  float64 `json:"system"`
+	IOWait  float64 `json:"iowait"`
+	CurFreq int     `json:"curFreq,omitempty"` // kHz
+	MinFreq int     `json:"minFreq,omitempty"`
+	MaxFreq int     `json:"maxFreq,omitempty"`
+}
+
+type CPUUsageStats struct {
+	Total           CoreStats   `json:"total"`
+	Cores           []CoreStats `json:"cores"`
+	ContextSwitches float64     `json:"contextSwitches"` // per second
+	Interrupts      float64     `json:"interrupts"`      // per second
+}
+
+type LoadAvg struct {
+	Load1   float64 `json:"load1"`
+	Load5   float64 `json:"load5"`
+	Load15  float64 `json:"load15"`
+	Running int     `json:"running"`
+	Total   int     `json:"total"`
+}
+
+type SwapStats struct {
+	Total uint64 `json:"total"` // KB
+	Free  uint64 `json:"free"`
+	Used  uint64 `json:"used"`
+}
+
+type ZramStats struct {
+	Name             string  `json:"name"`
+	DiskSize         uint64  `json:"diskSize"` // bytes
+	OrigDataSize     uint64  `json:"origDataSize"`
+	ComprDataSize    uint64  `json:"comprDataSize"`
+	MemUsedTotal     uint64  `json:"memUsedTotal"`
+	CompressionRatio float64 `json:"compressionRatio"`
+}
+
+type diskSpace struct {
+	Total     uint64 `json:"total"` // bytes
+	Free      uint64 `json:"free"`
+	Available uint64 `json:"available"` // free for non-root users
+}
+
+type DiskUsage struct {
+	diskSpace
+	Device      string  `json:"device"`
+	MountPoint  string  `json:"mountPoint"`
+	FsType      string  `json:"fsType"`
+	Used        uint64  `json:"used"`
+	UsedPercent float64 `json:"usedPercent"`
+}
+
+type ThermalZone struct {
+	Zone        string  `json:"zone"`
+	Type        string  `json:"type"`
+	Temperature float64 `json:"temperature"` // celsius
+}
+
+type BatteryStats struct {
+	Source      string  `json:"source"` // sysfs or dumpsys
+	Level       int     `json:"level"`  // percent
+	Status      string  `json:"status,omitempty"`
+	Current     float64 `json:"current"`     // mA, sign depends on the vendor
+	Voltage     float64 `json:"voltage"`     // mV
+	Power       float64 `json:"power"`       // mW
+	Temperature float64 `json:"temperature"` // celsius
+}
+
+type SystemStats struct {
+	Snapshot string            `json:"snapshot"` // pass as since in the next call
+	Since    string            `json:"since,omitempty"`
+	Interval float64           `json:"interval"` // seconds, cpu usage is calculated in the interval
+	Time     time.Time         `json:"time"`
+	Uptime   float64           `json:"uptime"`
+	CPU      *CPUUsageStats    `json:"cpu,omitempty"`
+	LoadAvg  *LoadAvg          `json:"loadavg,omitempty"`
+	Memory   map[string]uint64 `json:"memory,omitempty"` // /proc/meminfo, unit KB
+	Swap     *SwapStats        `json:"swap,omitempty"`
+	Zram     []ZramStats       `json:"zram"`
+	Disks    []DiskUsage       `json:"disks"`
+	Thermal  []ThermalZone     `json:"thermal"`
+	Battery  *BatteryStats     `json:"battery,omitempty"`
+	Errors   map[string]string `json:"errors,omitempty"` // section to error
+}
+
+// systemSnapshot keep the system cpu counters for usage calculation of the next request
+type systemSnapshot struct {
+	systemCPU
+	id       string
+	time     time.Time
+	hasStats bool
+}
+
+type systemStatsCollector struct {
+	mu        sync.Mutex
+	snapshots map[string]*systemSnapshot
+	order     []string // snapshot ids, oldest first
+
+	procRoot string
+	sysRoot  string
+	statfs   func(path string) (diskSpace, error)
+	battery  func() (*androidutils.Battery, error) // used when sysfs is not readable
+}
+
+func newSystemStatsCollector() *systemStatsCollector {
+	return &systemStatsCollector{
+		snapshots: make(map[string]*systemSnapshot),
+		procRoot:  "/proc",
+		sysRoot:   "/sys",
+		statfs:    statDiskSpace,
+		battery: func() (*androidutils.Battery, error) {
+			battery := &androidutils.Battery{}
+			return battery, battery.Update()
+		},
+	}
+}
+
+func roundPercent(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// cpuUsage calculate percents between last and cur, last is zero for usage since boot
+func cpuUsage(name string, last, cur cpuTimes) CoreStats {
+	stats := CoreStats{Name: name, Online: true}
+	total := cur.total()
+	lastTotal := last.total()
+	if total <= lastTotal {
+		return stats
+	}
+	delta := float64(total - lastTotal)
+	diff := func(a, b uint64) float64 {
+		if a < b { // counter reset when cpu offline
+			return 0
+		}
+		return float64(a - b)
+	}
+	idle := diff(cur.Idle, last.Idle) + diff(cur.IOWait, last.IOWait)
+	stats.Usage = roundPercent(100 * math.Max(delta-idle, 0) / delta)
+	stats.User = roundPercent(100 * (diff(cur.User, last.User) + diff(cur.Nice, last.Nice)) / delta)
+	stats.System = roundPercent(100 * (diff(cur.System, last.System) + diff(cur.IRQ, last.IRQ) + diff(cur.SoftIRQ, last.SoftIRQ)) / delta)
+	stats.IOWait = roundPercent(100 * diff(cur.IOWait, last.IOWait) / delta)
+	return stats
+}
+
+// readIntFile return 0 if file not exists or invalid
+func readIntFile(path string) int64 {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	v, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	return v
+}
+
+func readStringFile(path string) string {
+	data, _ := ioutil.ReadFile(path)
+	return strings.TrimSpace(string(data))
+}
+
+func (c *systemStatsCollector) cpuStats(cur, last *systemSnapshot) *CPUUsageStats {
+	stats := &CPUUsageStats{Cores: []CoreStats{}}
+	lastTimes := func(name string) cpuTimes {
+		if last != nil {
+			return last.Cpus[name]
+		}
+		return cpuTimes{}
+	}
+	stats.Total = cpuUsage("cpu", lastTimes("cpu"), cur.Cpus["cpu"])
+
+	// offline cores are not listed in /proc/stat
+	names := []string{}
+	for name := range cur.Cpus {
+		if name != "cpu" {
+			names = append(names, name)
+		}
+	}
+	cpuDir := filepath.Join(c.sysRoot, "devices/system/cpu")
+	if infos, err := ioutil.ReadDir(cpuDir); err == nil {
+		for _, info := range infos {
+			if cpuDirRe.MatchString(info.Name()) && !stringInSlice(info.Name(), names) {
+				names = append(names, info.Name())
+			}
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, _ := strconv.Atoi(strings.TrimPrefix(names[i], "cpu"))
+		b, _ := strconv.Atoi(strings.TrimPrefix(names[j], "cpu"))
+		return a < b
+	})
+	for _, name := range names {
+		core := CoreStats{Name: name}
+		if times, ok := cur.Cpus[name]; ok {
+			core = cpuUsage(name, lastTimes(name), times)
+		}
+		freqDir := filepath.Join(cpuDir, name, "cpufreq")
+		core.CurFreq = int(readIntFile(filepath.Join(freqDir, "scaling_cur_freq")))
+		core.MinFreq = int(readIntFile(filepath.Join(freqDir, "cpuinfo_min_freq")))
+		core.MaxFreq = int(readIntFile(filepath.Join(freqDir, "cpuinfo_max_freq")))
+		stats.Cores = append(stats.Cores, core)
+	}
+
+	if last != nil {
+		if seconds := cur.time.Sub(last.time).Seconds(); seconds > 0 && cur.Ctxt >= last.Ctxt && cur.Intr >= last.Intr {
+			stats.ContextSwitches = math.Round(float64(cur.Ctxt-last.Ctxt) / seconds)
+			stats.Interrupts = math.Round(float64(cur.Intr-last.Intr) / seconds)
+		}
+	} else if cur.Uptime > 0 {
+		stats.ContextSwitches = math.Round(float64(cur.Ctxt) / cur.Uptime)
+		stats.Interrupts = math.Round(float64(cur.Intr) / cur.Uptime)
+	}
+	return stats
+}
+
+func readLoadAvg(path string) (*LoadAvg, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// 0.85 0.76 0.70 2/1290 23451
+	fields := strings.Fields(string(data))
+	if len(fields) < 4 {
+		return nil, errors.New("invalid loadavg: " + string(data))
+	}
+	load := &LoadAvg{}
+	load.Load1, _ = strconv.ParseFloat(fields[0], 64)
+	load.Load5, _ = strconv.ParseFloat(fields[1], 64)
+	load.Load15, _ = strconv.ParseFloat(fields[2], 64)
+	if parts := strings.SplitN(fields[3], "/", 2); len(parts) == 2 {
+		load.Running, _ = strconv.Atoi(parts[0])
+		load.Total, _ = strconv.Atoi(parts[1])
+	}
+	return load, nil
+}
+
+// readMeminfo parse lines like: MemTotal:        3844700 kB
+func readMeminfo(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields := strings.Fields(parts[1])
+		if len(fields) == 0 {
+			continue
+		}
+		if v, err := strconv.ParseUint(fields[0], 10, 64); err == nil {
+			info[strings.TrimSpace(parts[0])] = v
+		}
+	}
+	return info, scanner.Err()
+}
+
+// readZram mm_stat: orig_data_size compr_data_size mem_used_total mem_limit mem_used_max same_pages ...
+func (c *systemStatsCollector) readZram() []ZramStats {
+	devices := []ZramStats{}
+	dirs, _ := filepath.Glob(filepath.Join(c.sysRoot, "block/zram*"))
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		zram := ZramStats{
+			Name:     filepath.Base(dir),
+			DiskSize: uint64(readIntFile(filepath.Join(dir, "disksize"))),
+		}
+		if zram.DiskSize == 0 {
+			continue // not initialized
+		}
+		fields := strings.Fields(readStringFile(filepath.Join(dir, "mm_stat")))
+		if len(fields) >= 3 {
+			zram.OrigDataSize, _ = strconv.ParseUint(fields[0], 10, 64)
+			zram.ComprDataSize, _ = strconv.ParseUint(fields[1], 10, 64)
+			zram.MemUsedTotal, _ = strconv.ParseUint(fields[2], 10, 64)
+		}
+		if zram.ComprDataSize > 0 {
+			zram.CompressionRatio = math.Round(float64(zram.OrigDataSize)/float64(zram.ComprDataSize)*100) / 100
+		}
+		devices = append(devices, zram)
+	}
+	return devices
+}
+
+// readDisks statfs mount points of real filesystems in /proc/mounts
+func (c *systemStatsCollector) readDisks() ([]DiskUsage, error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.procRoot, "mounts"))
+	if err != nil {
+		return nil, err
+	}
+	disks := []DiskUsage{}
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		// /dev/block/dm-2 /data f2fs rw,lazytime,seclabel,nosuid,nodev 0 0
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !stringInSlice(fields[2], diskFsTypes) {
+			continue
+		}
+		mountPoint := strings.Replace(fields[1], `\040`, " ", -1)
+		if seen[mountPoint] {
+			continue
+		}
+		seen[mountPoint] = true
+		space, err := c.statfs(mountPoint)
+		if err != nil || space.Total == 0 {
+			continue
+		}
+		disk := DiskUsage{
+			diskSpace:  space,
+			Device:     fields[0],
+			MountPoint: mountPoint,
+			FsType:     fields[2],
+		}
+		if space.Total > space.Free {
+			disk.Used = space.Total - space.Free
+		}
+		disk.UsedPercent = roundPercent(100 * float64(disk.Used) / float64(space.Total))
+		disks = append(disks, disk)
+	}
+	return disks, nil
+}
+
+// readThermal temp is millidegree celsius, some vendors use degree celsius
+func (c *systemStatsCollector) readThermal() []ThermalZone {
+	zones := []ThermalZone{}
+	dirs, _ := filepath.Glob(filepath.Join(c.sysRoot, "class/thermal/thermal_zone*"))
+	sort.Slice(dirs, func(i, j int) bool {
+		a, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(dirs[i]), "thermal_zone"))
+		b, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(dirs[j]), "thermal_zone"))
+		return a < b
+	})
+	for _, dir := range dirs {
+		raw := readStringFile(filepath.Join(dir, "temp"))
+		temp, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			continue // disabled zone returns EINVAL
+		}
+		if math.Abs(temp) >= 1000 {
+			temp /= 1000
+		}
+		zones = append(zones, ThermalZone{
+			Zone:        filepath.Base(dir),
+			Type:        readStringFile(filepath.Join(dir, "type")),
+			Temperature: math.Round(temp*10) / 10,
+		})
+	}
+	return zones
+}
+
+// readBattery current_now is microampere, voltage_now is microvolt, temp is decidegree celsius
+func (c *systemStatsCollector) readBattery() (*BatteryStats, error) {
+	dir := filepath.Join(c.sysRoot, "class/power_supply/battery")
+	if _, err := os.Stat(filepath.Join(dir, "capacity")); err == nil {
+		battery := &BatteryStats{
+			Source:      "sysfs",
+			Level:       int(readIntFile(filepath.Join(dir, "capacity"))),
+			Status:      strings.ToLower(readStringFile(filepath.Join(dir, "status"))),
+			Current:     float64(readIntFile(filepath.Join(dir, "current_now"))) / 1000,
+			Voltage:     float64(readIntFile(filepath.Join(dir, "voltage_now"))) / 1000,
+			Temperature: float64(readIntFile(filepath.Join(dir, "temp"))) / 10,
+		}
+		battery.Power = math.Round(math.Abs(battery.Current*battery.Voltage)/1000*10) / 10
+		return battery, nil
+	}
+	b, err := c.battery()
+	if err != nil {
+		return nil, err
+	}
+	return &BatteryStats{
+		Source:      "dumpsys",
+		Level:       b.Level,
+		Status:      b.StatusName(),
+		Voltage:     float64(b.Voltage),
+		Temperature: float64(b.Temperature) / 10,
+	}, nil
+}
+
+func (c *systemStatsCollector) saveSnapshot(snap *systemSnapshot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.snapshots[snap.id] = snap
+	c.order = append(c.order, snap.id)
+	for len(c.order) > systemStatsMaxSnapshots {
+		delete(c.snapshots, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+// Collect read all stats, cpu usage is calculated since the snapshot when since is not empty,
+// otherwise since boot. errNoSnapshot is returned when since is not found
+func (c *systemStatsCollector) Collect(since string) (*SystemStats, error) {
+	var last *systemSnapshot
+	if since != "" {
+		c.mu.Lock()
+		last = c.snapshots[since]
+		c.mu.Unlock()
+		if last == nil {
+			return nil, errNoSnapshot
+		}
+	}
+
+	randBytes := make([]byte, 8)
+	rand.Read(randBytes)
+	stats := &SystemStats{
+		Snapshot: hex.EncodeToString(randBytes),
+		Since:    since,
+		Time:     time.Now(),
+		Errors:   map[string]string{},
+	}
+	sys, err := readSystemCPU(c.procRoot)
+	if err != nil {
+		stats.Errors["cpu"] = err.Error()
+	}
+	stats.Uptime = sys.Uptime
+	snap := &systemSnapshot{systemCPU: sys, id: stats.Snapshot, time: stats.Time, hasStats: err == nil}
+	if snap.hasStats {
+		if last != nil && last.hasStats {
+			stats.Interval = math.Round(stats.Time.Sub(last.time).Seconds()*1000) / 1000
+			stats.CPU = c.cpuStats(snap, last)
+		} else {
+			stats.Interval = stats.Uptime
+			stats.CPU = c.cpuStats(snap, nil)
+		}
+	}
+	c.saveSnapshot(snap)
+
+	if stats.LoadAvg, err = readLoadAvg(filepath.Join(c.procRoot, "loadavg")); err != nil {
+		stats.Errors["loadavg"] = err.Error()
+	}
+	if stats.Memory, err = readMeminfo(filepath.Join(c.procRoot, "meminfo")); err != nil {
+		stats.Errors["memory"] = err.Error()
+	} else if total, ok := stats.Memory["SwapTotal"]; ok {
+		free := stats.Memory["SwapFree"]
+		stats.Swap = &SwapStats{Total: total, Free: free}
+		if total > free {
+			stats.Swap.Used = total - free
+		}
+	}
+	stats.Zram = c.readZram()
+	if stats.Disks, err = c.readDisks(); err != nil {
+		stats.Errors["disks"] = err.Error()
+		stats.Disks = []DiskUsage{}
+	}
+	stats.Thermal = c.readThermal()
+	if stats.Battery, err = c.readBattery(); err != nil {
+		stats.Errors["battery"] = err.Error()
+	}
+	return stats, nil
+}
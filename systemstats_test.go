@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openatx/androidutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSystemStatsCollector(t *testing.T) (c *systemStatsCollector, proc, sys fakeProcRoot, cleanup func()) {
+	dir, err := ioutil.TempDir("", "atx-system")
+	assert.NoError(t, err)
+	proc = fakeProcRoot(filepath.Join(dir, "proc"))
+	sys = fakeProcRoot(filepath.Join(dir, "sys"))
+	c = newSystemStatsCollector()
+	c.procRoot, c.sysRoot = string(proc), string(sys)
+	c.statfs = func(path string) (diskSpace, error) {
+		if path == "/data" {
+			return diskSpace{Total: 1000, Free: 250, Available: 200}, nil
+		}
+		return diskSpace{Total: 500, Free: 500, Available: 500}, nil
+	}
+	c.battery = func() (*androidutils.Battery, error) {
+		return &androidutils.Battery{Level: 80, Status: 2, Voltage: 4200, Temperature: 305}, nil
+	}
+
+	proc.write(t, "stat", `cpu  400 0 200 1200 100 50 50 0 0 0
+cpu0 200 0 100 600 50 25 25 0 0 0
+cpu1 200 0 100 600 50 25 25 0 0 0
+intr 10000 1 2 3
+ctxt 20000
+btime 1600000000
+`)
+	proc.write(t, "uptime", "10.00 30.00\n")
+	proc.write(t, "loadavg", "0.85 0.76 0.70 2/1290 23451\n")
+	proc.write(t, "meminfo", "MemTotal:        3844700 kB\nMemAvailable:    1200000 kB\nSwapTotal:       2097148 kB\nSwapFree:        1597148 kB\n")
+	proc.write(t, "mounts", `rootfs / rootfs ro,seclabel 0 0
+proc /proc proc rw,relatime 0 0
+/dev/block/dm-0 /system ext4 ro,seclabel,relatime 0 0
+/dev/block/dm-2 /data f2fs rw,lazytime,seclabel 0 0
+/dev/block/dm-2 /data f2fs rw,lazytime,seclabel 0 0
+/dev/fuse /storage/emulated fuse rw,lazytime,nosuid 0 0
+`)
+	sys.write(t, "devices/system/cpu/cpu0/cpufreq/scaling_cur_freq", "1804800\n")
+	sys.write(t, "devices/system/cpu/cpu0/cpufreq/cpuinfo_min_freq", "300000\n")
+	sys.write(t, "devices/system/cpu/cpu0/cpufreq/cpuinfo_max_freq", "1804800\n")
+	sys.write(t, "devices/system/cpu/cpu10/online", "0\n") // offline
+	sys.write(t, "block/zram0/disksize", "2147483648\n")
+	sys.write(t, "block/zram0/mm_stat", "400000000 100000000 110000000 0 120000000 1000 0\n")
+	sys.write(t, "block/zram1/disksize", "0\n")
+	sys.write(t, "class/thermal/thermal_zone10/type", "battery\n")
+	sys.write(t, "class/thermal/thermal_zone10/temp", "31\n")
+	sys.write(t, "class/thermal/thermal_zone2/type", "cpu-0-0\n")
+	sys.write(t, "class/thermal/thermal_zone2/temp", "45300\n")
+	sys.write(t, "class/thermal/thermal_zone3/temp", "") // disabled
+	return c, proc, sys, func() { os.RemoveAll(dir) }
+}
+
+func TestSystemStatsCollect(t *testing.T) {
+	c, proc, sys, cleanup := newTestSystemStatsCollector(t)
+	defer cleanup()
+
+	stats, err := c.Collect("")
+	assert.NoError(t, err)
+	assert.Empty(t, stats.Errors)
+	assert.Equal(t, 10.0, stats.Interval)
+	if assert.NotNil(t, stats.CPU) {
+		// since boot: idle+iowait 1300 of 2000
+		assert.Equal(t, CoreStats{Name: "cpu", Online: true, Usage: 35, User: 20, System: 15, IOWait: 5}, stats.CPU.Total)
+		if assert.Len(t, stats.CPU.Cores, 3) {
+			assert.Equal(t, "cpu0", stats.CPU.Cores[0].Name)
+			assert.Equal(t, 1804800, stats.CPU.Cores[0].CurFreq)
+			assert.Equal(t, 300000, stats.CPU.Cores[0].MinFreq)
+			assert.Equal(t, CoreStats{Name: "cpu10"}, stats.CPU.Cores[2])
+		}
+		assert.Equal(t, 2000.0, stats.CPU.ContextSwitches)
+	}
+	assert.Equal(t, &LoadAvg{0.85, 0.76, 0.70, 2, 1290}, stats.LoadAvg)
+	assert.Equal(t, uint64(3844700), stats.Memory["MemTotal"])
+	assert.Equal(t, &SwapStats{Total: 2097148, Free: 1597148, Used: 500000}, stats.Swap)
+	if assert.Len(t, stats.Zram, 1) {
+		assert.Equal(t, "zram0", stats.Zram[0].Name)
+		assert.Equal(t, 4.0, stats.Zram[0].CompressionRatio)
+	}
+	if assert.Len(t, stats.Disks, 3) {
+		assert.Equal(t, "/system", stats.Disks[0].MountPoint)
+		assert.Equal(t, DiskUsage{
+			diskSpace:   diskSpace{Total: 1000, Free: 250, Available: 200},
+			Device:      "/dev/block/dm-2",
+			MountPoint:  "/data",
+			FsType:      "f2fs",
+			Used:        750,
+			UsedPercent: 75,
+		}, stats.Disks[1])
+	}
+	assert.Equal(t, []ThermalZone{
+		{Zone: "thermal_zone2", Type: "cpu-0-0", Temperature: 45.3},
+		{Zone: "thermal_zone10", Type: "battery", Temperature: 31},
+	}, stats.Thermal)
+	assert.Equal(t, &BatteryStats{Source: "dumpsys", Level: 80, Status: "charging", Voltage: 4200, Temperature: 30.5}, stats.Battery)
+
+	// delta since the last snapshot
+	proc.write(t, "stat", `cpu  500 0 300 1500 100 50 50 0 0 0
+cpu0 300 0 200 700 50 25 25 0 0 0
+cpu1 200 0 100 800 50 25 25 0 0 0
+intr 10100 1 2 3
+ctxt 20400
+`)
+	sys.write(t, "class/power_supply/battery/capacity", "79\n")
+	sys.write(t, "class/power_supply/battery/status", "Discharging\n")
+	sys.write(t, "class/power_supply/battery/current_now", "-500000\n")
+	sys.write(t, "class/power_supply/battery/voltage_now", "4000000\n")
+	sys.write(t, "class/power_supply/battery/temp", "312\n")
+	delta, err := c.Collect(stats.Snapshot)
+	assert.NoError(t, err)
+	assert.Equal(t, stats.Snapshot, delta.Since)
+	assert.NotEqual(t, stats.Snapshot, delta.Snapshot)
+	if assert.NotNil(t, delta.CPU) {
+		// 500 jiffies, idle 300
+		assert.Equal(t, 40.0, delta.CPU.Total.Usage)
+		assert.Equal(t, 20.0, delta.CPU.Total.User)
+		assert.Equal(t, 0.0, delta.CPU.Total.IOWait)
+		assert.Equal(t, 66.67, delta.CPU.Cores[0].Usage)
+		assert.Equal(t, 0.0, delta.CPU.Cores[1].Usage)
+	}
+	assert.Equal(t, &BatteryStats{Source: "sysfs", Level: 79, Status: "discharging", Current: -500, Voltage: 4000, Power: 2000, Temperature: 31.2}, delta.Battery)
+
+	_, err = c.Collect("unknown")
+	assert.Equal(t, errNoSnapshot, err)
+}
+
+func TestSystemStatsSnapshotLimit(t *testing.T) {
+	c, _, _, cleanup := newTestSystemStatsCollector(t)
+	defer cleanup()
+	first, err := c.Collect("")
+	assert.NoError(t, err)
+	for i := 0; i < systemStatsMaxSnapshots; i++ {
+		_, err := c.Collect("")
+		assert.NoError(t, err)
+	}
+	assert.Len(t, c.snapshots, systemStatsMaxSnapshots)
+	_, err = c.Collect(first.Snapshot)
+	assert.Equal(t, errNoSnapshot, err)
+}
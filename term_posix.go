@@ -52,11 +52,26 @@ func handleTerminalWebsocket(w http.ResponseWriter, r *http.Request) {
 		conn.WriteMessage(websocket.TextMessage, []byte(err.Error()))
 		return
 	}
+
+	var rec *asciicastWriter
+	if termRecordEnabled || r.FormValue("record") == "true" {
+		rec, err = createTermRecord(r.RemoteAddr, asciicastHeader{
+			Title: "atx-agent terminal " + r.RemoteAddr,
+			Env: map[string]string{
+				"SHELL": shPath,
+				"TERM":  "xterm",
+			},
+		})
+		if err != nil {
+			l.WithError(err).Error("Unable to create terminal record")
+		}
+	}
 	defer func() {
 		cmd.Process.Kill()
 		cmd.Process.Wait()
 		tty.Close()
 		conn.Close()
+		rec.Close()
 	}()
 
 	go func() {
@@ -68,6 +83,7 @@ func handleTerminalWebsocket(w http.ResponseWriter, r *http.Request) {
 				l.WithError(err).Error("Unable to read from pty/cmd")
 				return
 			}
+			rec.WriteOutput(buf[:read])
 			conn.WriteMessage(websocket.BinaryMessage, buf[:read])
 		}
 	}()
@@ -100,7 +116,7 @@ func handleTerminalWebsocket(w http.ResponseWriter, r *http.Request) {
 
 		switch dataTypeBuf[0] {
 		case 0:
-			copied, err := io.Copy(tty, reader)
+			copied, err := io.Copy(tty, io.TeeReader(reader, rec.InputWriter()))
 			if err != nil {
 				l.WithError(err).Errorf("Error after copying %d bytes", copied)
 			}
@@ -113,6 +129,7 @@ func handleTerminalWebsocket(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 			l.WithField("resizeMessage", resizeMessage).Info("Resizing terminal")
+			rec.WriteResize(int(resizeMessage.Cols), int(resizeMessage.Rows))
 			_, _, errno := syscall.Syscall(
 				syscall.SYS_IOCTL,
 				tty.Fd(),
@@ -23,6 +23,9 @@ func getDeviceInfo() *DeviceInfo {
 		AgentVersion: version,
 	}
 	devInfo.Sdk, _ = strconv.Atoi(getCachedProperty("ro.build.version.sdk"))
+	devInfo.Abis = deviceAbis()
+	devInfo.Density = deviceDensity()
+	devInfo.Locale = deviceLocale()
 	devInfo.HWAddr, _ = androidutils.HWAddrWLAN()
 	display, _ := androidutils.WindowSize()
 	devInfo.Display = &display
@@ -63,6 +66,45 @@ func getDeviceInfo() *DeviceInfo {
 	return currentDeviceInfo
 }
 
+// deviceAbis return supported abis, the preferred one first
+func deviceAbis() []string {
+	if abilist := getCachedProperty("ro.product.cpu.abilist"); abilist != "" {
+		return strings.Split(abilist, ",")
+	}
+	abis := []string{}
+	for _, name := range []string{"ro.product.cpu.abi", "ro.product.cpu.abi2"} {
+		if abi := getCachedProperty(name); abi != "" {
+			abis = append(abis, abi)
+		}
+	}
+	return abis
+}
+
+func deviceDensity() int {
+	density, err := strconv.Atoi(getCachedProperty("ro.sf.lcd_density"))
+	if err != nil {
+		density, _ = strconv.Atoi(getCachedProperty("qemu.sf.lcd_density")) // emulator
+	}
+	return density
+}
+
+// deviceLocale return language tag like en-US, older devices (before android 5.0) use persist.sys.language and persist.sys.country
+func deviceLocale() string {
+	for _, name := range []string{"persist.sys.locale", "ro.product.locale"} {
+		if locale := getProperty(name); locale != "" {
+			return locale
+		}
+	}
+	language := getProperty("persist.sys.language")
+	if language == "" {
+		language = getCachedProperty("ro.product.locale.language")
+	}
+	if country := getProperty("persist.sys.country"); country != "" && language != "" {
+		return language + "-" + country
+	}
+	return language
+}
+
 // type versionResponse struct {
 // 	ServerVersion string `json:"version"`
 // 	AgentVersion  string `json:"atx-agent"`
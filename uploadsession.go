@@ -0,0 +1,332 @@
+/*
+Resumable upload, data is written to <target>.part directly and renamed to target when finished
+
+	# create session
+	$ curl -X POST -F target=/sdcard/big.obb -F size=2048 $DEVICE_URL/upload-sessions
+	# upload chunks, Upload-Offset: 0 is also supported
+	$ curl -X PUT -H "Content-Range: bytes 0-1023/2048" --data-binary @chunk0 $DEVICE_URL/upload-sessions/{id}
+	# query offset after network failure
+	$ curl $DEVICE_URL/upload-sessions/{id}
+	# finish with checksum verify
+	$ curl -X POST -F sha256=... $DEVICE_URL/upload-sessions/{id}/finish
+*/
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const uploadSessionExpire = 24 * time.Hour
+
+var (
+	ErrUploadOffsetMismatch = errors.New("upload offset mismatch")
+	ErrUploadSizeExceeded   = errors.New("upload data exceeds declared size")
+	ErrUploadIncomplete     = errors.New("upload not complete")
+	ErrUploadChecksum       = errors.New("upload checksum mismatch")
+	ErrUploadReplaced       = errors.New("upload session replaced by a new session of the same target")
+)
+
+var uploadSessions = newUploadSessionManager()
+
+type uploadSessionState struct {
+	ID        string    `json:"id"`
+	Target    string    `json:"target"`
+	Size      int64     `json:"size"` // -1 means unknown
+	Offset    int64     `json:"offset"`
+	Sha256    string    `json:"sha256,omitempty"` // expected checksum
+	Mode      string    `json:"mode"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type UploadSession struct {
+	uploadSessionState
+	mu       sync.Mutex
+	fileMode os.FileMode
+	partPath string
+	hasher   hash.Hash
+	writerId int  // only the latest Append can write
+	replaced bool // the .part file belongs to a new session
+}
+
+// State return a copy of session state
+func (s *UploadSession) State() uploadSessionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uploadSessionState
+}
+
+func (s *UploadSession) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.State())
+}
+
+type uploadSessionManager struct {
+	mu       sync.Mutex
+	sessions map[string]*UploadSession
+}
+
+func newUploadSessionManager() *uploadSessionManager {
+	return &uploadSessionManager{
+		sessions: make(map[string]*UploadSession),
+	}
+}
+
+// Create truncate the previous unfinished data of the same target.
+// Previous sessions of the same target are dropped, so they never write into the truncated file
+func (m *uploadSessionManager) Create(target string, size int64, sha256sum string, mode os.FileMode) (*UploadSession, error) {
+	if target == "" || strings.HasSuffix(target, "/") {
+		return nil, errors.New("target must be a file path")
+	}
+	m.expire()
+	m.dropTarget(target)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return nil, err
+	}
+	partPath := target + ".part"
+	f, err := os.Create(partPath)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	randBytes := make([]byte, 8)
+	rand.Read(randBytes)
+	s := &UploadSession{
+		uploadSessionState: uploadSessionState{
+			ID:        hex.EncodeToString(randBytes),
+			Target:    target,
+			Size:      size,
+			Sha256:    strings.ToLower(sha256sum),
+			Mode:      fmt.Sprintf("0%o", mode),
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		},
+		fileMode: mode,
+		partPath: partPath,
+		hasher:   sha256.New(),
+	}
+	m.mu.Lock()
+	m.sessions[s.ID] = s
+	m.mu.Unlock()
+	return s, nil
+}
+
+// Get return nil if not found
+func (m *uploadSessionManager) Get(id string) *UploadSession {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sessions[id]
+}
+
+func (m *uploadSessionManager) List() []*UploadSession {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions := make([]*UploadSession, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+	return sessions
+}
+
+// Remove session and the unfinished data
+func (m *uploadSessionManager) Remove(id string) {
+	m.mu.Lock()
+	s, ok := m.sessions[id]
+	delete(m.sessions, id)
+	m.mu.Unlock()
+	if ok {
+		s.mu.Lock()
+		os.Remove(s.partPath)
+		s.mu.Unlock()
+	}
+}
+
+// Finish verify the data and move to target
+func (m *uploadSessionManager) Finish(id string, sha256sum string) (*UploadSession, error) {
+	s := m.Get(id)
+	if s == nil {
+		return nil, os.ErrNotExist
+	}
+	if err := s.finish(sha256sum); err != nil {
+		return s, err
+	}
+	m.mu.Lock()
+	delete(m.sessions, id)
+	m.mu.Unlock()
+	return s, nil
+}
+
+// dropTarget remove sessions of target and stop their writing, the data is kept for the new session
+func (m *uploadSessionManager) dropTarget(target string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, s := range m.sessions {
+		s.mu.Lock()
+		if s.Target == target {
+			log.Printf("upload session %s replaced by a new session", id)
+			delete(m.sessions, id)
+			s.writerId++
+			s.replaced = true
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (m *uploadSessionManager) expire() {
+	m.mu.Lock()
+	var ids []string
+	for id, s := range m.sessions {
+		s.mu.Lock()
+		if time.Since(s.UpdatedAt) > uploadSessionExpire {
+			ids = append(ids, id)
+		}
+		s.mu.Unlock()
+	}
+	m.mu.Unlock()
+	for _, id := range ids {
+		log.Printf("upload session %s expired", id)
+		m.Remove(id)
+	}
+}
+
+// Append write data at offset, offset must be equal to the current offset.
+// Data received before network broken is kept, so client can query offset and continue.
+// The session is not locked while reading from rd, a new Append will take over the
+// stalled one, which can happen when the old connection is not closed yet.
+// length is the chunk size from Content-Range, data after it is not written.
+// total is the whole file size from Content-Range, -1 means unknown
+func (s *UploadSession) Append(offset, length, total int64, rd io.Reader) (written int64, err error) {
+	s.mu.Lock()
+	if s.replaced {
+		s.mu.Unlock()
+		return 0, ErrUploadReplaced
+	}
+	if offset != s.Offset {
+		s.mu.Unlock()
+		return 0, ErrUploadOffsetMismatch
+	}
+	if total >= 0 {
+		if s.Size >= 0 && s.Size != total {
+			s.mu.Unlock()
+			return 0, fmt.Errorf("upload size mismatch, expected %d, got %d", s.Size, total)
+		}
+		s.Size = total
+	}
+	f, err := os.OpenFile(s.partPath, os.O_WRONLY, 0644)
+	if err != nil {
+		s.mu.Unlock()
+		return
+	}
+	defer f.Close()
+	s.writerId++
+	wr := &uploadChunkWriter{s: s, f: f, id: s.writerId}
+	s.mu.Unlock()
+
+	if length >= 0 {
+		rd = io.LimitReader(rd, length)
+	}
+	return io.Copy(wr, rd)
+}
+
+type uploadChunkWriter struct {
+	s  *UploadSession
+	f  *os.File
+	id int
+}
+
+func (w *uploadChunkWriter) Write(p []byte) (n int, err error) {
+	s := w.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writerId != w.id {
+		return 0, errors.New("upload taken over by another request")
+	}
+	if s.Size >= 0 && s.Offset+int64(len(p)) > s.Size {
+		p = p[:s.Size-s.Offset]
+		err = ErrUploadSizeExceeded
+	}
+	n, er := w.f.WriteAt(p, s.Offset)
+	s.hasher.Write(p[:n])
+	s.Offset += int64(n)
+	s.UpdatedAt = time.Now()
+	if er != nil {
+		err = er
+	}
+	return
+}
+
+func (s *UploadSession) finish(sha256sum string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.replaced {
+		return ErrUploadReplaced
+	}
+	if s.Size >= 0 && s.Offset != s.Size {
+		return ErrUploadIncomplete
+	}
+	s.writerId++ // stop writing
+	if sha256sum == "" {
+		sha256sum = s.Sha256
+	}
+	realChecksum := hex.EncodeToString(s.hasher.Sum(nil))
+	if sha256sum != "" && !strings.EqualFold(sha256sum, realChecksum) {
+		return fmt.Errorf("%v, expected: %s, got: %s", ErrUploadChecksum, sha256sum, realChecksum)
+	}
+	if err := os.Rename(s.partPath, s.Target); err != nil {
+		return err
+	}
+	if s.fileMode != 0 {
+		os.Chmod(s.Target, s.fileMode)
+	}
+	s.Size = s.Offset
+	s.Sha256 = realChecksum
+	return nil
+}
+
+// parseUploadOffset read offset from header Content-Range or Upload-Offset.
+// length and total are -1 if not present in Content-Range
+//
+//	Content-Range: bytes 0-1023/2048
+//	Content-Range: bytes 0-1023/*
+//	Upload-Offset: 0
+func parseUploadOffset(contentRange, uploadOffset string) (offset, length, total int64, err error) {
+	length, total = -1, -1
+	if contentRange != "" {
+		var end int64
+		var totalStr string
+		_, err = fmt.Sscanf(contentRange, "bytes %d-%d/%s", &offset, &end, &totalStr)
+		if err != nil || offset < 0 || end < offset {
+			return 0, -1, -1, errors.New("invalid Content-Range: " + contentRange)
+		}
+		if totalStr != "*" {
+			if _, err = fmt.Sscanf(totalStr, "%d", &total); err != nil || end >= total {
+				return 0, -1, -1, errors.New("invalid Content-Range: " + contentRange)
+			}
+		}
+		length = end - offset + 1
+		return
+	}
+	if uploadOffset != "" {
+		if _, err = fmt.Sscanf(uploadOffset, "%d", &offset); err != nil {
+			return 0, -1, -1, errors.New("invalid Upload-Offset: " + uploadOffset)
+		}
+		return
+	}
+	return 0, -1, -1, errors.New("Content-Range or Upload-Offset header required")
+}
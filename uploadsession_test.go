@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadSession(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "atx-upload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	checksum := sha256.Sum256(content)
+	target := filepath.Join(tmpdir, "sub", "data.bin")
+
+	m := newUploadSessionManager()
+	s, err := m.Create(target, -1, "", 0600)
+	assert.NoError(t, err)
+
+	n, err := s.Append(0, -1, int64(len(content)), bytes.NewReader(content[:300]))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(300), n)
+
+	_, err = s.Append(100, -1, -1, bytes.NewReader(content[100:]))
+	assert.Equal(t, ErrUploadOffsetMismatch, err)
+
+	_, err = m.Finish(s.ID, "")
+	assert.Equal(t, ErrUploadIncomplete, err)
+
+	// data after the end of Content-Range is not written
+	n, err = s.Append(300, 100, -1, bytes.NewReader(content[300:]))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), n)
+
+	_, err = s.Append(400, -1, -1, bytes.NewReader(append(content[400:], 'x')))
+	assert.Equal(t, ErrUploadSizeExceeded, err)
+	assert.Equal(t, int64(len(content)), s.State().Offset)
+
+	_, err = m.Finish(s.ID, "0000")
+	assert.Error(t, err)
+	_, err = m.Finish(s.ID, hex.EncodeToString(checksum[:]))
+	assert.NoError(t, err)
+	assert.Nil(t, m.Get(s.ID))
+
+	data, err := ioutil.ReadFile(target)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.False(t, fileExists(target+".part"))
+}
+
+func TestUploadSessionSameTarget(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "atx-upload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	target := filepath.Join(tmpdir, "data.bin")
+
+	m := newUploadSessionManager()
+	old, err := m.Create(target, -1, "", 0644)
+	assert.NoError(t, err)
+	_, err = old.Append(0, -1, -1, bytes.NewReader([]byte("old data")))
+	assert.NoError(t, err)
+
+	s, err := m.Create(target, -1, "", 0644)
+	assert.NoError(t, err)
+	assert.Nil(t, m.Get(old.ID))
+	assert.Len(t, m.List(), 1)
+	// old session can not write into the truncated file
+	_, err = old.Append(8, -1, -1, bytes.NewReader([]byte("more")))
+	assert.Equal(t, ErrUploadReplaced, err)
+	_, err = s.Append(0, -1, -1, bytes.NewReader([]byte("new")))
+	assert.NoError(t, err)
+	_, err = m.Finish(s.ID, "")
+	assert.NoError(t, err)
+	data, _ := ioutil.ReadFile(target)
+	assert.Equal(t, "new", string(data))
+}
+
+func TestParseUploadOffset(t *testing.T) {
+	offset, length, total, err := parseUploadOffset("bytes 100-199/1000", "")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), offset)
+	assert.Equal(t, int64(100), length)
+	assert.Equal(t, int64(1000), total)
+
+	offset, length, total, err = parseUploadOffset("bytes 100-199/*", "")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), length)
+	assert.Equal(t, int64(-1), total)
+
+	offset, length, _, err = parseUploadOffset("", "42")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), offset)
+	assert.Equal(t, int64(-1), length)
+
+	_, _, _, err = parseUploadOffset("", "")
+	assert.Error(t, err)
+	_, _, _, err = parseUploadOffset("bytes 9-1/10", "")
+	assert.Error(t, err)
+	_, _, _, err = parseUploadOffset("bytes 0-10/10", "") // end out of total
+	assert.Error(t, err)
+}
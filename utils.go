@@ -17,6 +17,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/codeskyblue/goreq"
@@ -147,6 +148,16 @@ func runShell(args ...string) (output []byte, err error) {
 	}.CombinedOutput()
 }
 
+// runShellQuote quote every argument, use it when arguments come from request, eg: file path
+func runShellQuote(args ...string) (output []byte, err error) {
+	return Command{
+		Args:       args,
+		Shell:      true,
+		ShellQuote: true,
+		Timeout:    10 * time.Minute,
+	}.CombinedOutput()
+}
+
 func runShellOutput(args ...string) (output []byte, err error) {
 	return Command{
 		Args:       args,
@@ -280,6 +291,7 @@ type PackageInfo struct {
 	VersionCode  int         `json:"versionCode"`
 	Size         int64       `json:"size"`
 	Icon         image.Image `json:"-"`
+	Permissions  []string    `json:"-"` // requested permissions in manifest
 }
 
 func readPackageInfo(packageName string) (info PackageInfo, err error) {
@@ -317,6 +329,11 @@ func readPackageInfoFromPath(apkpath string) (info PackageInfo, err error) {
 	info.Icon, _ = pkg.Icon(nil)
 	info.VersionCode = int(pkg.Manifest().VersionCode.MustInt32())
 	info.VersionName = pkg.Manifest().VersionName.MustString()
+	for _, perm := range pkg.Manifest().UsesPermissions {
+		if name, err := perm.Name.String(); err == nil && name != "" {
+			info.Permissions = append(info.Permissions, name)
+		}
+	}
 	return
 }
 
@@ -374,6 +391,7 @@ func httpDownload(path string, urlStr string, perms os.FileMode) (written int64,
 	}
 	defer file.Close()
 	written, err = io.Copy(file, resp.Body)
+	agentMetrics.AddDownloadBytes(written)
 	log.Println("http download:", written)
 	return
 }
@@ -480,6 +498,8 @@ type CPUStat struct {
 	SystemIdle  uint
 	ProcUser    uint
 	ProcSystem  uint
+	StartTime   uint64  // process start time, jiffies after boot
+	Uptime      float64 // seconds since boot
 	UpdateTime  time.Time
 }
 
@@ -498,25 +518,38 @@ func (c *CPUStat) String() string {
 func (c *CPUStat) CPUPercent(last *CPUStat) float64 {
 	pjiff1 := last.ProcUser + last.ProcSystem
 	pjiff2 := c.ProcUser + c.ProcSystem
-	duration := c.SystemTotal - last.SystemTotal
-	if duration <= 0 {
+	if c.SystemTotal <= last.SystemTotal || pjiff2 < pjiff1 {
 		return 0.0
 	}
-	percent := 100.0 * float64(pjiff2-pjiff1) / float64(duration)
-	if percent < 0.0 {
-		log.Println("Warning: cpu percent < 0", percent)
-		percent = 0
-	}
-	return percent
+	duration := c.SystemTotal - last.SystemTotal
+	return 100.0 * float64(pjiff2-pjiff1) / float64(duration)
 }
 
 func (c *CPUStat) SystemCPUPercent(last *CPUStat) float64 {
+	if c.SystemTotal <= last.SystemTotal {
+		return 0.0
+	}
 	idle := c.SystemIdle - last.SystemIdle
 	jiff := c.SystemTotal - last.SystemTotal
 	percent := 100.0 * float64(idle) / float64(jiff)
 	return percent
 }
 
+// SinceStart estimate the stat when process started, assume system jiffies grow linearly since boot.
+// Used as history data, so that the first CPUPercent is the average since process start
+func (c *CPUStat) SinceStart() *CPUStat {
+	start := &CPUStat{Pid: c.Pid, StartTime: c.StartTime, UpdateTime: c.UpdateTime}
+	uptime := c.Uptime * 100 // USER_HZ
+	if uptime <= 0 || float64(c.StartTime) >= uptime {
+		start.SystemTotal, start.SystemIdle = c.SystemTotal, c.SystemIdle
+		return start
+	}
+	ratio := float64(c.StartTime) / uptime
+	start.SystemTotal = uint(float64(c.SystemTotal) * ratio)
+	start.SystemIdle = uint(float64(c.SystemIdle) * ratio)
+	return start
+}
+
 // Update proc jiffies data
 func (c *CPUStat) Update() error {
 	// retrive /proc/<pid>/stat
@@ -532,38 +565,94 @@ func (c *CPUStat) Update() error {
 	if err != nil {
 		return errors.Wrap(err, "read /proc/<pid>/stat")
 	}
-
-	// retrive /proc/stst
-	statData, err := ioutil.ReadFile("/proc/stat")
+	sys, err := readSystemCPU(procfs.DefaultMountPoint)
 	if err != nil {
-		return errors.Wrap(err, "read /proc/stat")
-	}
-	procStat := string(statData)
-	idx := strings.Index(procStat, "\n")
-	// cpuName, user, nice, system, idle, iowait, irq, softIrq, steal, guest, guestNice
-	fields := strings.Fields(procStat[:idx])
-	if fields[0] != "cpu" {
-		return errors.New("/proc/stat not startswith cpu")
-	}
-	var total, idle uint
-	for i, raw := range fields[1:] {
-		var v uint
-		fmt.Sscanf(raw, "%d", &v)
-		if i == 3 { // idle
-			idle = v
-		}
-		total += v
+		return err
 	}
+	c.setSystemCPU(sys)
+	c.setProcStat(stat)
+	return nil
+}
+
+func (c *CPUStat) setSystemCPU(sys systemCPU) {
+	c.SystemTotal = sys.Total
+	c.SystemIdle = sys.Idle
+	c.Uptime = sys.Uptime
+	c.UpdateTime = time.Now()
+}
 
+func (c *CPUStat) setProcStat(stat procfs.ProcStat) {
 	c.ProcSystem = stat.STime
 	c.ProcUser = stat.UTime
-	c.SystemTotal = total
-	c.SystemIdle = idle
-	c.UpdateTime = time.Now()
-	return nil
+	c.StartTime = stat.Starttime
+}
+
+// cpuTimes jiffies of a cpu line in /proc/stat
+type cpuTimes struct {
+	User, Nice, System, Idle, IOWait, IRQ, SoftIRQ, Steal uint64
+}
+
+func (t cpuTimes) total() uint64 {
+	// guest time is already included in user
+	return t.User + t.Nice + t.System + t.Idle + t.IOWait + t.IRQ + t.SoftIRQ + t.Steal
+}
+
+type systemCPU struct {
+	Total  uint // jiffies of all cpus
+	Idle   uint
+	Uptime float64
+	Cpus   map[string]cpuTimes // cpu for all cpus, and cpu0, cpu1... of online cores
+	Ctxt   uint64              // context switches since boot
+	Intr   uint64              // interrupts since boot
 }
 
-var cpuStats = make(map[int]*CPUStat)
+var cpuNameRe = regexp.MustCompile(`^cpu\d*$`)
+
+// readSystemCPU read jiffies from <procRoot>/stat and seconds from <procRoot>/uptime
+func readSystemCPU(procRoot string) (sys systemCPU, err error) {
+	// retrive /proc/stat
+	statData, err := ioutil.ReadFile(filepath.Join(procRoot, "stat"))
+	if err != nil {
+		return sys, errors.Wrap(err, "read /proc/stat")
+	}
+	sys.Cpus = make(map[string]cpuTimes)
+	for _, line := range strings.Split(string(statData), "\n") {
+		// cpuName, user, nice, system, idle, iowait, irq, softIrq, steal, guest, guestNice
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch {
+		case cpuNameRe.MatchString(fields[0]):
+			values := make([]uint64, 8)
+			for i := range values {
+				if i+1 < len(fields) {
+					values[i], _ = strconv.ParseUint(fields[i+1], 10, 64)
+				}
+			}
+			sys.Cpus[fields[0]] = cpuTimes{values[0], values[1], values[2], values[3], values[4], values[5], values[6], values[7]}
+		case fields[0] == "ctxt":
+			sys.Ctxt, _ = strconv.ParseUint(fields[1], 10, 64)
+		case fields[0] == "intr":
+			sys.Intr, _ = strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	all, ok := sys.Cpus["cpu"]
+	if !ok {
+		return sys, errors.New("/proc/stat has no cpu line")
+	}
+	sys.Total = uint(all.total())
+	sys.Idle = uint(all.Idle)
+	if data, err := ioutil.ReadFile(filepath.Join(procRoot, "uptime")); err == nil {
+		fmt.Sscanf(string(data), "%f", &sys.Uptime)
+	}
+	return sys, nil
+}
+
+var (
+	cpuStatsMu sync.Mutex
+	cpuStats   = make(map[int]*CPUStat)
+)
 
 var _cpuCoreCount int
 
@@ -593,22 +682,21 @@ type CPUInfo struct {
 	CoreCount     int     `json:"coreCount"`
 }
 
+// readCPUInfo percent is calculated since last call in 5 seconds,
+// or averaged since process started if there is no fresh history
 func readCPUInfo(pid int) (info CPUInfo, err error) {
-	last, ok := cpuStats[pid]
-	if !ok || // need fresh history data
-		last.UpdateTime.Add(5*time.Second).Before(time.Now()) {
-		last, err = NewCPUStat(pid)
-		if err != nil {
-			return
-		}
-		time.Sleep(100 * time.Millisecond)
-		log.Println("Update data")
-	}
 	stat, err := NewCPUStat(pid)
 	if err != nil {
 		return
 	}
+	cpuStatsMu.Lock()
+	last, ok := cpuStats[pid]
 	cpuStats[pid] = stat
+	cpuStatsMu.Unlock()
+	if !ok || last.StartTime != stat.StartTime || // pid reused
+		last.UpdateTime.Add(5*time.Second).Before(stat.UpdateTime) {
+		last = stat.SinceStart()
+	}
 	info.Pid = pid
 	info.User = stat.ProcUser
 	info.System = stat.ProcSystem
@@ -632,33 +720,38 @@ func dumpHierarchy() (xmlContent string, err error) {
 	return
 }
 
-func listPackages() (pkgs []PackageInfo, err error) {
-	c := NewCommand("pm", "list", "packages", "-f", "-3")
+var packagePathRe = regexp.MustCompile(`^package:(/.+)=([^=]+)$`)
+
+type packagePath struct {
+	Name string
+	Path string
+}
+
+// listPackagePaths parse output of pm list packages -f
+//
+//	package:/data/app/com.example-1/base.apk=com.example
+func listPackagePaths(args ...string) (paths []packagePath, err error) {
+	c := NewCommand(append([]string{"pm", "list", "packages", "-f"}, args...)...)
 	c.Shell = true
 	output, err := c.CombinedOutputString()
 	if err != nil {
 		return
 	}
 	for _, line := range strings.Split(output, "\n") {
-		if !strings.HasPrefix(line, "package:") {
-			continue
-		}
-		matches := regexp.MustCompile(`^package:(/.+)=([^=]+)$`).FindStringSubmatch(line)
+		matches := packagePathRe.FindStringSubmatch(strings.TrimSpace(line))
 		if len(matches) == 0 {
 			continue
 		}
-		pkgPath := matches[1]
-		pkgName := matches[2]
-		pkgInfo, er := readPackageInfoFromPath(pkgPath)
-		if er != nil {
-			log.Printf("Read package %s error %v", pkgName, er)
-			continue
-		}
-		pkgs = append(pkgs, pkgInfo)
+		paths = append(paths, packagePath{Name: matches[2], Path: matches[1]})
 	}
 	return
 }
 
+// listPackages read package info from packageIndex, only new or changed apks are parsed
+func listPackages(filter PackageFilter) (pkgs []PackageInfo, err error) {
+	return packageIndex.List(filter)
+}
+
 func killProcessByName(processName string) bool {
 	procs, err := procfs.AllProcs()
 	if err != nil {
@@ -700,3 +793,12 @@ func getPackagePath(packageName string) (string, error) {
 	packagePath := strings.TrimSpace(pmPathOutput[len("package:"):])
 	return packagePath, nil
 }
+
+func stringInSlice(a string, list []string) bool {
+	for _, b := range list {
+		if b == a {
+			return true
+		}
+	}
+	return false
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestTempFileName(t *testing.T) {
@@ -10,3 +13,37 @@ func TestTempFileName(t *testing.T) {
 	filename := TempFileName(tmpDir, ".apk")
 	t.Log(filename)
 }
+
+func TestRunShellQuote(t *testing.T) {
+	output, err := runShellQuote("echo", "/sdcard/my app.apk", "a;b", "$HOME")
+	assert.NoError(t, err)
+	assert.Equal(t, "/sdcard/my app.apk a;b $HOME\n", string(output))
+}
+
+func TestReadSystemCPU(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atx-proc")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := fakeProcRoot(dir)
+	root.write(t, "stat", `cpu  100 10 50 800 20 5 5 10 30 3
+cpu0 60 5 30 400 10 3 3 5 30 3
+cpu2 40 5 20 400 10 2 2 5 0 0
+intr 12345 1 2 3
+ctxt 67890
+btime 1600000000
+`)
+	root.write(t, "uptime", "123.45 100.00\n")
+	sys, err := readSystemCPU(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(1000), sys.Total) // guest is already counted in user
+	assert.Equal(t, uint(800), sys.Idle)
+	assert.Equal(t, 123.45, sys.Uptime)
+	assert.Equal(t, uint64(12345), sys.Intr)
+	assert.Equal(t, uint64(67890), sys.Ctxt)
+	assert.Len(t, sys.Cpus, 3)
+	assert.Equal(t, cpuTimes{40, 5, 20, 400, 10, 2, 2, 5}, sys.Cpus["cpu2"])
+
+	root.write(t, "stat", "intr 1\n")
+	_, err = readSystemCPU(dir)
+	assert.Error(t, err)
+}